@@ -72,6 +72,25 @@ func (m model) View() string {
 	return m.screen
 }
 
+// maxSnippetLength is how much of an unexpected response body is included in
+// errors.
+const maxSnippetLength = 200
+
+// snippet returns the start of a response body for error messages.
+func snippet(body []byte) string {
+	if len(body) > maxSnippetLength {
+		return string(body[:maxSnippetLength]) + "..."
+	}
+	return string(body)
+}
+
+// unexpectedStatus returns an error for a response with an unexpected status,
+// including the start of its body.
+func unexpectedStatus(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, maxSnippetLength+1))
+	return xerrors.Errorf("unexpected status %s: %q", res.Status, snippet(body))
+}
+
 func ReadScreenOverHTTP(ctx context.Context, url string, ch chan<- httpapi.ScreenUpdateBody) error {
 	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	req.Header.Set("Content-Type", "application/json")
@@ -83,6 +102,9 @@ func ReadScreenOverHTTP(ctx context.Context, url string, ch chan<- httpapi.Scree
 	defer func() {
 		_ = res.Body.Close()
 	}()
+	if res.StatusCode != http.StatusOK {
+		return xerrors.Errorf("failed to subscribe to screen: %w", unexpectedStatus(res))
+	}
 
 	for ev, err := range sse.Read(res.Body, &sse.ReadConfig{
 		// 256KB: screen can be big. The default terminal size is 80x1000,
@@ -94,7 +116,7 @@ func ReadScreenOverHTTP(ctx context.Context, url string, ch chan<- httpapi.Scree
 		}
 		var screen httpapi.ScreenUpdateBody
 		if err := json.Unmarshal([]byte(ev.Data), &screen); err != nil {
-			return xerrors.Errorf("failed to unmarshal screen: %w", err)
+			return xerrors.Errorf("failed to unmarshal %T from %q: %w", screen, snippet([]byte(ev.Data)), err)
 		}
 		ch <- screen
 	}
@@ -121,7 +143,7 @@ func WriteRawInputOverHTTP(ctx context.Context, url string, msg string) error {
 		_ = res.Body.Close()
 	}()
 	if res.StatusCode != http.StatusOK {
-		return xerrors.Errorf("failed to write raw input: %w", errors.New(res.Status))
+		return xerrors.Errorf("failed to write raw input: %w", unexpectedStatus(res))
 	}
 
 	return nil
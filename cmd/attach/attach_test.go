@@ -0,0 +1,57 @@
+package attach
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/coder/agentapi/lib/httpapi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadScreenOverHTTP_MalformedEvent(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("event: screen\ndata: {\"screen\": 42}\n\n"))
+	}))
+	t.Cleanup(srv.Close)
+
+	ch := make(chan httpapi.ScreenUpdateBody, 1)
+	err := ReadScreenOverHTTP(context.Background(), srv.URL, ch)
+	require.ErrorContains(t, err, `failed to unmarshal httpapi.ScreenUpdateBody from "{\"screen\": 42}"`)
+}
+
+func TestReadScreenOverHTTP_UnexpectedStatus(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, strings.Repeat("not found ", 50), http.StatusNotFound)
+	}))
+	t.Cleanup(srv.Close)
+
+	ch := make(chan httpapi.ScreenUpdateBody, 1)
+	err := ReadScreenOverHTTP(context.Background(), srv.URL, ch)
+	require.ErrorContains(t, err, "unexpected status 404 Not Found")
+	require.ErrorContains(t, err, `not found not found`)
+	// Long bodies are truncated.
+	require.ErrorContains(t, err, `..."`)
+	require.Less(t, len(err.Error()), 300)
+}
+
+func TestWriteRawInputOverHTTP_UnexpectedStatus(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"detail": "raw input rejected"}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	err := WriteRawInputOverHTTP(context.Background(), srv.URL, "x")
+	require.ErrorContains(t, err, `unexpected status 400 Bad Request: "{\"detail\": \"raw input rejected\"}"`)
+}
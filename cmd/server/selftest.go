@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/coder/agentapi/lib/httpapi"
+	"github.com/coder/agentapi/lib/msgfmt"
+	"golang.org/x/xerrors"
+)
+
+// selfTestConfig is what runSelfTest checks.
+type selfTestConfig struct {
+	// Agent is the first argument of the server command and AgentCmd the
+	// value of --agent-cmd.
+	Agent     string
+	AgentCmd  string
+	Args      []string
+	AgentType msgfmt.AgentType
+
+	TerminalWidth  uint16
+	TerminalHeight uint16
+	Term           string
+
+	// ReadyTimeout bounds how long the agent may take to be ready for input.
+	ReadyTimeout time.Duration
+	// Prompt, if set, is sent to the agent to check that it replies, within
+	// PromptTimeout.
+	Prompt        string
+	PromptTimeout time.Duration
+	GracePeriod   time.Duration
+}
+
+// selfTestReport prints the outcome of the checks of runSelfTest.
+type selfTestReport struct {
+	w      io.Writer
+	failed int
+}
+
+func (r *selfTestReport) pass(check string, detail string) {
+	fmt.Fprintf(r.w, "PASS %s: %s\n", check, detail)
+}
+
+func (r *selfTestReport) fail(check string, err error, hint string) {
+	r.failed++
+	fmt.Fprintf(r.w, "FAIL %s: %v\n", check, err)
+	fmt.Fprintf(r.w, "     hint: %s\n", hint)
+}
+
+func (r *selfTestReport) skip(check string, reason string) {
+	fmt.Fprintf(r.w, "SKIP %s: %s\n", check, reason)
+}
+
+// runSelfTest checks that the agent can be run without starting the HTTP
+// server: that its command is found, that it starts and gets ready for input
+// and, if a prompt is configured, that it replies to a message. It writes a
+// report to w and fails if any check failed.
+func runSelfTest(ctx context.Context, logger *slog.Logger, w io.Writer, cfg selfTestConfig) error {
+	report := &selfTestReport{w: w}
+	defer func() {
+		if report.failed == 0 {
+			fmt.Fprintln(w, "Self-test passed")
+		}
+	}()
+
+	program, err := resolveAgentCommand(cfg.Agent, cfg.AgentCmd)
+	if err != nil {
+		report.fail("agent command", err, fmt.Sprintf("Install the agent and make sure it's on the PATH, or point --%s at it.", FlagAgentCmd))
+		return selfTestFailed(report)
+	}
+	report.pass("agent command", program)
+
+	process, err := httpapi.SetupProcess(ctx, httpapi.SetupProcessConfig{
+		Program:        program,
+		ProgramArgs:    cfg.Args,
+		TerminalWidth:  cfg.TerminalWidth,
+		TerminalHeight: cfg.TerminalHeight,
+		Term:           cfg.Term,
+		AgentType:      cfg.AgentType,
+
+		ShutdownGracePeriod: cfg.GracePeriod,
+	})
+	if err != nil {
+		report.fail("agent start", err, "Check that the agent command is executable and runs in a terminal.")
+		return selfTestFailed(report)
+	}
+	report.pass("agent start", fmt.Sprintf("%s %s", program, strings.Join(cfg.Args, " ")))
+	defer func() {
+		if err := process.Close(logger, cfg.GracePeriod); err != nil {
+			logger.Error("Failed to close process", "error", err)
+		}
+	}()
+
+	srv, err := httpapi.NewServer(ctx, httpapi.ServerConfig{
+		AgentType:      cfg.AgentType,
+		Process:        process,
+		ChatBasePath:   "/chat",
+		AllowedHosts:   []string{"*"},
+		AllowedOrigins: []string{"*"},
+	})
+	if err != nil {
+		return xerrors.Errorf("failed to create server: %w", err)
+	}
+	defer func() {
+		if err := srv.Stop(context.Background()); err != nil {
+			logger.Error("Failed to stop server", "error", err)
+		}
+	}()
+	srv.StartSnapshotLoop(ctx)
+
+	processExitCh := make(chan error, 1)
+	go func() {
+		defer close(processExitCh)
+		if err := process.Wait(); err != nil {
+			processExitCh <- xerrors.Errorf("========\n%s\n========\n: %w", strings.TrimSpace(process.ReadScreen()), err)
+		}
+	}()
+
+	start := time.Now()
+	if err := waitForAgent(ctx, logger, srv, processExitCh, cfg.ReadyTimeout, agentWaitLogInterval); err != nil {
+		report.fail("agent ready", err, fmt.Sprintf("Run the agent in a terminal to check that it starts without asking for input, e.g. to log in or trust the directory. Raise --%s if it's slow to start.", FlagRequireAgentTimeout))
+		return selfTestFailed(report)
+	}
+	report.pass("agent ready", fmt.Sprintf("ready in %s", time.Since(start).Round(time.Millisecond)))
+
+	if cfg.Prompt == "" {
+		report.skip("round trip", fmt.Sprintf("set --%s to send a message to the agent", FlagSelftestPrompt))
+		return nil
+	}
+	promptCtx := ctx
+	if cfg.PromptTimeout > 0 {
+		var cancel context.CancelFunc
+		promptCtx, cancel = context.WithTimeout(ctx, cfg.PromptTimeout)
+		defer cancel()
+	}
+	start = time.Now()
+	reply, err := srv.RunOneShot(promptCtx, cfg.Prompt)
+	if err != nil {
+		report.fail("round trip", err, fmt.Sprintf("Send the prompt to the agent in a terminal to check its API key, model and network access. Raise --%s if it's slow to reply.", FlagOneshotTimeout))
+		return selfTestFailed(report)
+	}
+	if strings.TrimSpace(reply) == "" {
+		report.fail("round trip", xerrors.New("the agent's reply is empty"), fmt.Sprintf("Check that --%s matches the agent, so that its replies are recognized on the screen.", FlagType))
+		return selfTestFailed(report)
+	}
+	report.pass("round trip", fmt.Sprintf("replied with %d characters in %s", len(reply), time.Since(start).Round(time.Millisecond)))
+	return nil
+}
+
+func selfTestFailed(report *selfTestReport) error {
+	return xerrors.Errorf("self-test failed: %d check(s) failed", report.failed)
+}
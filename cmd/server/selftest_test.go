@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/coder/agentapi/lib/logctx"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunSelfTest(t *testing.T) {
+	t.Parallel()
+
+	logger := slog.New(logctx.DiscardHandler)
+	ctx := logctx.WithLogger(context.Background(), logger)
+	newConfig := func(agent string) selfTestConfig {
+		return selfTestConfig{
+			Agent:          agent,
+			AgentType:      AgentTypeCustom,
+			TerminalWidth:  80,
+			TerminalHeight: 24,
+			ReadyTimeout:   10 * time.Second,
+			PromptTimeout:  10 * time.Second,
+			GracePeriod:    time.Second,
+		}
+	}
+	// writeAgent writes a fake agent that shows a prompt and answers every
+	// line it reads.
+	writeAgent := func(t *testing.T, script string) string {
+		t.Helper()
+		if runtime.GOOS == "windows" {
+			t.Skip("the agent is a shell script")
+		}
+		path := filepath.Join(t.TempDir(), "agent.sh")
+		require.NoError(t, os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o755))
+		return path
+	}
+
+	t.Run("agent not found", func(t *testing.T) {
+		t.Parallel()
+		var out bytes.Buffer
+		err := runSelfTest(ctx, logger, &out, newConfig("agentapi-no-such-agent"))
+		require.ErrorContains(t, err, "self-test failed: 1 check(s) failed")
+		require.Contains(t, out.String(), `FAIL agent command: agent command "agentapi-no-such-agent" not found`)
+		require.Contains(t, out.String(), "hint: Install the agent")
+	})
+
+	t.Run("agent exits", func(t *testing.T) {
+		t.Parallel()
+		agent := writeAgent(t, "echo 'not logged in'\nexit 1\n")
+		var out bytes.Buffer
+		err := runSelfTest(ctx, logger, &out, newConfig(agent))
+		require.Error(t, err)
+		require.Contains(t, out.String(), "PASS agent command")
+		require.Contains(t, out.String(), "PASS agent start")
+		require.Contains(t, out.String(), "FAIL agent ready: agent exited before it was ready")
+		require.Contains(t, out.String(), "not logged in")
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		t.Parallel()
+		agent := writeAgent(t, "printf '> '\nwhile read line; do printf 'echo: %s\\n> ' \"$line\"; done\n")
+		cfg := newConfig(agent)
+		cfg.Prompt = "ping"
+		var out bytes.Buffer
+		require.NoError(t, runSelfTest(ctx, logger, &out, cfg), out.String())
+		require.Contains(t, out.String(), "PASS agent ready")
+		require.Contains(t, out.String(), "PASS round trip")
+		require.Contains(t, out.String(), "Self-test passed")
+	})
+
+	t.Run("no prompt", func(t *testing.T) {
+		t.Parallel()
+		agent := writeAgent(t, "printf '> '\nsleep 30\n")
+		var out bytes.Buffer
+		require.NoError(t, runSelfTest(ctx, logger, &out, newConfig(agent)), out.String())
+		require.Contains(t, out.String(), "SKIP round trip")
+	})
+}
@@ -6,10 +6,13 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"sort"
+	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mattn/go-isatty"
 	"github.com/spf13/cobra"
@@ -39,39 +42,59 @@ const (
 	AgentTypeCustom   AgentType = msgfmt.AgentTypeCustom
 )
 
-// agentTypeAliases contains the mapping of possible input agent type strings to their canonical AgentType values
-var agentTypeAliases = map[string]AgentType{
-	"claude":       AgentTypeClaude,
-	"goose":        AgentTypeGoose,
-	"aider":        AgentTypeAider,
-	"codex":        AgentTypeCodex,
-	"gemini":       AgentTypeGemini,
-	"copilot":      AgentTypeCopilot,
-	"amp":          AgentTypeAmp,
-	"auggie":       AgentTypeAuggie,
-	"cursor":       AgentTypeCursor,
-	"cursor-agent": AgentTypeCursor,
-	"q":            AgentTypeAmazonQ,
-	"amazonq":      AgentTypeAmazonQ,
-	"opencode":     AgentTypeOpencode,
-	"custom":       AgentTypeCustom,
-}
-
 func parseAgentType(firstArg string, agentTypeVar string) (AgentType, error) {
 	// if the agent type is provided, use it
-	if castedAgentType, ok := agentTypeAliases[agentTypeVar]; ok {
-		return castedAgentType, nil
+	if agent, ok := msgfmt.LookupAgent(agentTypeVar); ok {
+		return agent.Type, nil
 	}
 	if agentTypeVar != "" {
 		return AgentTypeCustom, fmt.Errorf("invalid agent type: %s", agentTypeVar)
 	}
 	// if the agent type is not provided, guess it from the first argument
-	if castedFirstArg, ok := agentTypeAliases[firstArg]; ok {
-		return castedFirstArg, nil
+	if agent, ok := msgfmt.LookupAgent(firstArg); ok {
+		return agent.Type, nil
 	}
 	return AgentTypeCustom, nil
 }
 
+// parseMeta parses the key=value pairs of --meta.
+func parseMeta(pairs []string) (map[string]string, error) {
+	meta := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, xerrors.Errorf("invalid metadata %q: expected key=value", pair)
+		}
+		meta[key] = value
+	}
+	return meta, nil
+}
+
+// parseKeys interprets the Go escape sequences in keys given on the command
+// line, e.g. \r for Enter.
+func parseKeys(keys string) (string, error) {
+	parsed, err := strconv.Unquote(`"` + strings.ReplaceAll(keys, `"`, `\"`) + `"`)
+	if err != nil {
+		return "", xerrors.Errorf("invalid escape sequence in %q", keys)
+	}
+	return parsed, nil
+}
+
+// resolveAgentCommand returns the path of the program that runs the agent:
+// override if it's set, or agent otherwise. It fails if the program can't be
+// found.
+func resolveAgentCommand(agent string, override string) (string, error) {
+	program := agent
+	if override != "" {
+		program = override
+	}
+	path, err := exec.LookPath(program)
+	if err != nil {
+		return "", xerrors.Errorf("agent command %q not found: %w", program, err)
+	}
+	return path, nil
+}
+
 func runServer(ctx context.Context, logger *slog.Logger, argsToPass []string) error {
 	agent := argsToPass[0]
 	agentTypeValue := viper.GetString(FlagType)
@@ -90,9 +113,57 @@ func runServer(ctx context.Context, logger *slog.Logger, argsToPass []string) er
 		return xerrors.Errorf("term height must be at least 10")
 	}
 
+	meta, err := parseMeta(viper.GetStringSlice(FlagMeta))
+	if err != nil {
+		return xerrors.Errorf("failed to parse --%s: %w", FlagMeta, err)
+	}
+	permissionApproveKeys, err := parseKeys(viper.GetString(FlagPermissionApproveKeys))
+	if err != nil {
+		return xerrors.Errorf("failed to parse --%s: %w", FlagPermissionApproveKeys, err)
+	}
+	permissionDenyKeys, err := parseKeys(viper.GetString(FlagPermissionDenyKeys))
+	if err != nil {
+		return xerrors.Errorf("failed to parse --%s: %w", FlagPermissionDenyKeys, err)
+	}
+
+	// The agent's own trim options are used unless --trim is set.
+	var trim *msgfmt.TrimOptions
+	if names := viper.GetStringSlice(FlagTrim); len(names) > 0 {
+		opts, err := msgfmt.ParseTrimOptions(names)
+		if err != nil {
+			return xerrors.Errorf("failed to parse --%s: %w", FlagTrim, err)
+		}
+		trim = &opts
+	}
+
+	oneshotPrompt := viper.GetString(FlagOneshot)
+	oneshot := oneshotPrompt != ""
+
+	if viper.GetBool(FlagSelftest) {
+		if oneshot {
+			return xerrors.Errorf("--%s cannot be combined with --%s", FlagSelftest, FlagOneshot)
+		}
+		return runSelfTest(ctx, logger, os.Stdout, selfTestConfig{
+			Agent:          agent,
+			AgentCmd:       viper.GetString(FlagAgentCmd),
+			Args:           argsToPass[1:],
+			AgentType:      agentType,
+			TerminalWidth:  termWidth,
+			TerminalHeight: termHeight,
+			Term:           viper.GetString(FlagTerm),
+			ReadyTimeout:   viper.GetDuration(FlagRequireAgentTimeout),
+			Prompt:         viper.GetString(FlagSelftestPrompt),
+			PromptTimeout:  viper.GetDuration(FlagOneshotTimeout),
+			GracePeriod:    viper.GetDuration(FlagShutdownGracePeriod),
+		})
+	}
+
 	// Read stdin if it's piped, to be used as initial prompt
 	initialPrompt := viper.GetString(FlagInitialPrompt)
-	if initialPrompt == "" {
+	if oneshot && initialPrompt != "" {
+		return xerrors.Errorf("--%s cannot be combined with --%s", FlagOneshot, FlagInitialPrompt)
+	}
+	if initialPrompt == "" && !oneshot {
 		if !isatty.IsTerminal(os.Stdin.Fd()) {
 			if stdinData, err := io.ReadAll(os.Stdin); err != nil {
 				return xerrors.Errorf("failed to read stdin: %w", err)
@@ -104,21 +175,57 @@ func runServer(ctx context.Context, logger *slog.Logger, argsToPass []string) er
 	}
 
 	printOpenAPI := viper.GetBool(FlagPrintOpenAPI)
+	// The gRPC port is taken before the agent starts, so that the agent
+	// isn't left behind if it's in use.
+	var grpcListener net.Listener
+	if grpcPort := viper.GetInt(FlagGRPCPort); grpcPort > 0 && !printOpenAPI && !oneshot {
+		lis, err := net.Listen("tcp", fmt.Sprintf(":%d", grpcPort))
+		if err != nil {
+			return xerrors.Errorf("failed to listen on gRPC port: %w", err)
+		}
+		defer func() {
+			_ = lis.Close()
+		}()
+		grpcListener = lis
+	}
 	var process *termexec.Process
 	if printOpenAPI {
 		process = nil
 	} else {
+		program, err := resolveAgentCommand(agent, viper.GetString(FlagAgentCmd))
+		if err != nil {
+			return err
+		}
+		var stderrBufferSize int
+		if viper.GetBool(FlagDebugStderr) {
+			stderrBufferSize = debugStderrBufferSize
+		}
 		process, err = httpapi.SetupProcess(ctx, httpapi.SetupProcessConfig{
-			Program:        agent,
+			Program:        program,
 			ProgramArgs:    argsToPass[1:],
 			TerminalWidth:  termWidth,
 			TerminalHeight: termHeight,
+			Term:           viper.GetString(FlagTerm),
 			AgentType:      agentType,
+
+			ShutdownGracePeriod: viper.GetDuration(FlagShutdownGracePeriod),
+			StderrBufferSize:    stderrBufferSize,
 		})
 		if err != nil {
 			return xerrors.Errorf("failed to setup process: %w", err)
 		}
 	}
+	var auditLogger *slog.Logger
+	if auditLogPath := viper.GetString(FlagAuditLog); auditLogPath != "" && !printOpenAPI {
+		auditLogFile, err := os.OpenFile(auditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return xerrors.Errorf("failed to open audit log: %w", err)
+		}
+		defer func() {
+			_ = auditLogFile.Close()
+		}()
+		auditLogger = logctx.WithInstance(slog.New(slog.NewJSONHandler(auditLogFile, nil)), viper.GetString(FlagInstanceId))
+	}
 	port := viper.GetInt(FlagPort)
 	srv, err := httpapi.NewServer(ctx, httpapi.ServerConfig{
 		AgentType:      agentType,
@@ -127,7 +234,54 @@ func runServer(ctx context.Context, logger *slog.Logger, argsToPass []string) er
 		ChatBasePath:   viper.GetString(FlagChatBasePath),
 		AllowedHosts:   viper.GetStringSlice(FlagAllowedHosts),
 		AllowedOrigins: viper.GetStringSlice(FlagAllowedOrigins),
+		TrustedProxies: viper.GetStringSlice(FlagTrustedProxies),
+		CORSMaxAge:     viper.GetDuration(FlagCORSMaxAge),
 		InitialPrompt:  initialPrompt,
+		Greeting:       viper.GetString(FlagGreeting),
+		Provider:       viper.GetString(FlagAgentProvider),
+		Model:          viper.GetString(FlagAgentModel),
+		PromptPrefix:   viper.GetString(FlagPromptPrefix),
+		PromptSuffix:   viper.GetString(FlagPromptSuffix),
+		RedactSecrets:  viper.GetBool(FlagRedactSecrets),
+		RedactPatterns: viper.GetStringSlice(FlagRedactPatterns),
+		RawInputAllow:  viper.GetStringSlice(FlagRawInputAllow),
+		RawInputDeny:   viper.GetStringSlice(FlagRawInputDeny),
+		ReadyPattern:   viper.GetString(FlagReadyPattern),
+		IdlePattern:    viper.GetString(FlagIdlePattern),
+
+		PermissionPattern:     viper.GetString(FlagPermissionPattern),
+		PermissionApproveKeys: permissionApproveKeys,
+		PermissionDenyKeys:    permissionDenyKeys,
+
+		AllowMessageInjection: viper.GetBool(FlagAllowMessageInjection),
+		ContinuePhrase:        viper.GetString(FlagContinuePhrase),
+		BusyPolicy:            httpapi.BusyPolicy(viper.GetString(FlagBusyPolicy)),
+		DisableScreen:         viper.GetBool(FlagDisableScreen),
+		MessagePreviewLength:  viper.GetInt(FlagMessagePreviewLength),
+		WebhookURL:            viper.GetString(FlagWebhookURL),
+		WebhookSecret:         viper.GetString(FlagWebhookSecret),
+		MinMessageInterval:    viper.GetDuration(FlagMinMessageInterval),
+		StuckStatusTimeout:    viper.GetDuration(FlagStuckStatusTimeout),
+		AuditLogger:           auditLogger,
+		AuditLogContent:       viper.GetBool(FlagAuditLogContent),
+		MaxConcurrentSends:    viper.GetInt(FlagMaxConcurrentSends),
+		DebugAgentIO:          viper.GetBool(FlagDebugAgentIO),
+		DebugRawScreen:        viper.GetBool(FlagDebugRawScreen),
+		KeepInvalidUTF8:       viper.GetBool(FlagKeepInvalidUTF8),
+		DebugStderr:           viper.GetBool(FlagDebugStderr) && !printOpenAPI,
+		Meta:                  meta,
+		PreserveANSI:          viper.GetBool(FlagPreserveANSI),
+		Trim:                  trim,
+		HangTimeout:           viper.GetDuration(FlagHangTimeout),
+		HangAction:            httpapi.HangAction(viper.GetString(FlagHangAction)),
+		HeartbeatInterval:     viper.GetDuration(FlagSSEHeartbeatInterval),
+		MaxEventsDuration:     viper.GetDuration(FlagSSEMaxDuration),
+		SlowSendThreshold:     viper.GetDuration(FlagSSESlowSendThreshold),
+		ProbeTimeout:          viper.GetDuration(FlagProbeTimeout),
+		EnableTail:            viper.GetBool(FlagWSTail),
+		ExtractDiffs:          viper.GetBool(FlagExtractDiffs),
+		ExtractCommands:       viper.GetBool(FlagExtractCommands),
+		FilesRoot:             viper.GetString(FlagFilesRoot),
 	})
 	if err != nil {
 		return xerrors.Errorf("failed to create server: %w", err)
@@ -137,7 +291,9 @@ func runServer(ctx context.Context, logger *slog.Logger, argsToPass []string) er
 		return nil
 	}
 	srv.StartSnapshotLoop(ctx)
-	logger.Info("Starting server on port", "port", port)
+	if oneshot {
+		return runOneShot(ctx, logger, srv, process, oneshotPrompt, viper.GetDuration(FlagOneshotTimeout), viper.GetDuration(FlagShutdownGracePeriod))
+	}
 	processExitCh := make(chan error, 1)
 	go func() {
 		defer close(processExitCh)
@@ -152,6 +308,26 @@ func runServer(ctx context.Context, logger *slog.Logger, argsToPass []string) er
 			logger.Error("Failed to stop server", "error", err)
 		}
 	}()
+	if requireAgent, startupWait := viper.GetBool(FlagRequireAgent), viper.GetDuration(FlagStartupWait); requireAgent || startupWait > 0 {
+		if requireAgent {
+			startupWait = viper.GetDuration(FlagRequireAgentTimeout)
+		}
+		if err := waitForStartup(ctx, logger, srv, processExitCh, startupWait, requireAgent); err != nil {
+			if closeErr := process.Close(logger, viper.GetDuration(FlagShutdownGracePeriod)); closeErr != nil {
+				logger.Error("Failed to close process", "error", closeErr)
+			}
+			return err
+		}
+	}
+	if grpcListener != nil {
+		logger.Info("Starting gRPC server on port", "port", viper.GetInt(FlagGRPCPort))
+		go func() {
+			if err := srv.ServeGRPC(grpcListener); err != nil {
+				logger.Error("gRPC server failed", "error", err)
+			}
+		}()
+	}
+	logger.Info("Starting server on port", "port", port)
 	if err := srv.Start(); err != nil && err != context.Canceled && err != http.ErrServerClosed {
 		return xerrors.Errorf("failed to start server: %w", err)
 	}
@@ -163,14 +339,112 @@ func runServer(ctx context.Context, logger *slog.Logger, argsToPass []string) er
 	return nil
 }
 
-var agentNames = (func() []string {
-	names := make([]string, 0, len(agentTypeAliases))
-	for agentType := range agentTypeAliases {
-		names = append(names, agentType)
+// debugStderrBufferSize is how much of the agent's stderr is kept with
+// --debug-stderr.
+const debugStderrBufferSize = 64 * 1024
+
+// agentWaitLogInterval is how often waitForAgent reports that it's still
+// waiting for the agent.
+const agentWaitLogInterval = 5 * time.Second
+
+// waitForAgent blocks until the agent is ready for input, logging its progress
+// every logInterval. It fails if ctx is canceled, the agent exits, which is
+// reported on processExitCh, or the agent isn't ready within timeout.
+func waitForAgent(ctx context.Context, logger *slog.Logger, srv *httpapi.Server, processExitCh <-chan error, timeout time.Duration, logInterval time.Duration) error {
+	parentCtx := ctx
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ready := make(chan error, 1)
+	go func() {
+		ready <- srv.WaitUntilReady(ctx)
+	}()
+	start := time.Now()
+	ticker := time.NewTicker(logInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-ready:
+			if err == nil {
+				return nil
+			}
+			if parentCtx.Err() != nil {
+				return xerrors.Errorf("stopped waiting for the agent to be ready: %w", parentCtx.Err())
+			}
+			return xerrors.Errorf("agent was not ready within %s: %w", timeout, err)
+		case err, ok := <-processExitCh:
+			if ok && err != nil {
+				return xerrors.Errorf("agent exited before it was ready: %w", err)
+			}
+			return xerrors.New("agent exited before it was ready")
+		case <-ticker.C:
+			logger.Info("Still waiting for the agent to be ready", "elapsed", time.Since(start).Round(time.Second), "timeout", timeout)
+		}
+	}
+}
+
+// waitForStartup holds off serving requests until the agent is ready for
+// input. If it isn't ready within timeout, startup fails if requireAgent is
+// set, and otherwise the server starts degraded. Startup always fails if the
+// agent exits.
+func waitForStartup(ctx context.Context, logger *slog.Logger, srv *httpapi.Server, processExitCh <-chan error, timeout time.Duration, requireAgent bool) error {
+	logger.Info("Waiting for the agent to be ready", "timeout", timeout)
+	err := waitForAgent(ctx, logger, srv, processExitCh, timeout, agentWaitLogInterval)
+	switch {
+	case err == nil:
+		logger.Info("Agent is ready", "startup", "ready")
+		return nil
+	case !requireAgent && ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded):
+		logger.Warn("Agent isn't ready, serving requests anyway", "startup", "degraded", "error", err)
+		return nil
+	default:
+		logger.Error("Agent failed to start", "startup", "failed", "error", err)
+		return err
+	}
+}
+
+// runOneShot sends a single prompt to the agent, prints the reply to stdout and
+// shuts everything down. It never starts the HTTP server.
+func runOneShot(ctx context.Context, logger *slog.Logger, srv *httpapi.Server, process *termexec.Process, prompt string, timeout time.Duration, gracePeriod time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
-	sort.Strings(names)
-	return names
-})()
+
+	var processErr error
+	processExited := make(chan struct{})
+	go func() {
+		defer close(processExited)
+		if err := process.Wait(); err != nil {
+			processErr = xerrors.Errorf("========\n%s\n========\n: %w", strings.TrimSpace(process.ReadScreen()), err)
+		} else {
+			processErr = xerrors.New("agent exited before replying")
+		}
+		cancel()
+	}()
+
+	reply, replyErr := srv.RunOneShot(ctx, prompt)
+
+	if err := srv.Stop(context.Background()); err != nil {
+		logger.Error("Failed to stop server", "error", err)
+	}
+	if err := process.Close(logger, gracePeriod); err != nil {
+		logger.Error("Failed to close process", "error", err)
+	}
+
+	if replyErr != nil {
+		select {
+		case <-processExited:
+			return xerrors.Errorf("agent exited with error: %w", processErr)
+		default:
+		}
+		return xerrors.Errorf("failed to run one-shot prompt: %w", replyErr)
+	}
+	fmt.Println(reply)
+	return nil
+}
 
 type flagSpec struct {
 	name         string
@@ -187,28 +461,115 @@ const (
 	FlagChatBasePath   = "chat-base-path"
 	FlagTermWidth      = "term-width"
 	FlagTermHeight     = "term-height"
+	FlagTerm           = "term"
 	FlagAllowedHosts   = "allowed-hosts"
 	FlagAllowedOrigins = "allowed-origins"
+	FlagCORSMaxAge     = "cors-max-age"
 	FlagExit           = "exit"
 	FlagInitialPrompt  = "initial-prompt"
+	FlagGreeting       = "greeting"
+	FlagPromptPrefix   = "prompt-prefix"
+	FlagPromptSuffix   = "prompt-suffix"
+	FlagRedactSecrets  = "redact-secrets"
+	FlagRedactPatterns = "redact-patterns"
+	FlagRawInputAllow  = "raw-input-allow"
+	FlagRawInputDeny   = "raw-input-deny"
+	FlagOneshot        = "oneshot"
+	FlagOneshotTimeout = "oneshot-timeout"
+
+	FlagAllowMessageInjection = "allow-message-injection"
+	FlagDisableScreen         = "disable-screen"
+	FlagStuckStatusTimeout    = "stuck-status-timeout"
+	FlagAuditLog              = "audit-log"
+	FlagAuditLogContent       = "audit-log-content"
+	FlagRequireAgent          = "require-agent"
+	FlagRequireAgentTimeout   = "require-agent-timeout"
+	FlagShutdownGracePeriod   = "shutdown-grace-period"
+	FlagMaxConcurrentSends    = "max-concurrent-sends"
+	FlagDebugAgentIO          = "debug-agent-io"
+	FlagDebugRawScreen        = "debug-raw-screen"
+	FlagDebugStderr           = "debug-stderr"
+	FlagGRPCPort              = "grpc-port"
+	FlagContinuePhrase        = "continue-phrase"
+	FlagBusyPolicy            = "busy-policy"
+	FlagSelftest              = "selftest"
+	FlagSelftestPrompt        = "selftest-prompt"
+	FlagKeepInvalidUTF8       = "keep-invalid-utf8"
+	FlagSSESlowSendThreshold  = "sse-slow-send-threshold"
+	FlagReadyPattern          = "ready-pattern"
+	FlagIdlePattern           = "idle-pattern"
+	FlagProbeTimeout          = "probe-timeout"
+	FlagWSTail                = "ws-tail"
+	FlagTrustedProxies        = "trusted-proxies"
+	FlagAgentProvider         = "agent-provider"
+	FlagAgentModel            = "agent-model"
+	FlagLogLevel              = "log-level"
+	FlagQuiet                 = "quiet"
+	FlagStartupWait           = "startup-wait"
+	FlagPermissionPattern     = "permission-pattern"
+	FlagPermissionApproveKeys = "permission-approve-keys"
+	FlagPermissionDenyKeys    = "permission-deny-keys"
+	FlagMessagePreviewLength  = "message-preview-length"
+	FlagWebhookURL            = "webhook-url"
+	FlagWebhookSecret         = "webhook-secret"
+	FlagMinMessageInterval    = "min-message-interval"
+	FlagMeta                  = "meta"
+	FlagPreserveANSI          = "preserve-ansi"
+	FlagTrim                  = "trim"
+	FlagHangTimeout           = "hang-timeout"
+	FlagHangAction            = "hang-action"
+	FlagInstanceId            = "instance-id"
+	FlagSSEHeartbeatInterval  = "sse-heartbeat-interval"
+	FlagSSEMaxDuration        = "sse-max-duration"
+	FlagAgentCmd              = "agent-cmd"
+	FlagExtractDiffs          = "extract-diffs"
+	FlagExtractCommands       = "extract-commands"
+	FlagFilesRoot             = "files-root"
 )
 
+// logLevel returns the minimum level of the server's logs, from --log-level
+// and --quiet.
+func logLevel() (slog.Level, error) {
+	level, err := logctx.ParseLevel(viper.GetString(FlagLogLevel))
+	if err != nil {
+		return 0, xerrors.Errorf("invalid --%s: %w", FlagLogLevel, err)
+	}
+	if viper.GetBool(FlagQuiet) {
+		level = max(level, slog.LevelWarn)
+	}
+	return level, nil
+}
+
 func CreateServerCmd() *cobra.Command {
 	serverCmd := &cobra.Command{
 		Use:   "server [agent]",
 		Short: "Run the server",
-		Long:  fmt.Sprintf("Run the server with the specified agent (one of: %s)", strings.Join(agentNames, ", ")),
+		Long:  fmt.Sprintf("Run the server with the specified agent (one of: %s)", strings.Join(msgfmt.AgentNames(), ", ")),
 		Args:  cobra.MinimumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			// The --exit flag is used for testing validation of flags in the test suite
 			if viper.GetBool(FlagExit) {
 				return
 			}
-			logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+			level, err := logLevel()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%+v\n", err)
+				os.Exit(1)
+			}
+			handlerOptions := &slog.HandlerOptions{Level: level}
+			logger := slog.New(slog.NewTextHandler(os.Stdout, handlerOptions))
+			if viper.GetString(FlagOneshot) != "" || viper.GetBool(FlagSelftest) {
+				// stdout is reserved for the agent's reply or the self-test report.
+				logger = slog.New(slog.NewTextHandler(os.Stderr, handlerOptions))
+			}
 			if viper.GetBool(FlagPrintOpenAPI) {
 				// We don't want log output here.
 				logger = slog.New(logctx.DiscardHandler)
 			}
+			logger = logctx.WithInstance(logger, viper.GetString(FlagInstanceId))
+			// Code that logs without a logger from the context gets the same
+			// output and level.
+			slog.SetDefault(logger)
 			ctx := logctx.WithLogger(context.Background(), logger)
 			if err := runServer(ctx, logger, cmd.Flags().Args()); err != nil {
 				fmt.Fprintf(os.Stderr, "%+v\n", err)
@@ -218,17 +579,76 @@ func CreateServerCmd() *cobra.Command {
 	}
 
 	flagSpecs := []flagSpec{
-		{FlagType, "t", "", fmt.Sprintf("Override the agent type (one of: %s, custom)", strings.Join(agentNames, ", ")), "string"},
+		{FlagType, "t", "", fmt.Sprintf("Override the agent type (one of: %s, custom)", strings.Join(msgfmt.AgentNames(), ", ")), "string"},
 		{FlagPort, "p", 3284, "Port to run the server on", "int"},
 		{FlagPrintOpenAPI, "P", false, "Print the OpenAPI schema to stdout and exit", "bool"},
 		{FlagChatBasePath, "c", "/chat", "Base path for assets and routes used in the static files of the chat interface", "string"},
 		{FlagTermWidth, "W", uint16(80), "Width of the emulated terminal", "uint16"},
 		{FlagTermHeight, "H", uint16(1000), "Height of the emulated terminal", "uint16"},
+		{FlagAgentCmd, "", "", "Program to run instead of the first argument, e.g. a wrapper script or a specific binary version. The first argument still determines the agent type unless --type is set, and the remaining arguments are passed to the program", "string"},
+		{FlagTerm, "", termexec.DefaultTerm, "Value of the TERM environment variable passed to the agent. The emulated terminal only supports vt100 escape sequences", "string"},
 		// localhost is the default host for the server. Port is ignored during matching.
 		{FlagAllowedHosts, "a", []string{"localhost", "127.0.0.1", "[::1]"}, "HTTP allowed hosts (hostnames only, no ports). Use '*' for all, comma-separated list via flag, space-separated list via AGENTAPI_ALLOWED_HOSTS env var", "stringSlice"},
 		// localhost:3284 is the default origin when you open the chat interface in your browser. localhost:3000 and 3001 are used during development.
 		{FlagAllowedOrigins, "o", []string{"http://localhost:3284", "http://localhost:3000", "http://localhost:3001"}, "HTTP allowed origins. Use '*' for all, comma-separated list via flag, space-separated list via AGENTAPI_ALLOWED_ORIGINS env var", "stringSlice"},
+		{FlagCORSMaxAge, "", 5 * time.Minute, "How long browsers may cache the results of CORS preflight requests. Negative values disable caching", "duration"},
 		{FlagInitialPrompt, "I", "", "Initial prompt for the agent. Recommended only if the agent doesn't support initial prompt in interaction mode. Will be read from stdin if piped (e.g., echo 'prompt' | agentapi server -- my-agent)", "string"},
+		{FlagGreeting, "", "", "Message shown as the first agent message of the conversation, before the agent's own output", "string"},
+		{FlagPromptPrefix, "", "", "Text prepended to every user message sent to the agent. Not shown in the conversation history", "string"},
+		{FlagPromptSuffix, "", "", "Text appended to every user message sent to the agent. Not shown in the conversation history", "string"},
+		{FlagRedactSecrets, "", false, "Replace common secret formats (API keys, tokens, private keys) in messages and the agent's screen with ***", "bool"},
+		{FlagRedactPatterns, "", []string{}, "Additional regular expressions to redact from messages and the agent's screen. Comma-separated list via flag, space-separated list via AGENTAPI_REDACT_PATTERNS env var", "stringSlice"},
+		{FlagRawInputAllow, "", []string{}, "Regular expressions of the only sequences allowed in raw messages (e.g. '\\x1b\\[[ABCD]' for arrow keys). Comma-separated list via flag, space-separated list via AGENTAPI_RAW_INPUT_ALLOW env var", "stringSlice"},
+		{FlagRawInputDeny, "", []string{}, "Regular expressions of sequences rejected in raw messages. Comma-separated list via flag, space-separated list via AGENTAPI_RAW_INPUT_DENY env var", "stringSlice"},
+		{FlagAllowMessageInjection, "", false, "Allow POST /message to append agent and system messages to the conversation history without sending them to the agent", "bool"},
+		{FlagDisableScreen, "", false, "Don't expose the contents of the agent's terminal screen: removes the /internal/screen endpoint and screen_update events", "bool"},
+		{FlagSSEHeartbeatInterval, "", time.Duration(0), "Send a heartbeat event with the server's time to /events subscribers at this interval, for clients that need to detect stale connections. 0 disables heartbeats", "duration"},
+		{FlagSSEMaxDuration, "", time.Duration(0), "Close /events streams after this long with a reconnect event, so that abandoned connections don't pile up. 0 keeps streams open until the client disconnects", "duration"},
+		{FlagStuckStatusTimeout, "", 2 * time.Minute, "Abandon writing a message to the agent and reset its status to stable if the write takes this long. Negative values disable the reset", "duration"},
+		{FlagHangTimeout, "", time.Duration(0), "Apply --hang-action to the agent if it has been running for this long without its screen changing. Should be shorter than --stuck-status-timeout. 0 disables the watchdog", "duration"},
+		{FlagHangAction, "", string(httpapi.HangActionInterrupt), fmt.Sprintf("What to do with an agent that looks hung: %s sends it SIGINT, %s kills it and stops the server so that a supervisor can restart it", httpapi.HangActionInterrupt, httpapi.HangActionKill), "string"},
+		{FlagAuditLog, "", "", "File to append a JSON line to for every POST /message request, its outcome and the agent's reply. By default, the entries go to the server log", "string"},
+		{FlagAuditLogContent, "", false, "Include the content of messages in the audit log entries", "bool"},
+		{FlagRequireAgent, "", false, "Exit with an error instead of serving requests if the agent exits or isn't ready for input at startup", "bool"},
+		{FlagRequireAgentTimeout, "", time.Minute, "How long to wait for the agent to be ready at startup with --require-agent", "duration"},
+		{FlagShutdownGracePeriod, "", 5 * time.Second, "How long the agent is given to exit after SIGINT, and then after SIGTERM, before it is killed", "duration"},
+		{FlagMaxConcurrentSends, "", 1, "How many user messages may be sent or waiting to be sent to the agent at once. Further messages are rejected with 429", "int"},
+		{FlagFilesRoot, "", "", "Directory whose files POST /message may reference by path. By default, files can't be referenced by path", "string"},
+		{FlagExtractDiffs, "", false, "Return the unified diffs printed by the agent as structured file changes in GET /messages. Supported for aider", "bool"},
+		{FlagExtractCommands, "", false, "Return the shell commands the agent runs, with their output, as structured data in GET /messages. Supported for claude and aider", "bool"},
+		{FlagPreserveANSI, "", false, "Keep ANSI escape sequences and control characters in agent messages, for clients that render them. By default, they're removed", "bool"},
+		{FlagTrim, "", []string{}, fmt.Sprintf("Rules for cleaning up agent messages, replacing the agent's defaults (one or more of: %s, or none). Comma-separated list via flag, space-separated list via AGENTAPI_TRIM env var", strings.Join(msgfmt.TrimOptionNames(), ", ")), "stringSlice"},
+		{FlagMeta, "", []string{}, "Key/value metadata attached to the conversation (e.g. project=web), returned by GET /meta and added to the audit log. Comma-separated list of key=value pairs via flag, space-separated list via AGENTAPI_META env var", "stringSlice"},
+		{FlagDebugAgentIO, "", false, "Keep the last writes to the agent's terminal and expose them at GET /internal/agent-io. They may contain sensitive content", "bool"},
+		{FlagInstanceId, "", "", "Identifier of this AgentAPI instance, added as the instance field to every log entry so that the logs of several instances can be told apart", "string"},
+		{FlagDebugRawScreen, "", false, "Add the screen every agent message was parsed from to GET /messages, to debug how messages are extracted. Can't be combined with --disable-screen", "bool"},
+		{FlagDebugStderr, "", false, "Keep the agent's stderr out of its terminal and expose its end at GET /internal/stderr, to diagnose agent failures. Agents that draw their interface on stderr can't be used with it. Not supported on Windows", "bool"},
+		{FlagGRPCPort, "", 0, "Port to serve the gRPC interface on, which mirrors the REST API. 0 disables it", "int"},
+		{FlagContinuePhrase, "", "", "User message sent to the agent by POST /continue, e.g. \"continue\". By default, POST /continue presses Enter", "string"},
+		{FlagBusyPolicy, "", string(httpapi.BusyPolicyReject), fmt.Sprintf("What to do with user messages sent while the agent is busy: %s rejects them with 409, %s sends them anyway. Raw messages are always sent", httpapi.BusyPolicyReject, httpapi.BusyPolicyForce), "string"},
+		{FlagSelftest, "", false, "Check that the agent is installed, starts and gets ready for input, print a report and exit without starting the HTTP server. Exits with an error if a check fails", "bool"},
+		{FlagSelftestPrompt, "", "", "With --selftest, also send this prompt to the agent and check that it replies", "string"},
+		{FlagKeepInvalidUTF8, "", false, "Add the original bytes of agent messages that aren't valid UTF-8 to GET /messages and message_update events, base64 encoded in raw_base64. The content of messages always has invalid UTF-8 replaced with U+FFFD", "bool"},
+		{FlagSSESlowSendThreshold, "", 5 * time.Second, "Disconnect /events subscribers when sending them an event takes longer than this several times in a row, so that slow clients don't hold up the server. 0 disables the check", "duration"},
+		{FlagReadyPattern, "", "", "Regular expression that matches the agent's screen once it accepts input, e.g. its prompt. Replaces the agent's own readiness detection, which is used before the initial prompt is sent and by --require-agent", "string"},
+		{FlagIdlePattern, "", "", "Regular expression that matches the agent's screen while it waits for input. The agent is then only reported as stable once its screen matches, for agents that pause while working", "string"},
+		{FlagProbeTimeout, "", 2 * time.Second, "How long GET /ping and GET /health wait for the agent before reporting it as unresponsive, so that they return quickly when the agent hangs. GET /ping can override it with timeout_ms", "duration"},
+		{FlagWSTail, "", false, "Serve GET /tail, a read-only WebSocket that sends the conversation history and then every new message as plain text lines of the form 'role: content'", "bool"},
+		{FlagTrustedProxies, "", []string{}, "CIDR ranges of the reverse proxies in front of the server. For requests from them, the client IP used in logs is taken from X-Forwarded-For. Comma-separated list via flag, space-separated list via AGENTAPI_TRUSTED_PROXIES env var", "stringSlice"},
+		{FlagAgentProvider, "", "", "Provider of the model the agent is configured to use (e.g. anthropic). Recorded on the agent's messages for auditing", "string"},
+		{FlagAgentModel, "", "", "Model the agent is configured to use (e.g. claude-sonnet-4). Recorded on the agent's messages for auditing. It isn't passed to the agent", "string"},
+		{FlagLogLevel, "", "info", fmt.Sprintf("Minimum level of the server's logs (one of: %s). The audit log isn't affected", strings.Join(logctx.LevelNames, ", ")), "string"},
+		{FlagQuiet, "q", false, "Only log warnings and errors, e.g. when embedding AgentAPI in other tools. Overrides a more verbose --log-level", "bool"},
+		{FlagStartupWait, "", time.Duration(0), "How long to wait for the agent to be ready before serving requests. If it isn't ready by then, the server starts anyway. With --require-agent, --require-agent-timeout is used instead and the server doesn't start", "duration"},
+		{FlagPermissionPattern, "", "", "Regular expression that matches the agent's prompts asking for permission, e.g. to run a tool. Matches are sent as permission_request events and answered with POST /permissions/{id}. Named groups 'tool' and 'action' are sent with the prompt", "string"},
+		{FlagPermissionApproveKeys, "", `\r`, "Keys sent to the agent to approve a permission request. Escape sequences like \\r and \\x1b are supported", "string"},
+		{FlagPermissionDenyKeys, "", `\x1b`, "Keys sent to the agent to deny a permission request. Escape sequences like \\r and \\x1b are supported", "string"},
+		{FlagMessagePreviewLength, "", 0, "Truncate the content of the messages returned by GET /messages to this many characters, for previews of long messages. GET /messages/{id}?full=true returns the full content. 0 disables truncation", "int"},
+		{FlagWebhookURL, "", "", "URL that receives a POST request with the event whenever the agent becomes stable or a message is complete", "string"},
+		{FlagWebhookSecret, "", "", "Secret that signs the webhook requests with an HMAC-SHA256 of their body in the X-AgentAPI-Signature header. Prefer setting it with the AGENTAPI_WEBHOOK_SECRET environment variable", "string"},
+		{FlagMinMessageInterval, "", time.Duration(0), "Minimum time between accepted user messages, e.g. to reject double submissions from a UI. Messages sent sooner are rejected with 429. 0 disables the check", "duration"},
+		{FlagOneshot, "", "", "Send this prompt to the agent, print its reply to stdout and exit without starting the HTTP server", "string"},
+		{FlagOneshotTimeout, "", 10 * time.Minute, "Maximum time to wait for the agent's reply in --oneshot mode. 0 disables the timeout", "duration"},
 	}
 
 	for _, spec := range flagSpecs {
@@ -241,6 +661,8 @@ func CreateServerCmd() *cobra.Command {
 			serverCmd.Flags().BoolP(spec.name, spec.shorthand, spec.defaultValue.(bool), spec.usage)
 		case "uint16":
 			serverCmd.Flags().Uint16P(spec.name, spec.shorthand, spec.defaultValue.(uint16), spec.usage)
+		case "duration":
+			serverCmd.Flags().DurationP(spec.name, spec.shorthand, spec.defaultValue.(time.Duration), spec.usage)
 		case "stringSlice":
 			serverCmd.Flags().StringSliceP(spec.name, spec.shorthand, spec.defaultValue.([]string), spec.usage)
 		default:
@@ -1,15 +1,25 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/coder/agentapi/lib/httpapi"
+	"github.com/coder/agentapi/lib/logctx"
+	"github.com/coder/agentapi/lib/termexec"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
 )
 
 type nullWriter struct{}
@@ -230,8 +240,67 @@ func TestServerCmd_AllArgs_Defaults(t *testing.T) {
 		{"chat-base-path default", FlagChatBasePath, "/chat", func() any { return viper.GetString(FlagChatBasePath) }},
 		{"term-width default", FlagTermWidth, uint16(80), func() any { return viper.GetUint16(FlagTermWidth) }},
 		{"term-height default", FlagTermHeight, uint16(1000), func() any { return viper.GetUint16(FlagTermHeight) }},
+		{"term default", FlagTerm, "vt100", func() any { return viper.GetString(FlagTerm) }},
 		{"allowed-hosts default", FlagAllowedHosts, []string{"localhost", "127.0.0.1", "[::1]"}, func() any { return viper.GetStringSlice(FlagAllowedHosts) }},
 		{"allowed-origins default", FlagAllowedOrigins, []string{"http://localhost:3284", "http://localhost:3000", "http://localhost:3001"}, func() any { return viper.GetStringSlice(FlagAllowedOrigins) }},
+		{"greeting default", FlagGreeting, "", func() any { return viper.GetString(FlagGreeting) }},
+		{"cors-max-age default", FlagCORSMaxAge, 5 * time.Minute, func() any { return viper.GetDuration(FlagCORSMaxAge) }},
+		{"prompt-prefix default", FlagPromptPrefix, "", func() any { return viper.GetString(FlagPromptPrefix) }},
+		{"prompt-suffix default", FlagPromptSuffix, "", func() any { return viper.GetString(FlagPromptSuffix) }},
+		{"redact-secrets default", FlagRedactSecrets, false, func() any { return viper.GetBool(FlagRedactSecrets) }},
+		{"redact-patterns default", FlagRedactPatterns, []string{}, func() any { return viper.GetStringSlice(FlagRedactPatterns) }},
+		{"raw-input-allow default", FlagRawInputAllow, []string{}, func() any { return viper.GetStringSlice(FlagRawInputAllow) }},
+		{"raw-input-deny default", FlagRawInputDeny, []string{}, func() any { return viper.GetStringSlice(FlagRawInputDeny) }},
+		{"allow-message-injection default", FlagAllowMessageInjection, false, func() any { return viper.GetBool(FlagAllowMessageInjection) }},
+		{"disable-screen default", FlagDisableScreen, false, func() any { return viper.GetBool(FlagDisableScreen) }},
+		{"stuck-status-timeout default", FlagStuckStatusTimeout, 2 * time.Minute, func() any { return viper.GetDuration(FlagStuckStatusTimeout) }},
+		{"audit-log default", FlagAuditLog, "", func() any { return viper.GetString(FlagAuditLog) }},
+		{"audit-log-content default", FlagAuditLogContent, false, func() any { return viper.GetBool(FlagAuditLogContent) }},
+		{"require-agent default", FlagRequireAgent, false, func() any { return viper.GetBool(FlagRequireAgent) }},
+		{"require-agent-timeout default", FlagRequireAgentTimeout, time.Minute, func() any { return viper.GetDuration(FlagRequireAgentTimeout) }},
+		{"shutdown-grace-period default", FlagShutdownGracePeriod, 5 * time.Second, func() any { return viper.GetDuration(FlagShutdownGracePeriod) }},
+		{"max-concurrent-sends default", FlagMaxConcurrentSends, 1, func() any { return viper.GetInt(FlagMaxConcurrentSends) }},
+		{"debug-agent-io default", FlagDebugAgentIO, false, func() any { return viper.GetBool(FlagDebugAgentIO) }},
+		{"meta default", FlagMeta, []string{}, func() any { return viper.GetStringSlice(FlagMeta) }},
+		{"preserve-ansi default", FlagPreserveANSI, false, func() any { return viper.GetBool(FlagPreserveANSI) }},
+		{"trim default", FlagTrim, []string{}, func() any { return viper.GetStringSlice(FlagTrim) }},
+		{"hang-timeout default", FlagHangTimeout, time.Duration(0), func() any { return viper.GetDuration(FlagHangTimeout) }},
+		{"hang-action default", FlagHangAction, "interrupt", func() any { return viper.GetString(FlagHangAction) }},
+		{"instance-id default", FlagInstanceId, "", func() any { return viper.GetString(FlagInstanceId) }},
+		{"sse-heartbeat-interval default", FlagSSEHeartbeatInterval, time.Duration(0), func() any { return viper.GetDuration(FlagSSEHeartbeatInterval) }},
+		{"sse-max-duration default", FlagSSEMaxDuration, time.Duration(0), func() any { return viper.GetDuration(FlagSSEMaxDuration) }},
+		{"extract-commands default", FlagExtractCommands, false, func() any { return viper.GetBool(FlagExtractCommands) }},
+		{"debug-raw-screen default", FlagDebugRawScreen, false, func() any { return viper.GetBool(FlagDebugRawScreen) }},
+		{"debug-stderr default", FlagDebugStderr, false, func() any { return viper.GetBool(FlagDebugStderr) }},
+		{"grpc-port default", FlagGRPCPort, 0, func() any { return viper.GetInt(FlagGRPCPort) }},
+		{"continue-phrase default", FlagContinuePhrase, "", func() any { return viper.GetString(FlagContinuePhrase) }},
+		{"busy-policy default", FlagBusyPolicy, "reject", func() any { return viper.GetString(FlagBusyPolicy) }},
+		{"selftest default", FlagSelftest, false, func() any { return viper.GetBool(FlagSelftest) }},
+		{"selftest-prompt default", FlagSelftestPrompt, "", func() any { return viper.GetString(FlagSelftestPrompt) }},
+		{"keep-invalid-utf8 default", FlagKeepInvalidUTF8, false, func() any { return viper.GetBool(FlagKeepInvalidUTF8) }},
+		{"sse-slow-send-threshold default", FlagSSESlowSendThreshold, 5 * time.Second, func() any { return viper.GetDuration(FlagSSESlowSendThreshold) }},
+		{"ready-pattern default", FlagReadyPattern, "", func() any { return viper.GetString(FlagReadyPattern) }},
+		{"idle-pattern default", FlagIdlePattern, "", func() any { return viper.GetString(FlagIdlePattern) }},
+		{"probe-timeout default", FlagProbeTimeout, 2 * time.Second, func() any { return viper.GetDuration(FlagProbeTimeout) }},
+		{"ws-tail default", FlagWSTail, false, func() any { return viper.GetBool(FlagWSTail) }},
+		{"trusted-proxies default", FlagTrustedProxies, []string{}, func() any { return viper.GetStringSlice(FlagTrustedProxies) }},
+		{"agent-provider default", FlagAgentProvider, "", func() any { return viper.GetString(FlagAgentProvider) }},
+		{"agent-model default", FlagAgentModel, "", func() any { return viper.GetString(FlagAgentModel) }},
+		{"log-level default", FlagLogLevel, "info", func() any { return viper.GetString(FlagLogLevel) }},
+		{"quiet default", FlagQuiet, false, func() any { return viper.GetBool(FlagQuiet) }},
+		{"startup-wait default", FlagStartupWait, time.Duration(0), func() any { return viper.GetDuration(FlagStartupWait) }},
+		{"permission-pattern default", FlagPermissionPattern, "", func() any { return viper.GetString(FlagPermissionPattern) }},
+		{"permission-approve-keys default", FlagPermissionApproveKeys, `\r`, func() any { return viper.GetString(FlagPermissionApproveKeys) }},
+		{"permission-deny-keys default", FlagPermissionDenyKeys, `\x1b`, func() any { return viper.GetString(FlagPermissionDenyKeys) }},
+		{"message-preview-length default", FlagMessagePreviewLength, 0, func() any { return viper.GetInt(FlagMessagePreviewLength) }},
+		{"webhook-url default", FlagWebhookURL, "", func() any { return viper.GetString(FlagWebhookURL) }},
+		{"webhook-secret default", FlagWebhookSecret, "", func() any { return viper.GetString(FlagWebhookSecret) }},
+		{"min-message-interval default", FlagMinMessageInterval, time.Duration(0), func() any { return viper.GetDuration(FlagMinMessageInterval) }},
+		{"agent-cmd default", FlagAgentCmd, "", func() any { return viper.GetString(FlagAgentCmd) }},
+		{"extract-diffs default", FlagExtractDiffs, false, func() any { return viper.GetBool(FlagExtractDiffs) }},
+		{"files-root default", FlagFilesRoot, "", func() any { return viper.GetString(FlagFilesRoot) }},
+		{"oneshot default", FlagOneshot, "", func() any { return viper.GetString(FlagOneshot) }},
+		{"oneshot-timeout default", FlagOneshotTimeout, 10 * time.Minute, func() any { return viper.GetDuration(FlagOneshotTimeout) }},
 	}
 
 	for _, tt := range tests {
@@ -264,8 +333,13 @@ func TestServerCmd_AllEnvVars(t *testing.T) {
 		{"AGENTAPI_CHAT_BASE_PATH", "AGENTAPI_CHAT_BASE_PATH", "/api", "/api", func() any { return viper.GetString(FlagChatBasePath) }},
 		{"AGENTAPI_TERM_WIDTH", "AGENTAPI_TERM_WIDTH", "120", uint16(120), func() any { return viper.GetUint16(FlagTermWidth) }},
 		{"AGENTAPI_TERM_HEIGHT", "AGENTAPI_TERM_HEIGHT", "500", uint16(500), func() any { return viper.GetUint16(FlagTermHeight) }},
+		{"AGENTAPI_TERM", "AGENTAPI_TERM", "xterm-256color", "xterm-256color", func() any { return viper.GetString(FlagTerm) }},
 		{"AGENTAPI_ALLOWED_HOSTS", "AGENTAPI_ALLOWED_HOSTS", "localhost example.com", []string{"localhost", "example.com"}, func() any { return viper.GetStringSlice(FlagAllowedHosts) }},
 		{"AGENTAPI_ALLOWED_ORIGINS", "AGENTAPI_ALLOWED_ORIGINS", "https://example.com http://localhost:3000", []string{"https://example.com", "http://localhost:3000"}, func() any { return viper.GetStringSlice(FlagAllowedOrigins) }},
+		{"AGENTAPI_PROMPT_PREFIX", "AGENTAPI_PROMPT_PREFIX", "You are a reviewer.", "You are a reviewer.", func() any { return viper.GetString(FlagPromptPrefix) }},
+		{"AGENTAPI_PROMPT_SUFFIX", "AGENTAPI_PROMPT_SUFFIX", "Be concise.", "Be concise.", func() any { return viper.GetString(FlagPromptSuffix) }},
+		{"AGENTAPI_SHUTDOWN_GRACE_PERIOD", "AGENTAPI_SHUTDOWN_GRACE_PERIOD", "30s", 30 * time.Second, func() any { return viper.GetDuration(FlagShutdownGracePeriod) }},
+		{"AGENTAPI_ONESHOT_TIMEOUT", "AGENTAPI_ONESHOT_TIMEOUT", "90s", 90 * time.Second, func() any { return viper.GetDuration(FlagOneshotTimeout) }},
 	}
 
 	for _, tt := range tests {
@@ -571,3 +645,254 @@ func TestServerCmd_AllowedOrigins(t *testing.T) {
 		})
 	}
 }
+
+type staticAgent struct {
+	screen string
+}
+
+func (a *staticAgent) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (a *staticAgent) ReadScreen() string {
+	return a.screen
+}
+
+func TestWaitForAgent(t *testing.T) {
+	t.Parallel()
+
+	discardLogger := slog.New(logctx.DiscardHandler)
+
+	newServer := func(t *testing.T, startSnapshotLoop bool) *httpapi.Server {
+		t.Helper()
+		ctx, cancel := context.WithCancel(logctx.WithLogger(context.Background(), slog.New(logctx.DiscardHandler)))
+		t.Cleanup(cancel)
+		srv, err := httpapi.NewServer(ctx, httpapi.ServerConfig{
+			AgentType:      AgentTypeCustom,
+			Process:        &staticAgent{screen: "> "},
+			ChatBasePath:   "/chat",
+			AllowedHosts:   []string{"*"},
+			AllowedOrigins: []string{"*"},
+		})
+		require.NoError(t, err)
+		if startSnapshotLoop {
+			srv.StartSnapshotLoop(ctx)
+		}
+		return srv
+	}
+
+	t.Run("ready", func(t *testing.T) {
+		t.Parallel()
+		srv := newServer(t, true)
+		require.NoError(t, waitForAgent(context.Background(), discardLogger, srv, make(chan error), 5*time.Second, time.Minute))
+	})
+
+	t.Run("agent exited", func(t *testing.T) {
+		t.Parallel()
+		// Without the snapshot loop, the agent never becomes ready.
+		srv := newServer(t, false)
+		processExitCh := make(chan error, 1)
+		processExitCh <- xerrors.New("exit status 1")
+		close(processExitCh)
+		err := waitForAgent(context.Background(), discardLogger, srv, processExitCh, 5*time.Second, time.Minute)
+		require.ErrorContains(t, err, "agent exited before it was ready: exit status 1")
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		t.Parallel()
+		srv := newServer(t, false)
+		err := waitForAgent(context.Background(), discardLogger, srv, make(chan error), 100*time.Millisecond, time.Minute)
+		require.ErrorContains(t, err, "agent was not ready within 100ms")
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		t.Parallel()
+		srv := newServer(t, false)
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+		start := time.Now()
+		err := waitForAgent(ctx, discardLogger, srv, make(chan error), time.Minute, time.Minute)
+		require.ErrorIs(t, err, context.Canceled)
+		require.Less(t, time.Since(start), 5*time.Second)
+	})
+
+	t.Run("progress", func(t *testing.T) {
+		t.Parallel()
+		srv := newServer(t, false)
+		var buf bytes.Buffer
+		logger := slog.New(slog.NewTextHandler(&buf, nil))
+		err := waitForAgent(context.Background(), logger, srv, make(chan error), 300*time.Millisecond, 50*time.Millisecond)
+		require.Error(t, err)
+		require.Contains(t, buf.String(), "Still waiting for the agent to be ready")
+	})
+}
+
+func TestWaitForStartup(t *testing.T) {
+	t.Parallel()
+
+	newServer := func(t *testing.T, startSnapshotLoop bool) *httpapi.Server {
+		t.Helper()
+		ctx, cancel := context.WithCancel(logctx.WithLogger(context.Background(), slog.New(logctx.DiscardHandler)))
+		t.Cleanup(cancel)
+		srv, err := httpapi.NewServer(ctx, httpapi.ServerConfig{
+			AgentType:      AgentTypeCustom,
+			Process:        &staticAgent{screen: "> "},
+			ChatBasePath:   "/chat",
+			AllowedHosts:   []string{"*"},
+			AllowedOrigins: []string{"*"},
+		})
+		require.NoError(t, err)
+		if startSnapshotLoop {
+			srv.StartSnapshotLoop(ctx)
+		}
+		return srv
+	}
+
+	for _, tc := range []struct {
+		name         string
+		ready        bool
+		exited       bool
+		requireAgent bool
+		wantErr      string
+		wantState    string
+	}{
+		{name: "ready", ready: true, wantState: "startup=ready"},
+		{name: "ready and required", ready: true, requireAgent: true, wantState: "startup=ready"},
+		// Without the snapshot loop, the agent never becomes ready.
+		{name: "not ready", wantState: "startup=degraded"},
+		{name: "not ready and required", requireAgent: true, wantErr: "agent was not ready within 200ms", wantState: "startup=failed"},
+		{name: "exited", exited: true, wantErr: "agent exited before it was ready", wantState: "startup=failed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			srv := newServer(t, tc.ready)
+			processExitCh := make(chan error, 1)
+			if tc.exited {
+				close(processExitCh)
+			}
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewTextHandler(&buf, nil))
+			timeout := 200 * time.Millisecond
+			if tc.ready {
+				// The agent's screen has to be stable for a while first.
+				timeout = 10 * time.Second
+			}
+			err := waitForStartup(context.Background(), logger, srv, processExitCh, timeout, tc.requireAgent)
+			if tc.wantErr != "" {
+				require.ErrorContains(t, err, tc.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Contains(t, buf.String(), tc.wantState)
+		})
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		args []string
+		want slog.Level
+		err  string
+	}{
+		{name: "default", want: slog.LevelInfo},
+		{name: "log level", args: []string{"--log-level", "debug"}, want: slog.LevelDebug},
+		{name: "quiet", args: []string{"--quiet"}, want: slog.LevelWarn},
+		{name: "quiet with debug", args: []string{"--quiet", "--log-level", "debug"}, want: slog.LevelWarn},
+		{name: "quiet with error", args: []string{"-q", "--log-level", "error"}, want: slog.LevelError},
+		{name: "invalid", args: []string{"--log-level", "loud"}, err: `invalid --log-level: unknown log level "loud"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			isolateViper(t)
+			serverCmd := CreateServerCmd()
+			setupCommandOutput(t, serverCmd)
+			serverCmd.SetArgs(append(tc.args, "--exit", "dummy-command"))
+			require.NoError(t, serverCmd.Execute())
+
+			level, err := logLevel()
+			if tc.err != "" {
+				require.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tc.want, level)
+
+			// Info logs are only written below the warn level.
+			var buf bytes.Buffer
+			slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: level})).Info("starting")
+			require.Equal(t, level <= slog.LevelInfo, strings.Contains(buf.String(), "starting"))
+		})
+	}
+}
+
+func TestParseMeta(t *testing.T) {
+	t.Parallel()
+
+	meta, err := parseMeta([]string{"project=web", "ticket=ENG-12", "query=a=b", "empty="})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"project": "web", "ticket": "ENG-12", "query": "a=b", "empty": ""}, meta)
+
+	_, err = parseMeta([]string{"project"})
+	require.ErrorContains(t, err, `invalid metadata "project"`)
+	_, err = parseMeta([]string{"=web"})
+	require.Error(t, err)
+}
+
+func TestParseKeys(t *testing.T) {
+	t.Parallel()
+
+	for keys, want := range map[string]string{
+		`\r`:       "\r",
+		`\x1b`:     "\x1b",
+		`y\r`:      "y\r",
+		`say "hi"`: `say "hi"`,
+		`\x1b[B\r`: "\x1b[B\r",
+	} {
+		parsed, err := parseKeys(keys)
+		require.NoError(t, err, keys)
+		require.Equal(t, want, parsed, keys)
+	}
+	_, err := parseKeys(`\q`)
+	require.ErrorContains(t, err, "invalid escape sequence")
+}
+
+func TestResolveAgentCommand(t *testing.T) {
+	t.Parallel()
+
+	t.Run("not found", func(t *testing.T) {
+		t.Parallel()
+		_, err := resolveAgentCommand("agentapi-no-such-agent", "")
+		require.ErrorContains(t, err, `agent command "agentapi-no-such-agent" not found`)
+		_, err = resolveAgentCommand("sh", "./agentapi-no-such-wrapper")
+		require.ErrorContains(t, err, `agent command "./agentapi-no-such-wrapper" not found`)
+	})
+
+	t.Run("override spawns the process", func(t *testing.T) {
+		t.Parallel()
+		if runtime.GOOS == "windows" {
+			t.Skip("the wrapper is a shell script")
+		}
+		wrapper := filepath.Join(t.TempDir(), "wrapper.sh")
+		require.NoError(t, os.WriteFile(wrapper, []byte("#!/bin/sh\necho \"wrapped $*\"\nsleep 10\n"), 0o755))
+
+		// The agent is claude, but the wrapper is what runs.
+		program, err := resolveAgentCommand("claude", wrapper)
+		require.NoError(t, err)
+		require.Equal(t, wrapper, program)
+
+		logger := slog.New(logctx.DiscardHandler)
+		process, err := termexec.StartProcess(logctx.WithLogger(context.Background(), logger), termexec.StartProcessConfig{
+			Program:        program,
+			Args:           []string{"--model", "opus"},
+			TerminalWidth:  80,
+			TerminalHeight: 24,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = process.Close(logger, time.Second)
+		})
+		require.Eventually(t, func() bool {
+			return strings.Contains(process.ReadScreen(), "wrapped --model opus")
+		}, 5*time.Second, 50*time.Millisecond, "screen: %q", process.ReadScreen())
+	})
+}
@@ -100,6 +100,25 @@ func TestE2E(t *testing.T) {
 		require.Equal(t, script[0].ExpectMessage, strings.TrimSpace(msgResp.Messages[1].Content))
 		require.Equal(t, script[0].ResponseMessage, strings.TrimSpace(msgResp.Messages[2].Content))
 	})
+
+	t.Run("oneshot", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+
+		scriptFilePath, script := readScript(t)
+		binaryPath := getBinaryPath(ctx, t)
+		cwd, err := os.Getwd()
+		require.NoError(t, err, "Failed to get current working directory")
+
+		cmd := exec.CommandContext(ctx, binaryPath, "server", "--oneshot", script[1].ExpectMessage, "--", "go", "run", filepath.Join(cwd, "echo.go"), scriptFilePath)
+		var stdout, stderr strings.Builder
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		err = cmd.Run()
+		t.Logf("stderr:\n%s", stderr.String())
+		require.NoError(t, err, "one-shot run failed")
+		require.Equal(t, script[1].ResponseMessage, strings.TrimSpace(stdout.String()))
+	})
 }
 
 type params struct {
@@ -120,28 +139,9 @@ func setup(ctx context.Context, t testing.TB, p *params) ([]ScriptEntry, *agenta
 		p.cmdFn = defaultCmdFn
 	}
 
-	scriptFilePath := filepath.Join("testdata", filepath.Base(t.Name())+".json")
-	data, err := os.ReadFile(scriptFilePath)
-	require.NoError(t, err, "Failed to read test script file: %s", scriptFilePath)
-
-	var script []ScriptEntry
-	err = json.Unmarshal(data, &script)
-	require.NoError(t, err, "Failed to unmarshal script from %s", scriptFilePath)
+	scriptFilePath, script := readScript(t)
 
-	binaryPath := os.Getenv("AGENTAPI_BINARY_PATH")
-	if binaryPath == "" {
-		cwd, err := os.Getwd()
-		require.NoError(t, err, "Failed to get current working directory")
-		binaryPath = filepath.Join(cwd, "..", "out", "agentapi")
-		_, err = os.Stat(binaryPath)
-		if err != nil {
-			t.Logf("Building binary at %s", binaryPath)
-			buildCmd := exec.CommandContext(ctx, "go", "build", "-o", binaryPath, ".")
-			buildCmd.Dir = filepath.Join(cwd, "..")
-			t.Logf("run: %s", buildCmd.String())
-			require.NoError(t, buildCmd.Run(), "Failed to build binary")
-		}
-	}
+	binaryPath := getBinaryPath(ctx, t)
 
 	serverPort, err := getFreePort()
 	require.NoError(t, err, "Failed to get free port for server")
@@ -196,6 +196,41 @@ func setup(ctx context.Context, t testing.TB, p *params) ([]ScriptEntry, *agenta
 	return script, apiClient
 }
 
+// readScript loads the echo agent script named after the current test.
+func readScript(t testing.TB) (string, []ScriptEntry) {
+	t.Helper()
+
+	scriptFilePath := filepath.Join("testdata", filepath.Base(t.Name())+".json")
+	data, err := os.ReadFile(scriptFilePath)
+	require.NoError(t, err, "Failed to read test script file: %s", scriptFilePath)
+
+	var script []ScriptEntry
+	err = json.Unmarshal(data, &script)
+	require.NoError(t, err, "Failed to unmarshal script from %s", scriptFilePath)
+	return scriptFilePath, script
+}
+
+// getBinaryPath returns the agentapi binary under test, building it if needed.
+func getBinaryPath(ctx context.Context, t testing.TB) string {
+	t.Helper()
+
+	binaryPath := os.Getenv("AGENTAPI_BINARY_PATH")
+	if binaryPath == "" {
+		cwd, err := os.Getwd()
+		require.NoError(t, err, "Failed to get current working directory")
+		binaryPath = filepath.Join(cwd, "..", "out", "agentapi")
+		_, err = os.Stat(binaryPath)
+		if err != nil {
+			t.Logf("Building binary at %s", binaryPath)
+			buildCmd := exec.CommandContext(ctx, "go", "build", "-o", binaryPath, ".")
+			buildCmd.Dir = filepath.Join(cwd, "..")
+			t.Logf("run: %s", buildCmd.String())
+			require.NoError(t, buildCmd.Run(), "Failed to build binary")
+		}
+	}
+	return binaryPath
+}
+
 // logOutput logs process output with prefix
 func logOutput(t testing.TB, prefix string, r io.Reader) {
 	t.Helper()
@@ -0,0 +1,5 @@
+// Package agentapipb holds the gRPC interface of AgentAPI, generated from
+// agentapi.proto. The service is implemented by httpapi.Server.
+package agentapipb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative agentapi.proto
@@ -0,0 +1,154 @@
+// Package client subscribes to the events of an AgentAPI server from Go.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"iter"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/coder/agentapi/lib/httpapi"
+	sse "github.com/tmaxmax/go-sse"
+	"golang.org/x/xerrors"
+)
+
+// maxEventSize bounds the size of a single event. The messages of a snapshot
+// event can be big.
+const maxEventSize = 16 * 1024 * 1024
+
+// Client talks to the AgentAPI server at a base URL, e.g.
+// "http://localhost:3284".
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// New returns a client for the server at baseURL. httpClient may be nil, in
+// which case http.DefaultClient is used.
+func New(baseURL string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{baseURL: strings.TrimRight(baseURL, "/"), httpClient: httpClient}
+}
+
+// EventsOptions are the query parameters of GET /events.
+type EventsOptions struct {
+	IncludeScreen bool
+	// Types are the event types to receive. The server's default types are
+	// sent if it's empty.
+	Types []string
+	// Snapshot recreates the state with a single snapshot event. It has no
+	// effect on resumed subscriptions.
+	Snapshot bool
+}
+
+// Event is an event received from the server.
+type Event struct {
+	Type httpapi.EventType
+	// Data is the payload of the event, e.g. an httpapi.MessageUpdateBody
+	// for a message_update event.
+	Data json.RawMessage
+}
+
+// Subscription is a stream of events. It keeps a cursor, the id of the last
+// event received, so that the stream can be resumed from it with
+// Client.Resume once its connection drops, without gaps or duplicates.
+type Subscription struct {
+	body        io.Closer
+	next        func() (sse.Event, error, bool)
+	stop        func()
+	lastEventId int
+}
+
+// Subscribe opens a stream that starts with the events that recreate the
+// current state.
+func (c *Client) Subscribe(ctx context.Context, opts EventsOptions) (*Subscription, error) {
+	return c.subscribe(ctx, opts, 0)
+}
+
+// Resume opens a stream for a client that has received the events up to and
+// including fromEventId, usually the LastEventId of its previous
+// subscription. It starts with the events emitted since then. If the server
+// doesn't have them anymore, or fromEventId is 0 because no event with an id
+// was received, it starts with the events that recreate the current state
+// like Subscribe.
+func (c *Client) Resume(ctx context.Context, fromEventId int, opts EventsOptions) (*Subscription, error) {
+	return c.subscribe(ctx, opts, fromEventId)
+}
+
+func (c *Client) subscribe(ctx context.Context, opts EventsOptions, fromEventId int) (*Subscription, error) {
+	query := url.Values{}
+	if opts.IncludeScreen {
+		query.Set("include_screen", "true")
+	}
+	if len(opts.Types) > 0 {
+		query.Set("types", strings.Join(opts.Types, ","))
+	}
+	if opts.Snapshot {
+		query.Set("snapshot", "true")
+	}
+	eventsURL := c.baseURL + "/events"
+	if len(query) > 0 {
+		eventsURL += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, eventsURL, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if fromEventId > 0 {
+		req.Header.Set("Last-Event-ID", strconv.Itoa(fromEventId))
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to do request: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		_ = res.Body.Close()
+		return nil, xerrors.Errorf("failed to subscribe to events: unexpected status %s: %q", res.Status, body)
+	}
+	next, stop := iter.Pull2(iter.Seq2[sse.Event, error](sse.Read(res.Body, &sse.ReadConfig{MaxEventSize: maxEventSize})))
+	return &Subscription{body: res.Body, next: next, stop: stop, lastEventId: fromEventId}, nil
+}
+
+// Next blocks until the next event arrives. It returns io.EOF once the server
+// ends the stream.
+func (s *Subscription) Next() (Event, error) {
+	ev, err, ok := s.next()
+	if !ok {
+		return Event{}, io.EOF
+	}
+	if err != nil {
+		return Event{}, xerrors.Errorf("failed to read event: %w", err)
+	}
+	// Events without an id, such as heartbeats and all but the last of the
+	// events that recreate the state, leave the cursor where it is.
+	if ev.LastEventID != "" {
+		id, err := strconv.Atoi(ev.LastEventID)
+		if err != nil {
+			return Event{}, xerrors.Errorf("invalid event id %q: %w", ev.LastEventID, err)
+		}
+		s.lastEventId = id
+	}
+	return Event{Type: httpapi.EventType(ev.Type), Data: json.RawMessage(ev.Data)}, nil
+}
+
+// LastEventId returns the cursor of the subscription: the id to resume from
+// once every event returned by Next so far has been handled.
+func (s *Subscription) LastEventId() int {
+	return s.lastEventId
+}
+
+// Close ends the stream. It must not be called while Next blocks; cancel the
+// context of the subscription to interrupt Next instead.
+func (s *Subscription) Close() error {
+	err := s.body.Close()
+	s.stop()
+	return err
+}
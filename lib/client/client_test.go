@@ -0,0 +1,166 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coder/agentapi/lib/client"
+	"github.com/coder/agentapi/lib/httpapi"
+	"github.com/coder/agentapi/lib/logctx"
+	"github.com/coder/agentapi/lib/msgfmt"
+	"github.com/stretchr/testify/require"
+)
+
+// echoAgent shows everything written to it on its screen.
+type echoAgent struct {
+	mu     sync.Mutex
+	screen string
+}
+
+func (a *echoAgent) Write(data []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.screen += string(data)
+	return len(data), nil
+}
+
+func (a *echoAgent) ReadScreen() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.screen
+}
+
+// newTestServer returns a server whose agent has sent its first message, so
+// that the state is recreated by several events.
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	ctx, cancel := context.WithCancel(logctx.WithLogger(context.Background(), slog.New(slog.NewTextHandler(os.Stdout, nil))))
+	t.Cleanup(cancel)
+	srv, err := httpapi.NewServer(ctx, httpapi.ServerConfig{
+		AgentType:      msgfmt.AgentTypeCustom,
+		Process:        &echoAgent{screen: "Hello!\n"},
+		ChatBasePath:   "/chat",
+		AllowedHosts:   []string{"*"},
+		AllowedOrigins: []string{"*"},
+	})
+	require.NoError(t, err)
+	srv.StartSnapshotLoop(ctx)
+	tsServer := httptest.NewServer(srv.Handler())
+	t.Cleanup(tsServer.Close)
+	c := client.New(tsServer.URL, tsServer.Client())
+	require.Eventually(t, func() bool {
+		return len(readState(t, subscribe(t, c, 0))) > 1
+	}, 5*time.Second, 50*time.Millisecond)
+	return tsServer
+}
+
+// writeRaw writes content to the agent's terminal.
+func writeRaw(t *testing.T, tsServer *httptest.Server, content string) {
+	t.Helper()
+	data, err := json.Marshal(httpapi.MessageRequestBody{Content: content, Type: httpapi.MessageTypeRaw})
+	require.NoError(t, err)
+	resp, err := tsServer.Client().Post(tsServer.URL+"/message", "application/json", bytes.NewReader(data))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+// subscribe returns a subscription that's closed when the test ends, and
+// whose reads fail after 10 seconds.
+func subscribe(t *testing.T, c *client.Client, fromEventId int) *client.Subscription {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	opts := client.EventsOptions{Types: []string{"message_update", "status_change"}}
+	var sub *client.Subscription
+	var err error
+	if fromEventId > 0 {
+		sub, err = c.Resume(ctx, fromEventId, opts)
+	} else {
+		sub, err = c.Subscribe(ctx, opts)
+	}
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = sub.Close()
+	})
+	return sub
+}
+
+// readUntil returns the events of sub up to and including the first one whose
+// data contains substr.
+func readUntil(t *testing.T, sub *client.Subscription, substr string) []client.Event {
+	t.Helper()
+	var events []client.Event
+	for {
+		event, err := sub.Next()
+		require.NoError(t, err)
+		events = append(events, event)
+		if strings.Contains(string(event.Data), substr) {
+			return events
+		}
+	}
+}
+
+// readState returns the events that recreate the state. Only the last of them
+// has an id.
+func readState(t *testing.T, sub *client.Subscription) []client.Event {
+	t.Helper()
+	var events []client.Event
+	for sub.LastEventId() == 0 {
+		event, err := sub.Next()
+		require.NoError(t, err)
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestSubscription_ResumeMidReplay(t *testing.T) {
+	t.Parallel()
+	tsServer := newTestServer(t)
+	c := client.New(tsServer.URL, tsServer.Client())
+
+	// The connection drops after the first of the events that recreate the
+	// state.
+	sub := subscribe(t, c, 0)
+	_, err := sub.Next()
+	require.NoError(t, err)
+	require.Zero(t, sub.LastEventId())
+	require.NoError(t, sub.Close())
+
+	// Resuming from the cursor sends the whole state again.
+	state := readState(t, subscribe(t, c, sub.LastEventId()))
+	require.Equal(t, readState(t, subscribe(t, c, 0)), state)
+}
+
+func TestSubscription_Resume(t *testing.T) {
+	t.Parallel()
+	tsServer := newTestServer(t)
+	c := client.New(tsServer.URL, tsServer.Client())
+
+	// The reference subscription stays connected the whole time.
+	reference := subscribe(t, c, 0)
+	readState(t, reference)
+	first := subscribe(t, c, 0)
+	readState(t, first)
+	writeRaw(t, tsServer, " one")
+	received := readUntil(t, first, "one")
+	require.NoError(t, first.Close())
+
+	// The agent keeps writing while the subscriber is disconnected.
+	writeRaw(t, tsServer, " two")
+	resumed := subscribe(t, c, first.LastEventId())
+	writeRaw(t, tsServer, " three")
+	received = append(received, readUntil(t, resumed, "three")...)
+
+	// Together, both subscriptions received every event exactly once.
+	require.Equal(t, readUntil(t, reference, "three"), received)
+}
@@ -0,0 +1,86 @@
+package httpapi
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	st "github.com/coder/agentapi/lib/screentracker"
+)
+
+// agentIOLogSize is how many writes to the agent's terminal agentIOLog keeps.
+const agentIOLogSize = 100
+
+// AgentIOLogEntry is a single write to the agent's terminal.
+type AgentIOLogEntry struct {
+	Time  time.Time `json:"time" doc:"When the write started"`
+	Data  string    `json:"data" doc:"Bytes written to the terminal, including control sequences"`
+	Error string    `json:"error,omitempty" doc:"Error returned by the write, if any"`
+}
+
+// AgentIOLogResponse is the response of GET /internal/agent-io.
+type AgentIOLogResponse struct {
+	Body struct {
+		Entries []AgentIOLogEntry `json:"entries" nullable:"false" doc:"The last writes to the agent's terminal, oldest first"`
+	}
+}
+
+// agentIOLog keeps the last agentIOLogSize writes to the agent's terminal
+// for debugging. The writes may contain sensitive content, so it's only
+// enabled on request.
+type agentIOLog struct {
+	mu      sync.Mutex
+	entries []AgentIOLogEntry
+	// next is the index of entries the next write is stored at once the
+	// buffer is full.
+	next int
+}
+
+func (l *agentIOLog) record(at time.Time, data []byte, err error) {
+	entry := AgentIOLogEntry{Time: at, Data: string(data)}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.entries) < agentIOLogSize {
+		l.entries = append(l.entries, entry)
+		return
+	}
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % agentIOLogSize
+}
+
+// list returns the recorded writes, oldest first.
+func (l *agentIOLog) list() []AgentIOLogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := make([]AgentIOLogEntry, 0, len(l.entries))
+	entries = append(entries, l.entries[l.next:]...)
+	return append(entries, l.entries[:l.next]...)
+}
+
+// write writes data to agentio and records it.
+func (l *agentIOLog) write(agentio st.AgentIO, data []byte) (int, error) {
+	at := time.Now()
+	n, err := agentio.Write(data)
+	l.record(at, data, err)
+	return n, err
+}
+
+// loggedAgentIO records the writes to an AgentIO in log.
+type loggedAgentIO struct {
+	st.AgentIO
+	log *agentIOLog
+}
+
+func (a *loggedAgentIO) Write(data []byte) (int, error) {
+	return a.log.write(a.AgentIO, data)
+}
+
+// getAgentIOLog handles GET /internal/agent-io
+func (s *Server) getAgentIOLog(ctx context.Context, input *struct{}) (*AgentIOLogResponse, error) {
+	resp := &AgentIOLogResponse{}
+	resp.Body.Entries = s.agentIOLog.list()
+	return resp, nil
+}
@@ -0,0 +1,27 @@
+package httpapi
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgentIOLog(t *testing.T) {
+	var l agentIOLog
+	require.Empty(t, l.list())
+
+	for i := range agentIOLogSize + 3 {
+		l.record(time.Now(), []byte(fmt.Sprint(i)), nil)
+	}
+	entries := l.list()
+	require.Len(t, entries, agentIOLogSize)
+	require.Equal(t, "3", entries[0].Data)
+	require.Equal(t, fmt.Sprint(agentIOLogSize+2), entries[len(entries)-1].Data)
+
+	l.record(time.Now(), []byte("x"), fmt.Errorf("closed"))
+	entries = l.list()
+	require.Equal(t, "x", entries[len(entries)-1].Data)
+	require.Equal(t, "closed", entries[len(entries)-1].Error)
+}
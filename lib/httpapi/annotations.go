@@ -0,0 +1,99 @@
+package httpapi
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+// maxAnnotationsPerMessage bounds the annotations kept for a message.
+const maxAnnotationsPerMessage = 100
+
+// messageAnnotations holds the annotations clients attached to messages, by
+// message id. They don't affect the agent; they capture feedback on the
+// conversation for later review.
+type messageAnnotations struct {
+	mu     sync.RWMutex
+	values map[int][]Annotation
+}
+
+// get returns a copy of the annotations of a message.
+func (a *messageAnnotations) get(messageId int) []Annotation {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return slices.Clone(a.values[messageId])
+}
+
+// add appends an annotation to a message and returns all of its annotations.
+func (a *messageAnnotations) add(messageId int, annotation Annotation) ([]Annotation, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.values[messageId]) >= maxAnnotationsPerMessage {
+		return nil, huma.Error409Conflict(fmt.Sprintf("message %d already has %d annotations", messageId, maxAnnotationsPerMessage))
+	}
+	if a.values == nil {
+		a.values = map[int][]Annotation{}
+	}
+	a.values[messageId] = append(a.values[messageId], annotation)
+	return slices.Clone(a.values[messageId]), nil
+}
+
+// clearFrom removes the annotations of the messages with fromId and later
+// ids, whose ids are reused by new messages.
+func (a *messageAnnotations) clearFrom(fromId int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for id := range a.values {
+		if id >= fromId {
+			delete(a.values, id)
+		}
+	}
+}
+
+// messageExists reports whether the conversation has a message with id.
+func (s *Server) messageExists(id int) bool {
+	messages := s.conversation.Messages()
+	return id >= 0 && id < len(messages) && messages[id].Id == id
+}
+
+// getAnnotations handles GET /messages/{id}/annotations
+func (s *Server) getAnnotations(ctx context.Context, input *AnnotationsRequest) (*AnnotationsResponse, error) {
+	if !s.messageExists(input.Id) {
+		return nil, huma.Error404NotFound(fmt.Sprintf("message %d not found", input.Id))
+	}
+	resp := &AnnotationsResponse{}
+	resp.Body.Annotations = s.annotations.get(input.Id)
+	if resp.Body.Annotations == nil {
+		resp.Body.Annotations = []Annotation{}
+	}
+	return resp, nil
+}
+
+// addAnnotation handles POST /messages/{id}/annotations
+func (s *Server) addAnnotation(ctx context.Context, input *AddAnnotationRequest) (*AnnotationsResponse, error) {
+	if !s.messageExists(input.Id) {
+		return nil, huma.Error404NotFound(fmt.Sprintf("message %d not found", input.Id))
+	}
+	note := strings.TrimSpace(input.Body.Note)
+	if input.Body.Reaction == "" && note == "" {
+		return nil, huma.Error400BadRequest("an annotation needs a reaction or a note")
+	}
+	annotations, err := s.annotations.add(input.Id, Annotation{
+		Reaction: input.Body.Reaction,
+		Note:     note,
+		Time:     time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Info("Message annotated", "messageId", input.Id, "reaction", input.Body.Reaction)
+
+	resp := &AnnotationsResponse{}
+	resp.Body.Annotations = annotations
+	return resp, nil
+}
@@ -0,0 +1,109 @@
+package httpapi
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	st "github.com/coder/agentapi/lib/screentracker"
+	"github.com/danielgtaylor/huma/v2"
+)
+
+// auditLog records every POST /message request, its outcome and the agent's
+// reply to it. The entries of a request share a correlation id.
+type auditLog struct {
+	logger *slog.Logger
+	// logContent adds the content of messages to the entries.
+	logContent bool
+	// meta, if set, is added to the entries of received requests.
+	meta *conversationMeta
+
+	mu sync.Mutex
+	// pendingId is the correlation id of the last user message sent to the
+	// agent that hasn't been replied to yet. sentAt is when it was received.
+	pendingId string
+	sentAt    time.Time
+}
+
+// newCorrelationId returns a random id for a request that didn't come with one.
+func newCorrelationId() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// start logs the receipt of a message request.
+func (a *auditLog) start(correlationId string, clientIP string, agentType string, body MessageRequestBody, role st.ConversationRole) {
+	attrs := []any{
+		"correlationId", correlationId,
+		"clientIp", clientIP,
+		"agentType", agentType,
+		"type", body.Type,
+		"role", role,
+		"contentLength", len(body.Content),
+	}
+	if a.meta != nil {
+		if meta := a.meta.get(); len(meta) > 0 {
+			attrs = append(attrs, "meta", meta)
+		}
+	}
+	if a.logContent {
+		attrs = append(attrs, "content", body.Content)
+	}
+	a.logger.Info("Message request received", attrs...)
+}
+
+// finish logs the outcome of a message request. If a user message was sent to
+// the agent, its reply is logged by received with the same correlation id.
+func (a *auditLog) finish(correlationId string, start time.Time, sentToAgent bool, err error) {
+	status := http.StatusOK
+	if err != nil {
+		status = http.StatusInternalServerError
+		var statusErr huma.StatusError
+		if errors.As(err, &statusErr) {
+			status = statusErr.GetStatus()
+		}
+	}
+	attrs := []any{
+		"correlationId", correlationId,
+		"status", status,
+		"latencyMs", time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		attrs = append(attrs, "error", err.Error())
+	}
+	a.logger.Info("Message request completed", attrs...)
+
+	if err == nil && sentToAgent {
+		a.mu.Lock()
+		a.pendingId = correlationId
+		a.sentAt = start
+		a.mu.Unlock()
+	}
+}
+
+// received logs the agent's reply to the last user message.
+func (a *auditLog) received(msg st.ConversationMessage) {
+	a.mu.Lock()
+	correlationId, sentAt := a.pendingId, a.sentAt
+	a.pendingId = ""
+	a.mu.Unlock()
+	if correlationId == "" {
+		return
+	}
+
+	attrs := []any{
+		"correlationId", correlationId,
+		"messageId", msg.Id,
+		"contentLength", len(msg.Message),
+		"latencyMs", msg.Time.Sub(sentAt).Milliseconds(),
+	}
+	if a.logContent {
+		attrs = append(attrs, "content", msg.Message)
+	}
+	a.logger.Info("Agent replied", attrs...)
+}
@@ -0,0 +1,41 @@
+package httpapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	st "github.com/coder/agentapi/lib/screentracker"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLogReply(t *testing.T) {
+	var buf bytes.Buffer
+	a := &auditLog{logger: slog.New(slog.NewJSONHandler(&buf, nil)), logContent: true}
+
+	start := time.Now()
+	a.start("abc", "192.0.2.1", "claude", MessageRequestBody{Content: "hi", Type: MessageTypeUser}, st.ConversationRoleUser)
+	a.finish("abc", start, true, nil)
+	a.received(st.ConversationMessage{Id: 2, Message: "hello", Role: st.ConversationRoleAgent, Time: start.Add(3 * time.Second)})
+	// Only the first reply belongs to the request.
+	a.received(st.ConversationMessage{Id: 4, Message: "again", Role: st.ConversationRoleAgent, Time: start.Add(5 * time.Second)})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 3)
+	var reply struct {
+		Msg           string `json:"msg"`
+		CorrelationId string `json:"correlationId"`
+		MessageId     int    `json:"messageId"`
+		Content       string `json:"content"`
+		LatencyMs     int64  `json:"latencyMs"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(lines[2]), &reply))
+	require.Equal(t, "Agent replied", reply.Msg)
+	require.Equal(t, "abc", reply.CorrelationId)
+	require.Equal(t, 2, reply.MessageId)
+	require.Equal(t, "hello", reply.Content)
+	require.Equal(t, int64(3000), reply.LatencyMs)
+}
@@ -0,0 +1,64 @@
+package httpapi
+
+import (
+	"context"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2/sse"
+)
+
+// maxSlowSends is how many events in a row may take longer than the slow send
+// threshold to be sent before the subscriber is disconnected.
+const maxSlowSends = 3
+
+// eventSender sends the events of a stream, telling subscribers that went away
+// apart from subscribers that can't keep up with the events. The latter are
+// disconnected and counted in Server.backpressureDisconnects, so that they
+// don't hold up the emitter. A failed send means that the subscriber went
+// away, e.g. its connection was reset, so it isn't counted.
+type eventSender struct {
+	s            *Server
+	ctx          context.Context
+	subscriberId int
+	send         func(sse.Message) error
+	// slowSends is the number of sends in a row that took at least
+	// s.slowSendThreshold.
+	slowSends int
+	// err is the error of the send that failed, if any.
+	err error
+}
+
+// sendEvent sends message and reports whether the stream should go on.
+func (e *eventSender) sendEvent(message sse.Message) bool {
+	start := time.Now()
+	err := e.send(message)
+	if err != nil {
+		e.err = err
+		if e.ctx.Err() != nil {
+			e.s.logger.Info("Subscriber disconnected", "subscriberId", e.subscriberId)
+		} else {
+			e.s.logger.Info("Subscriber disconnected, sending an event failed", "subscriberId", e.subscriberId, "error", err)
+		}
+		return false
+	}
+	if e.s.slowSendThreshold <= 0 {
+		return true
+	}
+	if elapsed := time.Since(start); elapsed < e.s.slowSendThreshold {
+		e.slowSends = 0
+		return true
+	}
+	e.slowSends++
+	if e.slowSends >= maxSlowSends {
+		e.disconnect("events are sent too slowly", "slowSends", e.slowSends, "threshold", e.s.slowSendThreshold)
+		return false
+	}
+	return true
+}
+
+// disconnect logs why a subscriber that couldn't keep up is disconnected and
+// counts it.
+func (e *eventSender) disconnect(reason string, attrs ...any) {
+	e.s.backpressureDisconnects.Add(1)
+	e.s.logger.Warn("Disconnecting slow subscriber", append([]any{"subscriberId", e.subscriberId, "reason", reason}, attrs...)...)
+}
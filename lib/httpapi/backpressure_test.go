@@ -0,0 +1,112 @@
+package httpapi
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/coder/agentapi/lib/logctx"
+	st "github.com/coder/agentapi/lib/screentracker"
+	"github.com/danielgtaylor/huma/v2/sse"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestStreamEventsBackpressure(t *testing.T) {
+	t.Parallel()
+
+	newServer := func() *Server {
+		return &Server{
+			logger:     slog.New(logctx.DiscardHandler),
+			emitter:    NewEventEmitter(1),
+			streamsCtx: context.Background(),
+		}
+	}
+	// stream runs streamEvents and fails the test if it doesn't return. It
+	// returns the error of streamEvents.
+	stream := func(t *testing.T, s *Server, ctx context.Context, send func(sse.Message) error) error {
+		t.Helper()
+		done := make(chan error, 1)
+		go func() {
+			done <- s.streamEvents(ctx, &EventsRequest{}, send)
+		}()
+		var err error
+		select {
+		case err = <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the stream wasn't closed")
+		}
+		s.emitter.mu.Lock()
+		defer s.emitter.mu.Unlock()
+		require.Empty(t, s.emitter.chans, "the subscriber is unsubscribed")
+		return err
+	}
+
+	t.Run("failing send", func(t *testing.T) {
+		t.Parallel()
+		s := newServer()
+		sends := 0
+		err := stream(t, s, context.Background(), func(sse.Message) error {
+			sends++
+			return xerrors.New("write: broken pipe")
+		})
+		require.ErrorContains(t, err, "broken pipe")
+		require.Equal(t, 1, sends)
+		require.Zero(t, s.backpressureDisconnects.Load(), "failed connections aren't counted")
+	})
+
+	t.Run("client closed", func(t *testing.T) {
+		t.Parallel()
+		s := newServer()
+		ctx, cancel := context.WithCancel(context.Background())
+		_ = stream(t, s, ctx, func(sse.Message) error {
+			cancel()
+			return context.Canceled
+		})
+		require.Zero(t, s.backpressureDisconnects.Load(), "clients that went away aren't counted")
+	})
+
+	t.Run("slow sends", func(t *testing.T) {
+		t.Parallel()
+		s := newServer()
+		s.slowSendThreshold = 5 * time.Millisecond
+		s.heartbeatInterval = time.Millisecond
+		sends := 0
+		require.NoError(t, stream(t, s, context.Background(), func(sse.Message) error {
+			sends++
+			time.Sleep(10 * time.Millisecond)
+			return nil
+		}))
+		require.Equal(t, maxSlowSends, sends)
+		require.EqualValues(t, 1, s.backpressureDisconnects.Load())
+
+		resp, err := s.getHealth(context.Background(), &struct{}{})
+		require.NoError(t, err)
+		require.EqualValues(t, 1, resp.Body.BackpressureDisconnects)
+	})
+
+	t.Run("full buffer", func(t *testing.T) {
+		t.Parallel()
+		s := newServer()
+		blocked := make(chan struct{})
+		unblock := make(chan struct{})
+		first := true
+		go func() {
+			<-blocked
+			// The buffer holds one event, so the second one overflows it.
+			s.emitter.UpdateStatusAndEmitChanges(st.ConversationStatusStable, "")
+			s.emitter.UpdateStatusAndEmitChanges(st.ConversationStatusChanging, "")
+			close(unblock)
+		}()
+		require.NoError(t, stream(t, s, context.Background(), func(sse.Message) error {
+			if first {
+				first = false
+				close(blocked)
+				<-unblock
+			}
+			return nil
+		}))
+		require.EqualValues(t, 1, s.backpressureDisconnects.Load())
+	})
+}
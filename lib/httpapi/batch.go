@@ -0,0 +1,99 @@
+package httpapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	st "github.com/coder/agentapi/lib/screentracker"
+	"golang.org/x/xerrors"
+)
+
+// defaultBatchMessageTimeout is how long POST /messages/batch waits for the
+// agent to become stable around each message by default.
+const defaultBatchMessageTimeout = 5 * time.Minute
+
+// sendBatch handles POST /messages/batch. The messages are sent one at a
+// time, each once the agent is stable, i.e. done with the previous one. The
+// first message that fails stops the batch, and so does canceling the
+// request; the remaining messages are skipped.
+func (s *Server) sendBatch(ctx context.Context, input *BatchMessageRequest) (*BatchMessageResponse, error) {
+	timeout := time.Duration(input.Body.TimeoutMs) * time.Millisecond
+	if timeout == 0 {
+		timeout = defaultBatchMessageTimeout
+	}
+	requestId := input.RequestId
+	if requestId == "" {
+		requestId = newCorrelationId()
+	}
+
+	resp := &BatchMessageResponse{RequestId: requestId}
+	resp.Body.Ok = true
+	resp.Body.Results = make([]BatchMessageResult, len(input.Body.Messages))
+	var stopped error
+	for i, body := range input.Body.Messages {
+		result := &resp.Body.Results[i]
+		if stopped == nil && ctx.Err() != nil {
+			stopped = xerrors.New("the request was canceled")
+		}
+		if stopped != nil {
+			result.Status = BatchMessageStatusSkipped
+			result.Error = stopped.Error()
+			continue
+		}
+		if err := s.sendBatchMessage(ctx, fmt.Sprintf("%s-%d", requestId, i), body, timeout); err != nil {
+			s.logger.Warn("Batch message failed", "requestId", requestId, "index", i, "error", err)
+			result.Status = BatchMessageStatusFailed
+			result.Error = err.Error()
+			resp.Body.Ok = false
+			stopped = xerrors.Errorf("message %d failed", i)
+			if errors.Is(err, context.Canceled) {
+				stopped = xerrors.New("the request was canceled")
+			}
+			continue
+		}
+		result.Status = BatchMessageStatusSent
+	}
+	if !resp.Body.Ok {
+		s.logger.Info("Batch stopped", "requestId", requestId, "messages", len(input.Body.Messages))
+	}
+	return resp, nil
+}
+
+// sendBatchMessage waits for the agent to be stable, sends a message of a
+// batch, and if it went to the agent, waits for the agent to be stable again.
+func (s *Server) sendBatchMessage(ctx context.Context, correlationId string, body MessageRequestBody, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	wait := func(what string) error {
+		err := s.waitForStableStatus(ctx)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return xerrors.Errorf("the agent did not become stable %s within %s", what, timeout)
+		}
+		return err
+	}
+
+	role := body.Role
+	if role == "" {
+		role = st.ConversationRoleUser
+	}
+	sentToAgent := body.Type == MessageTypeUser && role == st.ConversationRoleUser
+	if body.Type == MessageTypeUser {
+		if err := wait("before the message was sent"); err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	s.audit.start(correlationId, clientIPFrom(ctx), string(s.agentType), body, role)
+	_, err := s.sendMessageRequest(body, role)
+	s.audit.finish(correlationId, start, sentToAgent, err)
+	if err != nil {
+		return err
+	}
+	if sentToAgent {
+		return wait("after the message was sent")
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package httpapi
+
+import (
+	"context"
+
+	mf "github.com/coder/agentapi/lib/msgfmt"
+)
+
+// agentCapabilities returns the features the server supports for the agent
+// and configuration of config, for clients that adapt their UI to them.
+func agentCapabilities(config ServerConfig) Capabilities {
+	agent, _ := mf.LookupAgent(string(config.AgentType))
+	_, resizable := config.Process.(resizer)
+	return Capabilities{
+		RawInput:         config.Process != nil,
+		Attachments:      config.FilesRoot != "",
+		FileMentions:     agent.FileMentionPrefix != "",
+		ModelSelection:   false,
+		Sessions:         false,
+		Screen:           !config.DisableScreen,
+		Resize:           resizable,
+		Permissions:      config.PermissionPattern != "",
+		Diffs:            config.ExtractDiffs && agent.ExtractDiffs != nil,
+		Commands:         config.ExtractCommands && agent.ExtractCommands != nil,
+		Tail:             config.EnableTail,
+		MessageInjection: config.AllowMessageInjection,
+	}
+}
+
+// getCapabilities handles GET /capabilities
+func (s *Server) getCapabilities(ctx context.Context, input *struct{}) (*CapabilitiesResponse, error) {
+	resp := &CapabilitiesResponse{}
+	resp.Body.AgentType = s.agentType
+	resp.Body.Capabilities = s.capabilities
+	return resp, nil
+}
@@ -1,34 +1,72 @@
 package httpapi
 
 import (
+	"strings"
+
 	mf "github.com/coder/agentapi/lib/msgfmt"
 	st "github.com/coder/agentapi/lib/screentracker"
 )
 
-func formatPaste(message string) []st.MessagePart {
-	return []st.MessagePart{
+// promptAffixSeparator separates the configured prompt prefix and suffix
+// from the user's message.
+const promptAffixSeparator = "\n\n"
+
+func formatPaste(message string, prefix string, suffix string) []st.MessagePart {
+	parts := []st.MessagePart{
 		// Bracketed paste mode start sequence
 		st.MessagePartText{Content: "\x1b[200~", Hidden: true},
-		st.MessagePartText{Content: message},
-		// Bracketed paste mode end sequence
-		st.MessagePartText{Content: "\x1b[201~", Hidden: true},
 	}
+	// The prefix and suffix are hidden so that the conversation history
+	// shows the message as the user wrote it. The agent echoes them though.
+	if prefix != "" {
+		parts = append(parts, st.MessagePartText{Content: prefix + promptAffixSeparator, Hidden: true, Echoed: true})
+	}
+	parts = append(parts, st.MessagePartText{Content: message})
+	if suffix != "" {
+		parts = append(parts, st.MessagePartText{Content: promptAffixSeparator + suffix, Hidden: true, Echoed: true})
+	}
+	// Bracketed paste mode end sequence
+	parts = append(parts, st.MessagePartText{Content: "\x1b[201~", Hidden: true})
+	return parts
 }
 
-func formatClaudeCodeMessage(message string) []st.MessagePart {
+func formatClaudeCodeMessage(message string, prefix string, suffix string) []st.MessagePart {
 	parts := make([]st.MessagePart, 0)
 	// janky hack: send a random character and then a backspace because otherwise
 	// Claude Code echoes the startSeq back to the terminal.
 	// This basically simulates a user typing and then removing the character.
 	parts = append(parts, st.MessagePartText{Content: "x\b", Hidden: true})
-	parts = append(parts, formatPaste(message)...)
+	parts = append(parts, formatPaste(message, prefix, suffix)...)
 
 	return parts
 }
 
-func FormatMessage(agentType mf.AgentType, message string) []st.MessagePart {
+// FormatMessage converts a user message into the parts written to the agent's terminal.
+// The optional prefix and suffix are sent to the agent but are not part of the message
+// recorded in the conversation history.
+func FormatMessage(agentType mf.AgentType, message string, prefix string, suffix string) []st.MessagePart {
 	message = mf.TrimWhitespace(message)
+	prefix = mf.TrimWhitespace(prefix)
+	suffix = mf.TrimWhitespace(suffix)
 	// for now Claude Code formatting seems to also work for Goose and Aider
 	// so we can use the same function for all three
-	return formatClaudeCodeMessage(message)
+	return formatClaudeCodeMessage(message, prefix, suffix)
+}
+
+// FormatRawMessage writes a user message to the agent's terminal exactly as
+// given, without the agent-specific formatting, prompt prefix and suffix.
+// Leading and trailing whitespace is sent to the agent but isn't part of the
+// message recorded in the conversation history.
+func FormatRawMessage(message string) []st.MessagePart {
+	trimmedLeft := strings.TrimLeft(message, mf.WhiteSpaceChars)
+	trimmed := strings.TrimRight(trimmedLeft, mf.WhiteSpaceChars)
+	parts := make([]st.MessagePart, 0, 3)
+	if leading := message[:len(message)-len(trimmedLeft)]; leading != "" {
+		parts = append(parts, st.MessagePartText{Content: leading, Hidden: true})
+	}
+	parts = append(parts, st.MessagePartText{Content: trimmed})
+	if trailing := trimmedLeft[len(trimmed):]; trailing != "" {
+		parts = append(parts, st.MessagePartText{Content: trailing, Hidden: true})
+	}
+	return parts
 }
@@ -0,0 +1,77 @@
+package httpapi
+
+import (
+	"strings"
+	"testing"
+
+	mf "github.com/coder/agentapi/lib/msgfmt"
+	st "github.com/coder/agentapi/lib/screentracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingAgent struct {
+	written strings.Builder
+}
+
+func (a *recordingAgent) Write(data []byte) (int, error) {
+	return a.written.Write(data)
+}
+
+func (a *recordingAgent) ReadScreen() string {
+	return ""
+}
+
+func TestFormatMessage(t *testing.T) {
+	t.Run("no-affixes", func(t *testing.T) {
+		parts := FormatMessage(mf.AgentTypeClaude, " hello ", "", "")
+		agent := &recordingAgent{}
+		require.NoError(t, st.ExecuteParts(agent, parts...))
+		assert.Equal(t, "x\b\x1b[200~hello\x1b[201~", agent.written.String())
+		assert.Equal(t, "hello", st.PartsToString(parts...))
+	})
+
+	t.Run("prefix-and-suffix", func(t *testing.T) {
+		parts := FormatMessage(mf.AgentTypeClaude, "hello", "Act as a reviewer.", " Be concise. ")
+		agent := &recordingAgent{}
+		require.NoError(t, st.ExecuteParts(agent, parts...))
+		// The agent receives the wrapped message...
+		assert.Equal(t, "x\b\x1b[200~Act as a reviewer.\n\nhello\n\nBe concise.\x1b[201~", agent.written.String())
+		// ...but the conversation history records the original one.
+		assert.Equal(t, "hello", st.PartsToString(parts...))
+		// The agent echoes the prefix and suffix too.
+		assert.Equal(t, "Act as a reviewer.\n\nhello\n\nBe concise.", st.PartsToInput(parts...))
+	})
+
+	t.Run("suffix-only", func(t *testing.T) {
+		parts := FormatMessage(mf.AgentTypeGoose, "hello", "", "Be concise.")
+		agent := &recordingAgent{}
+		require.NoError(t, st.ExecuteParts(agent, parts...))
+		assert.Equal(t, "x\b\x1b[200~hello\n\nBe concise.\x1b[201~", agent.written.String())
+		assert.Equal(t, "hello", st.PartsToString(parts...))
+	})
+}
+
+func TestFormatRawMessage(t *testing.T) {
+	t.Run("verbatim", func(t *testing.T) {
+		parts := FormatRawMessage("/compact\r")
+		agent := &recordingAgent{}
+		require.NoError(t, st.ExecuteParts(agent, parts...))
+		assert.Equal(t, "/compact\r", agent.written.String())
+		assert.Equal(t, "/compact", st.PartsToString(parts...))
+	})
+
+	t.Run("no-whitespace", func(t *testing.T) {
+		parts := FormatRawMessage("hello")
+		require.Len(t, parts, 1)
+		assert.Equal(t, "hello", st.PartsToString(parts...))
+	})
+
+	t.Run("whitespace-only", func(t *testing.T) {
+		parts := FormatRawMessage(" \n")
+		agent := &recordingAgent{}
+		require.NoError(t, st.ExecuteParts(agent, parts...))
+		assert.Equal(t, " \n", agent.written.String())
+		assert.Equal(t, "", st.PartsToString(parts...))
+	})
+}
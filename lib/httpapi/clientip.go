@@ -0,0 +1,107 @@
+package httpapi
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// parseTrustedProxies parses the CIDR ranges of the proxies whose
+// X-Forwarded-For headers are trusted. Plain addresses are accepted as
+// single-address ranges.
+func parseTrustedProxies(input []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(input))
+	for _, item := range input {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				return nil, xerrors.Errorf("'%s' is not a valid IP address or CIDR range: %w", item, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			return nil, xerrors.Errorf("'%s' is not a valid IP address or CIDR range: %w", item, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// isTrustedProxy reports whether addr is in one of the trusted ranges.
+func isTrustedProxy(trusted []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client that made r. It's the direct
+// peer's address unless the peer is a trusted proxy, in which case it's the
+// last address of X-Forwarded-For that isn't a trusted proxy. Proxies append
+// the address of their peer to the header, so the addresses before the last
+// untrusted one may have been set by the client and are ignored.
+func clientIP(r *http.Request, trusted []netip.Prefix) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil {
+		return host
+	}
+	peer = peer.Unmap()
+	if !isTrustedProxy(trusted, peer) {
+		return peer.String()
+	}
+
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	client := peer
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			// A malformed entry can't be followed any further.
+			break
+		}
+		client = addr.Unmap()
+		if !isTrustedProxy(trusted, client) {
+			break
+		}
+	}
+	return client.String()
+}
+
+type clientIPKey struct{}
+
+// clientIPMiddleware adds the IP address of the client to the context of
+// requests, for clientIPFrom.
+func clientIPMiddleware(trusted []netip.Prefix) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), clientIPKey{}, clientIP(r, trusted))
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// clientIPFrom returns the IP address of the client of the request ctx
+// belongs to, or "" if it's unknown.
+func clientIPFrom(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
@@ -0,0 +1,67 @@
+package httpapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientIP(t *testing.T) {
+	t.Parallel()
+
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.7"})
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name string
+		// noProxies runs the case without trusted proxies.
+		noProxies  bool
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{name: "untrusted peer without header", remoteAddr: "198.51.100.1:1234", want: "198.51.100.1"},
+		{name: "untrusted peer ignores header", remoteAddr: "198.51.100.1:1234", forwarded: []string{"203.0.113.9"}, want: "198.51.100.1"},
+		{name: "no trusted proxies ignores header", noProxies: true, remoteAddr: "10.0.0.1:1234", forwarded: []string{"203.0.113.9"}, want: "10.0.0.1"},
+		{name: "trusted peer", remoteAddr: "10.0.0.1:1234", forwarded: []string{"203.0.113.9"}, want: "203.0.113.9"},
+		{name: "trusted peer without header", remoteAddr: "10.0.0.1:1234", want: "10.0.0.1"},
+		{name: "trusted single address", remoteAddr: "192.0.2.7:1234", forwarded: []string{"203.0.113.9"}, want: "203.0.113.9"},
+		{name: "chain of trusted proxies", remoteAddr: "10.0.0.1:1234", forwarded: []string{"203.0.113.9, 10.1.2.3"}, want: "203.0.113.9"},
+		{name: "spoofed entries are ignored", remoteAddr: "10.0.0.1:1234", forwarded: []string{"1.2.3.4, 203.0.113.9"}, want: "203.0.113.9"},
+		{name: "multiple headers", remoteAddr: "10.0.0.1:1234", forwarded: []string{"1.2.3.4", "203.0.113.9, 10.1.2.3"}, want: "203.0.113.9"},
+		{name: "malformed entry", remoteAddr: "10.0.0.1:1234", forwarded: []string{"203.0.113.9, garbage, 10.1.2.3"}, want: "10.1.2.3"},
+		{name: "ipv4-mapped peer", remoteAddr: "[::ffff:10.0.0.1]:1234", forwarded: []string{"2001:db8::1"}, want: "2001:db8::1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			r := httptest.NewRequest(http.MethodGet, "/status", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for _, value := range tc.forwarded {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			proxies := trusted
+			if tc.noProxies {
+				proxies = nil
+			}
+			require.Equal(t, tc.want, clientIP(r, proxies))
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	t.Parallel()
+
+	prefixes, err := parseTrustedProxies([]string{"10.1.2.3/8", "::1", " 192.0.2.1 "})
+	require.NoError(t, err)
+	require.Len(t, prefixes, 3)
+	require.Equal(t, "10.0.0.0/8", prefixes[0].String())
+	require.Equal(t, "::1/128", prefixes[1].String())
+	require.Equal(t, "192.0.2.1/32", prefixes[2].String())
+
+	_, err = parseTrustedProxies([]string{"proxy.internal"})
+	require.ErrorContains(t, err, "'proxy.internal' is not a valid IP address or CIDR range")
+	_, err = parseTrustedProxies([]string{"10.0.0.0/40"})
+	require.Error(t, err)
+}
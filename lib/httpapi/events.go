@@ -1,7 +1,10 @@
 package httpapi
 
 import (
+	"encoding/base64"
 	"fmt"
+	"reflect"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -16,10 +19,69 @@ type EventType string
 
 const (
 	EventTypeMessageUpdate EventType = "message_update"
+	EventTypeMessagesClear EventType = "messages_clear"
 	EventTypeStatusChange  EventType = "status_change"
 	EventTypeScreenUpdate  EventType = "screen_update"
+	EventTypeTypingStart   EventType = "typing_start"
+	EventTypeTypingStop    EventType = "typing_stop"
+	EventTypeNotice        EventType = "notice"
+	EventTypeHeartbeat     EventType = "heartbeat"
+	EventTypeReconnect     EventType = "reconnect"
+	// EventTypeSnapshot replaces the events that recreate the state for
+	// subscribers that ask for it.
+	EventTypeSnapshot EventType = "snapshot"
+	// EventTypePermissionRequest and EventTypePermissionResolved are only
+	// emitted by servers that run with --permission-pattern.
+	EventTypePermissionRequest  EventType = "permission_request"
+	EventTypePermissionResolved EventType = "permission_resolved"
 )
 
+// eventPayloads maps every event type to the type of its payload.
+var eventPayloads = map[string]any{
+	string(EventTypeMessageUpdate): MessageUpdateBody{},
+	string(EventTypeMessagesClear): MessagesClearBody{},
+	string(EventTypeStatusChange):  StatusChangeBody{},
+	string(EventTypeScreenUpdate):  ScreenUpdateBody{},
+	string(EventTypeTypingStart):   TypingStartBody{},
+	string(EventTypeTypingStop):    TypingStopBody{},
+	string(EventTypeNotice):        NoticeBody{},
+	string(EventTypeHeartbeat):     HeartbeatBody{},
+	string(EventTypeReconnect):     ReconnectBody{},
+	string(EventTypeSnapshot):      SnapshotBody{},
+
+	string(EventTypePermissionRequest):  PermissionRequestBody{},
+	string(EventTypePermissionResolved): PermissionResolvedBody{},
+}
+
+// optInEventTypes are only sent to the subscribers that ask for them with
+// types. Clients written before they were added reject unknown event types.
+var optInEventTypes = []EventType{
+	EventTypeMessagesClear,
+	EventTypeTypingStart,
+	EventTypeTypingStop,
+	EventTypeNotice,
+}
+
+// subscribedTo reports whether a subscriber that asked for types gets events
+// of eventType. No types stand for all event types but the opt-in ones.
+func subscribedTo(types []string, eventType EventType) bool {
+	if len(types) == 0 {
+		return !slices.Contains(optInEventTypes, eventType)
+	}
+	return slices.Contains(types, string(eventType))
+}
+
+// eventTypeOf returns the type of the event with payload.
+func eventTypeOf(payload any) EventType {
+	payloadType := reflect.TypeOf(payload)
+	for eventType, p := range eventPayloads {
+		if reflect.TypeOf(p) == payloadType {
+			return EventType(eventType)
+		}
+	}
+	return ""
+}
+
 type AgentStatus string
 
 const (
@@ -37,10 +99,20 @@ func (a AgentStatus) Schema(r huma.Registry) *huma.Schema {
 }
 
 type MessageUpdateBody struct {
-	Id      int                 `json:"id" doc:"Unique identifier for the message. This identifier also represents the order of the message in the conversation history."`
-	Role    st.ConversationRole `json:"role" doc:"Role of the message author"`
-	Message string              `json:"message" doc:"Message content. The message is formatted as it appears in the agent's terminal session, meaning that, by default, it consists of lines of text with 80 characters per line."`
-	Time    time.Time           `json:"time" doc:"Timestamp of the message"`
+	Id        int                 `json:"id" doc:"Unique identifier for the message. This identifier also represents the order of the message in the conversation history."`
+	Role      st.ConversationRole `json:"role" doc:"Role of the message author"`
+	Message   string              `json:"message" doc:"Message content. The message is formatted as it appears in the agent's terminal session, meaning that, by default, it consists of lines of text with 80 characters per line."`
+	Time      time.Time           `json:"time" doc:"Timestamp of the message"`
+	Complete  bool                `json:"complete" doc:"False while the agent is still writing this message. Only the last agent message can be incomplete."`
+	RawBase64 string              `json:"raw_base64,omitempty" doc:"The agent's message as read from the screen, base64 encoded, if it isn't valid UTF-8. The message has the invalid bytes replaced with U+FFFD. Only set if the server runs with --keep-invalid-utf8."`
+	Provider  string              `json:"provider,omitempty" doc:"Provider of the model that wrote this agent message, as set with --agent-provider."`
+	Model     string              `json:"model,omitempty" doc:"Model that wrote this agent message, as set with --agent-model."`
+}
+
+// MessagesClearBody is sent when messages are removed from the end of the
+// conversation history, e.g. when the agent's last reply is regenerated.
+type MessagesClearBody struct {
+	FromId int `json:"from_id" doc:"Messages with this identifier and all later ones were removed. Messages that take their place are sent with message_update events."`
 }
 
 type StatusChangeBody struct {
@@ -49,36 +121,148 @@ type StatusChangeBody struct {
 }
 
 type ScreenUpdateBody struct {
-	Screen string `json:"screen"`
+	Screen string `json:"screen" doc:"Contents of the agent's terminal screen, with trailing whitespace removed."`
+}
+
+// TypingStartBody is sent when the agent starts producing output.
+type TypingStartBody struct{}
+
+// TypingStopBody is sent when the agent stops producing output.
+type TypingStopBody struct{}
+
+// NoticeBody is a message from the server's operators to the clients that
+// subscribe to notices, e.g. about upcoming maintenance.
+type NoticeBody struct {
+	Severity string `json:"severity" enum:"info,warning,error" doc:"How important the notice is."`
+	Text     string `json:"text" doc:"Text of the notice."`
+}
+
+// HeartbeatBody is sent periodically to subscribers of servers that run with
+// --sse-heartbeat-interval, so that they can detect stale connections.
+type HeartbeatBody struct {
+	Time   time.Time `json:"time" doc:"The server's time when the heartbeat was sent."`
+	TimeMs int64     `json:"time_ms" doc:"The server's time when the heartbeat was sent, in milliseconds since the Unix epoch."`
+}
+
+// ReconnectBody is the last event of an /events stream that the server
+// closes because it reached --sse-max-duration.
+type ReconnectBody struct {
+	LastEventId int `json:"last_event_id" doc:"Id of the last event sent on the stream. Send it in the Last-Event-ID header when reconnecting to receive the events emitted since."`
+}
+
+// SnapshotBody is the state of the conversation, sent in one event instead
+// of a message_update event per message and a status_change event, so that
+// the messages and the status are consistent.
+type SnapshotBody struct {
+	Status    AgentStatus         `json:"status" doc:"Status of the agent."`
+	AgentType mf.AgentType        `json:"agent_type" doc:"Type of the agent being used by the server."`
+	Messages  []MessageUpdateBody `json:"messages" nullable:"false" doc:"The messages of the conversation, oldest first, as they would be sent in message_update events."`
+}
+
+// PermissionRequestBody is sent when the agent asks for permission, e.g. to
+// run a tool. Clients answer with POST /permissions/{id}.
+type PermissionRequestBody struct {
+	Id     int    `json:"id" doc:"Identifier of the request, for POST /permissions/{id}."`
+	Tool   string `json:"tool,omitempty" doc:"The tool the agent wants to use, if the permission pattern captures it."`
+	Action string `json:"action,omitempty" doc:"What the agent wants to do, if the permission pattern captures it."`
+	Prompt string `json:"prompt" doc:"The prompt on the agent's screen."`
+}
+
+// PermissionResolvedBody is sent when the agent's permission prompt goes away.
+type PermissionResolvedBody struct {
+	Id       int                `json:"id" doc:"Identifier of the request."`
+	Decision PermissionDecision `json:"decision,omitempty" doc:"How the request was answered with POST /permissions/{id}. Not set if it was answered in the agent's terminal."`
 }
 
 type Event struct {
+	// Id orders the events emitted by an EventEmitter, starting at 1. Events
+	// that recreate the state on subscription carry the id of the last
+	// emitted event.
+	Id      int
 	Type    EventType
 	Payload any
 }
 
+// eventHistorySize is how many events an EventEmitter keeps for subscribers
+// that resume after a dropped connection.
+const eventHistorySize = 1000
+
+// dropWindow is how far back EventEmitter.RecentDrops counts dropped
+// subscribers.
+const dropWindow = 5 * time.Minute
+
 type EventEmitter struct {
-	mu                  sync.Mutex
-	messages            []st.ConversationMessage
+	mu       sync.Mutex
+	messages []st.ConversationMessage
+	// messagesStatus is the status at the time messages were last emitted.
+	messagesStatus      AgentStatus
 	status              AgentStatus
 	agentType           mf.AgentType
 	chans               map[int]chan Event
 	chanIdx             int
 	subscriptionBufSize int
 	screen              string
+	typing              bool
+	// permission is the pending permission request, or nil.
+	permission *PermissionRequestBody
+	// lastEventId is the id of the last emitted event.
+	lastEventId int
+	// history holds the last emitted events except screen updates, oldest
+	// first. evictedId is the id of the last event dropped from it.
+	history   []Event
+	evictedId int
+	// drops are the times at which subscribers were dropped for not keeping
+	// up with the events, oldest first.
+	drops []time.Time
+}
+
+// agentStatuses maps every conversation status to the status reported by the
+// API. Clients only distinguish whether the agent accepts a new message, so
+// several conversation statuses can share an API status.
+var agentStatuses = map[st.ConversationStatus]AgentStatus{
+	// The agent is starting up and not ready for input yet.
+	st.ConversationStatusInitializing: AgentStatusRunning,
+	// The agent's screen is changing, or a message is being written to it.
+	st.ConversationStatusChanging: AgentStatusRunning,
+	// The agent's screen hasn't changed for a while and it's waiting for input.
+	st.ConversationStatusStable: AgentStatusStable,
 }
 
 func convertStatus(status st.ConversationStatus) AgentStatus {
-	switch status {
-	case st.ConversationStatusInitializing:
-		return AgentStatusRunning
-	case st.ConversationStatusStable:
-		return AgentStatusStable
-	case st.ConversationStatusChanging:
-		return AgentStatusRunning
-	default:
+	agentStatus, ok := agentStatuses[status]
+	if !ok {
 		panic(fmt.Sprintf("unknown conversation status: %s", status))
 	}
+	return agentStatus
+}
+
+// isMessageComplete reports whether messages[i] is done being written.
+// Only the last agent message can still be in progress, and only while
+// the agent is running.
+func isMessageComplete(messages []st.ConversationMessage, i int, status AgentStatus) bool {
+	return i != len(messages)-1 || messages[i].Role != st.ConversationRoleAgent || status == AgentStatusStable
+}
+
+func newMessageUpdateBody(messages []st.ConversationMessage, i int, status AgentStatus) MessageUpdateBody {
+	return MessageUpdateBody{
+		Id:        messages[i].Id,
+		Role:      messages[i].Role,
+		Message:   messages[i].Message,
+		Time:      messages[i].Time,
+		Complete:  isMessageComplete(messages, i, status),
+		RawBase64: encodeRawBytes(messages[i].RawBytes),
+		Provider:  messages[i].Provider,
+		Model:     messages[i].Model,
+	}
+}
+
+// encodeRawBytes returns the base64 encoding of the original bytes of a
+// message, or "" if there are none.
+func encodeRawBytes(raw []byte) string {
+	if raw == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(raw)
 }
 
 // subscriptionBufSize is the size of the buffer for each subscription.
@@ -90,6 +274,7 @@ func NewEventEmitter(subscriptionBufSize int) *EventEmitter {
 	return &EventEmitter{
 		mu:                  sync.Mutex{},
 		messages:            make([]st.ConversationMessage, 0),
+		messagesStatus:      AgentStatusRunning,
 		status:              AgentStatusRunning,
 		chans:               make(map[int]chan Event),
 		chanIdx:             0,
@@ -99,60 +284,102 @@ func NewEventEmitter(subscriptionBufSize int) *EventEmitter {
 
 // Assumes the caller holds the lock.
 func (e *EventEmitter) notifyChannels(eventType EventType, payload any) {
+	e.lastEventId++
+	event := Event{
+		Id:      e.lastEventId,
+		Type:    eventType,
+		Payload: payload,
+	}
+	// The screen changes too often to keep its updates. Resumed subscribers
+	// get the current screen instead.
+	if eventType != EventTypeScreenUpdate {
+		if len(e.history) == eventHistorySize {
+			e.evictedId = e.history[0].Id
+			e.history = e.history[1:]
+		}
+		e.history = append(e.history, event)
+	}
+
 	chanIds := make([]int, 0, len(e.chans))
 	for chanId := range e.chans {
 		chanIds = append(chanIds, chanId)
 	}
 	for _, chanId := range chanIds {
 		ch := e.chans[chanId]
-		event := Event{
-			Type:    eventType,
-			Payload: payload,
-		}
-
 		select {
 		case ch <- event:
 		default:
 			// If the channel is full, close it.
 			// Listeners must actively drain the channel.
 			e.unsubscribeInner(chanId)
+			// The old drops are pruned here too, so that they don't pile
+			// up if RecentDrops isn't called.
+			now := time.Now()
+			e.pruneDrops(now)
+			e.drops = append(e.drops, now)
 		}
 	}
 }
 
-// Assumes that only the last message can change or new messages can be added.
+// Assumes that only the last message can change, new messages can be added or
+// messages can be removed from the end of the history. Every changed or added
+// message is emitted as its own event, in the order of the history, so several
+// messages appended in one update arrive one after the other.
 // If a new message is injected between existing messages (identified by Id), the behavior is undefined.
+// A message is also emitted again when it becomes complete, so the status should be
+// updated before the messages.
 func (e *EventEmitter) UpdateMessagesAndEmitChanges(newMessages []st.ConversationMessage) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
-	maxLength := max(len(e.messages), len(newMessages))
-	for i := range maxLength {
-		var oldMsg st.ConversationMessage
-		var newMsg st.ConversationMessage
+	e.updateMessagesInner(newMessages)
+}
+
+// Assumes the caller holds the lock.
+func (e *EventEmitter) updateMessagesInner(newMessages []st.ConversationMessage) {
+	if len(newMessages) < len(e.messages) {
+		e.notifyChannels(EventTypeMessagesClear, MessagesClearBody{FromId: len(newMessages)})
+		e.messages = e.messages[:len(newMessages)]
+	}
+	for i := range newMessages {
+		var oldBody MessageUpdateBody
 		if i < len(e.messages) {
-			oldMsg = e.messages[i]
+			oldBody = newMessageUpdateBody(e.messages, i, e.messagesStatus)
 		}
-		if i < len(newMessages) {
-			newMsg = newMessages[i]
-		}
-		if oldMsg != newMsg {
-			e.notifyChannels(EventTypeMessageUpdate, MessageUpdateBody{
-				Id:      newMessages[i].Id,
-				Role:    newMessages[i].Role,
-				Message: newMessages[i].Message,
-				Time:    newMessages[i].Time,
-			})
+		newBody := newMessageUpdateBody(newMessages, i, e.status)
+		if oldBody != newBody {
+			e.notifyChannels(EventTypeMessageUpdate, newBody)
 		}
 	}
 
 	e.messages = newMessages
+	e.messagesStatus = e.status
 }
 
 func (e *EventEmitter) UpdateStatusAndEmitChanges(newStatus st.ConversationStatus, agentType mf.AgentType) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
+	e.updateStatusInner(newStatus, agentType)
+}
+
+// UpdateStateAndEmitChanges updates the status and then the messages under one
+// lock, so that subscribers never get a snapshot whose status doesn't belong
+// to its messages. status and messages should be read together, as returned
+// by Conversation.State.
+func (e *EventEmitter) UpdateStateAndEmitChanges(status st.ConversationStatus, agentType mf.AgentType, messages []st.ConversationMessage) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.updateStatusInner(status, agentType)
+	e.updateMessagesInner(messages)
+}
+
+// Assumes the caller holds the lock.
+func (e *EventEmitter) updateStatusInner(newStatus st.ConversationStatus, agentType mf.AgentType) {
+	// The agent type is recorded even if the status didn't change, for the
+	// events that recreate the state.
+	e.agentType = agentType
 	newAgentStatus := convertStatus(newStatus)
 	if e.status == newAgentStatus {
 		return
@@ -160,7 +387,6 @@ func (e *EventEmitter) UpdateStatusAndEmitChanges(newStatus st.ConversationStatu
 
 	e.notifyChannels(EventTypeStatusChange, StatusChangeBody{Status: newAgentStatus, AgentType: agentType})
 	e.status = newAgentStatus
-	e.agentType = agentType
 }
 
 func (e *EventEmitter) UpdateScreenAndEmitChanges(newScreen string) {
@@ -175,23 +401,87 @@ func (e *EventEmitter) UpdateScreenAndEmitChanges(newScreen string) {
 	e.screen = newScreen
 }
 
+func (e *EventEmitter) UpdateTypingAndEmitChanges(typing bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.typing == typing {
+		return
+	}
+
+	if typing {
+		e.notifyChannels(EventTypeTypingStart, TypingStartBody{})
+	} else {
+		e.notifyChannels(EventTypeTypingStop, TypingStopBody{})
+	}
+	e.typing = typing
+}
+
+// typingDetector tracks whether the agent is producing output, based on how
+// recently its screen changed.
+type typingDetector struct {
+	// idleAfter is how long the screen must stay unchanged for the agent to
+	// be considered idle.
+	idleAfter    time.Duration
+	screen       string
+	lastChangeAt time.Time
+}
+
+// update records the current screen and reports whether the agent is typing.
+func (d *typingDetector) update(screen string, now time.Time) bool {
+	if screen != d.screen {
+		d.screen = screen
+		d.lastChangeAt = now
+	}
+	return !d.lastChangeAt.IsZero() && now.Sub(d.lastChangeAt) < d.idleAfter
+}
+
+// currentStateAsEvents returns the events that recreate the current state. If
+// snapshot is set, the messages and the status are sent in a snapshot event.
 // Assumes the caller holds the lock.
-func (e *EventEmitter) currentStateAsEvents() []Event {
+func (e *EventEmitter) currentStateAsEvents(snapshot bool) []Event {
 	events := make([]Event, 0, len(e.messages)+2)
-	for _, msg := range e.messages {
+	if snapshot {
+		body := SnapshotBody{Status: e.status, AgentType: e.agentType, Messages: make([]MessageUpdateBody, 0, len(e.messages))}
+		for i := range e.messages {
+			// Completeness follows the status of the snapshot, so that a
+			// stable snapshot never contains an incomplete message.
+			body.Messages = append(body.Messages, newMessageUpdateBody(e.messages, i, e.status))
+		}
+		events = append(events, Event{
+			Id:      e.lastEventId,
+			Type:    EventTypeSnapshot,
+			Payload: body,
+		})
+	} else {
+		for i := range e.messages {
+			events = append(events, Event{
+				Id:      e.lastEventId,
+				Type:    EventTypeMessageUpdate,
+				Payload: newMessageUpdateBody(e.messages, i, e.messagesStatus),
+			})
+		}
 		events = append(events, Event{
-			Type:    EventTypeMessageUpdate,
-			Payload: MessageUpdateBody{Id: msg.Id, Role: msg.Role, Message: msg.Message, Time: msg.Time},
+			Id:      e.lastEventId,
+			Type:    EventTypeStatusChange,
+			Payload: StatusChangeBody{Status: e.status, AgentType: e.agentType},
+		})
+	}
+	events = append(events, e.currentScreenEvent())
+	if e.typing {
+		events = append(events, Event{
+			Id:      e.lastEventId,
+			Type:    EventTypeTypingStart,
+			Payload: TypingStartBody{},
+		})
+	}
+	if e.permission != nil {
+		events = append(events, Event{
+			Id:      e.lastEventId,
+			Type:    EventTypePermissionRequest,
+			Payload: *e.permission,
 		})
 	}
-	events = append(events, Event{
-		Type:    EventTypeStatusChange,
-		Payload: StatusChangeBody{Status: e.status, AgentType: e.agentType},
-	})
-	events = append(events, Event{
-		Type:    EventTypeScreenUpdate,
-		Payload: ScreenUpdateBody{Screen: strings.TrimRight(e.screen, mf.WhiteSpaceChars)},
-	})
 	return events
 }
 
@@ -202,21 +492,122 @@ func (e *EventEmitter) currentStateAsEvents() []Event {
 func (e *EventEmitter) Subscribe() (int, <-chan Event, []Event) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
-	stateEvents := e.currentStateAsEvents()
+	stateEvents := e.currentStateAsEvents(false)
+	id, ch := e.subscribeInner()
+	return id, ch, stateEvents
+}
+
+// SubscribeSnapshot is like Subscribe, but the state is recreated by a
+// single snapshot event instead of an event per message and a status change.
+func (e *EventEmitter) SubscribeSnapshot() (int, <-chan Event, []Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	stateEvents := e.currentStateAsEvents(true)
+	id, ch := e.subscribeInner()
+	return id, ch, stateEvents
+}
+
+// Resume is like Subscribe, but for a subscriber that has already received the
+// events up to and including lastEventId, e.g. before its connection dropped.
+// Instead of the state events, it returns the events emitted since then, so
+// that every event is received exactly once. Screen updates aren't kept; the
+// current screen is returned instead. If the events since lastEventId are no
+// longer kept, Resume returns the state events like Subscribe.
+func (e *EventEmitter) Resume(lastEventId int) (int, <-chan Event, []Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var events []Event
+	if lastEventId < e.evictedId || lastEventId > e.lastEventId {
+		events = e.currentStateAsEvents(false)
+	} else {
+		for _, event := range e.history {
+			if event.Id > lastEventId {
+				events = append(events, event)
+			}
+		}
+		events = append(events, e.currentScreenEvent())
+	}
+	id, ch := e.subscribeInner()
+	return id, ch, events
+}
 
+// Assumes the caller holds the lock.
+func (e *EventEmitter) currentScreenEvent() Event {
+	return Event{
+		Id:      e.lastEventId,
+		Type:    EventTypeScreenUpdate,
+		Payload: ScreenUpdateBody{Screen: strings.TrimRight(e.screen, mf.WhiteSpaceChars)},
+	}
+}
+
+// Assumes the caller holds the lock.
+func (e *EventEmitter) subscribeInner() (int, chan Event) {
 	// Once a channel becomes full, it will be closed.
 	ch := make(chan Event, e.subscriptionBufSize)
 	e.chans[e.chanIdx] = ch
 	e.chanIdx++
-	return e.chanIdx - 1, ch, stateEvents
+	return e.chanIdx - 1, ch
 }
 
-// Assumes the caller holds the lock.
+// Assumes the caller holds the lock. Subscribers dropped for a full buffer
+// are already unsubscribed.
 func (e *EventEmitter) unsubscribeInner(chanId int) {
-	close(e.chans[chanId])
+	ch, ok := e.chans[chanId]
+	if !ok {
+		return
+	}
+	close(ch)
 	delete(e.chans, chanId)
 }
 
+// EmitNotice sends a notice to all subscribers. Only the ones that ask for
+// notices pass it on.
+func (e *EventEmitter) EmitNotice(notice NoticeBody) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.notifyChannels(EventTypeNotice, notice)
+}
+
+// EmitPermissionRequest sends a permission request to all subscribers. It's
+// pending until EmitPermissionResolved is called with its id.
+func (e *EventEmitter) EmitPermissionRequest(request PermissionRequestBody) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.permission = &request
+	e.notifyChannels(EventTypePermissionRequest, request)
+}
+
+// EmitPermissionResolved tells all subscribers that a permission request is
+// no longer pending.
+func (e *EventEmitter) EmitPermissionResolved(resolved PermissionResolvedBody) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.permission != nil && e.permission.Id == resolved.Id {
+		e.permission = nil
+	}
+	e.notifyChannels(EventTypePermissionResolved, resolved)
+}
+
+// RecentDrops returns how many subscribers were dropped within dropWindow
+// before now because their buffer was full.
+func (e *EventEmitter) RecentDrops(now time.Time) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pruneDrops(now)
+	return len(e.drops)
+}
+
+// pruneDrops forgets the drops that are older than dropWindow at now.
+// Assumes the caller holds the lock.
+func (e *EventEmitter) pruneDrops(now time.Time) {
+	i := 0
+	for i < len(e.drops) && now.Sub(e.drops[i]) > dropWindow {
+		i++
+	}
+	e.drops = e.drops[i:]
+}
+
 func (e *EventEmitter) Unsubscribe(chanId int) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
@@ -32,8 +32,9 @@ func TestEventEmitter(t *testing.T) {
 		})
 		newEvent := <-ch
 		assert.Equal(t, Event{
+			Id:      1,
 			Type:    EventTypeMessageUpdate,
-			Payload: MessageUpdateBody{Id: 1, Message: "Hello, world!", Role: st.ConversationRoleUser, Time: now},
+			Payload: MessageUpdateBody{Id: 1, Message: "Hello, world!", Role: st.ConversationRoleUser, Time: now, Complete: true},
 		}, newEvent)
 
 		emitter.UpdateMessagesAndEmitChanges([]st.ConversationMessage{
@@ -42,12 +43,14 @@ func TestEventEmitter(t *testing.T) {
 		})
 		newEvent = <-ch
 		assert.Equal(t, Event{
+			Id:      2,
 			Type:    EventTypeMessageUpdate,
-			Payload: MessageUpdateBody{Id: 1, Message: "Hello, world! (updated)", Role: st.ConversationRoleUser, Time: now},
+			Payload: MessageUpdateBody{Id: 1, Message: "Hello, world! (updated)", Role: st.ConversationRoleUser, Time: now, Complete: true},
 		}, newEvent)
 
 		newEvent = <-ch
 		assert.Equal(t, Event{
+			Id:      3,
 			Type:    EventTypeMessageUpdate,
 			Payload: MessageUpdateBody{Id: 2, Message: "What's up?", Role: st.ConversationRoleAgent, Time: now},
 		}, newEvent)
@@ -55,6 +58,7 @@ func TestEventEmitter(t *testing.T) {
 		emitter.UpdateStatusAndEmitChanges(st.ConversationStatusStable, mf.AgentTypeAider)
 		newEvent = <-ch
 		assert.Equal(t, Event{
+			Id:      4,
 			Type:    EventTypeStatusChange,
 			Payload: StatusChangeBody{Status: AgentStatusStable, AgentType: mf.AgentTypeAider},
 		}, newEvent)
@@ -75,8 +79,9 @@ func TestEventEmitter(t *testing.T) {
 		for _, ch := range channels {
 			newEvent := <-ch
 			assert.Equal(t, Event{
+				Id:      1,
 				Type:    EventTypeMessageUpdate,
-				Payload: MessageUpdateBody{Id: 1, Message: "Hello, world!", Role: st.ConversationRoleUser, Time: now},
+				Payload: MessageUpdateBody{Id: 1, Message: "Hello, world!", Role: st.ConversationRoleUser, Time: now, Complete: true},
 			}, newEvent)
 		}
 	})
@@ -98,4 +103,272 @@ func TestEventEmitter(t *testing.T) {
 			t.Fatalf("read should not block")
 		}
 	})
+
+	t.Run("recent-drops", func(t *testing.T) {
+		emitter := NewEventEmitter(1)
+		_, ch, _ := emitter.Subscribe()
+		emitter.UpdateStatusAndEmitChanges(st.ConversationStatusStable, mf.AgentTypeClaude)
+		assert.Equal(t, 0, emitter.RecentDrops(time.Now()))
+		emitter.UpdateStatusAndEmitChanges(st.ConversationStatusChanging, mf.AgentTypeClaude)
+		<-ch
+		_, ok := <-ch
+		assert.False(t, ok)
+		assert.Equal(t, 1, emitter.RecentDrops(time.Now()))
+		assert.Equal(t, 0, emitter.RecentDrops(time.Now().Add(dropWindow+time.Second)))
+
+		// Old drops are pruned when a subscriber is dropped.
+		emitter.drops = []time.Time{time.Now().Add(-2 * dropWindow), time.Now().Add(-dropWindow - time.Second)}
+		_, ch, _ = emitter.Subscribe()
+		emitter.UpdateStatusAndEmitChanges(st.ConversationStatusStable, mf.AgentTypeClaude)
+		emitter.UpdateStatusAndEmitChanges(st.ConversationStatusChanging, mf.AgentTypeClaude)
+		<-ch
+		_, ok = <-ch
+		assert.False(t, ok)
+		assert.Len(t, emitter.drops, 1)
+	})
+
+	t.Run("message-complete", func(t *testing.T) {
+		emitter := NewEventEmitter(10)
+		_, ch, _ := emitter.Subscribe()
+		now := time.Now()
+		messages := []st.ConversationMessage{
+			{Id: 0, Message: "Hi", Role: st.ConversationRoleUser, Time: now},
+			{Id: 1, Message: "Working", Role: st.ConversationRoleAgent, Time: now},
+		}
+
+		emitter.UpdateStatusAndEmitChanges(st.ConversationStatusChanging, mf.AgentTypeClaude)
+		emitter.UpdateMessagesAndEmitChanges(messages)
+		assert.Equal(t, MessageUpdateBody{Id: 0, Message: "Hi", Role: st.ConversationRoleUser, Time: now, Complete: true}, (<-ch).Payload)
+		assert.Equal(t, MessageUpdateBody{Id: 1, Message: "Working", Role: st.ConversationRoleAgent, Time: now, Complete: false}, (<-ch).Payload)
+
+		// The message is emitted again once the agent becomes stable, even if its content didn't change.
+		emitter.UpdateStatusAndEmitChanges(st.ConversationStatusStable, mf.AgentTypeClaude)
+		assert.Equal(t, EventTypeStatusChange, (<-ch).Type)
+		emitter.UpdateMessagesAndEmitChanges(messages)
+		assert.Equal(t, MessageUpdateBody{Id: 1, Message: "Working", Role: st.ConversationRoleAgent, Time: now, Complete: true}, (<-ch).Payload)
+
+		emitter.UpdateMessagesAndEmitChanges(messages)
+		assert.Empty(t, ch)
+
+		_, _, stateEvents := emitter.Subscribe()
+		assert.Equal(t, MessageUpdateBody{Id: 1, Message: "Working", Role: st.ConversationRoleAgent, Time: now, Complete: true}, stateEvents[1].Payload)
+	})
+
+	t.Run("messages-clear", func(t *testing.T) {
+		emitter := NewEventEmitter(10)
+		emitter.UpdateStatusAndEmitChanges(st.ConversationStatusStable, mf.AgentTypeClaude)
+		now := time.Now()
+		emitter.UpdateMessagesAndEmitChanges([]st.ConversationMessage{
+			{Id: 0, Message: "Hi", Role: st.ConversationRoleUser, Time: now},
+			{Id: 1, Message: "Hello", Role: st.ConversationRoleAgent, Time: now},
+		})
+		_, ch, _ := emitter.Subscribe()
+
+		// The reply is discarded and the user message is sent again.
+		later := now.Add(time.Second)
+		emitter.UpdateMessagesAndEmitChanges(nil)
+		assert.Equal(t, Event{Id: 4, Type: EventTypeMessagesClear, Payload: MessagesClearBody{FromId: 0}}, <-ch)
+		emitter.UpdateMessagesAndEmitChanges([]st.ConversationMessage{
+			{Id: 0, Message: "Hi", Role: st.ConversationRoleUser, Time: later},
+			{Id: 1, Message: "Hey", Role: st.ConversationRoleAgent, Time: later},
+		})
+		assert.Equal(t, MessageUpdateBody{Id: 0, Message: "Hi", Role: st.ConversationRoleUser, Time: later, Complete: true}, (<-ch).Payload)
+		assert.Equal(t, MessageUpdateBody{Id: 1, Message: "Hey", Role: st.ConversationRoleAgent, Time: later, Complete: true}, (<-ch).Payload)
+
+		emitter.UpdateMessagesAndEmitChanges([]st.ConversationMessage{
+			{Id: 0, Message: "Hi", Role: st.ConversationRoleUser, Time: later},
+		})
+		assert.Equal(t, Event{Id: 7, Type: EventTypeMessagesClear, Payload: MessagesClearBody{FromId: 1}}, <-ch)
+		assert.Empty(t, ch)
+	})
+
+	t.Run("multi-message-turn", func(t *testing.T) {
+		emitter := NewEventEmitter(10)
+		emitter.UpdateStatusAndEmitChanges(st.ConversationStatusChanging, mf.AgentTypeClaude)
+		now := time.Now()
+		emitter.UpdateMessagesAndEmitChanges([]st.ConversationMessage{
+			{Id: 0, Message: "Fix it", Role: st.ConversationRoleUser, Time: now},
+		})
+		_, ch, _ := emitter.Subscribe()
+
+		// Several agent messages are appended at once, e.g. a tool result
+		// followed by the answer.
+		emitter.UpdateMessagesAndEmitChanges([]st.ConversationMessage{
+			{Id: 0, Message: "Fix it", Role: st.ConversationRoleUser, Time: now},
+			{Id: 1, Message: "Ran tests: 1 failed", Role: st.ConversationRoleAgent, Time: now},
+			{Id: 2, Message: "Fixed the", Role: st.ConversationRoleAgent, Time: now},
+		})
+		first, second := <-ch, <-ch
+		assert.Less(t, first.Id, second.Id)
+		assert.Equal(t, MessageUpdateBody{Id: 1, Message: "Ran tests: 1 failed", Role: st.ConversationRoleAgent, Time: now, Complete: true}, first.Payload)
+		assert.Equal(t, MessageUpdateBody{Id: 2, Message: "Fixed the", Role: st.ConversationRoleAgent, Time: now}, second.Payload)
+
+		// Only the message that's still being written is emitted again.
+		emitter.UpdateMessagesAndEmitChanges([]st.ConversationMessage{
+			{Id: 0, Message: "Fix it", Role: st.ConversationRoleUser, Time: now},
+			{Id: 1, Message: "Ran tests: 1 failed", Role: st.ConversationRoleAgent, Time: now},
+			{Id: 2, Message: "Fixed the bug", Role: st.ConversationRoleAgent, Time: now},
+			{Id: 3, Message: "Anything else?", Role: st.ConversationRoleAgent, Time: now},
+		})
+		assert.Equal(t, MessageUpdateBody{Id: 2, Message: "Fixed the bug", Role: st.ConversationRoleAgent, Time: now, Complete: true}, (<-ch).Payload)
+		assert.Equal(t, MessageUpdateBody{Id: 3, Message: "Anything else?", Role: st.ConversationRoleAgent, Time: now}, (<-ch).Payload)
+		assert.Empty(t, ch)
+	})
+
+	t.Run("state", func(t *testing.T) {
+		emitter := NewEventEmitter(10)
+		_, ch, _ := emitter.Subscribe()
+		now := time.Now()
+		messages := []st.ConversationMessage{
+			{Id: 0, Message: "Hi", Role: st.ConversationRoleUser, Time: now},
+			{Id: 1, Message: "Hello", Role: st.ConversationRoleAgent, Time: now},
+		}
+
+		// The status is emitted before the messages it belongs to.
+		emitter.UpdateStateAndEmitChanges(st.ConversationStatusStable, mf.AgentTypeClaude, messages)
+		assert.Equal(t, EventTypeStatusChange, (<-ch).Type)
+		assert.Equal(t, MessageUpdateBody{Id: 0, Message: "Hi", Role: st.ConversationRoleUser, Time: now, Complete: true}, (<-ch).Payload)
+		assert.Equal(t, MessageUpdateBody{Id: 1, Message: "Hello", Role: st.ConversationRoleAgent, Time: now, Complete: true}, (<-ch).Payload)
+		assert.Empty(t, ch)
+
+		_, _, events := emitter.SubscribeSnapshot()
+		assert.Equal(t, SnapshotBody{
+			Status:    AgentStatusStable,
+			AgentType: mf.AgentTypeClaude,
+			Messages: []MessageUpdateBody{
+				{Id: 0, Message: "Hi", Role: st.ConversationRoleUser, Time: now, Complete: true},
+				{Id: 1, Message: "Hello", Role: st.ConversationRoleAgent, Time: now, Complete: true},
+			},
+		}, events[0].Payload)
+
+		// The completeness of the messages in a snapshot follows its status.
+		emitter.UpdateStatusAndEmitChanges(st.ConversationStatusChanging, mf.AgentTypeClaude)
+		_, _, events = emitter.SubscribeSnapshot()
+		body := events[0].Payload.(SnapshotBody)
+		assert.Equal(t, AgentStatusRunning, body.Status)
+		assert.False(t, body.Messages[1].Complete)
+	})
+
+	t.Run("resume", func(t *testing.T) {
+		emitter := NewEventEmitter(10)
+		now := time.Now()
+		emitter.UpdateMessagesAndEmitChanges([]st.ConversationMessage{
+			{Id: 0, Message: "Hi", Role: st.ConversationRoleUser, Time: now},
+		})
+		emitter.UpdateScreenAndEmitChanges("> Hi")
+		emitter.UpdateStatusAndEmitChanges(st.ConversationStatusStable, mf.AgentTypeClaude)
+
+		_, ch, events := emitter.Resume(1)
+		assert.Equal(t, []Event{
+			{Id: 3, Type: EventTypeStatusChange, Payload: StatusChangeBody{Status: AgentStatusStable, AgentType: mf.AgentTypeClaude}},
+			{Id: 3, Type: EventTypeScreenUpdate, Payload: ScreenUpdateBody{Screen: "> Hi"}},
+		}, events)
+		emitter.UpdateTypingAndEmitChanges(true)
+		assert.Equal(t, Event{Id: 4, Type: EventTypeTypingStart, Payload: TypingStartBody{}}, <-ch)
+
+		// Nothing was missed.
+		_, _, events = emitter.Resume(4)
+		assert.Equal(t, []Event{
+			{Id: 4, Type: EventTypeScreenUpdate, Payload: ScreenUpdateBody{Screen: "> Hi"}},
+		}, events)
+
+		// Unknown ids get the state events.
+		_, _, stateEvents := emitter.Subscribe()
+		_, _, events = emitter.Resume(5)
+		assert.Equal(t, stateEvents, events)
+		_, _, events = emitter.Resume(-1)
+		assert.Equal(t, stateEvents, events)
+	})
+
+	t.Run("resume-evicted", func(t *testing.T) {
+		emitter := NewEventEmitter(10)
+		for i := range eventHistorySize + 1 {
+			emitter.UpdateTypingAndEmitChanges(i%2 == 0)
+		}
+		_, _, stateEvents := emitter.Subscribe()
+		_, _, events := emitter.Resume(0)
+		assert.Equal(t, stateEvents, events)
+		_, _, events = emitter.Resume(1)
+		assert.Len(t, events, eventHistorySize+1)
+		assert.Equal(t, 2, events[0].Id)
+	})
+}
+
+func TestTypingEvents(t *testing.T) {
+	t.Run("emitter", func(t *testing.T) {
+		emitter := NewEventEmitter(10)
+		_, ch, _ := emitter.Subscribe()
+
+		emitter.UpdateTypingAndEmitChanges(false)
+		assert.Empty(t, ch)
+
+		emitter.UpdateTypingAndEmitChanges(true)
+		assert.Equal(t, Event{Id: 1, Type: EventTypeTypingStart, Payload: TypingStartBody{}}, <-ch)
+		emitter.UpdateTypingAndEmitChanges(true)
+		assert.Empty(t, ch)
+
+		// New subscribers learn that the agent is typing.
+		_, _, stateEvents := emitter.Subscribe()
+		assert.Equal(t, Event{Id: 1, Type: EventTypeTypingStart, Payload: TypingStartBody{}}, stateEvents[len(stateEvents)-1])
+
+		emitter.UpdateTypingAndEmitChanges(false)
+		assert.Equal(t, Event{Id: 2, Type: EventTypeTypingStop, Payload: TypingStopBody{}}, <-ch)
+	})
+
+	t.Run("simulated run", func(t *testing.T) {
+		emitter := NewEventEmitter(10)
+		_, ch, _ := emitter.Subscribe()
+		detector := typingDetector{idleAfter: 500 * time.Millisecond}
+		now := time.Now()
+		step := func(screen string, elapsed time.Duration) {
+			now = now.Add(elapsed)
+			emitter.UpdateTypingAndEmitChanges(detector.update(screen, now))
+		}
+
+		// idle before the run
+		step("", 0)
+		step("", time.Second)
+		assert.Empty(t, ch)
+
+		// the agent writes its reply; the message text doesn't matter
+		step("> hi", 100*time.Millisecond)
+		assert.Equal(t, EventTypeTypingStart, (<-ch).Type)
+		step("> hi\n⠋", 100*time.Millisecond)
+		step("> hi\n⠙", 100*time.Millisecond)
+		step("> hi\n⠙", 400*time.Millisecond)
+		assert.Empty(t, ch)
+
+		// the screen stops changing
+		step("> hi\n⠙", 100*time.Millisecond)
+		assert.Equal(t, EventTypeTypingStop, (<-ch).Type)
+		step("> hi\n⠙", time.Second)
+		assert.Empty(t, ch)
+	})
+}
+
+func TestSubscribedTo(t *testing.T) {
+	assert.True(t, subscribedTo(nil, EventTypeMessageUpdate))
+	assert.True(t, subscribedTo(nil, EventTypeStatusChange))
+	for _, eventType := range optInEventTypes {
+		assert.False(t, subscribedTo(nil, eventType), eventType)
+		assert.True(t, subscribedTo([]string{string(eventType)}, eventType), eventType)
+	}
+	assert.False(t, subscribedTo([]string{"status_change"}, EventTypeMessageUpdate))
+	assert.Contains(t, optInEventTypes, EventTypeMessagesClear)
+	assert.Contains(t, optInEventTypes, EventTypeNotice)
+}
+
+func TestConvertStatus(t *testing.T) {
+	for _, status := range st.ConversationStatusValues {
+		t.Run(string(status), func(t *testing.T) {
+			assert.Contains(t, AgentStatusValues, convertStatus(status))
+		})
+	}
+	assert.Equal(t, AgentStatusRunning, convertStatus(st.ConversationStatusInitializing))
+	assert.Equal(t, AgentStatusRunning, convertStatus(st.ConversationStatusChanging))
+	assert.Equal(t, AgentStatusStable, convertStatus(st.ConversationStatusStable))
+	assert.Len(t, agentStatuses, len(st.ConversationStatusValues))
+	assert.Panics(t, func() {
+		convertStatus("unknown")
+	})
 }
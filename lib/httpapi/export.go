@@ -0,0 +1,152 @@
+package httpapi
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+	"time"
+
+	mf "github.com/coder/agentapi/lib/msgfmt"
+	"golang.org/x/xerrors"
+)
+
+// transcriptTemplate renders a conversation as a standalone HTML page. The
+// styles are inline so that the page can be saved as a single file.
+var transcriptTemplate = template.Must(template.New("transcript").Funcs(template.FuncMap{
+	"markdown": renderMarkdownHTML,
+	"rfc3339":  func(t time.Time) string { return t.UTC().Format(time.RFC3339) },
+	"display":  func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04:05 UTC") },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { margin: 0 auto; max-width: 960px; padding: 24px; font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Helvetica, Arial, sans-serif; color: #1f2328; background: #ffffff; }
+header { border-bottom: 1px solid #d0d7de; margin-bottom: 24px; }
+h1 { font-size: 1.5em; margin: 0 0 4px; }
+.meta { color: #59636e; font-size: 0.875em; margin: 0 0 16px; }
+.message { border: 1px solid #d0d7de; border-radius: 6px; margin-bottom: 16px; overflow: hidden; }
+.message header { display: flex; justify-content: space-between; margin: 0; padding: 8px 16px; background: #f6f8fa; font-size: 0.875em; }
+.message.user header { background: #ddf4ff; }
+.role { font-weight: 600; text-transform: capitalize; }
+.content { padding: 8px 16px; }
+.content p { white-space: pre-wrap; }
+pre { padding: 12px; overflow-x: auto; background: #f6f8fa; border-radius: 6px; }
+code { font-family: ui-monospace, SFMono-Regular, Menlo, Consolas, monospace; font-size: 0.875em; }
+p code { padding: 0.1em 0.3em; background: #eff1f3; border-radius: 4px; }
+</style>
+</head>
+<body>
+<header>
+<h1>{{.Title}}</h1>
+<p class="meta">Exported <time datetime="{{rfc3339 .ExportedAt}}">{{display .ExportedAt}}</time>{{if .AgentType}} &middot; Agent: {{.AgentType}}{{end}} &middot; Messages: {{len .Messages}}</p>
+</header>
+<main>
+{{- range .Messages}}
+<article class="message {{.Role}}" id="message-{{.Id}}">
+<header><span class="role">{{.Role}}</span><time datetime="{{rfc3339 .Time}}">{{display .Time}}</time></header>
+<div class="content">{{markdown .Content}}</div>
+</article>
+{{- end}}
+</main>
+</body>
+</html>
+`))
+
+type transcript struct {
+	Title      string
+	AgentType  mf.AgentType
+	ExportedAt time.Time
+	Messages   []Message
+}
+
+// renderTranscript renders messages as a standalone HTML page.
+func renderTranscript(messages []Message, agentType mf.AgentType, exportedAt time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	err := transcriptTemplate.Execute(&buf, transcript{
+		Title:      "AgentAPI conversation",
+		AgentType:  agentType,
+		ExportedAt: exportedAt,
+		Messages:   messages,
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("failed to render transcript: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+var (
+	markdownHeading    = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	markdownInlineCode = regexp.MustCompile("`([^`\n]+)`")
+	markdownBold       = regexp.MustCompile(`\*\*([^*\n]+)\*\*`)
+)
+
+// renderMarkdownHTML renders the markdown the agents commonly write: fenced
+// code blocks, headings, inline code and bold text. The rest is kept as text
+// with its line breaks, since agent messages are laid out for a terminal.
+func renderMarkdownHTML(content string) template.HTML {
+	var sb strings.Builder
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) == 0 {
+			return
+		}
+		sb.WriteString("<p>")
+		sb.WriteString(renderMarkdownInline(strings.Join(paragraph, "\n")))
+		sb.WriteString("</p>\n")
+		paragraph = nil
+	}
+	// fence is the opening fence of the code block we're in, if any.
+	fence := ""
+	var code []string
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case fence == "" && (strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~")):
+			flush()
+			fence = trimmed[:3]
+			sb.WriteString("<pre><code")
+			if lang := strings.TrimSpace(strings.TrimLeft(trimmed, fence[:1])); lang != "" {
+				sb.WriteString(` class="language-` + html.EscapeString(lang) + `"`)
+			}
+			sb.WriteString(">")
+		case fence != "" && strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "":
+			sb.WriteString(html.EscapeString(strings.Join(code, "\n")))
+			sb.WriteString("</code></pre>\n")
+			fence, code = "", nil
+		case fence != "":
+			code = append(code, line)
+		case trimmed == "":
+			flush()
+		case markdownHeading.MatchString(trimmed):
+			flush()
+			match := markdownHeading.FindStringSubmatch(trimmed)
+			// Headings rank below the page title.
+			level := min(len(match[1])+1, 6)
+			sb.WriteString("<h" + string(rune('0'+level)) + ">")
+			sb.WriteString(renderMarkdownInline(match[2]))
+			sb.WriteString("</h" + string(rune('0'+level)) + ">\n")
+		default:
+			paragraph = append(paragraph, line)
+		}
+	}
+	if fence != "" {
+		// Unterminated code blocks run to the end of the message.
+		sb.WriteString(html.EscapeString(strings.Join(code, "\n")))
+		sb.WriteString("</code></pre>\n")
+	}
+	flush()
+	return template.HTML(sb.String())
+}
+
+// renderMarkdownInline escapes text and renders its inline code and bold
+// text.
+func renderMarkdownInline(text string) string {
+	text = html.EscapeString(text)
+	text = markdownInlineCode.ReplaceAllString(text, "<code>$1</code>")
+	return markdownBold.ReplaceAllString(text, "<strong>$1</strong>")
+}
@@ -0,0 +1,84 @@
+package httpapi
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	mf "github.com/coder/agentapi/lib/msgfmt"
+	st "github.com/coder/agentapi/lib/screentracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// requireBalancedHTML checks that every element of page is closed in order.
+func requireBalancedHTML(t *testing.T, page string) {
+	t.Helper()
+	decoder := xml.NewDecoder(strings.NewReader(page))
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+	var open []string
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		switch token := token.(type) {
+		case xml.StartElement:
+			open = append(open, token.Name.Local)
+		case xml.EndElement:
+			require.NotEmpty(t, open, "unexpected </%s>", token.Name.Local)
+			require.Equal(t, open[len(open)-1], token.Name.Local)
+			open = open[:len(open)-1]
+		}
+	}
+	require.Empty(t, open)
+}
+
+func TestRenderTranscript(t *testing.T) {
+	at := time.Date(2025, 6, 1, 12, 30, 0, 0, time.UTC)
+	messages := []Message{
+		{Id: 0, Role: st.ConversationRoleUser, Content: "Fix <the> bug & test it", Time: at},
+		{Id: 1, Role: st.ConversationRoleAgent, Content: "## Done\nI changed `main.go`:\n```go\nif a < b {\n}\n```\nAll **tests** pass.", Time: at.Add(time.Minute)},
+	}
+	page, err := renderTranscript(messages, mf.AgentTypeClaude, at.Add(time.Hour))
+	require.NoError(t, err)
+	html := string(page)
+
+	require.True(t, strings.HasPrefix(html, "<!DOCTYPE html>\n<html lang=\"en\">"))
+	requireBalancedHTML(t, html)
+	assert.Contains(t, html, "<style>")
+	assert.Contains(t, html, "Agent: claude")
+	assert.Contains(t, html, `<time datetime="2025-06-01T13:30:00Z">2025-06-01 13:30:00 UTC</time>`)
+	assert.Contains(t, html, `<article class="message user" id="message-0">`)
+	assert.Contains(t, html, `<span class="role">user</span><time datetime="2025-06-01T12:30:00Z">`)
+	assert.Contains(t, html, "<p>Fix &lt;the&gt; bug &amp; test it</p>")
+	assert.Contains(t, html, `<article class="message agent" id="message-1">`)
+	assert.Contains(t, html, "<h3>Done</h3>")
+	assert.Contains(t, html, "<p>I changed <code>main.go</code>:</p>")
+	assert.Contains(t, html, "<pre><code class=\"language-go\">if a &lt; b {\n}</code></pre>")
+	assert.Contains(t, html, "<p>All <strong>tests</strong> pass.</p>")
+}
+
+func TestRenderMarkdownHTML(t *testing.T) {
+	cases := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"paragraphs", "first\nline\n\nsecond", "<p>first\nline</p>\n<p>second</p>\n"},
+		{"unterminated fence", "```\n<b>", "<pre><code>&lt;b&gt;</code></pre>\n"},
+		{"code is not inline-rendered", "```\n`x` **y**\n```", "<pre><code>`x` **y**</code></pre>\n"},
+		{"script", "<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"fence language is escaped", "```\"><x\n```", "<pre><code class=\"language-&#34;&gt;&lt;x\"></code></pre>\n"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expected, string(renderMarkdownHTML(c.content)))
+		})
+	}
+}
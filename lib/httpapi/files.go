@@ -0,0 +1,95 @@
+package httpapi
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	mf "github.com/coder/agentapi/lib/msgfmt"
+	"golang.org/x/xerrors"
+)
+
+var (
+	// errFileOutsideRoot is returned for files that resolve to a path
+	// outside of the files root, e.g. through ".." or a symlink.
+	errFileOutsideRoot = xerrors.New("file is outside of the files root")
+	errFileNotFound    = xerrors.New("file not found")
+)
+
+// filesRoot is the directory that the files attached to messages by path
+// must be in.
+type filesRoot struct {
+	// dir is absolute and has no symlinks.
+	dir string
+}
+
+func newFilesRoot(dir string) (*filesRoot, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to resolve files root: %w", err)
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to resolve files root: %w", err)
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to stat files root: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, xerrors.Errorf("files root %s is not a directory", dir)
+	}
+	return &filesRoot{dir: resolved}, nil
+}
+
+// resolve returns the absolute path of a regular file in the root. Relative
+// paths are relative to the root.
+func (r *filesRoot) resolve(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(r.dir, path)
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Clean(path))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Don't reveal whether files outside of the root exist.
+			if !r.contains(filepath.Clean(path)) {
+				return "", errFileOutsideRoot
+			}
+			return "", errFileNotFound
+		}
+		return "", xerrors.Errorf("failed to resolve file: %w", err)
+	}
+	if !r.contains(resolved) {
+		return "", errFileOutsideRoot
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", xerrors.Errorf("failed to stat file: %w", err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", xerrors.Errorf("%s is not a regular file", path)
+	}
+	return resolved, nil
+}
+
+func (r *filesRoot) contains(path string) bool {
+	rel, err := filepath.Rel(r.dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// appendFileReferences adds references to files to a message, in the syntax
+// the agent uses to mention files.
+func appendFileReferences(agentType mf.AgentType, content string, paths []string) string {
+	if len(paths) == 0 {
+		return content
+	}
+	prefix := ""
+	if agent, ok := mf.LookupAgent(string(agentType)); ok {
+		prefix = agent.FileMentionPrefix
+	}
+	refs := make([]string, 0, len(paths))
+	for _, path := range paths {
+		refs = append(refs, prefix+path)
+	}
+	return content + "\n\n" + strings.Join(refs, " ")
+}
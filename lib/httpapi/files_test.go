@@ -0,0 +1,77 @@
+package httpapi
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	mf "github.com/coder/agentapi/lib/msgfmt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilesRoot(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "workspace")
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "src"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "src", "main.go"), []byte("package main"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0o644))
+
+	r, err := newFilesRoot(root)
+	require.NoError(t, err)
+	main := filepath.Join(r.dir, "src", "main.go")
+
+	t.Run("relative", func(t *testing.T) {
+		path, err := r.resolve("src/main.go")
+		require.NoError(t, err)
+		require.Equal(t, main, path)
+	})
+
+	t.Run("absolute", func(t *testing.T) {
+		path, err := r.resolve(main)
+		require.NoError(t, err)
+		require.Equal(t, main, path)
+	})
+
+	t.Run("traversal", func(t *testing.T) {
+		_, err := r.resolve("../secret.txt")
+		require.ErrorIs(t, err, errFileOutsideRoot)
+		_, err = r.resolve("src/../../secret.txt")
+		require.ErrorIs(t, err, errFileOutsideRoot)
+		_, err = r.resolve(filepath.Join(dir, "secret.txt"))
+		require.ErrorIs(t, err, errFileOutsideRoot)
+		// Missing files outside of the root are reported the same way.
+		_, err = r.resolve("../missing.txt")
+		require.ErrorIs(t, err, errFileOutsideRoot)
+	})
+
+	t.Run("symlink", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("creating symlinks requires privileges on Windows")
+		}
+		require.NoError(t, os.Symlink(filepath.Join(dir, "secret.txt"), filepath.Join(root, "link.txt")))
+		_, err := r.resolve("link.txt")
+		require.ErrorIs(t, err, errFileOutsideRoot)
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		_, err := r.resolve("src/missing.go")
+		require.ErrorIs(t, err, errFileNotFound)
+	})
+
+	t.Run("directory", func(t *testing.T) {
+		_, err := r.resolve("src")
+		require.ErrorContains(t, err, "is not a regular file")
+	})
+
+	t.Run("root must exist", func(t *testing.T) {
+		_, err := newFilesRoot(filepath.Join(dir, "missing"))
+		require.Error(t, err)
+	})
+}
+
+func TestAppendFileReferences(t *testing.T) {
+	require.Equal(t, "Fix it", appendFileReferences(mf.AgentTypeClaude, "Fix it", nil))
+	require.Equal(t, "Fix it\n\n@/w/a.go @/w/b.go", appendFileReferences(mf.AgentTypeClaude, "Fix it", []string{"/w/a.go", "/w/b.go"}))
+	require.Equal(t, "Fix it\n\n/w/a.go", appendFileReferences(mf.AgentTypeGoose, "Fix it", []string{"/w/a.go"}))
+}
@@ -0,0 +1,158 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/coder/agentapi/lib/agentapipb"
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/danielgtaylor/huma/v2/sse"
+	"golang.org/x/xerrors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcService implements the gRPC interface with the handlers of the REST
+// API, so that both behave the same.
+type grpcService struct {
+	agentapipb.UnimplementedAgentAPIServer
+	s *Server
+}
+
+// grpcCodes maps the statuses returned by the REST handlers to gRPC codes.
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusConflict:            codes.FailedPrecondition,
+	http.StatusUnprocessableEntity: codes.InvalidArgument,
+	http.StatusTooManyRequests:     codes.ResourceExhausted,
+	http.StatusServiceUnavailable:  codes.Unavailable,
+}
+
+// grpcError converts an error returned by a REST handler to a gRPC status.
+func grpcError(err error) error {
+	var statusErr huma.StatusError
+	if !errors.As(err, &statusErr) {
+		return status.Error(codes.Internal, err.Error())
+	}
+	code, ok := grpcCodes[statusErr.GetStatus()]
+	if !ok {
+		code = codes.Internal
+	}
+	return status.Error(code, statusErr.Error())
+}
+
+func (g *grpcService) Status(ctx context.Context, req *agentapipb.StatusRequest) (*agentapipb.StatusResponse, error) {
+	resp, err := g.s.getStatus(ctx, &struct{}{})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &agentapipb.StatusResponse{
+		Status:    string(resp.Body.Status),
+		AgentType: string(resp.Body.AgentType),
+	}, nil
+}
+
+func (g *grpcService) SendMessage(ctx context.Context, req *agentapipb.SendMessageRequest) (*agentapipb.SendMessageResponse, error) {
+	messageType := MessageType(req.Type)
+	if messageType == "" {
+		messageType = MessageTypeUser
+	}
+	if !slices.Contains(MessageTypeValues, messageType) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid message type %q", req.Type)
+	}
+	resp, err := g.s.createMessage(ctx, &MessageRequest{
+		RequestId:      req.RequestId,
+		IdempotencyKey: req.IdempotencyKey,
+		Body:           MessageRequestBody{Content: req.Content, Type: messageType},
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &agentapipb.SendMessageResponse{Ok: resp.Body.Ok}, nil
+}
+
+func (g *grpcService) GetMessages(ctx context.Context, req *agentapipb.GetMessagesRequest) (*agentapipb.GetMessagesResponse, error) {
+	order := req.Order
+	switch order {
+	case "":
+		order = "asc"
+	case "asc", "desc":
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid order %q", req.Order)
+	}
+	if req.Limit < 0 {
+		return nil, status.Error(codes.InvalidArgument, "limit must not be negative")
+	}
+	resp := g.s.listMessages(&MessagesRequest{Order: order, Limit: int(req.Limit)}, 0)
+	messages := make([]*agentapipb.Message, 0, len(resp.Body.Messages))
+	for _, message := range resp.Body.Messages {
+		messages = append(messages, &agentapipb.Message{
+			Id:       int64(message.Id),
+			Role:     string(message.Role),
+			Content:  message.Content,
+			Time:     timestamppb.New(message.Time),
+			Complete: message.Complete,
+		})
+	}
+	return &agentapipb.GetMessagesResponse{Messages: messages}, nil
+}
+
+func (g *grpcService) Events(req *agentapipb.EventsRequest, stream grpc.ServerStreamingServer[agentapipb.Event]) error {
+	for _, eventType := range req.Types {
+		if _, ok := eventPayloads[eventType]; !ok {
+			return status.Errorf(codes.InvalidArgument, "unknown event type %q", eventType)
+		}
+	}
+	input := &EventsRequest{IncludeScreen: req.IncludeScreen, Types: req.Types}
+	if req.LastEventId > 0 {
+		input.LastEventId = strconv.FormatInt(req.LastEventId, 10)
+	}
+	return g.s.streamEvents(stream.Context(), input, func(message sse.Message) error {
+		data, err := json.Marshal(message.Data)
+		if err != nil {
+			return xerrors.Errorf("failed to marshal event: %w", err)
+		}
+		return stream.Send(&agentapipb.Event{
+			Id:   int64(message.ID),
+			Type: string(eventTypeOf(message.Data)),
+			Data: data,
+		})
+	})
+}
+
+// newGRPCServer returns a gRPC server with the gRPC interface of s.
+func newGRPCServer(s *Server) *grpc.Server {
+	grpcServer := grpc.NewServer()
+	agentapipb.RegisterAgentAPIServer(grpcServer, &grpcService{s: s})
+	return grpcServer
+}
+
+// ServeGRPC serves the gRPC interface on lis until Stop is called. It shares
+// the conversation with the HTTP server.
+func (s *Server) ServeGRPC(lis net.Listener) error {
+	return s.grpcServer.Serve(lis)
+}
+
+// stopGRPC stops the gRPC server, waiting for the running RPCs until ctx is
+// done. Stop ends the event streams before.
+func (s *Server) stopGRPC(ctx context.Context) {
+	stopped := make(chan struct{})
+	go func() {
+		s.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.grpcServer.Stop()
+	}
+}
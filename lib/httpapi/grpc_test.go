@@ -0,0 +1,143 @@
+package httpapi_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/agentapi/lib/agentapipb"
+	"github.com/coder/agentapi/lib/httpapi"
+	"github.com/coder/agentapi/lib/logctx"
+	"github.com/coder/agentapi/lib/msgfmt"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestServer_GRPC(t *testing.T) {
+	t.Parallel()
+
+	agent := &fakeAgent{screen: "> "}
+	ctx := logctx.WithLogger(context.Background(), slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	srv, err := httpapi.NewServer(ctx, httpapi.ServerConfig{
+		AgentType:      msgfmt.AgentTypeClaude,
+		Process:        agent,
+		Port:           0,
+		ChatBasePath:   "/chat",
+		AllowedHosts:   []string{"*"},
+		AllowedOrigins: []string{"*"},
+		Greeting:       "Hello!",
+		// Only GET /messages truncates messages.
+		MessagePreviewLength: 2,
+	})
+	require.NoError(t, err)
+	tsServer := httptest.NewServer(srv.Handler())
+	t.Cleanup(tsServer.Close)
+
+	lis := bufconn.Listen(1 << 20)
+	go func() {
+		_ = srv.ServeGRPC(lis)
+	}()
+	t.Cleanup(func() {
+		_ = srv.Stop(context.Background())
+	})
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	client := agentapipb.NewAgentAPIClient(conn)
+
+	reqCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("status", func(t *testing.T) {
+		resp, err := client.Status(reqCtx, &agentapipb.StatusRequest{})
+		require.NoError(t, err)
+		require.Equal(t, "claude", resp.AgentType)
+	})
+
+	t.Run("events", func(t *testing.T) {
+		stream, err := client.Events(reqCtx, &agentapipb.EventsRequest{Types: []string{"status_change", "notice"}})
+		require.NoError(t, err)
+		// The events that recreate the state are sent first.
+		event, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, "status_change", event.Type)
+		var statusChange httpapi.StatusChangeBody
+		require.NoError(t, json.Unmarshal(event.Data, &statusChange))
+
+		resp, err := tsServer.Client().Post(tsServer.URL+"/internal/notice", "application/json", strings.NewReader(`{"text": "Maintenance at noon.", "severity": "info"}`))
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		event, err = stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, "notice", event.Type)
+		require.Positive(t, event.Id)
+		var notice httpapi.NoticeBody
+		require.NoError(t, json.Unmarshal(event.Data, &notice))
+		require.Equal(t, httpapi.NoticeBody{Severity: "info", Text: "Maintenance at noon."}, notice)
+	})
+
+	t.Run("unknown event type", func(t *testing.T) {
+		stream, err := client.Events(reqCtx, &agentapipb.EventsRequest{Types: []string{"everything"}})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("send message", func(t *testing.T) {
+		resp, err := client.SendMessage(reqCtx, &agentapipb.SendMessageRequest{Content: "\x1b[A", Type: "raw"})
+		require.NoError(t, err)
+		require.True(t, resp.Ok)
+		require.Equal(t, "\x1b[A", agent.Written())
+
+		_, err = client.SendMessage(reqCtx, &agentapipb.SendMessageRequest{Content: "hi", Type: "shell"})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("get messages", func(t *testing.T) {
+		resp, err := client.GetMessages(reqCtx, &agentapipb.GetMessagesRequest{})
+		require.NoError(t, err)
+		require.Len(t, resp.Messages, 1)
+		require.Equal(t, "Hello!", resp.Messages[0].Content)
+
+		_, err = client.GetMessages(reqCtx, &agentapipb.GetMessagesRequest{Order: "random"})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("stop ends event streams", func(t *testing.T) {
+		stream, err := client.Events(reqCtx, &agentapipb.EventsRequest{})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		require.NoError(t, err)
+
+		// Stop doesn't wait for the stream until its context is done.
+		stopCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		require.NoError(t, srv.Stop(stopCtx))
+		require.NoError(t, stopCtx.Err())
+		for err == nil {
+			_, err = stream.Recv()
+		}
+		require.ErrorIs(t, err, io.EOF)
+	})
+}
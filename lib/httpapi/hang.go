@@ -0,0 +1,88 @@
+package httpapi
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// HangAction is what the hang watchdog does to an agent that stopped
+// responding.
+type HangAction string
+
+const (
+	// HangActionInterrupt sends SIGINT to the agent, like pressing Ctrl+C.
+	HangActionInterrupt HangAction = "interrupt"
+	// HangActionKill kills the agent. The server stops with it, so that a
+	// supervisor can restart both.
+	HangActionKill HangAction = "kill"
+)
+
+// signaler is implemented by agents that run as a process.
+type signaler interface {
+	Signal(sig os.Signal) error
+}
+
+// hangWatchdog acts on an agent that looks hung.
+type hangWatchdog struct {
+	timeout time.Duration
+	action  HangAction
+	agent   signaler
+}
+
+// newHangWatchdog returns nil if timeout is zero.
+func newHangWatchdog(timeout time.Duration, action HangAction, agent any) (*hangWatchdog, error) {
+	if timeout <= 0 {
+		return nil, nil
+	}
+	switch action {
+	case "":
+		action = HangActionInterrupt
+	case HangActionInterrupt, HangActionKill:
+	default:
+		return nil, xerrors.Errorf("unknown hang action %q (valid actions: %s, %s)", action, HangActionInterrupt, HangActionKill)
+	}
+	s, ok := agent.(signaler)
+	if !ok {
+		return nil, xerrors.New("the hang watchdog requires an agent that runs as a process")
+	}
+	return &hangWatchdog{timeout: timeout, action: action, agent: s}, nil
+}
+
+func (h *hangWatchdog) signal() os.Signal {
+	if h.action == HangActionKill {
+		return os.Kill
+	}
+	return syscall.SIGINT
+}
+
+// runHangWatchdog applies the hang action whenever the status has been
+// changing without any screen activity for the hang timeout, until ctx is
+// done. Subscribers are sent a notice about it.
+func (s *Server) runHangWatchdog(ctx context.Context) {
+	w := statusWatchdog{timeout: s.hang.timeout}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(snapshotInterval):
+		}
+		if !w.update(s.conversation.Status(), s.conversation.Screen(), time.Now()) {
+			continue
+		}
+		w.changingSince = time.Time{}
+		s.logger.Warn("The agent looks hung", "timeout", s.hang.timeout, "action", s.hang.action)
+		if err := s.hang.agent.Signal(s.hang.signal()); err != nil {
+			s.logger.Error("Failed to signal hung agent", "action", s.hang.action, "error", err)
+			continue
+		}
+		s.emitter.EmitNotice(NoticeBody{
+			Severity: "warning",
+			Text:     fmt.Sprintf("The agent didn't respond for %s. Applied the hang action: %s.", s.hang.timeout, s.hang.action),
+		})
+	}
+}
@@ -0,0 +1,37 @@
+package httpapi
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// degradedDropThreshold is how many subscribers may be dropped within
+// dropWindow before the server reports itself as degraded.
+const degradedDropThreshold = 3
+
+// getHealth handles GET /health
+func (s *Server) getHealth(ctx context.Context, input *struct{}) (*HealthResponse, error) {
+	drops := s.emitter.RecentDrops(time.Now())
+
+	resp := &HealthResponse{}
+	resp.Body.Status = HealthStatusOk
+	resp.Body.DroppedSubscribers = drops
+	resp.Body.BackpressureDisconnects = s.backpressureDisconnects.Load()
+	if drops >= degradedDropThreshold {
+		resp.Body.Status = HealthStatusDegraded
+		resp.Body.Warning = fmt.Sprintf("%d event subscribers were disconnected in the last %s because their event buffer was full", drops, dropWindow)
+	}
+
+	err := s.probeAgent(ctx, 0)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	resp.Body.AgentResponsive = err == nil
+	if err != nil {
+		s.logger.Warn("Agent is unresponsive", "error", err)
+		resp.Body.Status = HealthStatusUnhealthy
+		resp.Body.Warning = fmt.Sprintf("the agent is unresponsive: %s", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,81 @@
+package httpapi
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/coder/agentapi/lib/logctx"
+	st "github.com/coder/agentapi/lib/screentracker"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetHealth(t *testing.T) {
+	s := &Server{emitter: NewEventEmitter(1)}
+
+	resp, err := s.getHealth(context.Background(), &struct{}{})
+	require.NoError(t, err)
+	require.Equal(t, HealthStatusOk, resp.Body.Status)
+	require.Empty(t, resp.Body.Warning)
+
+	// Subscribers that never read their events are dropped once their
+	// buffer is full.
+	for range degradedDropThreshold {
+		s.emitter.Subscribe()
+	}
+	s.emitter.UpdateStatusAndEmitChanges(st.ConversationStatusStable, "")
+	s.emitter.UpdateStatusAndEmitChanges(st.ConversationStatusChanging, "")
+
+	resp, err = s.getHealth(context.Background(), &struct{}{})
+	require.NoError(t, err)
+	require.Equal(t, HealthStatusDegraded, resp.Body.Status)
+	require.Equal(t, degradedDropThreshold, resp.Body.DroppedSubscribers)
+	require.Contains(t, resp.Body.Warning, "event subscribers were disconnected")
+}
+
+// blockingAgent is a wedged agent: its screen can't be read until unblock is
+// closed.
+type blockingAgent struct {
+	unblock chan struct{}
+}
+
+func (a *blockingAgent) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (a *blockingAgent) ReadScreen() string {
+	<-a.unblock
+	return ""
+}
+
+func TestGetHealth_UnresponsiveAgent(t *testing.T) {
+	agent := &blockingAgent{unblock: make(chan struct{})}
+	t.Cleanup(func() { close(agent.unblock) })
+	s := &Server{
+		logger:       slog.New(logctx.DiscardHandler),
+		emitter:      NewEventEmitter(1),
+		agentio:      agent,
+		probeTimeout: 50 * time.Millisecond,
+	}
+
+	for range 3 {
+		start := time.Now()
+		resp, err := s.getHealth(context.Background(), &struct{}{})
+		require.NoError(t, err)
+		require.Less(t, time.Since(start), time.Second, "the check doesn't wait for the agent")
+		require.Equal(t, HealthStatusUnhealthy, resp.Body.Status)
+		require.False(t, resp.Body.AgentResponsive)
+		require.Contains(t, resp.Body.Warning, "the agent did not respond within 50ms")
+	}
+	// The checks share the blocked read instead of starting one each.
+	s.probe.mu.Lock()
+	require.NotNil(t, s.probe.inFlight)
+	s.probe.mu.Unlock()
+
+	// A canceled request returns right away.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := s.getHealth(ctx, &struct{}{})
+	require.ErrorIs(t, err, context.Canceled)
+}
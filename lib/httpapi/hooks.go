@@ -0,0 +1,28 @@
+package httpapi
+
+import (
+	st "github.com/coder/agentapi/lib/screentracker"
+)
+
+// Hooks lets embedders observe and transform the messages exchanged with the agent.
+type Hooks interface {
+	// BeforeSend is called with the content of every user message before it's
+	// sent to the agent, including when it's sent again by POST /regenerate.
+	// The returned string replaces the content. Returning an error rejects the
+	// message; POST /message and POST /regenerate then respond with 400.
+	BeforeSend(content string) (string, error)
+	// AfterReceive is called once for every agent message, after the agent
+	// finished writing it. Errors are logged.
+	AfterReceive(msg st.ConversationMessage) error
+}
+
+// NoopHooks is the default Hooks implementation. It leaves messages unchanged.
+type NoopHooks struct{}
+
+func (NoopHooks) BeforeSend(content string) (string, error) {
+	return content, nil
+}
+
+func (NoopHooks) AfterReceive(msg st.ConversationMessage) error {
+	return nil
+}
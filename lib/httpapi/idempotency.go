@@ -0,0 +1,112 @@
+package httpapi
+
+import (
+	"crypto/sha256"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// idempotencyKeyTTL is how long the response to a message request is
+	// returned again for requests with the same idempotency key.
+	idempotencyKeyTTL = 10 * time.Minute
+	// maxIdempotencyKeys bounds the number of remembered keys. The oldest
+	// keys are forgotten first.
+	maxIdempotencyKeys = 1000
+)
+
+// errIdempotencyKeyReused is returned for requests that reuse the idempotency
+// key of a request with a different body.
+var errIdempotencyKeyReused = xerrors.New("the idempotency key was already used for a different request")
+
+type idempotencyEntry struct {
+	createdAt time.Time
+	// bodyHash is the SHA-256 of the body of the request that used the key.
+	bodyHash [sha256.Size]byte
+	// done is closed once resp and err are set.
+	done chan struct{}
+	resp *MessageResponse
+	err  error
+}
+
+// idempotencyCache remembers the responses to message requests by their
+// idempotency key, so that a retried request isn't sent to the agent twice.
+type idempotencyCache struct {
+	ttl     time.Duration
+	maxKeys int
+	now     func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	// keys are the keys of entries, oldest first.
+	keys []string
+}
+
+func newIdempotencyCache(ttl time.Duration, maxKeys int, now func() time.Time) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:     ttl,
+		maxKeys: maxKeys,
+		now:     now,
+		entries: make(map[string]*idempotencyEntry),
+	}
+}
+
+// do calls fn and remembers its response under key. If key was already used
+// within the TTL, do returns the response of that call instead, waiting for
+// it if it's still running. replayed reports whether fn was skipped. If the
+// earlier call was for a request with another body hash, do returns
+// errIdempotencyKeyReused instead. Failed calls are forgotten, so that they
+// can be retried with the same key once they complete.
+func (c *idempotencyCache) do(key string, bodyHash [sha256.Size]byte, fn func() (*MessageResponse, error)) (resp *MessageResponse, replayed bool, err error) {
+	c.mu.Lock()
+	now := c.now()
+	c.evict(now)
+	if entry, ok := c.entries[key]; ok {
+		c.mu.Unlock()
+		if entry.bodyHash != bodyHash {
+			return nil, false, errIdempotencyKeyReused
+		}
+		<-entry.done
+		return entry.resp, true, entry.err
+	}
+	entry := &idempotencyEntry{createdAt: now, bodyHash: bodyHash, done: make(chan struct{})}
+	c.entries[key] = entry
+	// The key of a failed call is still in keys. It's moved to the end, so
+	// that it's evicted by the age of the new entry.
+	if i := slices.Index(c.keys, key); i >= 0 {
+		c.keys = slices.Delete(c.keys, i, i+1)
+	}
+	c.keys = append(c.keys, key)
+	c.mu.Unlock()
+
+	entry.resp, entry.err = fn()
+	close(entry.done)
+	if entry.err != nil {
+		c.mu.Lock()
+		if c.entries[key] == entry {
+			delete(c.entries, key)
+		}
+		c.mu.Unlock()
+	}
+	return entry.resp, false, entry.err
+}
+
+// evict forgets expired keys and the oldest keys above maxKeys. The caller
+// must hold c.mu.
+func (c *idempotencyCache) evict(now time.Time) {
+	for len(c.keys) > 0 {
+		key := c.keys[0]
+		entry, ok := c.entries[key]
+		if ok && now.Sub(entry.createdAt) < c.ttl && len(c.entries) < c.maxKeys {
+			return
+		}
+		// Failed calls have already been removed from entries.
+		if ok {
+			delete(c.entries, key)
+		}
+		c.keys = c.keys[1:]
+	}
+}
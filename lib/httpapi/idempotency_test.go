@@ -0,0 +1,135 @@
+package httpapi
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestIdempotencyCache(t *testing.T) {
+	t.Parallel()
+
+	okResponse := func() *MessageResponse {
+		resp := &MessageResponse{}
+		resp.Body.Ok = true
+		return resp
+	}
+	hash := sha256.Sum256([]byte(`{"content":"a"}`))
+
+	t.Run("ttl", func(t *testing.T) {
+		t.Parallel()
+		now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+		c := newIdempotencyCache(time.Minute, 10, func() time.Time { return now })
+		calls := 0
+		fn := func() (*MessageResponse, error) {
+			calls++
+			return okResponse(), nil
+		}
+
+		_, replayed, err := c.do("a", hash, fn)
+		require.NoError(t, err)
+		require.False(t, replayed)
+		now = now.Add(59 * time.Second)
+		resp, replayed, err := c.do("a", hash, fn)
+		require.NoError(t, err)
+		require.True(t, replayed)
+		require.True(t, resp.Body.Ok)
+		require.Equal(t, 1, calls)
+
+		now = now.Add(time.Second)
+		_, replayed, err = c.do("a", hash, fn)
+		require.NoError(t, err)
+		require.False(t, replayed)
+		require.Equal(t, 2, calls)
+	})
+
+	t.Run("failures are forgotten", func(t *testing.T) {
+		t.Parallel()
+		c := newIdempotencyCache(time.Minute, 10, time.Now)
+		_, _, err := c.do("a", hash, func() (*MessageResponse, error) {
+			return nil, xerrors.New("agent is busy")
+		})
+		require.Error(t, err)
+		_, replayed, err := c.do("a", hash, func() (*MessageResponse, error) {
+			return okResponse(), nil
+		})
+		require.NoError(t, err)
+		require.False(t, replayed)
+	})
+
+	t.Run("retried failures are kept once", func(t *testing.T) {
+		t.Parallel()
+		c := newIdempotencyCache(time.Minute, 10, time.Now)
+		for range 3 {
+			_, _, err := c.do("a", hash, func() (*MessageResponse, error) {
+				return nil, xerrors.New("agent is busy")
+			})
+			require.Error(t, err)
+		}
+		_, _, err := c.do("a", hash, func() (*MessageResponse, error) {
+			return okResponse(), nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, []string{"a"}, c.keys)
+	})
+
+	t.Run("different body", func(t *testing.T) {
+		t.Parallel()
+		c := newIdempotencyCache(time.Minute, 10, time.Now)
+		calls := 0
+		fn := func() (*MessageResponse, error) {
+			calls++
+			return okResponse(), nil
+		}
+		_, _, err := c.do("a", hash, fn)
+		require.NoError(t, err)
+		_, replayed, err := c.do("a", sha256.Sum256([]byte(`{"content":"b"}`)), fn)
+		require.ErrorIs(t, err, errIdempotencyKeyReused)
+		require.False(t, replayed)
+		require.Equal(t, 1, calls)
+	})
+
+	t.Run("max keys", func(t *testing.T) {
+		t.Parallel()
+		c := newIdempotencyCache(time.Minute, 3, time.Now)
+		for i := range 4 {
+			_, _, err := c.do(fmt.Sprint(i), hash, func() (*MessageResponse, error) {
+				return okResponse(), nil
+			})
+			require.NoError(t, err)
+		}
+		require.Len(t, c.entries, 3)
+		require.NotContains(t, c.entries, "0")
+	})
+
+	t.Run("concurrent duplicates wait", func(t *testing.T) {
+		t.Parallel()
+		c := newIdempotencyCache(time.Minute, 10, time.Now)
+		var calls atomic.Int32
+		unblock := make(chan struct{})
+		var wg sync.WaitGroup
+		for range 5 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, _, err := c.do("a", hash, func() (*MessageResponse, error) {
+					calls.Add(1)
+					<-unblock
+					return okResponse(), nil
+				})
+				require.NoError(t, err)
+				require.True(t, resp.Body.Ok)
+			}()
+		}
+		time.Sleep(50 * time.Millisecond)
+		close(unblock)
+		wg.Wait()
+		require.Equal(t, int32(1), calls.Load())
+	})
+}
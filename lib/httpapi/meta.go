@@ -0,0 +1,54 @@
+package httpapi
+
+import (
+	"context"
+	"maps"
+	"sync"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+// conversationMeta holds the key/value metadata attached to the conversation.
+// It doesn't affect the agent; clients use it to group and filter sessions.
+type conversationMeta struct {
+	mu     sync.RWMutex
+	values map[string]string
+}
+
+// get returns a copy of the metadata.
+func (m *conversationMeta) get() map[string]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	values := make(map[string]string, len(m.values))
+	maps.Copy(values, m.values)
+	return values
+}
+
+// set replaces the metadata with a copy of values.
+func (m *conversationMeta) set(values map[string]string) {
+	copied := make(map[string]string, len(values))
+	maps.Copy(copied, values)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values = copied
+}
+
+// getMeta handles GET /meta
+func (s *Server) getMeta(ctx context.Context, input *struct{}) (*MetaResponse, error) {
+	resp := &MetaResponse{}
+	resp.Body.Meta = s.meta.get()
+	return resp, nil
+}
+
+// setMeta handles PUT /meta
+func (s *Server) setMeta(ctx context.Context, input *SetMetaRequest) (*MetaResponse, error) {
+	if _, ok := input.Body.Meta[""]; ok {
+		return nil, huma.Error400BadRequest("metadata keys must not be empty")
+	}
+	s.meta.set(input.Body.Meta)
+	s.logger.Info("Conversation metadata updated", "meta", input.Body.Meta)
+
+	resp := &MetaResponse{}
+	resp.Body.Meta = s.meta.get()
+	return resp, nil
+}
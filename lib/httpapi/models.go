@@ -27,10 +27,34 @@ func (m MessageType) Schema(r huma.Registry) *huma.Schema {
 
 // Message represents a message
 type Message struct {
-	Id      int                 `json:"id" doc:"Unique identifier for the message. This identifier also represents the order of the message in the conversation history."`
-	Content string              `json:"content" example:"Hello world" doc:"Message content. The message is formatted as it appears in the agent's terminal session, meaning that, by default, it consists of lines of text with 80 characters per line."`
-	Role    st.ConversationRole `json:"role" doc:"Role of the message author"`
-	Time    time.Time           `json:"time" doc:"Timestamp of the message"`
+	Id          int                 `json:"id" doc:"Unique identifier for the message. This identifier also represents the order of the message in the conversation history."`
+	Content     string              `json:"content" example:"Hello world" doc:"Message content. The message is formatted as it appears in the agent's terminal session, meaning that, by default, it consists of lines of text with 80 characters per line."`
+	Role        st.ConversationRole `json:"role" doc:"Role of the message author"`
+	Time        time.Time           `json:"time" doc:"Timestamp of the message in RFC 3339 format"`
+	TimeMs      int64               `json:"time_ms" doc:"Timestamp of the message in milliseconds since the Unix epoch. Same as time, for clients that don't parse RFC 3339."`
+	Complete    bool                `json:"complete" doc:"False while the agent is still writing this message. Only the last agent message can be incomplete."`
+	Diffs       []FileDiff          `json:"diffs,omitempty" doc:"File changes the agent printed in this message as unified diffs. Only set if the server runs with --extract-diffs and the agent's diffs are recognized. The content still contains them."`
+	Commands    []CommandRun        `json:"commands,omitempty" doc:"Shell commands the agent ran in this message. Only set if the server runs with --extract-commands and the agent's command runs are recognized. The content still contains them."`
+	RawScreen   string              `json:"raw_screen,omitempty" doc:"The agent's screen this message was parsed from, for debugging. Only set for agent messages if the server runs with --debug-raw-screen."`
+	Annotations []Annotation        `json:"annotations,omitempty" doc:"Annotations clients attached to this message with POST /messages/{id}/annotations, oldest first."`
+	RawBase64   string              `json:"raw_base64,omitempty" doc:"The agent's message as read from the screen, base64 encoded, if it isn't valid UTF-8. The content has the invalid bytes replaced with U+FFFD. Only set if the server runs with --keep-invalid-utf8."`
+	Provider    string              `json:"provider,omitempty" doc:"Provider of the model that wrote this agent message, as set with --agent-provider."`
+	Model       string              `json:"model,omitempty" doc:"Model that wrote this agent message, as set with --agent-model."`
+	Truncated   bool                `json:"truncated,omitempty" doc:"True if the content is truncated to the requested length. GET /messages/{id}?full=true returns the full content."`
+	Length      int                 `json:"length,omitempty" doc:"Number of characters of the full content. Only set if the content is truncated."`
+}
+
+// FileDiff is the unified diff of a file in an agent message
+type FileDiff struct {
+	Path  string   `json:"path" doc:"Path of the changed file."`
+	Hunks []string `json:"hunks" doc:"Hunks of the diff, each starting with its '@@' header line."`
+}
+
+// CommandRun is a shell command the agent ran, found in an agent message
+type CommandRun struct {
+	Command string `json:"command" doc:"The command line."`
+	Output  string `json:"output" doc:"Output of the command as far as the agent shows it. The agent may truncate it."`
+	Status  string `json:"status" enum:"ok,error,unknown" doc:"Whether the command succeeded according to the agent's output. 'unknown' for agents that don't show it."`
 }
 
 // StatusResponse represents the server status
@@ -41,6 +65,73 @@ type StatusResponse struct {
 	}
 }
 
+// SnapshotResponse represents the state of the conversation at a point in time
+type SnapshotResponse struct {
+	Body struct {
+		Status    AgentStatus  `json:"status" doc:"Current agent status, as returned by GET /status."`
+		AgentType mf.AgentType `json:"agent_type" doc:"Type of the agent being used by the server."`
+		Messages  []Message    `json:"messages" nullable:"false" doc:"All messages of the conversation history, including system messages, oldest first. The status was read together with them, so it describes the last message."`
+	}
+}
+
+// MessagesRequest represents the query parameters of GET /messages
+type MessagesRequest struct {
+	Since     time.Time `query:"since" doc:"Only return messages with a timestamp strictly after this time (RFC 3339). An agent message's timestamp is updated every time its content changes, so messages that are still being written are returned again."`
+	Include   []string  `query:"include" enum:"system" doc:"Comma-separated list of the roles of the messages to return in addition to user and agent messages."`
+	Order     string    `query:"order" enum:"asc,desc" default:"asc" doc:"Order of the messages: 'asc' returns the oldest message first, 'desc' the newest message first."`
+	Limit     int       `query:"limit" minimum:"0" doc:"Maximum number of messages to return, taken from the start of the requested order. With order=desc, these are the newest messages. 0 returns all messages."`
+	MaxLength int       `query:"max_length" minimum:"0" doc:"Truncate the content of messages to this many characters, e.g. to render previews of long messages. Truncated messages are marked, and GET /messages/{id}?full=true returns their full content. 0 uses the server's --message-preview-length, which doesn't truncate by default."`
+}
+
+// GetMessageRequest represents the parameters of GET /messages/{id}
+type GetMessageRequest struct {
+	Id   int  `path:"id" doc:"Identifier of the message."`
+	Full bool `query:"full" doc:"Return the full content even if the server runs with --message-preview-length."`
+}
+
+// GetMessageResponse represents a message of the conversation history
+type GetMessageResponse struct {
+	Body Message
+}
+
+// MessagesTextRequest represents the query parameters of GET /messages/text
+type MessagesTextRequest struct {
+	Fences string `query:"fences" enum:"keep,strip,hint" default:"keep" doc:"How markdown code fences in messages are rendered: 'keep' leaves them unchanged, 'strip' removes the fence lines, 'hint' replaces them with plain markers naming the code's language."`
+}
+
+// MessagesExportRequest represents the query parameters of GET
+// /messages/export
+type MessagesExportRequest struct {
+	Format string `query:"format" enum:"html" default:"html" doc:"Format of the transcript: 'html' is a standalone HTML page with inline styles."`
+}
+
+// MessagesExportResponse is the conversation history as a downloadable
+// transcript
+type MessagesExportResponse struct {
+	ContentType        string `header:"Content-Type"`
+	ContentDisposition string `header:"Content-Disposition"`
+	Body               []byte
+}
+
+// MessagesTextResponse is the conversation history rendered as plain text
+type MessagesTextResponse struct {
+	ContentType string `header:"Content-Type"`
+	Body        []byte
+}
+
+// EventsRequest represents the query parameters of GET /events
+type EventsRequest struct {
+	IncludeScreen bool     `query:"include_screen" doc:"Also send screen_update events with the contents of the agent's terminal screen."`
+	LastEventId   string   `header:"Last-Event-ID" doc:"Id of the last event received before the connection dropped. The events emitted since then are sent instead of the events that recreate the current state, if the server still has them. Browsers set this header when they reconnect."`
+	Types         []string `query:"types" enum:"message_update,messages_clear,status_change,screen_update,typing_start,typing_stop,notice,heartbeat,permission_request,permission_resolved" doc:"Comma-separated list of the event types to send. Defaults to all event types except messages_clear, typing_start, typing_stop and notice, which are only sent if listed. screen_update events are only sent if include_screen is also set."`
+	Snapshot      bool     `query:"snapshot" doc:"Recreate the current state with a single snapshot event that has the messages and the agent's status, instead of a message_update event per message and a status_change event. The snapshot event is sent regardless of types. It isn't sent to clients that resume with Last-Event-ID."`
+}
+
+// ScreenRequest represents the query parameters of GET /internal/screen
+type ScreenRequest struct {
+	Diff bool `query:"diff" doc:"Send screen_diff events with the lines that changed since the last screen sent, instead of the whole screen on every change. A full screen event is still sent first and periodically."`
+}
+
 // MessagesResponse represents the list of messages
 type MessagesResponse struct {
 	Body struct {
@@ -49,22 +140,290 @@ type MessagesResponse struct {
 }
 
 type MessageRequestBody struct {
-	Content string      `json:"content" example:"Hello, agent!" doc:"Message content"`
-	Type    MessageType `json:"type" doc:"A 'user' type message will be logged as a user message in the conversation history and submitted to the agent. AgentAPI will wait until the agent starts carrying out the task described in the message before responding. A 'raw' type message will be written directly to the agent's terminal session as keystrokes and will not be saved in the conversation history. 'raw' messages are useful for sending escape sequences to the terminal."`
+	Content   string              `json:"content" example:"Hello, agent!" doc:"Message content"`
+	Type      MessageType         `json:"type" doc:"A 'user' type message will be logged as a user message in the conversation history and submitted to the agent. AgentAPI will wait until the agent starts carrying out the task described in the message before responding. A 'raw' type message will be written directly to the agent's terminal session as keystrokes and will not be saved in the conversation history. 'raw' messages are useful for sending escape sequences to the terminal."`
+	Role      st.ConversationRole `json:"role,omitempty" doc:"Role of a 'user' type message in the conversation history. Defaults to 'user'. 'agent' and 'system' messages are only appended to the conversation history and are not submitted to the agent. They are rejected unless the server runs with --allow-message-injection."`
+	RawFormat bool                `json:"raw_format,omitempty" doc:"Write a 'user' type message to the agent's terminal exactly as given, skipping the agent-specific formatting and the configured prompt prefix and suffix. Unlike 'raw' type messages, the message is recorded in the conversation history and the agent's status is tracked as usual. Leading and trailing whitespace is sent to the agent but not recorded."`
+	Files     []string            `json:"files,omitempty" doc:"Paths of files on the server to reference in a 'user' type message, absolute or relative to the files root. The paths are appended to the message in the syntax the agent uses to mention files, e.g. '@path'. Requires the server to run with --files-root, and the files must be inside it."`
 }
 
 // MessageRequest represents a request to create a new message
 type MessageRequest struct {
-	Body MessageRequestBody `json:"body" doc:"Message content and type"`
+	RequestId      string             `header:"X-Request-Id" doc:"Correlation id of the request in the audit log. Generated if not set."`
+	IdempotencyKey string             `header:"Idempotency-Key" doc:"Unique key of the request. A retried request with the same key gets the response to the original request instead of being sent to the agent again. Reusing a key for a request with a different body is rejected with 422."`
+	Body           MessageRequestBody `json:"body" doc:"Message content and type"`
+}
+
+// MessageFormRequest represents a request to create a new message from an
+// HTML form or curl's --data options
+type MessageFormRequest struct {
+	Origin         string `header:"Origin" doc:"Origin of the page that submitted the form. Set by browsers. Submissions from origins that aren't allowed are rejected."`
+	RequestId      string `header:"X-Request-Id" doc:"Correlation id of the request in the audit log. Generated if not set."`
+	IdempotencyKey string `header:"Idempotency-Key" doc:"Unique key of the request. A retried request with the same key gets the response to the original request instead of being sent to the agent again. Reusing a key for a request with a different body is rejected with 422."`
+	RawBody        []byte `contentType:"application/x-www-form-urlencoded" doc:"The form fields 'content', the message content, and 'type', 'user' (the default) or 'raw'. They have the same meaning as in POST /message."`
 }
 
 // MessageResponse represents a newly created message
 type MessageResponse struct {
-	Body struct {
+	RequestId string `header:"X-Request-Id" doc:"Correlation id of the request in the audit log."`
+	Body      struct {
 		Ok bool `json:"ok" doc:"Indicates whether the message was sent successfully. For messages of type 'user', success means detecting that the agent began executing the task described. For messages of type 'raw', success means the keystrokes were sent to the terminal."`
 	}
 }
 
+// BatchMessageStatus is the outcome of a message of POST /messages/batch
+type BatchMessageStatus string
+
+const (
+	BatchMessageStatusSent   BatchMessageStatus = "sent"
+	BatchMessageStatusFailed BatchMessageStatus = "failed"
+	// BatchMessageStatusSkipped means that the message wasn't sent because
+	// an earlier message failed or the request was canceled.
+	BatchMessageStatusSkipped BatchMessageStatus = "skipped"
+)
+
+var BatchMessageStatusValues = []BatchMessageStatus{
+	BatchMessageStatusSent,
+	BatchMessageStatusFailed,
+	BatchMessageStatusSkipped,
+}
+
+func (b BatchMessageStatus) Schema(r huma.Registry) *huma.Schema {
+	return util.OpenAPISchema(r, "BatchMessageStatus", BatchMessageStatusValues)
+}
+
+// BatchMessageRequest represents a request to send a sequence of messages
+type BatchMessageRequest struct {
+	RequestId string `header:"X-Request-Id" doc:"Prefix of the correlation ids of the messages in the audit log. Each message's id is the prefix followed by its index. Generated if not set."`
+	Body      struct {
+		Messages  []MessageRequestBody `json:"messages" minItems:"1" maxItems:"100" doc:"Messages to send, in order. They have the same fields as the body of POST /message."`
+		TimeoutMs int                  `json:"timeout_ms,omitempty" minimum:"0" maximum:"3600000" doc:"How long to wait for the agent to become stable before and after sending each message, in milliseconds. Defaults to 5 minutes."`
+	}
+}
+
+// BatchMessageResult represents the outcome of a message of a batch
+type BatchMessageResult struct {
+	Status BatchMessageStatus `json:"status" doc:"'sent' if the message was sent and, for 'user' messages sent to the agent, the agent became stable again within the timeout."`
+	Error  string             `json:"error,omitempty" doc:"Why the message failed or was skipped."`
+}
+
+// BatchMessageResponse represents the outcome of a batch of messages
+type BatchMessageResponse struct {
+	RequestId string `header:"X-Request-Id" doc:"Prefix of the correlation ids of the messages in the audit log."`
+	Body      struct {
+		Ok      bool                 `json:"ok" doc:"Whether all messages were sent."`
+		Results []BatchMessageResult `json:"results" nullable:"false" doc:"Outcome of every message, in the order of the request."`
+	}
+}
+
+// ConversationStatsResponse represents aggregates over the conversation history
+type ConversationStatsResponse struct {
+	Body struct {
+		UserMessages      int       `json:"user_messages" doc:"Number of user messages."`
+		AgentMessages     int       `json:"agent_messages" doc:"Number of agent messages."`
+		SystemMessages    int       `json:"system_messages" doc:"Number of system messages."`
+		Responses         int       `json:"responses" doc:"Number of complete agent replies to user messages. Response times are measured from the user message to the last update of the reply."`
+		TotalRunTimeMs    int64     `json:"total_run_time_ms" doc:"Sum of the response times in milliseconds."`
+		AverageResponseMs int64     `json:"average_response_ms" doc:"Average response time in milliseconds. 0 if there are no responses."`
+		LongestResponseMs int64     `json:"longest_response_ms" doc:"Longest response time in milliseconds."`
+		LastActivity      time.Time `json:"last_activity" doc:"Timestamp of the most recent message."`
+	}
+}
+
+// PingRequest represents a request to check whether the agent is responsive
+type PingRequest struct {
+	TimeoutMs int `query:"timeout_ms" minimum:"0" maximum:"60000" doc:"How long to wait for the agent, in milliseconds, before reporting it as unresponsive. Defaults to the server's probe timeout, set with --probe-timeout (2 seconds by default)."`
+}
+
+// PingResponse represents the result of checking whether the agent is responsive
+type PingResponse struct {
+	Body struct {
+		Responsive bool   `json:"responsive" doc:"Whether the agent answered within the timeout."`
+		LatencyMs  int64  `json:"latency_ms" doc:"Round-trip time of the check in milliseconds. If the agent didn't answer, this is about the timeout."`
+		Error      string `json:"error,omitempty" doc:"Why the agent is considered unresponsive."`
+	}
+}
+
+// PermissionDecision is the answer to a permission request
+type PermissionDecision string
+
+const (
+	PermissionDecisionApprove PermissionDecision = "approve"
+	PermissionDecisionDeny    PermissionDecision = "deny"
+)
+
+var PermissionDecisionValues = []PermissionDecision{
+	PermissionDecisionApprove,
+	PermissionDecisionDeny,
+}
+
+func (p PermissionDecision) Schema(r huma.Registry) *huma.Schema {
+	return util.OpenAPISchema(r, "PermissionDecision", PermissionDecisionValues)
+}
+
+// PermissionDecisionRequest represents the answer to a permission request
+type PermissionDecisionRequest struct {
+	Id   int `path:"id" doc:"Identifier of the permission request, from its permission_request event."`
+	Body struct {
+		Decision PermissionDecision `json:"decision" doc:"Whether to let the agent go ahead."`
+	}
+}
+
+// PermissionDecisionResponse represents the result of answering a permission request
+type PermissionDecisionResponse struct {
+	Body struct {
+		Ok bool `json:"ok" doc:"Indicates whether the answer was sent to the agent."`
+	}
+}
+
+// HealthStatus is the overall health of the server
+type HealthStatus string
+
+const (
+	HealthStatusOk       HealthStatus = "ok"
+	HealthStatusDegraded HealthStatus = "degraded"
+	// HealthStatusUnhealthy means that the agent didn't respond.
+	HealthStatusUnhealthy HealthStatus = "unhealthy"
+)
+
+var HealthStatusValues = []HealthStatus{
+	HealthStatusOk,
+	HealthStatusDegraded,
+	HealthStatusUnhealthy,
+}
+
+func (h HealthStatus) Schema(r huma.Registry) *huma.Schema {
+	return util.OpenAPISchema(r, "HealthStatus", HealthStatusValues)
+}
+
+// HealthResponse represents the health of the server
+type HealthResponse struct {
+	Body struct {
+		Status                  HealthStatus `json:"status" doc:"'unhealthy' if the agent didn't respond within the server's probe timeout. 'degraded' if the server is serving requests but has recently failed to deliver events to subscribers."`
+		AgentResponsive         bool         `json:"agent_responsive" doc:"Whether the agent responded within the server's probe timeout, like for GET /ping."`
+		DroppedSubscribers      int          `json:"dropped_subscribers" doc:"Number of event subscribers disconnected in the last 5 minutes because they didn't read events fast enough."`
+		BackpressureDisconnects int64        `json:"backpressure_disconnects" doc:"Number of event subscribers disconnected since the server started because they couldn't keep up with the events: their event buffer was full or sending them an event was slow several times in a row. Subscribers whose connection failed aren't counted."`
+		Warning                 string       `json:"warning,omitempty" doc:"Why the server is degraded or unhealthy."`
+	}
+}
+
+// ContinueResponse represents the result of letting the agent go on
+type ContinueResponse struct {
+	Body struct {
+		Ok bool `json:"ok" doc:"Indicates whether Enter was pressed or the continue phrase was sent to the agent. Like for 'user' messages sent with POST /message, sending the phrase succeeds once the agent began executing it."`
+	}
+}
+
+// RegenerateResponse represents the result of regenerating the agent's last reply
+type RegenerateResponse struct {
+	Body struct {
+		Ok bool `json:"ok" doc:"Indicates whether the user message was sent to the agent again. Like for 'user' messages sent with POST /message, success means detecting that the agent began executing the task."`
+	}
+}
+
+// NoticeRequest represents a notice to broadcast to the event subscribers
+type NoticeRequest struct {
+	Body struct {
+		Severity string `json:"severity,omitempty" enum:"info,warning,error" default:"info" doc:"How important the notice is."`
+		Text     string `json:"text" minLength:"1" example:"The server restarts in 30 seconds." doc:"Text of the notice."`
+	}
+}
+
+// NoticeResponse represents the result of broadcasting a notice
+type NoticeResponse struct {
+	Body struct {
+		Ok bool `json:"ok" doc:"Indicates whether the notice was sent to the subscribers."`
+	}
+}
+
+// ResetStatusResponse represents the result of resetting the agent's status
+type ResetStatusResponse struct {
+	Body struct {
+		Status AgentStatus `json:"status" doc:"The agent's status after the reset."`
+	}
+}
+
+// MetaResponse represents the metadata attached to the conversation
+type MetaResponse struct {
+	Body struct {
+		Meta map[string]string `json:"meta" nullable:"false" doc:"Key/value metadata attached to the conversation, e.g. a user id or a ticket number. It doesn't affect the agent."`
+	}
+}
+
+// Annotation is feedback a client attached to a message
+type Annotation struct {
+	Reaction string    `json:"reaction,omitempty" enum:"thumbs_up,thumbs_down" doc:"Reaction to the message."`
+	Note     string    `json:"note,omitempty" doc:"Free-form note on the message."`
+	Time     time.Time `json:"time" doc:"When the annotation was added."`
+}
+
+// AnnotationsRequest represents a request for the annotations of a message
+type AnnotationsRequest struct {
+	Id int `path:"id" doc:"Identifier of the message."`
+}
+
+// AddAnnotationRequest represents a request to annotate a message
+type AddAnnotationRequest struct {
+	Id   int `path:"id" doc:"Identifier of the message."`
+	Body struct {
+		Reaction string `json:"reaction,omitempty" enum:"thumbs_up,thumbs_down" doc:"Reaction to the message."`
+		Note     string `json:"note,omitempty" maxLength:"10000" doc:"Free-form note on the message. An annotation needs a reaction, a note or both."`
+	}
+}
+
+// AnnotationsResponse represents the annotations of a message
+type AnnotationsResponse struct {
+	Body struct {
+		Annotations []Annotation `json:"annotations" doc:"Annotations of the message, oldest first."`
+	}
+}
+
+// SetMetaRequest represents a request to replace the conversation's metadata
+type SetMetaRequest struct {
+	Body struct {
+		Meta map[string]string `json:"meta" doc:"The new metadata. It replaces all existing keys."`
+	}
+}
+
+// ResizeRequest represents a request to resize the agent's terminal
+type ResizeRequest struct {
+	Body struct {
+		Width  int `json:"width" example:"80" doc:"Width of the terminal in columns. Must be between 10 and 65535."`
+		Height int `json:"height" example:"24" doc:"Height of the terminal in rows. Must be between 10 and 65535."`
+	}
+}
+
+// Capabilities are the features the server supports for the agent
+type Capabilities struct {
+	RawInput         bool `json:"raw_input" doc:"Messages of type 'raw' can be sent to the agent's terminal, e.g. to press Escape or Ctrl+C to interrupt the agent."`
+	Attachments      bool `json:"attachments" doc:"Files on the server can be attached to messages by path, i.e. the server runs with --files-root."`
+	FileMentions     bool `json:"file_mentions" doc:"The agent reads the files mentioned in messages by path, e.g. as @path."`
+	ModelSelection   bool `json:"model_selection" doc:"The model of the agent can be chosen through the API. The server can't switch the agent's model, so this is always false."`
+	Sessions         bool `json:"sessions" doc:"The server manages several conversations. It serves a single conversation, so this is always false."`
+	Screen           bool `json:"screen" doc:"The agent's terminal screen is exposed, in screen update events. False if the server runs with --disable-screen."`
+	Resize           bool `json:"resize" doc:"The agent's terminal can be resized with POST /resize."`
+	Permissions      bool `json:"permissions" doc:"The agent's permission prompts are sent as permission_request events and can be answered with POST /permissions/{id}."`
+	Diffs            bool `json:"diffs" doc:"The file diffs the agent prints are added to its messages."`
+	Commands         bool `json:"commands" doc:"The shell commands the agent runs are added to its messages."`
+	Tail             bool `json:"tail" doc:"GET /tail streams the conversation over a WebSocket."`
+	MessageInjection bool `json:"message_injection" doc:"Agent and system messages can be appended to the conversation history with POST /message."`
+}
+
+// CapabilitiesResponse represents the features the server supports for the agent
+type CapabilitiesResponse struct {
+	Body struct {
+		AgentType    mf.AgentType `json:"agent_type" doc:"Type of the agent being used by the server."`
+		Capabilities Capabilities `json:"capabilities" doc:"The features the server supports for the agent, derived from the agent type and the server's configuration."`
+	}
+}
+
+// ResizeResponse represents the result of resizing the agent's terminal
+type ResizeResponse struct {
+	Body struct {
+		Ok bool `json:"ok" doc:"Indicates whether the terminal was resized."`
+	}
+}
+
 type UploadResponse struct {
 	Body struct {
 		Ok       bool   `json:"ok" doc:"Indicates whether the files were uploaded successfully."`
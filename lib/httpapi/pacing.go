@@ -0,0 +1,72 @@
+package httpapi
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+// messagePacer enforces a minimum time between the user messages accepted
+// by POST /message, so that double submissions from a UI are rejected
+// instead of sent to the agent twice.
+type messagePacer struct {
+	interval time.Duration
+
+	mu sync.Mutex
+	// last is when the last message was accepted.
+	last time.Time
+}
+
+// newMessagePacer returns nil if interval is zero.
+func newMessagePacer(interval time.Duration) *messagePacer {
+	if interval <= 0 {
+		return nil
+	}
+	return &messagePacer{interval: interval}
+}
+
+// reserve accepts a message at now, unless the last one was accepted less
+// than the interval ago. It then returns how long until a message is
+// accepted again. A nil pacer accepts every message.
+func (p *messagePacer) reserve(now time.Time) (prev time.Time, wait time.Duration) {
+	if p == nil {
+		return time.Time{}, 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.last.IsZero() {
+		if elapsed := now.Sub(p.last); elapsed < p.interval {
+			return p.last, p.interval - elapsed
+		}
+	}
+	prev, p.last = p.last, now
+	return prev, 0
+}
+
+// release undoes the reservation made at now, for a message that wasn't sent
+// after all. prev is the time returned by reserve.
+func (p *messagePacer) release(now time.Time, prev time.Time) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.last.Equal(now) {
+		p.last = prev
+	}
+}
+
+// errTooSoon returns the error for a message sent wait too early. It responds
+// with 429 and a Retry-After header in whole seconds.
+func errTooSoon(interval time.Duration, wait time.Duration) error {
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	return huma.ErrorWithHeaders(
+		huma.Error429TooManyRequests(fmt.Sprintf("messages must be at least %s apart, retry in %s", interval, wait.Round(time.Millisecond))),
+		http.Header{"Retry-After": []string{strconv.Itoa(retryAfter)}},
+	)
+}
@@ -0,0 +1,51 @@
+package httpapi
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/danielgtaylor/huma/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessagePacer(t *testing.T) {
+	t.Parallel()
+
+	require.Nil(t, newMessagePacer(0))
+	var disabled *messagePacer
+	_, wait := disabled.reserve(time.Now())
+	require.Zero(t, wait)
+
+	p := newMessagePacer(2 * time.Second)
+	start := time.Now()
+	prev, wait := p.reserve(start)
+	require.Zero(t, wait)
+	require.True(t, prev.IsZero())
+
+	_, wait = p.reserve(start.Add(500 * time.Millisecond))
+	require.Equal(t, 1500*time.Millisecond, wait)
+
+	next := start.Add(2 * time.Second)
+	prev, wait = p.reserve(next)
+	require.Zero(t, wait)
+	require.Equal(t, start, prev)
+
+	// A message that wasn't sent after all doesn't count.
+	p.release(next, prev)
+	_, wait = p.reserve(start.Add(3 * time.Second))
+	require.Zero(t, wait)
+}
+
+func TestErrTooSoon(t *testing.T) {
+	t.Parallel()
+
+	err := errTooSoon(2*time.Second, 1200*time.Millisecond)
+	var statusErr huma.StatusError
+	require.True(t, errors.As(err, &statusErr))
+	require.Equal(t, 429, statusErr.GetStatus())
+	require.Contains(t, err.Error(), "at least 2s apart, retry in 1.2s")
+	var headersErr huma.HeadersError
+	require.True(t, errors.As(err, &headersErr))
+	require.Equal(t, "2", headersErr.GetHeaders().Get("Retry-After"))
+}
@@ -0,0 +1,169 @@
+package httpapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/danielgtaylor/huma/v2"
+	"golang.org/x/xerrors"
+)
+
+// Default keys that answer a permission prompt. Agents usually highlight the
+// option that approves, and Escape dismisses the prompt.
+const (
+	defaultPermissionApproveKeys = "\r"
+	defaultPermissionDenyKeys    = "\x1b"
+)
+
+// permissionPrompts detects the prompts in which the agent asks for
+// permission, e.g. before running a tool, so that clients can answer them
+// with POST /permissions/{id} instead of the session stalling.
+type permissionPrompts struct {
+	// pattern matches a prompt on the agent's screen. Its "tool" and
+	// "action" groups, if any, describe what the agent asks for.
+	pattern     *regexp.Regexp
+	approveKeys string
+	denyKeys    string
+
+	mu sync.Mutex
+	// pending is the prompt on the screen, or nil. decision is how it was
+	// answered, or "" if it wasn't yet.
+	pending  *PermissionRequestBody
+	decision PermissionDecision
+	// nextId is the id of the next prompt.
+	nextId int
+}
+
+// newPermissionPrompts returns nil if pattern is empty.
+func newPermissionPrompts(pattern string, approveKeys string, denyKeys string) (*permissionPrompts, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid permission pattern: %w", err)
+	}
+	if approveKeys == "" {
+		approveKeys = defaultPermissionApproveKeys
+	}
+	if denyKeys == "" {
+		denyKeys = defaultPermissionDenyKeys
+	}
+	return &permissionPrompts{pattern: re, approveKeys: approveKeys, denyKeys: denyKeys}, nil
+}
+
+// update looks for a prompt on screen. It returns the prompt that appeared
+// and the one that went away, if any. Only the last prompt on screen counts,
+// since answered prompts can stay on screen above a new one.
+func (p *permissionPrompts) update(screen string) (appeared *PermissionRequestBody, resolved *PermissionResolvedBody) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var current *PermissionRequestBody
+	if matches := p.pattern.FindAllStringSubmatch(screen, -1); len(matches) > 0 {
+		match := matches[len(matches)-1]
+		current = &PermissionRequestBody{Prompt: strings.TrimSpace(match[0])}
+		if i := p.pattern.SubexpIndex("tool"); i >= 0 {
+			current.Tool = strings.TrimSpace(match[i])
+		}
+		if i := p.pattern.SubexpIndex("action"); i >= 0 {
+			current.Action = strings.TrimSpace(match[i])
+		}
+	}
+	if p.pending != nil && current != nil && p.pending.Prompt == current.Prompt {
+		return nil, nil
+	}
+	if p.pending != nil {
+		resolved = &PermissionResolvedBody{Id: p.pending.Id, Decision: p.decision}
+		p.pending, p.decision = nil, ""
+	}
+	if current != nil {
+		current.Id = p.nextId
+		p.nextId++
+		p.pending = current
+		appeared = current
+	}
+	return appeared, resolved
+}
+
+var (
+	errPermissionNotFound = xerrors.New("no such permission request")
+	errPermissionAnswered = xerrors.New("the permission request was already answered")
+)
+
+// answer records the decision on the pending prompt with id and returns the
+// keys that answer it.
+func (p *permissionPrompts) answer(id int, decision PermissionDecision) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending == nil || p.pending.Id != id {
+		return "", errPermissionNotFound
+	}
+	if p.decision != "" {
+		return "", errPermissionAnswered
+	}
+	p.decision = decision
+	if decision == PermissionDecisionApprove {
+		return p.approveKeys, nil
+	}
+	return p.denyKeys, nil
+}
+
+// unanswer forgets the decision on the prompt with id, e.g. because its keys
+// couldn't be sent.
+func (p *permissionPrompts) unanswer(id int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pending != nil && p.pending.Id == id {
+		p.decision = ""
+	}
+}
+
+// updatePermissions emits the changes of the permission prompt on screen.
+func (s *Server) updatePermissions(screen string) {
+	if s.permissions == nil {
+		return
+	}
+	appeared, resolved := s.permissions.update(screen)
+	if resolved != nil {
+		s.emitter.EmitPermissionResolved(*resolved)
+	}
+	if appeared != nil {
+		s.logger.Info("Agent asks for permission", "permissionId", appeared.Id, "tool", appeared.Tool, "action", appeared.Action)
+		s.emitter.EmitPermissionRequest(*appeared)
+	}
+}
+
+// answerPermission handles POST /permissions/{id}
+func (s *Server) answerPermission(ctx context.Context, input *PermissionDecisionRequest) (*PermissionDecisionResponse, error) {
+	if s.permissions == nil {
+		return nil, huma.Error404NotFound("permission prompts aren't detected, start the server with --permission-pattern to enable it")
+	}
+	keys, err := s.permissions.answer(input.Id, input.Body.Decision)
+	if errors.Is(err, errPermissionNotFound) {
+		return nil, huma.Error404NotFound(fmt.Sprintf("permission request %d isn't pending", input.Id))
+	}
+	if errors.Is(err, errPermissionAnswered) {
+		return nil, huma.Error409Conflict(fmt.Sprintf("permission request %d was already answered", input.Id))
+	}
+
+	s.mu.Lock()
+	err = s.writeRaw([]byte(keys))
+	s.mu.Unlock()
+	if err != nil {
+		s.permissions.unanswer(input.Id)
+		if errors.Is(err, errRawWriteTimeout) {
+			return nil, huma.Error503ServiceUnavailable(err.Error())
+		}
+		return nil, xerrors.Errorf("failed to answer permission request: %w", err)
+	}
+	s.logger.Info("Permission request answered", "permissionId", input.Id, "decision", input.Body.Decision)
+
+	resp := &PermissionDecisionResponse{}
+	resp.Body.Ok = true
+	return resp, nil
+}
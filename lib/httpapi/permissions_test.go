@@ -0,0 +1,70 @@
+package httpapi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPermissionPrompts(t *testing.T) {
+	t.Parallel()
+
+	p, err := newPermissionPrompts(`Allow (?P<tool>\w+)\((?P<action>[^)]*)\)\?`, "", "")
+	require.NoError(t, err)
+
+	appeared, resolved := p.update("> ")
+	require.Nil(t, appeared)
+	require.Nil(t, resolved)
+
+	appeared, resolved = p.update("Allow Bash(rm -rf build)? [y/n]")
+	require.Nil(t, resolved)
+	require.Equal(t, &PermissionRequestBody{Id: 0, Tool: "Bash", Action: "rm -rf build", Prompt: "Allow Bash(rm -rf build)?"}, appeared)
+
+	// The prompt is only announced once.
+	appeared, resolved = p.update("Allow Bash(rm -rf build)? [y/n] ")
+	require.Nil(t, appeared)
+	require.Nil(t, resolved)
+
+	_, err = p.answer(1, PermissionDecisionApprove)
+	require.ErrorIs(t, err, errPermissionNotFound)
+	keys, err := p.answer(0, PermissionDecisionDeny)
+	require.NoError(t, err)
+	require.Equal(t, defaultPermissionDenyKeys, keys)
+	_, err = p.answer(0, PermissionDecisionApprove)
+	require.ErrorIs(t, err, errPermissionAnswered)
+
+	// A different prompt replaces the answered one.
+	appeared, resolved = p.update("Allow Edit(main.go)?")
+	require.Equal(t, &PermissionResolvedBody{Id: 0, Decision: PermissionDecisionDeny}, resolved)
+	require.Equal(t, &PermissionRequestBody{Id: 1, Tool: "Edit", Action: "main.go", Prompt: "Allow Edit(main.go)?"}, appeared)
+
+	// A failed answer can be retried.
+	_, err = p.answer(1, PermissionDecisionApprove)
+	require.NoError(t, err)
+	p.unanswer(1)
+	keys, err = p.answer(1, PermissionDecisionApprove)
+	require.NoError(t, err)
+	require.Equal(t, defaultPermissionApproveKeys, keys)
+
+	appeared, resolved = p.update("> ")
+	require.Nil(t, appeared)
+	require.Equal(t, &PermissionResolvedBody{Id: 1, Decision: PermissionDecisionApprove}, resolved)
+	_, err = p.answer(1, PermissionDecisionApprove)
+	require.ErrorIs(t, err, errPermissionNotFound)
+
+	// An answered prompt that stays on screen doesn't hide a new one below it.
+	appeared, resolved = p.update("Allow Edit(main.go)? yes\nAllow Bash(go test)?")
+	require.Nil(t, resolved)
+	require.Equal(t, &PermissionRequestBody{Id: 2, Tool: "Bash", Action: "go test", Prompt: "Allow Bash(go test)?"}, appeared)
+	_, err = p.answer(2, PermissionDecisionApprove)
+	require.NoError(t, err)
+	appeared, resolved = p.update("Allow Edit(main.go)? yes\nAllow Bash(go test)? yes\nAllow Write(out.txt)?")
+	require.Equal(t, &PermissionResolvedBody{Id: 2, Decision: PermissionDecisionApprove}, resolved)
+	require.Equal(t, &PermissionRequestBody{Id: 3, Tool: "Write", Action: "out.txt", Prompt: "Allow Write(out.txt)?"}, appeared)
+
+	p, err = newPermissionPrompts("", "", "")
+	require.NoError(t, err)
+	require.Nil(t, p)
+	_, err = newPermissionPrompts("(", "", "")
+	require.ErrorContains(t, err, "invalid permission pattern")
+}
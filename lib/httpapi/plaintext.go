@@ -0,0 +1,70 @@
+package httpapi
+
+import (
+	"fmt"
+	"strings"
+
+	st "github.com/coder/agentapi/lib/screentracker"
+)
+
+// fenceMode controls how renderPlain handles markdown code fences.
+type fenceMode string
+
+const (
+	// fenceKeep leaves code fences as they are.
+	fenceKeep fenceMode = "keep"
+	// fenceStrip removes the fence lines and keeps the code.
+	fenceStrip fenceMode = "strip"
+	// fenceHint replaces the fence lines with plain markers that name the
+	// fence's language, if any.
+	fenceHint fenceMode = "hint"
+)
+
+type plainOptions struct {
+	fences fenceMode
+}
+
+// renderPlain renders messages as plain text for terminals. Every message
+// starts with a line naming its role and is followed by a blank line.
+func renderPlain(messages []st.ConversationMessage, opts plainOptions) string {
+	var sb strings.Builder
+	for _, msg := range messages {
+		fmt.Fprintf(&sb, "%s:\n", msg.Role)
+		sb.WriteString(renderPlainContent(msg.Message, opts))
+		sb.WriteString("\n\n")
+	}
+	return sb.String()
+}
+
+// renderPlainContent applies opts to the content of a single message.
+func renderPlainContent(content string, opts plainOptions) string {
+	if opts.fences == "" || opts.fences == fenceKeep {
+		return content
+	}
+	lines := strings.Split(content, "\n")
+	out := make([]string, 0, len(lines))
+	// fence is the opening fence of the code block we're in, if any.
+	fence := ""
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case fence == "" && (strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~")):
+			fence = trimmed[:3]
+			if opts.fences == fenceHint {
+				if lang := strings.TrimSpace(strings.TrimLeft(trimmed, fence[:1])); lang != "" {
+					out = append(out, fmt.Sprintf("--- %s ---", lang))
+				} else {
+					out = append(out, "---")
+				}
+			}
+		case fence != "" && strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "":
+			fence = ""
+			if opts.fences == fenceHint {
+				out = append(out, "---")
+			}
+		default:
+			out = append(out, line)
+		}
+	}
+	return strings.Join(out, "\n")
+}
@@ -0,0 +1,38 @@
+package httpapi
+
+import (
+	"testing"
+
+	st "github.com/coder/agentapi/lib/screentracker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderPlain(t *testing.T) {
+	fenced := "Run this:\n```go\nfmt.Println(\"hi\")\n```\nand this:\n  ~~~\n  ls\n  ~~~"
+	unfenced := "No code here.\nJust `inline` code."
+	messages := []st.ConversationMessage{
+		{Id: 0, Role: st.ConversationRoleUser, Message: "Show me"},
+		{Id: 1, Role: st.ConversationRoleAgent, Message: fenced},
+	}
+
+	t.Run("keep", func(t *testing.T) {
+		assert.Equal(t, "user:\nShow me\n\nagent:\n"+fenced+"\n\n", renderPlain(messages, plainOptions{fences: fenceKeep}))
+		assert.Equal(t, renderPlain(messages, plainOptions{fences: fenceKeep}), renderPlain(messages, plainOptions{}))
+	})
+
+	t.Run("strip", func(t *testing.T) {
+		assert.Equal(t, "Run this:\nfmt.Println(\"hi\")\nand this:\n  ls", renderPlainContent(fenced, plainOptions{fences: fenceStrip}))
+		assert.Equal(t, unfenced, renderPlainContent(unfenced, plainOptions{fences: fenceStrip}))
+	})
+
+	t.Run("hint", func(t *testing.T) {
+		assert.Equal(t, "Run this:\n--- go ---\nfmt.Println(\"hi\")\n---\nand this:\n---\n  ls\n---", renderPlainContent(fenced, plainOptions{fences: fenceHint}))
+		assert.Equal(t, unfenced, renderPlainContent(unfenced, plainOptions{fences: fenceHint}))
+	})
+
+	t.Run("nested fence", func(t *testing.T) {
+		// A ~~~ line inside a ``` block is code.
+		content := "```\n~~~\n```"
+		assert.Equal(t, "~~~", renderPlainContent(content, plainOptions{fences: fenceStrip}))
+	})
+}
@@ -0,0 +1,45 @@
+package httpapi
+
+import (
+	"context"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/danielgtaylor/huma/v2"
+)
+
+// truncateMessage shortens the content of message to its first maxLength
+// characters, for previews of long messages. It marks truncated messages
+// and records the length of their full content. maxLength <= 0 leaves
+// message unchanged.
+func truncateMessage(message Message, maxLength int) Message {
+	if maxLength <= 0 {
+		return message
+	}
+	length := utf8.RuneCountInString(message.Content)
+	if length <= maxLength {
+		return message
+	}
+	cut := 0
+	for i := 0; i < maxLength; i++ {
+		_, size := utf8.DecodeRuneInString(message.Content[cut:])
+		cut += size
+	}
+	message.Content = message.Content[:cut]
+	message.Truncated = true
+	message.Length = length
+	return message
+}
+
+// getMessage handles GET /messages/{id}
+func (s *Server) getMessage(ctx context.Context, input *GetMessageRequest) (*GetMessageResponse, error) {
+	messages := s.conversation.Messages()
+	if input.Id < 0 || input.Id >= len(messages) || messages[input.Id].Id != input.Id {
+		return nil, huma.Error404NotFound(fmt.Sprintf("message %d not found", input.Id))
+	}
+	message := s.convertMessage(messages, input.Id, convertStatus(s.conversation.Status()))
+	if !input.Full {
+		message = truncateMessage(message, s.messagePreviewLength)
+	}
+	return &GetMessageResponse{Body: message}, nil
+}
@@ -0,0 +1,29 @@
+package httpapi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTruncateMessage(t *testing.T) {
+	t.Parallel()
+
+	message := Message{Id: 3, Content: "héllo wörld"}
+	for _, tc := range []struct {
+		name      string
+		maxLength int
+		expected  Message
+	}{
+		{"disabled", 0, message},
+		{"longer than the content", 20, message},
+		{"as long as the content", 11, message},
+		{"shorter than the content", 5, Message{Id: 3, Content: "héllo", Truncated: true, Length: 11}},
+		{"cuts after a multibyte character", 8, Message{Id: 3, Content: "héllo wö", Truncated: true, Length: 11}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, tc.expected, truncateMessage(message, tc.maxLength))
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package httpapi
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// defaultProbeTimeout is how long GET /ping and GET /health wait for the agent
+// by default.
+const defaultProbeTimeout = 2 * time.Second
+
+// pinger is implemented by agents that can check their own responsiveness.
+type pinger interface {
+	Ping() error
+}
+
+// agentProbe runs the checks of whether the agent is responsive. A wedged
+// agent blocks a check until it recovers, so concurrent probes share the check
+// in flight instead of piling up blocked ones.
+type agentProbe struct {
+	mu       sync.Mutex
+	inFlight *probeCall
+}
+
+type probeCall struct {
+	done chan struct{}
+	err  error
+}
+
+// start runs check unless a check is already in flight, and returns the
+// running check.
+func (p *agentProbe) start(check func() error) *probeCall {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.inFlight != nil {
+		return p.inFlight
+	}
+	call := &probeCall{done: make(chan struct{})}
+	p.inFlight = call
+	go func() {
+		call.err = check()
+		p.mu.Lock()
+		p.inFlight = nil
+		p.mu.Unlock()
+		close(call.done)
+	}()
+	return call
+}
+
+// probeAgent checks that the agent responds within timeout, or the server's
+// probe timeout if it's zero. It returns as soon as ctx is done, even if the
+// agent hangs. Servers without an agent are always responsive.
+func (s *Server) probeAgent(ctx context.Context, timeout time.Duration) error {
+	if s.agentio == nil {
+		return nil
+	}
+	if timeout <= 0 {
+		timeout = s.probeTimeout
+	}
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+	call := s.probe.start(func() error {
+		if p, ok := s.agentio.(pinger); ok {
+			return p.Ping()
+		}
+		s.agentio.ReadScreen()
+		return nil
+	})
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-call.done:
+		return call.err
+	case <-timer.C:
+		return xerrors.Errorf("the agent did not respond within %s", timeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
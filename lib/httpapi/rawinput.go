@@ -0,0 +1,60 @@
+package httpapi
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// rawInputFilter validates the content of raw messages before it's written
+// to the agent's terminal. A nil filter allows everything.
+type rawInputFilter struct {
+	// allow matches content made up entirely of allowed sequences.
+	allow *regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+// newRawInputFilter compiles the allow and deny patterns. It returns nil if
+// both lists are empty.
+func newRawInputFilter(allowPatterns []string, denyPatterns []string) (*rawInputFilter, error) {
+	if len(allowPatterns) == 0 && len(denyPatterns) == 0 {
+		return nil, nil
+	}
+	f := &rawInputFilter{}
+	if len(allowPatterns) > 0 {
+		groups := make([]string, 0, len(allowPatterns))
+		for _, pattern := range allowPatterns {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return nil, xerrors.Errorf("invalid raw input allow pattern %q: %w", pattern, err)
+			}
+			groups = append(groups, "(?:"+pattern+")")
+		}
+		f.allow = regexp.MustCompile(`\A(?:` + strings.Join(groups, "|") + `)+\z`)
+	}
+	for _, pattern := range denyPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid raw input deny pattern %q: %w", pattern, err)
+		}
+		f.deny = append(f.deny, re)
+	}
+	return f, nil
+}
+
+// check returns an error if content contains a denied sequence or, when an
+// allowlist is configured, anything other than allowed sequences.
+func (f *rawInputFilter) check(content string) error {
+	if f == nil {
+		return nil
+	}
+	for _, re := range f.deny {
+		if loc := re.FindStringIndex(content); loc != nil {
+			return xerrors.Errorf("raw input contains a denied sequence: %q", content[loc[0]:loc[1]])
+		}
+	}
+	if f.allow != nil && !f.allow.MatchString(content) {
+		return xerrors.Errorf("raw input contains sequences that are not allowed")
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package httpapi
+
+import (
+	"strings"
+)
+
+// screenDiffsPerFrame is how many screen diffs are sent to a subscriber of
+// /internal/screen between two full frames. The full frames let clients that
+// applied a diff incorrectly recover.
+const screenDiffsPerFrame = 50
+
+// ScreenLineChange is a line of the screen that changed.
+type ScreenLineChange struct {
+	Line int    `json:"line" doc:"Index of the line, starting at 0."`
+	Text string `json:"text" doc:"New content of the line."`
+}
+
+// ScreenDiffBody is sent instead of a full screen update to subscribers that
+// asked for diffs. It's relative to the last screen sent to the subscriber.
+type ScreenDiffBody struct {
+	Lines   int                `json:"lines" doc:"Number of lines of the new screen. Lines of the previous screen past it are removed, and missing lines are added empty before the changes are applied."`
+	Changes []ScreenLineChange `json:"changes" nullable:"false" doc:"Lines that differ from the previous screen."`
+}
+
+// diffScreen returns the changes that turn prev into next.
+func diffScreen(prev string, next string) ScreenDiffBody {
+	prevLines := strings.Split(prev, "\n")
+	nextLines := strings.Split(next, "\n")
+	diff := ScreenDiffBody{Lines: len(nextLines), Changes: []ScreenLineChange{}}
+	for i, line := range nextLines {
+		if i < len(prevLines) && prevLines[i] == line {
+			continue
+		}
+		// Lines added at the end start out empty.
+		if i >= len(prevLines) && line == "" {
+			continue
+		}
+		diff.Changes = append(diff.Changes, ScreenLineChange{Line: i, Text: line})
+	}
+	return diff
+}
+
+// size estimates the number of bytes the diff takes to send.
+func (d ScreenDiffBody) size() int {
+	size := 0
+	for _, change := range d.Changes {
+		size += len(change.Text) + len(`{"line":0000,"text":""},`)
+	}
+	return size
+}
+
+// screenStream decides whether each screen update is sent to a subscriber as
+// a full frame or as a diff against the last screen it was sent.
+type screenStream struct {
+	diffs bool
+	// sent is the last screen sent. sentFrame is false until a full frame
+	// has been sent.
+	sent      string
+	sentFrame bool
+	// diffsSinceFrame counts the diffs sent since the last full frame.
+	diffsSinceFrame int
+}
+
+// next returns the payload to send for the screen update.
+func (s *screenStream) next(update ScreenUpdateBody) any {
+	prev := s.sent
+	s.sent = update.Screen
+	if s.diffs && s.sentFrame && s.diffsSinceFrame < screenDiffsPerFrame {
+		diff := diffScreen(prev, update.Screen)
+		if diff.size() < len(update.Screen) {
+			s.diffsSinceFrame++
+			return diff
+		}
+	}
+	s.sentFrame = true
+	s.diffsSinceFrame = 0
+	return update
+}
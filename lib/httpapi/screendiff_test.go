@@ -0,0 +1,93 @@
+package httpapi
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// applyScreenDiff applies diff to screen the way a client would.
+func applyScreenDiff(screen string, diff ScreenDiffBody) string {
+	lines := strings.Split(screen, "\n")
+	if len(lines) > diff.Lines {
+		lines = lines[:diff.Lines]
+	}
+	for len(lines) < diff.Lines {
+		lines = append(lines, "")
+	}
+	for _, change := range diff.Changes {
+		lines[change.Line] = change.Text
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestDiffScreen(t *testing.T) {
+	cases := []struct {
+		name string
+		prev string
+		next string
+	}{
+		{"changed line", "a\nb\nc", "a\nB\nc"},
+		{"added lines", "a", "a\n\nb"},
+		{"removed lines", "a\nb\nc", "a"},
+		{"from empty", "", "a\nb"},
+		{"to empty", "a\nb", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			require.Equal(t, c.next, applyScreenDiff(c.prev, diffScreen(c.prev, c.next)))
+		})
+	}
+
+	diff := diffScreen("a\nb\nc", "a\nB\nc\n\nd")
+	require.Equal(t, ScreenDiffBody{Lines: 5, Changes: []ScreenLineChange{{Line: 1, Text: "B"}, {Line: 4, Text: "d"}}}, diff)
+}
+
+func TestScreenStream(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	lines := make([]string, 40)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("line %d of the agent's terminal screen", i)
+	}
+	// Screens that mostly change a line or two, like a terminal agent's.
+	screens := make([]string, 200)
+	for i := range screens {
+		switch rnd.Intn(10) {
+		case 0:
+			lines = lines[:rnd.Intn(len(lines))+1]
+		case 1:
+			lines = append(lines, "", fmt.Sprintf("new line %d", i))
+		default:
+			lines[rnd.Intn(len(lines))] = fmt.Sprintf("changed line %d", i)
+		}
+		screens[i] = strings.Join(lines, "\n")
+	}
+
+	stream := screenStream{diffs: true}
+	client := ""
+	frames, diffs := 0, 0
+	for i, screen := range screens {
+		switch payload := stream.next(ScreenUpdateBody{Screen: screen}).(type) {
+		case ScreenUpdateBody:
+			frames++
+			client = payload.Screen
+		case ScreenDiffBody:
+			require.NotZero(t, i, "the first update is a full frame")
+			diffs++
+			client = applyScreenDiff(client, payload)
+		}
+		require.Equal(t, screen, client, "update %d", i)
+	}
+	require.Greater(t, diffs, frames)
+	// Full frames are sent periodically to resync.
+	require.GreaterOrEqual(t, frames, len(screens)/(screenDiffsPerFrame+1))
+
+	// Without diffs, every update is a full frame.
+	stream = screenStream{}
+	for _, screen := range screens[:3] {
+		require.Equal(t, ScreenUpdateBody{Screen: screen}, stream.next(ScreenUpdateBody{Screen: screen}))
+	}
+}
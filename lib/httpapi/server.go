@@ -5,47 +5,147 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 
 	"github.com/coder/agentapi/internal/version"
 	"github.com/coder/agentapi/lib/logctx"
 	mf "github.com/coder/agentapi/lib/msgfmt"
+	"github.com/coder/agentapi/lib/redact"
 	st "github.com/coder/agentapi/lib/screentracker"
-	"github.com/coder/agentapi/lib/termexec"
 	"github.com/danielgtaylor/huma/v2"
 	"github.com/danielgtaylor/huma/v2/adapters/humachi"
 	"github.com/danielgtaylor/huma/v2/sse"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
 	"golang.org/x/xerrors"
+	"google.golang.org/grpc"
 )
 
 // Server represents the HTTP server
 type Server struct {
-	router       chi.Router
-	api          huma.API
-	port         int
-	srv          *http.Server
-	mu           sync.RWMutex
+	router chi.Router
+	api    huma.API
+	port   int
+	srv    *http.Server
+	// mu serializes operations that write to the agent's terminal.
+	mu           sync.Mutex
 	logger       *slog.Logger
 	conversation *st.Conversation
-	agentio      *termexec.Process
+	agentio      st.AgentIO
 	agentType    mf.AgentType
 	emitter      *EventEmitter
 	chatBasePath string
-	tempDir      string
+	// allowedOrigins are the parsed allowed origins, or "*" for all.
+	allowedOrigins []string
+	tempDir        string
+	promptPrefix   string
+	promptSuffix   string
+	hooks          Hooks
+	rawInput       *rawInputFilter
+	// redactor redacts the screens sent to clients. The conversation redacts
+	// the messages.
+	redactor *redact.Redactor
+	// allowMessageInjection allows POST /message to append agent and system
+	// messages to the conversation history.
+	allowMessageInjection bool
+	// continuePhrase is sent by POST /continue. Empty to press Enter.
+	continuePhrase string
+	// disableScreen stops the agent's screen from being exposed.
+	disableScreen bool
+	// rawWriteTimeout bounds writes of raw messages. pendingRawWrite is closed
+	// once a write that exceeded the timeout completes. Both are protected by mu.
+	rawWriteTimeout time.Duration
+	pendingRawWrite chan struct{}
+	// stuckStatusTimeout is how long writing a message may take before it's
+	// abandoned and the status is reset. Zero disables the watchdog.
+	stuckStatusTimeout time.Duration
+	// heartbeatInterval is how often heartbeat events are sent to event
+	// subscribers. Zero disables them.
+	heartbeatInterval time.Duration
+	// maxEventsDuration is how long /events streams stay open. Zero means
+	// forever.
+	maxEventsDuration time.Duration
+	// probeTimeout is how long GET /ping and GET /health wait for the agent
+	// by default. probe runs their checks.
+	probeTimeout time.Duration
+	probe        agentProbe
+	// streamsCtx is canceled by Stop to end the event streams of GET /events,
+	// GET /screen and the Events RPC, which would otherwise keep the HTTP and
+	// gRPC servers from shutting down.
+	streamsCtx  context.Context
+	stopStreams context.CancelFunc
+	// tailCtx is canceled by Stop to close the connections of GET /tail.
+	// It's nil unless the endpoint is enabled.
+	tailCtx   context.Context
+	stopTails context.CancelFunc
+	// slowSendThreshold is how long sending an event may take before it
+	// counts as slow. Zero disables the check.
+	slowSendThreshold time.Duration
+	// backpressureDisconnects counts the event subscribers disconnected
+	// because they couldn't keep up with the events.
+	backpressureDisconnects atomic.Int64
+	// hang is nil unless the hang watchdog is enabled.
+	hang        *hangWatchdog
+	audit       *auditLog
+	idempotency *idempotencyCache
+	meta        *conversationMeta
+	annotations *messageAnnotations
+	// pacer is nil unless user messages must be some time apart.
+	pacer *messagePacer
+	// webhook is nil unless events are forwarded to a webhook.
+	webhook *webhook
+	// permissions is nil unless permission prompts are detected.
+	permissions *permissionPrompts
+	// filesRoot is nil unless files may be attached to messages by path.
+	filesRoot *filesRoot
+	// messagePreviewLength is the number of characters GET /messages
+	// truncates message contents to by default. Zero disables truncation.
+	messagePreviewLength int
+	// capabilities are the features supported for the agent, as returned by
+	// GET /capabilities.
+	capabilities Capabilities
+	// agentIOLog records writes to the agent's terminal. Nil unless enabled.
+	agentIOLog *agentIOLog
+	// grpcServer serves the gRPC interface once ServeGRPC is called.
+	grpcServer *grpc.Server
+	// stderr exposes the agent's stderr. Nil unless enabled.
+	stderr stderrReader
+	// sendSlots limits the number of user messages that are being sent to
+	// the agent or waiting for mu. Every send holds one slot.
+	sendSlots chan struct{}
+	// stats are updated by the snapshot loop.
+	stats conversationStats
+	// lastReceivedMessageId is the id of the last agent message passed to
+	// Hooks.AfterReceive. It's moved back when a reply is regenerated.
+	lastReceivedMessageId atomic.Int64
+	// lastUserMessage is the last user message sent by sendUserMessage, as
+	// it was before Hooks.BeforeSend, so that regenerating a reply runs the
+	// hook again.
+	lastUserMessage atomic.Pointer[userMessage]
+	// typing detects whether the agent is producing output. Only accessed by
+	// the snapshot loop.
+	typing typingDetector
+	// stopSnapshotLoop cancels the context of the snapshot loops started by
+	// StartSnapshotLoop. snapshotLoopDone is closed once the server's loop exits.
+	stopSnapshotLoop context.CancelFunc
+	snapshotLoopDone chan struct{}
 }
 
 func (s *Server) NormalizeSchema(schema any) any {
@@ -94,14 +194,165 @@ func (s *Server) GetOpenAPI() string {
 // because the action of taking a snapshot takes time too.
 const snapshotInterval = 25 * time.Millisecond
 
+// typingIdleAfter is how long the agent's screen must stay unchanged before
+// a typing_stop event is sent.
+const typingIdleAfter = 500 * time.Millisecond
+
 type ServerConfig struct {
 	AgentType      mf.AgentType
-	Process        *termexec.Process
+	Process        st.AgentIO
 	Port           int
 	ChatBasePath   string
 	AllowedHosts   []string
 	AllowedOrigins []string
+	// TrustedProxies are the CIDR ranges of the reverse proxies in front of
+	// the server. The client IP of requests from them is taken from
+	// X-Forwarded-For. Other requests' X-Forwarded-For headers are ignored.
+	TrustedProxies []string
 	InitialPrompt  string
+	// PromptPrefix and PromptSuffix are added to every user message sent to the agent.
+	// They are not recorded in the conversation history.
+	PromptPrefix string
+	PromptSuffix string
+	// RedactSecrets enables redaction of common secret formats in messages
+	// and the agent's screen. RedactPatterns are additional regular
+	// expressions to redact.
+	RedactSecrets  bool
+	RedactPatterns []string
+	// RawInputAllow and RawInputDeny are regular expressions that restrict the
+	// content of raw messages. If RawInputAllow is set, raw messages must consist
+	// solely of sequences matching its patterns. Raw messages containing a match
+	// of any RawInputDeny pattern are rejected.
+	RawInputAllow []string
+	RawInputDeny  []string
+	// ReadyPattern and IdlePattern, if set, are regular expressions that
+	// match the agent's screen once it accepts input and while it waits for
+	// input. ReadyPattern replaces the agent's own readiness detection. With
+	// IdlePattern, the agent is only stable once its screen matches.
+	ReadyPattern string
+	IdlePattern  string
+	// PermissionPattern, if set, is a regular expression that matches the
+	// prompts in which the agent asks for permission, e.g. to run a tool.
+	// Its "tool" and "action" groups, if any, are sent to clients with the
+	// prompt. Clients answer prompts with POST /permissions/{id}, which sends
+	// PermissionApproveKeys or PermissionDenyKeys to the agent. They default
+	// to Enter and Escape.
+	PermissionPattern     string
+	PermissionApproveKeys string
+	PermissionDenyKeys    string
+	// AllowMessageInjection allows clients to append agent and system messages
+	// to the conversation history without sending them to the agent.
+	AllowMessageInjection bool
+	// BusyPolicy is what happens to user messages sent while the agent isn't
+	// waiting for input. Defaults to BusyPolicyReject.
+	BusyPolicy BusyPolicy
+	// ContinuePhrase is the user message sent by POST /continue to let the
+	// agent go on. If empty, POST /continue presses Enter instead.
+	ContinuePhrase string
+	// RawWriteTimeout is how long a raw message may take to be written to the
+	// agent's terminal before POST /message gives up with 503. Defaults to
+	// defaultRawWriteTimeout.
+	RawWriteTimeout time.Duration
+	// CORSMaxAge is how long browsers may cache the results of CORS preflight
+	// requests. Defaults to defaultCORSMaxAge. A negative value disables caching.
+	CORSMaxAge time.Duration
+	// MaxConcurrentSends is how many user messages may be sent or waiting to
+	// be sent to the agent at the same time. Further messages are rejected
+	// with 429. Defaults to 1.
+	MaxConcurrentSends int
+	// StuckStatusTimeout is how long writing a message to the agent may take
+	// before the write is abandoned and the status is reset to stable.
+	// Defaults to defaultStuckStatusTimeout. A negative value disables the
+	// reset.
+	StuckStatusTimeout time.Duration
+	// FilesRoot, if set, allows POST /message to reference files by their
+	// path on the server. The files must be inside this directory.
+	FilesRoot string
+	// ExtractDiffs adds the file diffs the agent prints in its messages to
+	// GET /messages, for agents whose diffs are recognized.
+	ExtractDiffs bool
+	// ExtractCommands adds the shell commands the agent runs to GET
+	// /messages, for agents whose command runs are recognized.
+	ExtractCommands bool
+	// DebugRawScreen adds the screen every agent message was parsed from to
+	// GET /messages. It can't be combined with DisableScreen.
+	DebugRawScreen bool
+	// KeepInvalidUTF8 adds the original bytes of agent messages that aren't
+	// valid UTF-8 to GET /messages and message_update events, base64 encoded.
+	// The content of messages always has invalid UTF-8 replaced with U+FFFD.
+	KeepInvalidUTF8 bool
+	// HangTimeout, if set, enables the hang watchdog: when the status has
+	// been changing for this long without the agent's screen changing,
+	// HangAction is applied to the agent. It defaults to HangActionInterrupt.
+	// Process must implement Signal.
+	HangTimeout time.Duration
+	HangAction  HangAction
+	// HeartbeatInterval, if set, is how often heartbeat events are sent to
+	// the subscribers of /events.
+	HeartbeatInterval time.Duration
+	// MaxEventsDuration, if set, is how long an /events stream stays open.
+	// The server then sends a reconnect event and closes it.
+	MaxEventsDuration time.Duration
+	// EnableTail serves GET /tail, a WebSocket that streams the conversation
+	// as plain text lines.
+	EnableTail bool
+	// ProbeTimeout is how long GET /ping, unless the request sets its own
+	// timeout, and GET /health wait for the agent before reporting it as
+	// unresponsive. Defaults to defaultProbeTimeout.
+	ProbeTimeout time.Duration
+	// SlowSendThreshold, if set, is how long sending an event to a subscriber
+	// of /events may take before it counts as slow. Subscribers whose events
+	// are sent slowly several times in a row are disconnected.
+	SlowSendThreshold time.Duration
+	// PreserveANSI keeps ANSI escape sequences and control characters in
+	// agent messages. By default, they're removed.
+	PreserveANSI bool
+	// Trim, if set, replaces the agent's rules for cleaning up its messages.
+	Trim *mf.TrimOptions
+	// Greeting, if set, is shown as the first agent message of the conversation.
+	Greeting string
+	// Provider and Model, if set, name the model the agent is configured to
+	// use. The server can't tell which model the agent uses, so they're
+	// only labels: they're added to the agent's messages for auditing.
+	Provider string
+	Model    string
+	// MessagePreviewLength, if set, is the number of characters that GET
+	// /messages and GET /messages/{id} truncate message contents to, for
+	// previews of long messages. Requests can choose another length, and GET
+	// /messages/{id}?full=true returns the full content.
+	MessagePreviewLength int
+	// DisableScreen removes the /internal/screen endpoint and stops sending
+	// the contents of the agent's terminal screen to subscribers.
+	DisableScreen bool
+	// AuditLogger receives an entry for every POST /message request, its
+	// outcome and the agent's reply. Defaults to the server's logger.
+	// AuditLogContent adds the content of the messages to the entries.
+	AuditLogger     *slog.Logger
+	AuditLogContent bool
+	// Meta is the initial key/value metadata attached to the conversation.
+	// It's returned by GET /meta and added to the audit log entries.
+	Meta map[string]string
+	// DebugAgentIO keeps the last writes to the agent's terminal and exposes
+	// them at GET /internal/agent-io. The writes may contain sensitive content.
+	DebugAgentIO bool
+	// DebugStderr exposes the end of the agent's stderr at GET
+	// /internal/stderr. Process must implement Stderr and have been started
+	// with its stderr captured.
+	DebugStderr bool
+	// MinMessageInterval, if set, is the minimum time between the user
+	// messages accepted by POST /message, e.g. to reject double submissions.
+	// Messages sent sooner are rejected with 429 and a Retry-After header.
+	// Messages of a batch aren't paced.
+	MinMessageInterval time.Duration
+	// WebhookURL, if set, receives a POST request with the event whenever
+	// the agent becomes stable or a message is complete. WebhookSecret, if
+	// set, signs the requests with an HMAC-SHA256 of their body in the
+	// X-AgentAPI-Signature header.
+	WebhookURL    string
+	WebhookSecret string
+	// Hooks are called around every message exchanged with the agent.
+	// Defaults to NoopHooks.
+	Hooks Hooks
 }
 
 // Validate allowed hosts don't contain whitespace, commas, schemes, or ports.
@@ -188,6 +439,19 @@ func parseAllowedOrigins(input []string) ([]string, error) {
 	return origins, nil
 }
 
+// corsAllowedMethods must include the method of every registered route.
+var corsAllowedMethods = []string{
+	http.MethodGet,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodOptions,
+}
+
+// defaultCORSMaxAge is the maximum value not ignored by any of the major browsers.
+const defaultCORSMaxAge = 5 * time.Minute
+
 // NewServer creates a new server instance
 func NewServer(ctx context.Context, config ServerConfig) (*Server, error) {
 	router := chi.NewMux()
@@ -205,6 +469,14 @@ func NewServer(ctx context.Context, config ServerConfig) (*Server, error) {
 
 	logger.Info(fmt.Sprintf("Allowed hosts: %s", strings.Join(allowedHosts, ", ")))
 	logger.Info(fmt.Sprintf("Allowed origins: %s", strings.Join(allowedOrigins, ", ")))
+	trustedProxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to parse trusted proxies: %w", err)
+	}
+	if len(trustedProxies) > 0 {
+		logger.Info(fmt.Sprintf("Trusted proxies: %s", strings.Join(config.TrustedProxies, ", ")))
+	}
+	router.Use(clientIPMiddleware(trustedProxies))
 
 	// Enforce allowed hosts in a custom middleware that ignores the port during matching.
 	badHostHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -212,37 +484,155 @@ func NewServer(ctx context.Context, config ServerConfig) (*Server, error) {
 	})
 	router.Use(hostAuthorizationMiddleware(allowedHosts, badHostHandler))
 
+	corsMaxAge := config.CORSMaxAge
+	if corsMaxAge == 0 {
+		corsMaxAge = defaultCORSMaxAge
+	}
 	corsMiddleware := cors.New(cors.Options{
 		AllowedOrigins:   allowedOrigins,
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedMethods:   corsAllowedMethods,
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "Idempotency-Key", "X-CSRF-Token", "X-Request-Id"},
+		ExposedHeaders:   []string{"Link", "Retry-After", "X-Request-Id"},
 		AllowCredentials: true,
-		MaxAge:           300, // Maximum value not ignored by any of major browsers
+		// A negative max age disables the cache: the middleware only sends
+		// the header for positive values.
+		MaxAge: int(corsMaxAge.Seconds()),
 	})
 	router.Use(corsMiddleware.Handler)
 
 	humaConfig := huma.DefaultConfig("AgentAPI", version.Version)
 	humaConfig.Info.Description = "HTTP API for Claude Code, Goose, and Aider.\n\nhttps://github.com/coder/agentapi"
+	humaConfig.Tags = []*huma.Tag{
+		{Name: tagConversation, Description: "Messages exchanged with the agent and events about them."},
+		{Name: tagAgent, Description: "The agent's status and terminal."},
+		{Name: tagFiles, Description: "Files shared with the agent."},
+	}
 	api := humachi.New(router, humaConfig)
 	formatMessage := func(message string, userInput string) string {
-		return mf.FormatAgentMessage(config.AgentType, message, userInput)
+		if !config.PreserveANSI {
+			message = mf.StripANSI(message)
+		}
+		return mf.FormatAgentMessageWithTrim(config.AgentType, message, userInput, config.Trim)
+	}
+
+	redactor, err := redact.New(config.RedactPatterns, config.RedactSecrets)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create redactor: %w", err)
+	}
+	rawInput, err := newRawInputFilter(config.RawInputAllow, config.RawInputDeny)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create raw input filter: %w", err)
+	}
+	if config.DebugRawScreen && config.DisableScreen {
+		return nil, xerrors.New("the raw screens of messages can't be returned when the screen is disabled")
+	}
+	permissions, err := newPermissionPrompts(config.PermissionPattern, config.PermissionApproveKeys, config.PermissionDenyKeys)
+	if err != nil {
+		return nil, err
+	}
+	webhook, err := newWebhook(config.WebhookURL, config.WebhookSecret)
+	if err != nil {
+		return nil, err
+	}
+	hang, err := newHangWatchdog(config.HangTimeout, config.HangAction, config.Process)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to create hang watchdog: %w", err)
+	}
+	var stderr stderrReader
+	if config.DebugStderr {
+		stderr, err = newStderrSource(config.Process)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var files *filesRoot
+	if config.FilesRoot != "" {
+		files, err = newFilesRoot(config.FilesRoot)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var redactMessage func(message string) string
+	if redactor.Enabled() {
+		redactMessage = redactor.Redact
+	}
+
+	var extractDiffs func(message string) []mf.FileDiff
+	if config.ExtractDiffs {
+		extractDiffs = func(message string) []mf.FileDiff {
+			return mf.ExtractAgentDiffs(config.AgentType, message)
+		}
+	}
+
+	var extractCommands func(message string) []mf.CommandRun
+	if config.ExtractCommands {
+		extractCommands = func(message string) []mf.CommandRun {
+			return mf.ExtractAgentCommands(config.AgentType, message)
+		}
+	}
+
+	busyPolicy := config.BusyPolicy
+	switch busyPolicy {
+	case "":
+		busyPolicy = BusyPolicyReject
+	case BusyPolicyReject, BusyPolicyForce:
+	default:
+		return nil, xerrors.Errorf("unknown busy policy %q (valid policies: %s, %s)", busyPolicy, BusyPolicyReject, BusyPolicyForce)
 	}
 
 	isAgentReadyForInitialPrompt := func(message string) bool {
 		return mf.IsAgentReadyForInitialPrompt(config.AgentType, message)
 	}
+	if config.ReadyPattern != "" {
+		readyPattern, err := regexp.Compile(config.ReadyPattern)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid ready pattern: %w", err)
+		}
+		isAgentReadyForInitialPrompt = readyPattern.MatchString
+	}
+	// isAgentIdle stays nil without an idle pattern: the agent is stable
+	// once its screen stops changing.
+	var isAgentIdle func(screen string) bool
+	if config.IdlePattern != "" {
+		idlePattern, err := regexp.Compile(config.IdlePattern)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid idle pattern: %w", err)
+		}
+		isAgentIdle = idlePattern.MatchString
+	}
+
+	// The conversation gets a wrapped AgentIO so that its writes are
+	// recorded, but the server keeps the process itself because it checks
+	// for optional interfaces on it.
+	var ioLog *agentIOLog
+	conversationIO := config.Process
+	if config.DebugAgentIO {
+		ioLog = &agentIOLog{}
+		conversationIO = &loggedAgentIO{AgentIO: config.Process, log: ioLog}
+	}
 
 	conversation := st.NewConversation(ctx, st.ConversationConfig{
 		AgentType: config.AgentType,
-		AgentIO:   config.Process,
+		AgentIO:   conversationIO,
 		GetTime: func() time.Time {
 			return time.Now()
 		},
 		SnapshotInterval:      snapshotInterval,
 		ScreenStabilityLength: 2 * time.Second,
 		FormatMessage:         formatMessage,
+		RedactMessage:         redactMessage,
+		ExtractDiffs:          extractDiffs,
+		ExtractCommands:       extractCommands,
+		KeepRawScreen:         config.DebugRawScreen,
+		KeepInvalidUTF8:       config.KeepInvalidUTF8,
 		ReadyForInitialPrompt: isAgentReadyForInitialPrompt,
+		IsIdle:                isAgentIdle,
+		Greeting:              mf.TrimWhitespace(config.Greeting),
+		Provider:              config.Provider,
+		Model:                 config.Model,
+		// Raw messages are never checked: they're keystrokes, which are also
+		// meant for a busy agent, e.g. to interrupt it or answer its prompts.
+		SkipSendMessageStatusCheck: busyPolicy == BusyPolicyForce,
 	}, config.InitialPrompt)
 	emitter := NewEventEmitter(1024)
 
@@ -253,17 +643,83 @@ func NewServer(ctx context.Context, config ServerConfig) (*Server, error) {
 	}
 	logger.Info("Created temporary directory for uploads", "tempDir", tempDir)
 
+	hooks := config.Hooks
+	if hooks == nil {
+		hooks = NoopHooks{}
+	}
+
+	rawWriteTimeout := config.RawWriteTimeout
+	if rawWriteTimeout == 0 {
+		rawWriteTimeout = defaultRawWriteTimeout
+	}
+	maxConcurrentSends := config.MaxConcurrentSends
+	if maxConcurrentSends <= 0 {
+		maxConcurrentSends = 1
+	}
+
+	auditLogger := config.AuditLogger
+	if auditLogger == nil {
+		auditLogger = logger
+	}
+
+	stuckStatusTimeout := config.StuckStatusTimeout
+	if stuckStatusTimeout == 0 {
+		stuckStatusTimeout = defaultStuckStatusTimeout
+	} else if stuckStatusTimeout < 0 {
+		stuckStatusTimeout = 0
+	}
+
+	meta := &conversationMeta{}
+	meta.set(config.Meta)
+
 	s := &Server{
-		router:       router,
-		api:          api,
-		port:         config.Port,
-		conversation: conversation,
-		logger:       logger,
-		agentio:      config.Process,
-		agentType:    config.AgentType,
-		emitter:      emitter,
-		chatBasePath: strings.TrimSuffix(config.ChatBasePath, "/"),
-		tempDir:      tempDir,
+		router:         router,
+		api:            api,
+		port:           config.Port,
+		conversation:   conversation,
+		logger:         logger,
+		agentio:        config.Process,
+		agentType:      config.AgentType,
+		emitter:        emitter,
+		chatBasePath:   strings.TrimSuffix(config.ChatBasePath, "/"),
+		allowedOrigins: allowedOrigins,
+		tempDir:        tempDir,
+		promptPrefix:   config.PromptPrefix,
+		promptSuffix:   config.PromptSuffix,
+		hooks:          hooks,
+		rawInput:       rawInput,
+		redactor:       redactor,
+
+		allowMessageInjection: config.AllowMessageInjection,
+		continuePhrase:        config.ContinuePhrase,
+		disableScreen:         config.DisableScreen,
+		rawWriteTimeout:       rawWriteTimeout,
+		stuckStatusTimeout:    stuckStatusTimeout,
+		hang:                  hang,
+		heartbeatInterval:     config.HeartbeatInterval,
+		maxEventsDuration:     config.MaxEventsDuration,
+		slowSendThreshold:     config.SlowSendThreshold,
+		probeTimeout:          config.ProbeTimeout,
+		sendSlots:             make(chan struct{}, maxConcurrentSends),
+		audit:                 &auditLog{logger: auditLogger, logContent: config.AuditLogContent, meta: meta},
+		meta:                  meta,
+		annotations:           &messageAnnotations{},
+		permissions:           permissions,
+		webhook:               webhook,
+		pacer:                 newMessagePacer(config.MinMessageInterval),
+		filesRoot:             files,
+		messagePreviewLength:  max(config.MessagePreviewLength, 0),
+		capabilities:          agentCapabilities(config),
+		idempotency:           newIdempotencyCache(idempotencyKeyTTL, maxIdempotencyKeys, time.Now),
+		agentIOLog:            ioLog,
+		stderr:                stderr,
+		typing:                typingDetector{idleAfter: typingIdleAfter},
+	}
+	s.lastReceivedMessageId.Store(-1)
+	s.grpcServer = newGRPCServer(s)
+	s.streamsCtx, s.stopStreams = context.WithCancel(context.Background())
+	if config.EnableTail {
+		s.tailCtx, s.stopTails = context.WithCancel(context.Background())
 	}
 
 	// Register API routes
@@ -324,16 +780,38 @@ func sseMiddleware(ctx huma.Context, next func(huma.Context)) {
 	next(ctx)
 }
 
+// StartSnapshotLoop starts the loops that track the agent's screen and emit
+// events to subscribers. The loops run until ctx is cancelled or Stop is called.
 func (s *Server) StartSnapshotLoop(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	s.stopSnapshotLoop = cancel
+	s.snapshotLoopDone = make(chan struct{})
 	s.conversation.StartSnapshotLoop(ctx)
+	if s.stuckStatusTimeout > 0 {
+		go s.runStatusWatchdog(ctx)
+	}
+	if s.hang != nil {
+		go s.runHangWatchdog(ctx)
+	}
+	if s.webhook != nil {
+		go s.runWebhook(ctx)
+	}
 	go func() {
+		defer close(s.snapshotLoopDone)
+		// The messages are only copied and compared again once they or the
+		// status changed since they were last emitted. The status matters
+		// because it determines whether the last message is complete.
+		var emittedVersion uint64
+		var emittedStatus AgentStatus
+		emitted := false
 		for {
 			currentStatus := s.conversation.Status()
+			s.runAfterReceiveHook(currentStatus)
 
 			// Send initial prompt when agent becomes stable for the first time
 			if !s.conversation.InitialPromptSent && convertStatus(currentStatus) == AgentStatusStable {
 
-				if err := s.conversation.SendMessage(FormatMessage(s.agentType, s.conversation.InitialPrompt)...); err != nil {
+				if err := s.sendUserMessage(s.conversation.InitialPrompt, false); err != nil {
 					s.logger.Error("Failed to send initial prompt", "error", err)
 				} else {
 					s.conversation.InitialPromptSent = true
@@ -342,59 +820,410 @@ func (s *Server) StartSnapshotLoop(ctx context.Context) {
 					s.logger.Info("Initial prompt sent successfully")
 				}
 			}
-			s.emitter.UpdateStatusAndEmitChanges(currentStatus, s.agentType)
-			s.emitter.UpdateMessagesAndEmitChanges(s.conversation.Messages())
-			s.emitter.UpdateScreenAndEmitChanges(s.conversation.Screen())
-			time.Sleep(snapshotInterval)
+			version := s.conversation.MessagesVersion()
+			if status := convertStatus(currentStatus); !emitted || version != emittedVersion || status != emittedStatus {
+				// The messages and the status are read and emitted together,
+				// so that the status always belongs to the messages.
+				messages, conversationStatus := s.conversation.State()
+				s.emitter.UpdateStateAndEmitChanges(conversationStatus, s.agentType, messages)
+				status = convertStatus(conversationStatus)
+				s.stats.update(messages, status)
+				emittedVersion, emittedStatus, emitted = version, status, true
+			}
+			screen := s.conversation.Screen()
+			if !s.disableScreen {
+				s.emitter.UpdateScreenAndEmitChanges(s.redactor.Redact(screen))
+			}
+			s.emitter.UpdateTypingAndEmitChanges(s.typing.update(screen, time.Now()))
+			s.updatePermissions(screen)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(snapshotInterval):
+			}
 		}
 	}()
 }
 
-// registerRoutes sets up all API endpoints
+// waitForStableStatus blocks until the agent is stable or ctx is done.
+func (s *Server) waitForStableStatus(ctx context.Context) error {
+	for {
+		if s.conversation.Status() == st.ConversationStatusStable {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(snapshotInterval):
+		}
+	}
+}
+
+// WaitUntilReady blocks until the agent is ready for input or ctx is done. The
+// snapshot loop must be running.
+func (s *Server) WaitUntilReady(ctx context.Context) error {
+	return s.waitForStableStatus(ctx)
+}
+
+// RunOneShot waits for the agent to be ready, sends it a single user message and
+// returns the agent's reply once the agent is stable again. The snapshot loop
+// must be running.
+func (s *Server) RunOneShot(ctx context.Context, prompt string) (string, error) {
+	if err := s.waitForStableStatus(ctx); err != nil {
+		return "", xerrors.Errorf("failed to wait for the agent to be ready: %w", err)
+	}
+
+	s.mu.Lock()
+	err := s.sendUserMessage(prompt, false)
+	s.mu.Unlock()
+	if err != nil {
+		return "", xerrors.Errorf("failed to send message: %w", err)
+	}
+
+	if err := s.waitForStableStatus(ctx); err != nil {
+		return "", xerrors.Errorf("failed to wait for the agent to reply: %w", err)
+	}
+	messages := s.conversation.Messages()
+	reply := messages[len(messages)-1]
+	if reply.Role != st.ConversationRoleAgent {
+		return "", xerrors.Errorf("agent did not reply")
+	}
+	return reply.Message, nil
+}
+
+// runAfterReceiveHook passes the last agent message to Hooks.AfterReceive once
+// the agent is done writing it.
+func (s *Server) runAfterReceiveHook(status st.ConversationStatus) {
+	if status != st.ConversationStatusStable {
+		return
+	}
+	messages := s.conversation.Messages()
+	if len(messages) == 0 {
+		return
+	}
+	last := messages[len(messages)-1]
+	// It's also run by sendUserMessage, so the id is swapped to pass each
+	// message on once.
+	lastReceived := s.lastReceivedMessageId.Load()
+	if last.Role != st.ConversationRoleAgent || int64(last.Id) <= lastReceived ||
+		!s.lastReceivedMessageId.CompareAndSwap(lastReceived, int64(last.Id)) {
+		return
+	}
+	s.audit.received(last)
+	if err := s.hooks.AfterReceive(last); err != nil {
+		s.logger.Error("AfterReceive hook failed", "messageId", last.Id, "error", err)
+	}
+}
+
+// BusyPolicy is what the server does with a message sent while the agent
+// isn't waiting for input.
+type BusyPolicy string
+
+const (
+	// BusyPolicyReject rejects the message with 409, so that it doesn't
+	// interfere with what the agent is doing.
+	BusyPolicyReject BusyPolicy = "reject"
+	// BusyPolicyForce sends the message anyway. The agent may mix it up
+	// with its current task.
+	BusyPolicyForce BusyPolicy = "force"
+)
+
+// errAgentBusy is returned for messages rejected by BusyPolicyReject.
+var errAgentBusy = xerrors.New("the agent is busy, messages can only be sent when it's waiting for input")
+
+// errMessageRejected wraps errors returned by Hooks.BeforeSend.
+var errMessageRejected = xerrors.New("message rejected")
+
+// sendUserMessage runs the BeforeSend hook and sends the resulting message to
+// the agent. If rawFormat is true, the message is sent verbatim instead of being
+// formatted for the agent. The caller must hold s.mu if the server is handling
+// requests.
+func (s *Server) sendUserMessage(content string, rawFormat bool) error {
+	parts, err := s.userMessageParts(content, rawFormat)
+	if err != nil {
+		return err
+	}
+	// The snapshot loop may not have seen the agent's last message complete
+	// yet. It's passed on here, so that AfterReceive gets it before the
+	// reply to this message.
+	s.runAfterReceiveHook(s.conversation.Status())
+	if err := s.conversation.SendMessage(parts...); err != nil {
+		return err
+	}
+	s.lastUserMessage.Store(&userMessage{content: content, rawFormat: rawFormat})
+	return nil
+}
+
+// userMessage is a user message as it was passed to sendUserMessage.
+type userMessage struct {
+	content   string
+	rawFormat bool
+}
+
+// userMessageParts runs the BeforeSend hook and formats the resulting message
+// for the agent.
+func (s *Server) userMessageParts(content string, rawFormat bool) ([]st.MessagePart, error) {
+	content, err := s.hooks.BeforeSend(content)
+	if err != nil {
+		return nil, xerrors.Errorf("%w: %s", errMessageRejected, err)
+	}
+	if rawFormat {
+		return FormatRawMessage(content), nil
+	}
+	return s.formatUserMessage(content), nil
+}
+
+// formatUserMessage formats a user message for the agent, applying the configured
+// prompt prefix and suffix.
+func (s *Server) formatUserMessage(message string) []st.MessagePart {
+	return FormatMessage(s.agentType, message, s.promptPrefix, s.promptSuffix)
+}
+
+// OpenAPI tags that group the endpoints in generated clients.
+const (
+	tagConversation = "Conversation"
+	tagAgent        = "Agent"
+	tagFiles        = "Files"
+)
+
+// registerRoutes sets up all API endpoints. Every endpoint has an explicit
+// operation ID so that the method names of generated clients stay stable.
 func (s *Server) registerRoutes() {
 	// GET /status endpoint
 	huma.Get(s.api, "/status", s.getStatus, func(o *huma.Operation) {
+		o.OperationID = "getStatus"
+		o.Tags = []string{tagAgent}
 		o.Description = "Returns the current status of the agent."
 	})
 
+	// GET /capabilities endpoint
+	huma.Get(s.api, "/capabilities", s.getCapabilities, func(o *huma.Operation) {
+		o.OperationID = "getCapabilities"
+		o.Tags = []string{tagAgent}
+		o.Description = "Returns the features the server supports for the agent, e.g. whether its terminal screen is exposed or its permission prompts can be answered. They're derived from the agent type and the server's configuration and don't change while the server runs, so that clients can adapt their UI to the agent instead of guessing from its type."
+	})
+
+	// GET /snapshot endpoint
+	huma.Get(s.api, "/snapshot", s.getSnapshot, func(o *huma.Operation) {
+		o.OperationID = "getSnapshot"
+		o.Tags = []string{tagConversation}
+		o.Description = "Returns the messages of the conversation and the agent's status, read at the same point in time. Fetching GET /messages and GET /status separately may return a status that doesn't match the messages, e.g. if the agent replies in between."
+	})
+
 	// GET /messages endpoint
 	huma.Get(s.api, "/messages", s.getMessages, func(o *huma.Operation) {
+		o.OperationID = "getMessages"
+		o.Tags = []string{tagConversation}
 		o.Description = "Returns a list of messages representing the conversation history with the agent."
 	})
 
+	// GET /messages/{id} endpoint
+	huma.Get(s.api, "/messages/{id}", s.getMessage, func(o *huma.Operation) {
+		o.OperationID = "getMessage"
+		o.Tags = []string{tagConversation}
+		o.Description = "Returns a message of the conversation history, e.g. the full content of a message that GET /messages truncated. The content is truncated like by GET /messages if the server runs with --message-preview-length, unless full is set. Returns 404 if the message doesn't exist."
+	})
+
+	// GET /messages/text endpoint
+	huma.Get(s.api, "/messages/text", s.getMessagesText, func(o *huma.Operation) {
+		o.OperationID = "getMessagesText"
+		o.Tags = []string{tagConversation}
+		o.Description = "Returns the conversation history as plain text for display in a terminal. GET /messages returns the unmodified content."
+		o.Responses = map[string]*huma.Response{
+			"200": {
+				Description: "The conversation history as plain text.",
+				Content: map[string]*huma.MediaType{
+					"text/plain": {Schema: &huma.Schema{Type: "string"}},
+				},
+			},
+		}
+	})
+
+	// GET /messages/export endpoint
+	huma.Get(s.api, "/messages/export", s.exportMessages, func(o *huma.Operation) {
+		o.OperationID = "exportMessages"
+		o.Tags = []string{tagConversation}
+		o.Description = "Returns the conversation history as a transcript file for sharing, e.g. a standalone HTML page with the messages' roles and timestamps and their markdown rendered. It contains the messages returned by GET /messages."
+		o.Responses = map[string]*huma.Response{
+			"200": {
+				Description: "The transcript.",
+				Content: map[string]*huma.MediaType{
+					"text/html": {Schema: &huma.Schema{Type: "string"}},
+				},
+			},
+		}
+	})
+
+	// GET /messages/{id}/annotations endpoint
+	huma.Get(s.api, "/messages/{id}/annotations", s.getAnnotations, func(o *huma.Operation) {
+		o.OperationID = "getAnnotations"
+		o.Tags = []string{tagConversation}
+		o.Description = "Returns the annotations attached to a message. They're also returned with the message by GET /messages. Returns 404 if the message doesn't exist."
+	})
+
+	// POST /messages/{id}/annotations endpoint
+	huma.Post(s.api, "/messages/{id}/annotations", s.addAnnotation, func(o *huma.Operation) {
+		o.OperationID = "addAnnotation"
+		o.Tags = []string{tagConversation}
+		o.Description = "Attach a reaction, a note or both to a message, e.g. to capture feedback in review workflows. Annotations don't affect the agent and are kept in memory for the lifetime of the server. The annotations of an agent reply are dropped when it's regenerated. Returns all annotations of the message."
+	})
+
+	// GET /stats/conversation endpoint
+	huma.Get(s.api, "/stats/conversation", s.getConversationStats, func(o *huma.Operation) {
+		o.OperationID = "getConversationStats"
+		o.Tags = []string{tagConversation}
+		o.Description = "Returns message counts and response times aggregated over the conversation history."
+	})
+
 	// POST /message endpoint
 	huma.Post(s.api, "/message", s.createMessage, func(o *huma.Operation) {
-		o.Description = "Send a message to the agent. For messages of type 'user', the agent's status must be 'stable' for the operation to complete successfully. Otherwise, this endpoint will return an error."
+		o.OperationID = "createMessage"
+		o.Tags = []string{tagConversation}
+		o.Description = "Send a message to the agent. For messages of type 'user', the agent's status must be 'stable'. Otherwise, this endpoint returns 409, unless the server runs with --busy-policy=force. Messages of type 'raw' are sent in any status. Returns 429 if another 'user' message is already being sent, or, if the server runs with --min-message-interval, if the last one was accepted less than that interval ago; the Retry-After header then says when to retry. Requests with the Idempotency-Key header of a successful request from the last 10 minutes aren't processed again; they get the earlier response."
+	})
+
+	// POST /message/form endpoint
+	huma.Post(s.api, "/message/form", s.createMessageForm, func(o *huma.Operation) {
+		o.OperationID = "createMessageForm"
+		o.Tags = []string{tagConversation}
+		o.Description = "Send a message to the agent like POST /message, with the message as form fields instead of JSON, e.g. with curl --data-urlencode content=... Requests from browser pages on origins that aren't allowed are rejected with 403."
+	})
+
+	// POST /permissions/{id} endpoint
+	huma.Post(s.api, "/permissions/{id}", s.answerPermission, func(o *huma.Operation) {
+		o.OperationID = "answerPermission"
+		o.Tags = []string{tagAgent}
+		o.Description = "Approve or deny a request of the agent for permission, e.g. to run a tool, announced by a permission_request event. The answer is sent to the agent's terminal as keystrokes. Returns 404 if the request isn't pending, e.g. because it was answered in the terminal, or if the server doesn't run with --permission-pattern, and 409 if it was already answered."
+	})
+
+	// POST /messages/batch endpoint
+	huma.Post(s.api, "/messages/batch", s.sendBatch, func(o *huma.Operation) {
+		o.OperationID = "sendMessageBatch"
+		o.Tags = []string{tagConversation}
+		o.Description = "Send a sequence of messages to the agent in order, e.g. a scripted series of prompts. Each 'user' message is sent once the agent is stable and the next one once the agent is stable again, i.e. done with it. The response is sent once all messages are processed. The first message that fails, e.g. because the agent didn't become stable within the timeout, stops the batch, and so does closing the request: the remaining messages are skipped. Returns the outcome of every message."
+	})
+
+	// GET /meta endpoint
+	huma.Get(s.api, "/meta", s.getMeta, func(o *huma.Operation) {
+		o.OperationID = "getMeta"
+		o.Tags = []string{tagConversation}
+		o.Description = "Returns the key/value metadata attached to the conversation. The metadata is set with --meta or PUT /meta and doesn't affect the agent."
+	})
+
+	// PUT /meta endpoint
+	huma.Put(s.api, "/meta", s.setMeta, func(o *huma.Operation) {
+		o.OperationID = "setMeta"
+		o.Tags = []string{tagConversation}
+		o.Description = "Replace the key/value metadata attached to the conversation. The metadata is added to the audit log entries of later messages."
 	})
 
+	// POST /upload endpoint
 	huma.Post(s.api, "/upload", s.uploadFiles, func(o *huma.Operation) {
+		o.OperationID = "uploadFiles"
+		o.Tags = []string{tagFiles}
 		o.Description = "Upload files to the specified upload path."
 	})
 
+	// GET /ping endpoint
+	huma.Get(s.api, "/ping", s.ping, func(o *huma.Operation) {
+		o.OperationID = "ping"
+		o.Tags = []string{tagAgent}
+		o.Description = "Actively checks whether the agent is responsive. For terminal agents, this checks that the agent's process is running and that its terminal output is still being read. Unlike the other endpoints, this detects agents whose process is alive but wedged."
+	})
+
+	// GET /health endpoint
+	huma.Get(s.api, "/health", s.getHealth, func(o *huma.Operation) {
+		o.OperationID = "getHealth"
+		o.Tags = []string{tagAgent}
+		o.Description = "Returns whether the server is healthy. The status is 'unhealthy' if the agent doesn't respond within the server's probe timeout, set with --probe-timeout, like for GET /ping. It's 'degraded' if several event subscribers were disconnected in the last 5 minutes because they didn't read events fast enough. The response is 200 in all cases, and returns within the probe timeout even if the agent hangs."
+	})
+
+	// POST /regenerate endpoint
+	huma.Post(s.api, "/regenerate", s.regenerateMessage, func(o *huma.Operation) {
+		o.OperationID = "regenerateMessage"
+		o.Tags = []string{tagConversation}
+		o.Description = "Discard the agent's last reply and send the user message that preceded it to the agent again. The agent's status must be 'stable' and the last message must be an agent reply to a user message. Otherwise, this endpoint returns 409. The user message goes through the server's BeforeSend hook again, and this endpoint returns 400 if the hook rejects it."
+	})
+
+	// POST /continue endpoint
+	huma.Post(s.api, "/continue", s.continueAgent, func(o *huma.Operation) {
+		o.OperationID = "continueAgent"
+		o.Tags = []string{tagConversation}
+		o.Description = "Let an agent that paused for confirmation go on, by pressing Enter or, if the server runs with --continue-phrase, by sending that phrase as a user message. The agent's status must be 'stable'. Otherwise, this endpoint returns 409."
+	})
+
+	// POST /internal/reset-status endpoint
+	huma.Post(s.api, "/internal/reset-status", s.resetStatusHandler, func(o *huma.Operation) {
+		o.OperationID = "resetStatus"
+		o.Tags = []string{tagAgent}
+		o.Description = "Force the agent's status back to 'stable'. This is a safety valve for a conversation stuck in the 'running' status, which rejects all new messages. A message that's still being written to the agent is abandoned, and its request fails. The status changes again as soon as the agent's screen does."
+	})
+
+	// POST /internal/notice endpoint
+	huma.Post(s.api, "/internal/notice", s.postNotice, func(o *huma.Operation) {
+		o.OperationID = "postNotice"
+		o.Tags = []string{tagConversation}
+		o.Description = "Send a notice to the clients subscribed to /events that list notice in the types query parameter, e.g. to warn about upcoming maintenance. The notice isn't part of the conversation history, and clients that subscribe later don't receive it."
+	})
+
+	// POST /resize endpoint
+	huma.Post(s.api, "/resize", s.resizeTerminal, func(o *huma.Operation) {
+		o.OperationID = "resizeTerminal"
+		o.Tags = []string{tagAgent}
+		o.Description = "Resize the agent's terminal. The agent is notified of the new size and redraws its screen. Returns 409 if the agent doesn't run in a terminal."
+	})
+
 	// GET /events endpoint
 	sse.Register(s.api, huma.Operation{
 		OperationID: "subscribeEvents",
 		Method:      http.MethodGet,
 		Path:        "/events",
 		Summary:     "Subscribe to events",
-		Description: "The events are sent as Server-Sent Events (SSE). Initially, the endpoint returns a list of events needed to reconstruct the current state of the conversation and the agent's status. After that, it only returns events that have occurred since the last event was sent.\n\nNote: When an agent is running, the last message in the conversation history is updated frequently, and the endpoint sends a new message update event each time.",
+		Tags:        []string{tagConversation},
+		Description: "The events are sent as Server-Sent Events (SSE). Initially, the endpoint returns a list of events needed to reconstruct the current state of the conversation and the agent's status. After that, it only returns events that have occurred since the last event was sent.\n\nNote: When an agent is running, the last message in the conversation history is updated frequently, and the endpoint sends a new message update event each time.\n\nScreen update events are only sent when the include_screen query parameter is set, and never if the server runs with --disable-screen.\n\nTyping start and stop events are sent when the agent starts and stops producing output, independently of message updates. They're only sent if they're listed in the types query parameter.\n\nA messages clear event is sent when messages are removed from the end of the conversation history, e.g. when the agent's last reply is regenerated. It's only sent if messages_clear is listed in the types query parameter.\n\nEvents carry increasing ids. A client that reconnects with the Last-Event-ID header receives the events it missed, except screen updates, instead of the events that recreate the current state. Only the current screen is sent again. Only the last of the events that recreate the state has an id, so a client that was cut off before receiving it resumes from its previous id, or receives the whole state again.\n\nWith the snapshot query parameter, the messages and the agent's status are sent in a single snapshot event instead, so that they're consistent with each other.\n\nNotice events carry messages from the server's operators, sent with POST /internal/notice. They're only sent if notice is listed in the types query parameter.\n\nIf the server runs with --permission-pattern, a permission request event is sent when the agent asks for permission, e.g. to run a tool, and a permission resolved event once the prompt goes away. Answer requests with POST /permissions/{id}. A pending request is part of the current state.\n\nIf the server runs with --sse-heartbeat-interval, heartbeat events with the server's time are sent at that interval. They have no id and aren't resent on reconnection.\n\nIf the server runs with --sse-max-duration, it closes the stream after that long. The last event is then a reconnect event, which is sent regardless of the types query parameter.",
 		Middlewares: []func(huma.Context, func(huma.Context)){sseMiddleware},
-	}, map[string]any{
-		// Mapping of event type name to Go struct for that event.
-		"message_update": MessageUpdateBody{},
-		"status_change":  StatusChangeBody{},
-	}, s.subscribeEvents)
+	}, eventPayloads, s.subscribeEvents)
+
+	if !s.disableScreen {
+		sse.Register(s.api, huma.Operation{
+			OperationID: "subscribeScreen",
+			Method:      http.MethodGet,
+			Path:        "/internal/screen",
+			Summary:     "Subscribe to screen",
+			Tags:        []string{tagAgent},
+			Hidden:      true,
+			Middlewares: []func(huma.Context, func(huma.Context)){sseMiddleware},
+		}, map[string]any{
+			"screen":      ScreenUpdateBody{},
+			"screen_diff": ScreenDiffBody{},
+		}, s.subscribeScreen)
+	}
 
-	sse.Register(s.api, huma.Operation{
-		OperationID: "subscribeScreen",
-		Method:      http.MethodGet,
-		Path:        "/internal/screen",
-		Summary:     "Subscribe to screen",
-		Hidden:      true,
-		Middlewares: []func(huma.Context, func(huma.Context)){sseMiddleware},
-	}, map[string]any{
-		"screen": ScreenUpdateBody{},
-	}, s.subscribeScreen)
+	if s.agentIOLog != nil {
+		huma.Register(s.api, huma.Operation{
+			OperationID: "getAgentIOLog",
+			Method:      http.MethodGet,
+			Path:        "/internal/agent-io",
+			Summary:     "Get the last writes to the agent's terminal",
+			Tags:        []string{tagAgent},
+			Hidden:      true,
+		}, s.getAgentIOLog)
+	}
+
+	if s.stderr != nil {
+		huma.Register(s.api, huma.Operation{
+			OperationID: "getStderr",
+			Method:      http.MethodGet,
+			Path:        "/internal/stderr",
+			Summary:     "Get the end of the agent's stderr",
+			Tags:        []string{tagAgent},
+			Hidden:      true,
+		}, s.getStderr)
+	}
+
+	if s.tailCtx != nil {
+		s.router.Get("/tail", s.tail)
+	}
 
 	s.router.Handle("/", http.HandlerFunc(s.redirectToChat))
 
@@ -404,9 +1233,6 @@ func (s *Server) registerRoutes() {
 
 // getStatus handles GET /status
 func (s *Server) getStatus(ctx context.Context, input *struct{}) (*StatusResponse, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
 	status := s.conversation.Status()
 	agentStatus := convertStatus(status)
 
@@ -417,37 +1243,320 @@ func (s *Server) getStatus(ctx context.Context, input *struct{}) (*StatusRespons
 	return resp, nil
 }
 
+// getSnapshot handles GET /snapshot
+func (s *Server) getSnapshot(ctx context.Context, input *struct{}) (*SnapshotResponse, error) {
+	messages, conversationStatus := s.conversation.State()
+	status := convertStatus(conversationStatus)
+
+	resp := &SnapshotResponse{}
+	resp.Body.Status = status
+	resp.Body.AgentType = s.agentType
+	resp.Body.Messages = make([]Message, 0, len(messages))
+	for i := range messages {
+		resp.Body.Messages = append(resp.Body.Messages, s.convertMessage(messages, i, status))
+	}
+	return resp, nil
+}
+
 // getMessages handles GET /messages
-func (s *Server) getMessages(ctx context.Context, input *struct{}) (*MessagesResponse, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func (s *Server) getMessages(ctx context.Context, input *MessagesRequest) (*MessagesResponse, error) {
+	maxLength := input.MaxLength
+	if maxLength == 0 {
+		maxLength = s.messagePreviewLength
+	}
+	return s.listMessages(input, maxLength), nil
+}
 
+// listMessages returns the messages selected by input, with their contents
+// truncated to maxLength characters. maxLength <= 0 returns the full
+// contents, which is what everything but GET /messages should use.
+func (s *Server) listMessages(input *MessagesRequest, maxLength int) *MessagesResponse {
 	resp := &MessagesResponse{}
-	resp.Body.Messages = make([]Message, len(s.conversation.Messages()))
-	for i, msg := range s.conversation.Messages() {
-		resp.Body.Messages[i] = Message{
-			Id:      msg.Id,
-			Role:    msg.Role,
-			Content: msg.Message,
-			Time:    msg.Time,
+	resp.Body.Messages = make([]Message, 0)
+	messages, conversationStatus := s.conversation.State()
+	status := convertStatus(conversationStatus)
+	for i, msg := range messages {
+		if !input.Since.IsZero() && !msg.Time.After(input.Since) {
+			continue
 		}
+		if msg.Role != st.ConversationRoleUser && msg.Role != st.ConversationRoleAgent && !slices.Contains(input.Include, string(msg.Role)) {
+			continue
+		}
+		resp.Body.Messages = append(resp.Body.Messages, truncateMessage(s.convertMessage(messages, i, status), maxLength))
+	}
+	if input.Order == "desc" {
+		slices.Reverse(resp.Body.Messages)
 	}
+	if input.Limit > 0 && len(resp.Body.Messages) > input.Limit {
+		resp.Body.Messages = resp.Body.Messages[:input.Limit]
+	}
+
+	return resp
+}
+
+// convertMessage returns the API representation of messages[i].
+func (s *Server) convertMessage(messages []st.ConversationMessage, i int, status AgentStatus) Message {
+	msg := messages[i]
+	return Message{
+		Id:        msg.Id,
+		Role:      msg.Role,
+		Content:   msg.Message,
+		Time:      msg.Time,
+		TimeMs:    msg.Time.UnixMilli(),
+		Complete:  isMessageComplete(messages, i, status),
+		Diffs:     convertDiffs(msg.Diffs),
+		Commands:  convertCommands(msg.Commands),
+		RawScreen: msg.RawScreen,
+		RawBase64: encodeRawBytes(msg.RawBytes),
+		Provider:  msg.Provider,
+		Model:     msg.Model,
+
+		Annotations: s.annotations.get(msg.Id),
+	}
+}
+
+func convertDiffs(diffs []mf.FileDiff) []FileDiff {
+	if len(diffs) == 0 {
+		return nil
+	}
+	result := make([]FileDiff, 0, len(diffs))
+	for _, diff := range diffs {
+		result = append(result, FileDiff{Path: diff.Path, Hunks: diff.Hunks})
+	}
+	return result
+}
+
+func convertCommands(commands []mf.CommandRun) []CommandRun {
+	if len(commands) == 0 {
+		return nil
+	}
+	result := make([]CommandRun, 0, len(commands))
+	for _, command := range commands {
+		result = append(result, CommandRun{Command: command.Command, Output: command.Output, Status: string(command.Status)})
+	}
+	return result
+}
+
+// getMessagesText handles GET /messages/text
+func (s *Server) getMessagesText(ctx context.Context, input *MessagesTextRequest) (*MessagesTextResponse, error) {
+	text := renderPlain(s.conversation.Messages(), plainOptions{fences: fenceMode(input.Fences)})
+
+	resp := &MessagesTextResponse{}
+	resp.ContentType = "text/plain; charset=utf-8"
+	resp.Body = []byte(text)
+
+	return resp, nil
+}
+
+// exportMessages handles GET /messages/export
+func (s *Server) exportMessages(ctx context.Context, input *MessagesExportRequest) (*MessagesExportResponse, error) {
+	messages := s.listMessages(&MessagesRequest{Order: "asc"}, 0)
+	page, err := renderTranscript(messages.Body.Messages, s.agentType, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &MessagesExportResponse{}
+	resp.ContentType = "text/html; charset=utf-8"
+	resp.ContentDisposition = `attachment; filename="conversation.html"`
+	resp.Body = page
+
+	return resp, nil
+}
+
+// getConversationStats handles GET /stats/conversation
+func (s *Server) getConversationStats(ctx context.Context, input *struct{}) (*ConversationStatsResponse, error) {
+	totals := s.stats.totals()
+
+	resp := &ConversationStatsResponse{}
+	resp.Body.UserMessages = totals.userMessages
+	resp.Body.AgentMessages = totals.agentMessages
+	resp.Body.SystemMessages = totals.systemMessages
+	resp.Body.Responses = totals.responses
+	resp.Body.TotalRunTimeMs = totals.runTime.Milliseconds()
+	if totals.responses > 0 {
+		resp.Body.AverageResponseMs = totals.runTime.Milliseconds() / int64(totals.responses)
+	}
+	resp.Body.LongestResponseMs = totals.longestResponse.Milliseconds()
+	resp.Body.LastActivity = totals.lastActivity
 
 	return resp, nil
 }
 
 // createMessage handles POST /message
 func (s *Server) createMessage(ctx context.Context, input *MessageRequest) (*MessageResponse, error) {
+	if input.IdempotencyKey == "" {
+		return s.createMessageOnce(ctx, input)
+	}
+	body, err := json.Marshal(input.Body)
+	if err != nil {
+		return nil, xerrors.Errorf("failed to encode message request: %w", err)
+	}
+	resp, replayed, err := s.idempotency.do(input.IdempotencyKey, sha256.Sum256(body), func() (*MessageResponse, error) {
+		return s.createMessageOnce(ctx, input)
+	})
+	if errors.Is(err, errIdempotencyKeyReused) {
+		return nil, huma.Error422UnprocessableEntity(err.Error())
+	}
+	if replayed {
+		s.logger.Info("Returning the response of an earlier message request with the same idempotency key", "idempotencyKey", input.IdempotencyKey)
+	}
+	return resp, err
+}
+
+// originAllowed reports whether origin is one of allowedOrigins, as parsed by
+// parseAllowedOrigins.
+func originAllowed(allowedOrigins []string, origin string) bool {
+	return slices.Contains(allowedOrigins, "*") || slices.Contains(allowedOrigins, origin)
+}
+
+// createMessageForm handles POST /message/form
+func (s *Server) createMessageForm(ctx context.Context, input *MessageFormRequest) (*MessageResponse, error) {
+	// Unlike JSON requests, browsers send form submissions to other origins
+	// without asking for permission first.
+	if input.Origin != "" && !originAllowed(s.allowedOrigins, input.Origin) {
+		return nil, huma.Error403Forbidden(fmt.Sprintf("form submissions from %s are not allowed", input.Origin))
+	}
+	values, err := url.ParseQuery(string(input.RawBody))
+	if err != nil {
+		return nil, huma.Error400BadRequest("failed to parse form", err)
+	}
+	body := MessageRequestBody{
+		Content: values.Get("content"),
+		Type:    MessageType(values.Get("type")),
+	}
+	if body.Type == "" {
+		body.Type = MessageTypeUser
+	}
+	if !slices.Contains(MessageTypeValues, body.Type) {
+		return nil, huma.Error422UnprocessableEntity(fmt.Sprintf("invalid message type %q", body.Type))
+	}
+	return s.createMessage(ctx, &MessageRequest{
+		RequestId:      input.RequestId,
+		IdempotencyKey: input.IdempotencyKey,
+		Body:           body,
+	})
+}
+
+// createMessageOnce handles a POST /message request that isn't a duplicate.
+func (s *Server) createMessageOnce(ctx context.Context, input *MessageRequest) (*MessageResponse, error) {
+	correlationId := input.RequestId
+	if correlationId == "" {
+		correlationId = newCorrelationId()
+	}
+	role := input.Body.Role
+	if role == "" {
+		role = st.ConversationRoleUser
+	}
+	start := time.Now()
+	s.audit.start(correlationId, clientIPFrom(ctx), string(s.agentType), input.Body, role)
+
+	// Only user messages for the agent are paced, not keystrokes or
+	// injected messages.
+	paced := input.Body.Type == MessageTypeUser && role == st.ConversationRoleUser
+	var prevAccepted time.Time
+	if paced {
+		var wait time.Duration
+		prevAccepted, wait = s.pacer.reserve(start)
+		if wait > 0 {
+			err := errTooSoon(s.pacer.interval, wait)
+			s.audit.finish(correlationId, start, paced, err)
+			return nil, err
+		}
+	}
+	resp, err := s.sendMessageRequest(input.Body, role)
+	s.audit.finish(correlationId, start, paced, err)
+	if err != nil {
+		if paced {
+			s.pacer.release(start, prevAccepted)
+		}
+		return nil, err
+	}
+	resp.RequestId = correlationId
+	return resp, nil
+}
+
+// referenceFiles appends references to files in the files root to a
+// message.
+func (s *Server) referenceFiles(content string, files []string) (string, error) {
+	if s.filesRoot == nil {
+		return "", huma.Error403Forbidden("attaching files by path is disabled, start the server with --files-root to enable it")
+	}
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		path, err := s.filesRoot.resolve(file)
+		if errors.Is(err, errFileOutsideRoot) {
+			return "", huma.Error403Forbidden(fmt.Sprintf("%s: %s", file, err))
+		}
+		if err != nil {
+			return "", huma.Error400BadRequest(fmt.Sprintf("%s: %s", file, err))
+		}
+		paths = append(paths, path)
+	}
+	return appendFileReferences(s.agentType, content, paths), nil
+}
+
+// sendMessageRequest sends or injects the message of a POST /message request.
+func (s *Server) sendMessageRequest(body MessageRequestBody, role st.ConversationRole) (*MessageResponse, error) {
+	if body.Type == MessageTypeUser && role == st.ConversationRoleUser {
+		if err := s.acquireSendSlot(); err != nil {
+			return nil, err
+		}
+		defer s.releaseSendSlot()
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	switch input.Body.Type {
+	if body.RawFormat && (body.Type != MessageTypeUser || role != st.ConversationRoleUser) {
+		return nil, huma.Error400BadRequest("raw_format only applies to 'user' type messages sent to the agent")
+	}
+	if len(body.Files) > 0 {
+		if body.Type != MessageTypeUser || role != st.ConversationRoleUser {
+			return nil, huma.Error400BadRequest("files only apply to 'user' type messages sent to the agent")
+		}
+		content, err := s.referenceFiles(body.Content, body.Files)
+		if err != nil {
+			return nil, err
+		}
+		body.Content = content
+	}
+	if role != st.ConversationRoleUser {
+		if body.Type != MessageTypeUser {
+			return nil, huma.Error400BadRequest(fmt.Sprintf("messages of type '%s' can't have a role", body.Type))
+		}
+		if !s.allowMessageInjection {
+			return nil, huma.Error403Forbidden("injecting agent and system messages is disabled, start the server with --allow-message-injection to enable it")
+		}
+		if err := s.conversation.InjectMessage(role, body.Content); err != nil {
+			if errors.Is(err, st.MessageValidationErrorChanging) {
+				return nil, huma.Error409Conflict(errAgentBusy.Error())
+			}
+			return nil, xerrors.Errorf("failed to inject message: %w", err)
+		}
+		resp := &MessageResponse{}
+		resp.Body.Ok = true
+		return resp, nil
+	}
+
+	switch body.Type {
 	case MessageTypeUser:
-		if err := s.conversation.SendMessage(FormatMessage(s.agentType, input.Body.Content)...); err != nil {
+		if err := s.sendUserMessage(body.Content, body.RawFormat); err != nil {
+			if errors.Is(err, errMessageRejected) {
+				return nil, huma.Error400BadRequest(err.Error())
+			}
+			if errors.Is(err, st.MessageValidationErrorChanging) {
+				return nil, huma.Error409Conflict(errAgentBusy.Error())
+			}
 			return nil, xerrors.Errorf("failed to send message: %w", err)
 		}
 	case MessageTypeRaw:
-		if _, err := s.agentio.Write([]byte(input.Body.Content)); err != nil {
+		if err := s.rawInput.check(body.Content); err != nil {
+			return nil, huma.Error400BadRequest(err.Error())
+		}
+		if err := s.writeRaw([]byte(body.Content)); err != nil {
+			if errors.Is(err, errRawWriteTimeout) {
+				return nil, huma.Error503ServiceUnavailable(err.Error())
+			}
 			return nil, xerrors.Errorf("failed to send message: %w", err)
 		}
 	}
@@ -458,6 +1567,212 @@ func (s *Server) createMessage(ctx context.Context, input *MessageRequest) (*Mes
 	return resp, nil
 }
 
+// acquireSendSlot takes a send slot without waiting. If all slots are taken,
+// it returns an error that responds with 429.
+func (s *Server) acquireSendSlot() error {
+	select {
+	case s.sendSlots <- struct{}{}:
+		return nil
+	default:
+		return huma.Error429TooManyRequests("too many messages are already being sent to the agent")
+	}
+}
+
+func (s *Server) releaseSendSlot() {
+	<-s.sendSlots
+}
+
+// ping handles GET /ping
+func (s *Server) ping(ctx context.Context, input *PingRequest) (*PingResponse, error) {
+	start := time.Now()
+	err := s.probeAgent(ctx, time.Duration(input.TimeoutMs)*time.Millisecond)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	latency := time.Since(start)
+
+	resp := &PingResponse{}
+	resp.Body.Responsive = err == nil
+	resp.Body.LatencyMs = latency.Milliseconds()
+	if err != nil {
+		resp.Body.Error = err.Error()
+		s.logger.Warn("Agent is unresponsive", "error", err)
+	}
+	return resp, nil
+}
+
+// regenerateMessage handles POST /regenerate
+func (s *Server) regenerateMessage(ctx context.Context, input *struct{}) (*RegenerateResponse, error) {
+	if err := s.acquireSendSlot(); err != nil {
+		return nil, err
+	}
+	defer s.releaseSendSlot()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The user message is passed through Hooks.BeforeSend again, like every
+	// message sent to the agent. Messages the server didn't send, e.g. of a
+	// restored conversation, are sent again as they are.
+	var parts []st.MessagePart
+	if last := s.lastUserMessage.Load(); last != nil {
+		var err error
+		parts, err = s.userMessageParts(last.content, last.rawFormat)
+		if err != nil {
+			return nil, huma.Error400BadRequest(err.Error())
+		}
+	}
+	if err := s.conversation.Regenerate(parts...); err != nil {
+		if errors.Is(err, st.MessageValidationErrorChanging) || errors.Is(err, st.MessageValidationErrorRegenerate) {
+			return nil, huma.Error409Conflict(err.Error())
+		}
+		return nil, xerrors.Errorf("failed to regenerate message: %w", err)
+	}
+	// The new reply gets the id of the discarded one, so the ids passed to
+	// Hooks.AfterReceive restart at the re-sent user message, and the
+	// annotations of the discarded reply are dropped.
+	messages := s.conversation.Messages()
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == st.ConversationRoleUser {
+			s.lastReceivedMessageId.Store(int64(messages[i].Id))
+			s.annotations.clearFrom(messages[i].Id + 1)
+			break
+		}
+	}
+
+	resp := &RegenerateResponse{}
+	resp.Body.Ok = true
+
+	return resp, nil
+}
+
+// continueAgent handles POST /continue
+func (s *Server) continueAgent(ctx context.Context, input *struct{}) (*ContinueResponse, error) {
+	if s.continuePhrase != "" {
+		if err := s.acquireSendSlot(); err != nil {
+			return nil, err
+		}
+		defer s.releaseSendSlot()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conversation.Status() != st.ConversationStatusStable {
+		return nil, huma.Error409Conflict("the agent is busy")
+	}
+	if s.continuePhrase == "" {
+		if err := s.writeRaw([]byte("\r")); err != nil {
+			if errors.Is(err, errRawWriteTimeout) {
+				return nil, huma.Error503ServiceUnavailable(err.Error())
+			}
+			return nil, xerrors.Errorf("failed to press enter: %w", err)
+		}
+	} else if err := s.sendUserMessage(s.continuePhrase, false); err != nil {
+		switch {
+		case errors.Is(err, errMessageRejected):
+			return nil, huma.Error400BadRequest(err.Error())
+		case errors.Is(err, st.MessageValidationErrorChanging):
+			return nil, huma.Error409Conflict(err.Error())
+		}
+		return nil, xerrors.Errorf("failed to send continue phrase: %w", err)
+	}
+
+	resp := &ContinueResponse{}
+	resp.Body.Ok = true
+	return resp, nil
+}
+
+// resetStatusHandler handles POST /internal/reset-status
+func (s *Server) resetStatusHandler(ctx context.Context, input *struct{}) (*ResetStatusResponse, error) {
+	status := s.resetStatus()
+	s.logger.Warn("Status reset by request")
+
+	resp := &ResetStatusResponse{}
+	resp.Body.Status = convertStatus(status)
+
+	return resp, nil
+}
+
+// postNotice handles POST /internal/notice
+func (s *Server) postNotice(ctx context.Context, input *NoticeRequest) (*NoticeResponse, error) {
+	s.emitter.EmitNotice(NoticeBody{Severity: input.Body.Severity, Text: input.Body.Text})
+	s.logger.Info("Notice sent", "severity", input.Body.Severity, "text", input.Body.Text)
+
+	resp := &NoticeResponse{}
+	resp.Body.Ok = true
+	return resp, nil
+}
+
+// defaultRawWriteTimeout is how long a raw message may take to be written to
+// the agent's terminal by default.
+const defaultRawWriteTimeout = 10 * time.Second
+
+// errRawWriteTimeout is returned by writeRaw if the agent doesn't read its input.
+var errRawWriteTimeout = xerrors.New("the agent is not reading its input")
+
+// writeRaw writes data to the agent's terminal. If the agent doesn't read it
+// within s.rawWriteTimeout, e.g. because the pseudo terminal's buffer is full,
+// writeRaw returns errRawWriteTimeout. The write then continues in the
+// background, and until it completes, further raw writes fail the same way so
+// that input isn't interleaved. The caller must hold s.mu.
+func (s *Server) writeRaw(data []byte) error {
+	if s.pendingRawWrite != nil {
+		select {
+		case <-s.pendingRawWrite:
+			s.pendingRawWrite = nil
+		default:
+			return errRawWriteTimeout
+		}
+	}
+
+	done := make(chan struct{})
+	var err error
+	go func() {
+		defer close(done)
+		if s.agentIOLog != nil {
+			_, err = s.agentIOLog.write(s.agentio, data)
+		} else {
+			_, err = s.agentio.Write(data)
+		}
+	}()
+	select {
+	case <-done:
+		return err
+	case <-time.After(s.rawWriteTimeout):
+		s.pendingRawWrite = done
+		return errRawWriteTimeout
+	}
+}
+
+// resizer is implemented by agents that run in a resizable terminal.
+type resizer interface {
+	Resize(width, height uint16) error
+}
+
+// resizeTerminal handles POST /resize
+func (s *Server) resizeTerminal(ctx context.Context, input *ResizeRequest) (*ResizeResponse, error) {
+	width, height := input.Body.Width, input.Body.Height
+	if width < 10 || width > math.MaxUint16 || height < 10 || height > math.MaxUint16 {
+		return nil, huma.Error400BadRequest(fmt.Sprintf("invalid terminal size %dx%d: width and height must be between 10 and %d", width, height, math.MaxUint16))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.agentio.(resizer)
+	if !ok {
+		return nil, huma.Error409Conflict("the agent does not run in a resizable terminal")
+	}
+	if err := r.Resize(uint16(width), uint16(height)); err != nil {
+		return nil, xerrors.Errorf("failed to resize terminal: %w", err)
+	}
+	s.logger.Info("Resized terminal", "width", width, "height", height)
+
+	resp := &ResizeResponse{}
+	resp.Body.Ok = true
+
+	return resp, nil
+}
+
 // uploadFiles handles POST /upload
 func (s *Server) uploadFiles(ctx context.Context, input *struct {
 	RawBody huma.MultipartFormFiles[UploadRequest]
@@ -503,50 +1818,138 @@ func (s *Server) uploadFiles(ctx context.Context, input *struct {
 }
 
 // subscribeEvents is an SSE endpoint that sends events to the client
-func (s *Server) subscribeEvents(ctx context.Context, input *struct{}, send sse.Sender) {
-	subscriberId, ch, stateEvents := s.emitter.Subscribe()
+func (s *Server) subscribeEvents(ctx context.Context, input *EventsRequest, send sse.Sender) {
+	// Failed sends are logged by streamEvents.
+	_ = s.streamEvents(ctx, input, send)
+}
+
+// streamContext returns a context that's also canceled when Stop ends the
+// event streams.
+func (s *Server) streamContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(s.streamsCtx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// streamEvents sends the events requested by input until ctx is done, the
+// server stops, the subscriber is dropped, the stream reaches its maximum
+// duration or send fails. Events without an id have a zero ID. It's shared by
+// GET /events and the Events RPC, and returns the error of the failed send.
+func (s *Server) streamEvents(ctx context.Context, input *EventsRequest, send func(sse.Message) error) error {
+	ctx, cancel := s.streamContext(ctx)
+	defer cancel()
+	var subscriberId int
+	var ch <-chan Event
+	var stateEvents []Event
+	// lastEventId is the id of the last event the client has received, for
+	// the reconnect event.
+	lastEventId := 0
+	if resumeId, err := strconv.Atoi(input.LastEventId); err == nil {
+		subscriberId, ch, stateEvents = s.emitter.Resume(resumeId)
+		lastEventId = resumeId
+	} else if input.Snapshot {
+		subscriberId, ch, stateEvents = s.emitter.SubscribeSnapshot()
+	} else {
+		subscriberId, ch, stateEvents = s.emitter.Subscribe()
+	}
 	defer s.emitter.Unsubscribe(subscriberId)
-	s.logger.Info("New subscriber", "subscriberId", subscriberId)
+	includeScreen := input.IncludeScreen && !s.disableScreen
+	wanted := func(event Event) bool {
+		if event.Type == EventTypeScreenUpdate && !includeScreen {
+			return false
+		}
+		if event.Type == EventTypeSnapshot {
+			return true
+		}
+		return subscribedTo(input.Types, event.Type)
+	}
+	s.logger.Info("New subscriber", "subscriberId", subscriberId, "clientIp", clientIPFrom(ctx), "lastEventId", input.LastEventId, "includeScreen", includeScreen, "types", input.Types)
+	sender := &eventSender{s: s, ctx: ctx, subscriberId: subscriberId, send: send}
+	replayed := make([]Event, 0, len(stateEvents))
 	for _, event := range stateEvents {
-		if event.Type == EventTypeScreenUpdate {
-			continue
+		lastEventId = max(lastEventId, event.Id)
+		if wanted(event) {
+			replayed = append(replayed, event)
 		}
-		if err := send.Data(event.Payload); err != nil {
-			s.logger.Error("Failed to send event", "subscriberId", subscriberId, "error", err)
-			return
+	}
+	for i, event := range replayed {
+		// The events that recreate the state share an id. Only the last of
+		// them carries it, so that a client that resumes from an id has
+		// received every event before it.
+		id := event.Id
+		if i+1 < len(replayed) && replayed[i+1].Id == id {
+			id = 0
+		}
+		if !sender.sendEvent(sse.Message{ID: id, Data: event.Payload}) {
+			return sender.err
 		}
 	}
 
+	// expired stays nil if streams are kept open forever.
+	var expired <-chan time.Time
+	if s.maxEventsDuration > 0 {
+		timer := time.NewTimer(s.maxEventsDuration)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	// heartbeats stays nil if heartbeats are disabled or not wanted.
+	var heartbeats <-chan time.Time
+	if s.heartbeatInterval > 0 && wanted(Event{Type: EventTypeHeartbeat}) {
+		ticker := time.NewTicker(s.heartbeatInterval)
+		defer ticker.Stop()
+		heartbeats = ticker.C
+	}
+
 	for {
 		select {
 		case event, ok := <-ch:
 			if !ok {
-				s.logger.Info("Channel closed", "subscriberId", subscriberId)
-				return
+				// The emitter closes the channels of subscribers whose
+				// buffer is full.
+				sender.disconnect("the event buffer is full")
+				return nil
 			}
-			if event.Type == EventTypeScreenUpdate {
+			lastEventId = event.Id
+			if !wanted(event) {
 				continue
 			}
-			if err := send.Data(event.Payload); err != nil {
-				s.logger.Error("Failed to send event", "subscriberId", subscriberId, "error", err)
-				return
+			if !sender.sendEvent(sse.Message{ID: event.Id, Data: event.Payload}) {
+				return sender.err
+			}
+		case <-expired:
+			s.logger.Info("Closing event stream that reached its maximum duration", "subscriberId", subscriberId, "maxDuration", s.maxEventsDuration)
+			if err := send(sse.Message{Data: ReconnectBody{LastEventId: lastEventId}}); err != nil {
+				s.logger.Error("Failed to send reconnect event", "subscriberId", subscriberId, "error", err)
+				return err
+			}
+			return nil
+		case now := <-heartbeats:
+			// Heartbeats aren't part of the event history, so they have no id.
+			if !sender.sendEvent(sse.Message{Data: HeartbeatBody{Time: now, TimeMs: now.UnixMilli()}}) {
+				return sender.err
 			}
 		case <-ctx.Done():
 			s.logger.Info("Context done", "subscriberId", subscriberId)
-			return
+			return nil
 		}
 	}
 }
 
-func (s *Server) subscribeScreen(ctx context.Context, input *struct{}, send sse.Sender) {
+func (s *Server) subscribeScreen(ctx context.Context, input *ScreenRequest, send sse.Sender) {
+	ctx, cancel := s.streamContext(ctx)
+	defer cancel()
 	subscriberId, ch, stateEvents := s.emitter.Subscribe()
 	defer s.emitter.Unsubscribe(subscriberId)
-	s.logger.Info("New screen subscriber", "subscriberId", subscriberId)
+	s.logger.Info("New screen subscriber", "subscriberId", subscriberId, "clientIp", clientIPFrom(ctx))
+	stream := screenStream{diffs: input.Diff}
 	for _, event := range stateEvents {
 		if event.Type != EventTypeScreenUpdate {
 			continue
 		}
-		if err := send.Data(event.Payload); err != nil {
+		if err := send.Data(stream.next(event.Payload.(ScreenUpdateBody))); err != nil {
 			s.logger.Error("Failed to send screen event", "subscriberId", subscriberId, "error", err)
 			return
 		}
@@ -561,7 +1964,7 @@ func (s *Server) subscribeScreen(ctx context.Context, input *struct{}, send sse.
 			if event.Type != EventTypeScreenUpdate {
 				continue
 			}
-			if err := send.Data(event.Payload); err != nil {
+			if err := send.Data(stream.next(event.Payload.(ScreenUpdateBody))); err != nil {
 				s.logger.Error("Failed to send screen event", "subscriberId", subscriberId, "error", err)
 				return
 			}
@@ -585,13 +1988,32 @@ func (s *Server) Start() error {
 
 // Stop gracefully stops the HTTP server
 func (s *Server) Stop(ctx context.Context) error {
-	// Clean up temporary directory
-	s.cleanupTempDir()
+	// Stop the snapshot loops and wait for the server's loop to exit
+	if s.stopSnapshotLoop != nil {
+		s.stopSnapshotLoop()
+		select {
+		case <-s.snapshotLoopDone:
+		case <-ctx.Done():
+		}
+	}
+
+	// End the long-lived streams first: the HTTP and gRPC servers wait for
+	// them otherwise.
+	s.stopStreams()
+	if s.stopTails != nil {
+		s.stopTails()
+	}
 
+	var err error
 	if s.srv != nil {
-		return s.srv.Shutdown(ctx)
+		err = s.srv.Shutdown(ctx)
 	}
-	return nil
+	s.stopGRPC(ctx)
+
+	// Clean up temporary directory
+	s.cleanupTempDir()
+
+	return err
 }
 
 // cleanupTempDir removes the temporary directory and all its contents
@@ -1,24 +1,43 @@
 package httpapi_test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log/slog"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/coder/agentapi/lib/httpapi"
 	"github.com/coder/agentapi/lib/logctx"
 	"github.com/coder/agentapi/lib/msgfmt"
+	st "github.com/coder/agentapi/lib/screentracker"
+	"github.com/coder/websocket"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
 )
 
 // Ensure the OpenAPI schema on disk is up to date.
@@ -62,6 +81,158 @@ func TestOpenAPISchema(t *testing.T) {
 	require.Equal(t, currentSchema, diskSchema)
 }
 
+// Ensure clients can generate types for the SSE event payloads from the OpenAPI schema.
+func TestOpenAPISchema_EventSchemas(t *testing.T) {
+	t.Parallel()
+
+	ctx := logctx.WithLogger(context.Background(), slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	srv, err := httpapi.NewServer(ctx, httpapi.ServerConfig{
+		AgentType:      msgfmt.AgentTypeClaude,
+		Process:        nil,
+		Port:           0,
+		ChatBasePath:   "/chat",
+		AllowedHosts:   []string{"*"},
+		AllowedOrigins: []string{"*"},
+	})
+	require.NoError(t, err)
+
+	var schema struct {
+		Components struct {
+			Schemas map[string]json.RawMessage `json:"schemas"`
+		} `json:"components"`
+	}
+	schemaStr := srv.GetOpenAPI()
+	require.NoError(t, json.Unmarshal([]byte(schemaStr), &schema))
+
+	for _, name := range []string{"Message", "MessageUpdateBody", "StatusChangeBody", "ScreenUpdateBody"} {
+		require.Contains(t, schema.Components.Schemas, name)
+	}
+
+	// Every reference, including the ones in the SSE event definitions, must resolve.
+	for _, match := range regexp.MustCompile(`"\$ref":\s*"#/components/schemas/([^"]+)"`).FindAllStringSubmatch(schemaStr, -1) {
+		require.Contains(t, schema.Components.Schemas, match[1])
+	}
+	require.Contains(t, schemaStr, `"#/components/schemas/MessageUpdateBody"`)
+	require.Contains(t, schemaStr, `"#/components/schemas/StatusChangeBody"`)
+}
+
+// Generated clients derive their method names from the operation IDs, so they
+// must not change.
+func TestOpenAPISchema_OperationIDs(t *testing.T) {
+	t.Parallel()
+
+	ctx := logctx.WithLogger(context.Background(), slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	srv, err := httpapi.NewServer(ctx, httpapi.ServerConfig{
+		AgentType:      msgfmt.AgentTypeClaude,
+		Process:        nil,
+		Port:           0,
+		ChatBasePath:   "/chat",
+		AllowedHosts:   []string{"*"},
+		AllowedOrigins: []string{"*"},
+	})
+	require.NoError(t, err)
+
+	var schema struct {
+		Paths map[string]map[string]struct {
+			OperationID string   `json:"operationId"`
+			Tags        []string `json:"tags"`
+		} `json:"paths"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(srv.GetOpenAPI()), &schema))
+
+	expected := map[string]string{
+		"GET /status":                     "getStatus",
+		"GET /snapshot":                   "getSnapshot",
+		"GET /messages":                   "getMessages",
+		"GET /messages/text":              "getMessagesText",
+		"GET /stats/conversation":         "getConversationStats",
+		"POST /message":                   "createMessage",
+		"POST /message/form":              "createMessageForm",
+		"POST /messages/batch":            "sendMessageBatch",
+		"POST /permissions/{id}":          "answerPermission",
+		"GET /meta":                       "getMeta",
+		"PUT /meta":                       "setMeta",
+		"POST /upload":                    "uploadFiles",
+		"GET /ping":                       "ping",
+		"GET /health":                     "getHealth",
+		"POST /regenerate":                "regenerateMessage",
+		"POST /continue":                  "continueAgent",
+		"GET /messages/export":            "exportMessages",
+		"GET /messages/{id}":              "getMessage",
+		"GET /messages/{id}/annotations":  "getAnnotations",
+		"POST /messages/{id}/annotations": "addAnnotation",
+		"POST /internal/reset-status":     "resetStatus",
+		"POST /internal/notice":           "postNotice",
+		"POST /resize":                    "resizeTerminal",
+		"GET /capabilities":               "getCapabilities",
+		"GET /events":                     "subscribeEvents",
+	}
+	actual := map[string]string{}
+	for path, operations := range schema.Paths {
+		for method, operation := range operations {
+			actual[strings.ToUpper(method)+" "+path] = operation.OperationID
+			require.Len(t, operation.Tags, 1, "%s %s", method, path)
+		}
+	}
+	require.Equal(t, expected, actual)
+}
+
+// The schema and the documentation UI are served over HTTP, so that clients
+// don't need a copy of openapi.json.
+func TestServer_OpenAPIRoutes(t *testing.T) {
+	t.Parallel()
+
+	ctx := logctx.WithLogger(context.Background(), slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	srv, err := httpapi.NewServer(ctx, httpapi.ServerConfig{
+		AgentType:      msgfmt.AgentTypeClaude,
+		Process:        nil,
+		Port:           0,
+		ChatBasePath:   "/chat",
+		AllowedHosts:   []string{"*"},
+		AllowedOrigins: []string{"*"},
+	})
+	require.NoError(t, err)
+	tsServer := httptest.NewServer(srv.Handler())
+	t.Cleanup(tsServer.Close)
+
+	get := func(t *testing.T, path string) (*http.Response, []byte) {
+		t.Helper()
+		resp, err := tsServer.Client().Get(tsServer.URL + path)
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp, body
+	}
+
+	t.Run("json", func(t *testing.T) {
+		t.Parallel()
+		_, body := get(t, "/openapi.json")
+		var schema struct {
+			Paths map[string]any `json:"paths"`
+		}
+		require.NoError(t, json.Unmarshal(body, &schema))
+		for _, path := range []string{"/status", "/messages", "/message", "/events"} {
+			require.Contains(t, schema.Paths, path)
+		}
+	})
+
+	t.Run("yaml", func(t *testing.T) {
+		t.Parallel()
+		_, body := get(t, "/openapi.yaml")
+		require.Contains(t, string(body), "/messages:")
+	})
+
+	t.Run("docs", func(t *testing.T) {
+		t.Parallel()
+		resp, _ := get(t, "/docs")
+		require.Contains(t, resp.Header.Get("Content-Type"), "text/html")
+	})
+}
+
 func TestServer_redirectToChat(t *testing.T) {
 	cases := []struct {
 		name                 string
@@ -610,6 +781,118 @@ func TestServer_CORSPreflightOrigins(t *testing.T) {
 	}
 }
 
+func TestServer_CORSPreflightMethods(t *testing.T) {
+	t.Parallel()
+
+	newServer := func(t *testing.T, maxAge time.Duration) (*httpapi.Server, *httptest.Server) {
+		t.Helper()
+		ctx := logctx.WithLogger(context.Background(), slog.New(slog.NewTextHandler(os.Stdout, nil)))
+		s, err := httpapi.NewServer(ctx, httpapi.ServerConfig{
+			AgentType:      msgfmt.AgentTypeClaude,
+			Process:        nil,
+			Port:           0,
+			ChatBasePath:   "/chat",
+			AllowedHosts:   []string{"*"},
+			AllowedOrigins: []string{"*"},
+			CORSMaxAge:     maxAge,
+		})
+		require.NoError(t, err)
+		tsServer := httptest.NewServer(s.Handler())
+		t.Cleanup(tsServer.Close)
+		return s, tsServer
+	}
+	preflight := func(t *testing.T, tsServer *httptest.Server, method string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodOptions, tsServer.URL+"/status", nil)
+		require.NoError(t, err)
+		req.Header.Set("Origin", "https://example.com")
+		req.Header.Set("Access-Control-Request-Method", method)
+		resp, err := tsServer.Client().Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = resp.Body.Close()
+		})
+		return resp
+	}
+
+	t.Run("delete", func(t *testing.T) {
+		t.Parallel()
+		_, tsServer := newServer(t, 0)
+		resp := preflight(t, tsServer, http.MethodDelete)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, http.MethodDelete, resp.Header.Get("Access-Control-Allow-Methods"))
+		require.Equal(t, "300", resp.Header.Get("Access-Control-Max-Age"))
+	})
+
+	t.Run("every registered method", func(t *testing.T) {
+		t.Parallel()
+		s, tsServer := newServer(t, 0)
+		var schema struct {
+			Paths map[string]map[string]any `json:"paths"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(s.GetOpenAPI()), &schema))
+		for path, operations := range schema.Paths {
+			for method := range operations {
+				method = strings.ToUpper(method)
+				resp := preflight(t, tsServer, method)
+				require.Equal(t, method, resp.Header.Get("Access-Control-Allow-Methods"), "%s %s", method, path)
+			}
+		}
+	})
+
+	t.Run("max age", func(t *testing.T) {
+		t.Parallel()
+		_, tsServer := newServer(t, time.Hour)
+		require.Equal(t, "3600", preflight(t, tsServer, http.MethodPost).Header.Get("Access-Control-Max-Age"))
+	})
+
+	t.Run("max age disabled", func(t *testing.T) {
+		t.Parallel()
+		_, tsServer := newServer(t, -1)
+		require.Empty(t, preflight(t, tsServer, http.MethodPost).Header.Get("Access-Control-Max-Age"))
+	})
+}
+
+func TestServer_CORSHeaders(t *testing.T) {
+	t.Parallel()
+	_, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType: msgfmt.AgentTypeClaude,
+		Process:   &fakeAgent{screen: "> "},
+	})
+
+	t.Run("allowed", func(t *testing.T) {
+		t.Parallel()
+		for _, header := range []string{"Idempotency-Key", "X-Request-Id"} {
+			req, err := http.NewRequest(http.MethodOptions, tsServer.URL+"/message", nil)
+			require.NoError(t, err)
+			req.Header.Set("Origin", "https://example.com")
+			req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			req.Header.Set("Access-Control-Request-Headers", header)
+			resp, err := tsServer.Client().Do(req)
+			require.NoError(t, err)
+			_ = resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode, header)
+			require.True(t, strings.EqualFold(header, resp.Header.Get("Access-Control-Allow-Headers")), header)
+		}
+	})
+
+	t.Run("exposed", func(t *testing.T) {
+		t.Parallel()
+		req, err := http.NewRequest(http.MethodGet, tsServer.URL+"/status", nil)
+		require.NoError(t, err)
+		req.Header.Set("Origin", "https://example.com")
+		resp, err := tsServer.Client().Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		exposed := strings.Split(resp.Header.Get("Access-Control-Expose-Headers"), ", ")
+		for _, header := range []string{"Retry-After", "X-Request-Id"} {
+			require.True(t, slices.ContainsFunc(exposed, func(h string) bool {
+				return strings.EqualFold(h, header)
+			}), "%s isn't in %q", header, exposed)
+		}
+	})
+}
+
 func TestServer_SSEMiddleware_Events(t *testing.T) {
 	t.Parallel()
 	ctx := logctx.WithLogger(context.Background(), slog.New(slog.NewTextHandler(os.Stdout, nil)))
@@ -647,6 +930,215 @@ func TestServer_SSEMiddleware_Events(t *testing.T) {
 	})
 }
 
+func TestServer_EventsIncludeScreen(t *testing.T) {
+	t.Parallel()
+	_, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType: msgfmt.AgentTypeClaude,
+		Process:   &fakeAgent{screen: "> "},
+	})
+
+	t.Run("screen excluded by default", func(t *testing.T) {
+		t.Parallel()
+		events := readEventTypes(t, tsServer, "")
+		require.Contains(t, events, "status_change")
+		require.NotContains(t, events, "screen_update")
+	})
+
+	t.Run("include_screen", func(t *testing.T) {
+		t.Parallel()
+		events := readEventTypes(t, tsServer, "?include_screen=true")
+		require.Contains(t, events, "status_change")
+		require.Contains(t, events, "screen_update")
+	})
+}
+
+func TestServer_EventsResume(t *testing.T) {
+	t.Parallel()
+	_, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType: msgfmt.AgentTypeCustom,
+		Process:   &fakeAgent{screen: "> ", echo: true},
+	})
+
+	type event struct {
+		id   int
+		name string
+		data string
+	}
+	// readEvents returns the events received until the stream is cut off
+	// after timeout. It's called from other goroutines, so it doesn't use
+	// require. The raw writes below only show up as typing events, which
+	// have to be asked for.
+	readEvents := func(lastEventId string, timeout time.Duration) []event {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, tsServer.URL+"/events?types=message_update,status_change,typing_start,typing_stop", nil)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		if lastEventId != "" {
+			req.Header.Set("Last-Event-ID", lastEventId)
+		}
+		resp, err := tsServer.Client().Do(req)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		body, _ := io.ReadAll(resp.Body)
+		var events []event
+		for _, block := range strings.Split(string(body), "\n\n") {
+			var e event
+			for _, line := range strings.Split(block, "\n") {
+				if v, ok := strings.CutPrefix(line, "id: "); ok {
+					e.id, _ = strconv.Atoi(v)
+				} else if v, ok := strings.CutPrefix(line, "event: "); ok {
+					e.name = v
+				} else if v, ok := strings.CutPrefix(line, "data: "); ok {
+					e.data = v
+				}
+			}
+			if e.name != "" {
+				events = append(events, e)
+			}
+		}
+		return events
+	}
+	postRaw := func(content string) {
+		require.Equal(t, http.StatusOK, postMessage(t, tsServer, httpapi.MessageRequestBody{Content: content, Type: httpapi.MessageTypeRaw}))
+	}
+	// stateEnd returns the index of the last of the events that recreate the
+	// state on connection. Only that one has an id.
+	stateEnd := func(events []event) int {
+		return slices.IndexFunc(events, func(e event) bool {
+			return e.id > 0
+		})
+	}
+	// live drops the events that recreate the state.
+	live := func(events []event) []event {
+		return events[stateEnd(events)+1:]
+	}
+
+	// The reference subscriber stays connected the whole time.
+	referenceCh := make(chan []event, 1)
+	go func() {
+		referenceCh <- readEvents("", 2500*time.Millisecond)
+	}()
+	firstCh := make(chan []event, 1)
+	go func() {
+		firstCh <- readEvents("", 600*time.Millisecond)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	postRaw(" one")
+	first := <-firstCh
+	require.NotEmpty(t, live(first))
+	lastEventId := first[len(first)-1].id
+
+	// The agent keeps writing while the subscriber is disconnected.
+	postRaw(" two")
+	time.Sleep(300 * time.Millisecond)
+
+	resumedCh := make(chan []event, 1)
+	go func() {
+		resumedCh <- readEvents(strconv.Itoa(lastEventId), 800*time.Millisecond)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	postRaw(" three")
+	resumed := <-resumedCh
+	require.NotEmpty(t, resumed)
+	require.Greater(t, resumed[0].id, lastEventId)
+
+	// Together, both connections received every event exactly once.
+	received := append(live(first), resumed...)
+	reference := live(<-referenceCh)
+	var expected []event
+	for _, e := range reference {
+		if e.id > first[stateEnd(first)].id && e.id <= received[len(received)-1].id {
+			expected = append(expected, e)
+		}
+	}
+	require.Equal(t, expected, received)
+}
+
+func TestServer_EventsTypes(t *testing.T) {
+	t.Parallel()
+	_, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType: msgfmt.AgentTypeClaude,
+		Process:   &fakeAgent{screen: "> "},
+		Greeting:  "Hello!",
+	})
+
+	// Wait for the snapshot loop to pass the greeting on to the event emitter.
+	require.Eventually(t, func() bool {
+		return slices.Contains(readEventTypes(t, tsServer, ""), "message_update")
+	}, 5*time.Second, 10*time.Millisecond)
+
+	t.Run("all types by default", func(t *testing.T) {
+		t.Parallel()
+		events := readEventTypes(t, tsServer, "")
+		require.Contains(t, events, "status_change")
+		require.Contains(t, events, "message_update")
+	})
+
+	t.Run("filtered", func(t *testing.T) {
+		t.Parallel()
+		events := readEventTypes(t, tsServer, "?types=status_change")
+		require.Contains(t, events, "status_change")
+		require.NotContains(t, events, "message_update")
+	})
+
+	t.Run("screen requires include_screen", func(t *testing.T) {
+		t.Parallel()
+		events := readEventTypes(t, tsServer, "?types=screen_update,message_update")
+		require.Equal(t, []string{"message_update"}, events)
+		events = readEventTypes(t, tsServer, "?types=screen_update,message_update&include_screen=true")
+		require.Contains(t, events, "screen_update")
+		require.Contains(t, events, "message_update")
+		require.NotContains(t, events, "status_change")
+	})
+
+	t.Run("unknown type", func(t *testing.T) {
+		t.Parallel()
+		resp, err := tsServer.Client().Get(tsServer.URL + "/events?types=status_change,run_finished")
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	})
+}
+
+func TestServer_TypingEvents(t *testing.T) {
+	t.Parallel()
+	agent := &fakeAgent{screen: "> "}
+	_, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType: msgfmt.AgentTypeCustom,
+		Process:   agent,
+	})
+	// The agent keeps writing, so it's typing the whole time.
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(50 * time.Millisecond):
+				agent.mu.Lock()
+				agent.screen += "."
+				agent.mu.Unlock()
+			}
+		}
+	}()
+
+	// Typing events are only sent on request.
+	events := readEventTypes(t, tsServer, "")
+	require.Contains(t, events, "message_update")
+	require.NotContains(t, events, "typing_start")
+	events = readEventTypes(t, tsServer, "?types=typing_start,typing_stop")
+	require.Contains(t, events, "typing_start")
+}
+
 func assertSSEHeaders(t testing.TB, resp *http.Response) {
 	t.Helper()
 	assert.Equal(t, "no-cache, no-store, must-revalidate", resp.Header.Get("Cache-Control"))
@@ -956,3 +1448,3027 @@ func TestServer_UploadFiles_Errors(t *testing.T) {
 		require.Contains(t, string(body), "file size exceeds 10MB limit")
 	})
 }
+
+// fakeAgent is an in-memory stand-in for the agent's terminal.
+type fakeAgent struct {
+	mu      sync.Mutex
+	screen  string
+	written strings.Builder
+	// echo makes everything written to the agent appear on its screen.
+	echo bool
+}
+
+func (a *fakeAgent) Write(data []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.echo {
+		a.screen += string(data)
+	}
+	return a.written.Write(data)
+}
+
+func (a *fakeAgent) Written() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.written.String()
+}
+
+func (a *fakeAgent) ReadScreen() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.screen
+}
+
+// newTestServer creates a server for config, starts its snapshot loop and
+// serves it until the test ends. The chat base path, allowed hosts and
+// allowed origins default to ones that accept every request.
+func newTestServer(t *testing.T, config httpapi.ServerConfig) (*httpapi.Server, *httptest.Server) {
+	t.Helper()
+	srv, tsServer, err := tryNewTestServer(t, config)
+	require.NoError(t, err)
+	return srv, tsServer
+}
+
+// tryNewTestServer is newTestServer for tests that check the error of
+// httpapi.NewServer.
+func tryNewTestServer(t *testing.T, config httpapi.ServerConfig) (*httpapi.Server, *httptest.Server, error) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(logctx.WithLogger(context.Background(), slog.New(slog.NewTextHandler(os.Stdout, nil))))
+	t.Cleanup(cancel)
+	if config.ChatBasePath == "" {
+		config.ChatBasePath = "/chat"
+	}
+	if config.AllowedHosts == nil {
+		config.AllowedHosts = []string{"*"}
+	}
+	if config.AllowedOrigins == nil {
+		config.AllowedOrigins = []string{"*"}
+	}
+	srv, err := httpapi.NewServer(ctx, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	srv.StartSnapshotLoop(ctx)
+	tsServer := httptest.NewServer(srv.Handler())
+	t.Cleanup(tsServer.Close)
+	return srv, tsServer, nil
+}
+
+// postJSON posts body to path as JSON. The response body is closed when the
+// test ends.
+func postJSON(t *testing.T, tsServer *httptest.Server, path string, body any) *http.Response {
+	t.Helper()
+	data, err := json.Marshal(body)
+	require.NoError(t, err)
+	resp, err := tsServer.Client().Post(tsServer.URL+path, "application/json", bytes.NewReader(data))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = resp.Body.Close()
+	})
+	return resp
+}
+
+// postMessage posts a message and returns the status code of the response.
+func postMessage(t *testing.T, tsServer *httptest.Server, body httpapi.MessageRequestBody) int {
+	t.Helper()
+	return postJSON(t, tsServer, "/message", body).StatusCode
+}
+
+// sendWhenStable posts a message once the server accepts it. The server
+// rejects messages until the agent is stable.
+func sendWhenStable(t *testing.T, tsServer *httptest.Server, body httpapi.MessageRequestBody) {
+	t.Helper()
+	var status int
+	require.Eventually(t, func() bool {
+		status = postMessage(t, tsServer, body)
+		return status != http.StatusConflict
+	}, 10*time.Second, 100*time.Millisecond)
+	require.Equal(t, http.StatusOK, status)
+}
+
+// readEventTypes returns the types of the events received from GET /events
+// until the stream is cut off after 500ms.
+func readEventTypes(t *testing.T, tsServer *httptest.Server, query string) []string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tsServer.URL+"/events"+query, nil)
+	require.NoError(t, err)
+	resp, err := tsServer.Client().Do(req)
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, _ := io.ReadAll(resp.Body)
+	var events []string
+	for _, line := range strings.Split(string(body), "\n") {
+		if name, ok := strings.CutPrefix(line, "event: "); ok {
+			events = append(events, name)
+		}
+	}
+	return events
+}
+
+func TestServer_StopEndsEventStreams(t *testing.T) {
+	t.Parallel()
+	srv, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType: msgfmt.AgentTypeClaude,
+		Process:   &fakeAgent{screen: "> "},
+	})
+
+	reqCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var bodies []io.ReadCloser
+	for _, path := range []string{"/events", "/internal/screen"} {
+		req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, tsServer.URL+path, nil)
+		require.NoError(t, err)
+		resp, err := tsServer.Client().Do(req)
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		bodies = append(bodies, resp.Body)
+	}
+
+	require.NoError(t, srv.Stop(reqCtx))
+	for _, body := range bodies {
+		_, err := io.ReadAll(body)
+		require.NoError(t, err)
+	}
+	require.NoError(t, reqCtx.Err(), "the streams should end when the server stops")
+}
+
+func TestServer_StopEndsSnapshotLoop(t *testing.T) {
+	// Not parallel: the test counts the goroutines of the whole process.
+	ctx := logctx.WithLogger(context.Background(), slog.New(slog.NewTextHandler(os.Stdout, nil)))
+	srv, err := httpapi.NewServer(ctx, httpapi.ServerConfig{
+		AgentType:      msgfmt.AgentTypeClaude,
+		Process:        &fakeAgent{screen: "> "},
+		Port:           0,
+		ChatBasePath:   "/chat",
+		AllowedHosts:   []string{"*"},
+		AllowedOrigins: []string{"*"},
+	})
+	require.NoError(t, err)
+
+	baseline := runtime.NumGoroutine()
+	srv.StartSnapshotLoop(ctx)
+	require.Greater(t, runtime.NumGoroutine(), baseline)
+
+	require.NoError(t, srv.Stop(ctx))
+	// Poll manually: require.Eventually runs its condition in a goroutine of its own.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.LessOrEqual(t, runtime.NumGoroutine(), baseline, "snapshot loop goroutines should exit after Stop")
+}
+
+func TestServer_GetMessagesSince(t *testing.T) {
+	t.Parallel()
+	_, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType: msgfmt.AgentTypeClaude,
+		Process:   &fakeAgent{},
+	})
+
+	getMessages := func(t *testing.T, query string) (int, []httpapi.Message) {
+		t.Helper()
+		resp, err := tsServer.Client().Get(tsServer.URL + "/messages" + query)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = resp.Body.Close()
+		})
+		var body struct {
+			Messages []httpapi.Message `json:"messages"`
+		}
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		}
+		return resp.StatusCode, body.Messages
+	}
+
+	status, all := getMessages(t, "")
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, all, 1)
+	msgTime := all[0].Time
+
+	cases := []struct {
+		name          string
+		since         string
+		expectedCount int
+	}{
+		{"before the message", msgTime.Add(-time.Nanosecond).Format(time.RFC3339Nano), 1},
+		{"equal to the message time is excluded", msgTime.Format(time.RFC3339Nano), 0},
+		{"after the message", msgTime.Add(time.Second).Format(time.RFC3339Nano), 0},
+		{"rfc3339 without fractional seconds", msgTime.Add(-time.Hour).Format(time.RFC3339), 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			status, messages := getMessages(t, "?since="+url.QueryEscape(tc.since))
+			require.Equal(t, http.StatusOK, status)
+			require.Len(t, messages, tc.expectedCount)
+		})
+	}
+
+	t.Run("invalid timestamp", func(t *testing.T) {
+		t.Parallel()
+		status, _ := getMessages(t, "?since=yesterday")
+		require.Equal(t, http.StatusUnprocessableEntity, status)
+	})
+}
+
+func TestServer_GetMessagesTime(t *testing.T) {
+	t.Parallel()
+	_, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType: msgfmt.AgentTypeClaude,
+		Process:   &fakeAgent{},
+	})
+
+	resp, err := tsServer.Client().Get(tsServer.URL + "/messages")
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	// Decode the raw fields to check how they are serialized.
+	var body struct {
+		Messages []map[string]any `json:"messages"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.Len(t, body.Messages, 1)
+	rawTime, ok := body.Messages[0]["time"].(string)
+	require.True(t, ok, "time is a string")
+	rawTimeMs, ok := body.Messages[0]["time_ms"].(float64)
+	require.True(t, ok, "time_ms is a number")
+
+	msgTime, err := time.Parse(time.RFC3339Nano, rawTime)
+	require.NoError(t, err)
+	require.Equal(t, msgTime.UnixMilli(), int64(rawTimeMs))
+}
+
+func TestServer_GetMessagesOrder(t *testing.T) {
+	t.Parallel()
+	srv, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType:             msgfmt.AgentTypeCustom,
+		Process:               &fakeAgent{screen: "> "},
+		AllowMessageInjection: true,
+	})
+	require.NoError(t, srv.WaitUntilReady(context.Background()))
+
+	for _, content := range []string{"one", "two", "three"} {
+		require.Equal(t, http.StatusOK, postMessage(t, tsServer, httpapi.MessageRequestBody{Content: content, Type: httpapi.MessageTypeUser, Role: st.ConversationRoleAgent}))
+	}
+
+	getContents := func(query string) []string {
+		resp, err := tsServer.Client().Get(tsServer.URL + "/messages" + query)
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var body struct {
+			Messages []httpapi.Message `json:"messages"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		contents := make([]string, 0, len(body.Messages))
+		for _, msg := range body.Messages {
+			contents = append(contents, msg.Content)
+		}
+		return contents
+	}
+	// The first message is the agent's empty screen.
+	require.Equal(t, []string{"", "one", "two", "three"}, getContents(""))
+	require.Equal(t, []string{"", "one", "two", "three"}, getContents("?order=asc"))
+	require.Equal(t, []string{"", "one"}, getContents("?order=asc&limit=2"))
+	require.Equal(t, []string{"three", "two", "one", ""}, getContents("?order=desc"))
+	require.Equal(t, []string{"three", "two"}, getContents("?order=desc&limit=2"))
+	require.Equal(t, []string{"three", "two", "one", ""}, getContents("?order=desc&limit=10"))
+
+	for _, query := range []string{"?order=newest", "?limit=-1"} {
+		resp, err := tsServer.Client().Get(tsServer.URL + "/messages" + query)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, query)
+	}
+}
+
+type testHooks struct {
+	beforeSend func(content string) (string, error)
+	received   chan st.ConversationMessage
+}
+
+func (h testHooks) BeforeSend(content string) (string, error) {
+	return h.beforeSend(content)
+}
+
+func (h testHooks) AfterReceive(msg st.ConversationMessage) error {
+	if h.received != nil {
+		h.received <- msg
+	}
+	return nil
+}
+
+func TestServer_Hooks(t *testing.T) {
+	t.Parallel()
+
+	newServer := func(t *testing.T, agent *fakeAgent, hooks httpapi.Hooks) *httptest.Server {
+		t.Helper()
+		_, tsServer := newTestServer(t, httpapi.ServerConfig{
+			AgentType: msgfmt.AgentTypeCustom,
+			Process:   agent,
+			Hooks:     hooks,
+		})
+		return tsServer
+	}
+	hello := httpapi.MessageRequestBody{Content: "hello", Type: httpapi.MessageTypeUser}
+
+	t.Run("rewrite", func(t *testing.T) {
+		t.Parallel()
+		agent := &fakeAgent{screen: "> ", echo: true}
+		received := make(chan st.ConversationMessage, 10)
+		tsServer := newServer(t, agent, testHooks{
+			beforeSend: func(content string) (string, error) {
+				return strings.ToUpper(content), nil
+			},
+			received: received,
+		})
+
+		sendWhenStable(t, tsServer, hello)
+		require.Contains(t, agent.Written(), "HELLO")
+		require.NotContains(t, agent.Written(), "hello")
+
+		// The agent's first message was complete before the user message was accepted.
+		msg := <-received
+		require.Equal(t, 0, msg.Id)
+		require.Equal(t, st.ConversationRoleAgent, msg.Role)
+	})
+
+	t.Run("block", func(t *testing.T) {
+		t.Parallel()
+		agent := &fakeAgent{screen: "> ", echo: true}
+		tsServer := newServer(t, agent, testHooks{beforeSend: func(content string) (string, error) {
+			return "", xerrors.New("forbidden word")
+		}})
+
+		resp := postJSON(t, tsServer, "/message", hello)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Contains(t, string(body), "forbidden word")
+		require.Empty(t, agent.Written())
+	})
+
+	t.Run("regenerate", func(t *testing.T) {
+		t.Parallel()
+		agent := &fakeAgent{screen: "> ", echo: true}
+		var blocked atomic.Bool
+		tsServer := newServer(t, agent, testHooks{beforeSend: func(content string) (string, error) {
+			if blocked.Load() {
+				return "", xerrors.New("forbidden word")
+			}
+			return content + "!", nil
+		}})
+
+		sendWhenStable(t, tsServer, hello)
+		agent.mu.Lock()
+		agent.screen += "\nfirst reply"
+		agent.mu.Unlock()
+		// The hook gets the message as it was sent, not its own output.
+		require.Eventually(t, func() bool {
+			resp := postJSON(t, tsServer, "/regenerate", nil)
+			return resp.StatusCode == http.StatusOK
+		}, 10*time.Second, 100*time.Millisecond)
+		require.Equal(t, 2, strings.Count(agent.Written(), "hello!"))
+		require.NotContains(t, agent.Written(), "hello!!")
+
+		blocked.Store(true)
+		resp := postJSON(t, tsServer, "/regenerate", nil)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		require.Equal(t, 2, strings.Count(agent.Written(), "hello!"))
+	})
+}
+
+// resizableAgent is a fakeAgent that records the size of its terminal.
+type resizableAgent struct {
+	fakeAgent
+	width, height uint16
+}
+
+func (a *resizableAgent) Resize(width, height uint16) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.width, a.height = width, height
+	return nil
+}
+
+func TestServer_Resize(t *testing.T) {
+	t.Parallel()
+
+	newServer := func(t *testing.T, agent st.AgentIO) *httptest.Server {
+		t.Helper()
+		_, tsServer := newTestServer(t, httpapi.ServerConfig{
+			AgentType: msgfmt.AgentTypeClaude,
+			Process:   agent,
+		})
+		return tsServer
+	}
+	resize := func(t *testing.T, tsServer *httptest.Server, body string) int {
+		t.Helper()
+		resp, err := tsServer.Client().Post(tsServer.URL+"/resize", "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("resizes the terminal", func(t *testing.T) {
+		t.Parallel()
+		agent := &resizableAgent{}
+		tsServer := newServer(t, agent)
+		require.Equal(t, http.StatusOK, resize(t, tsServer, `{"width": 120, "height": 40}`))
+		require.Equal(t, uint16(120), agent.width)
+		require.Equal(t, uint16(40), agent.height)
+	})
+
+	t.Run("invalid sizes", func(t *testing.T) {
+		t.Parallel()
+		agent := &resizableAgent{}
+		tsServer := newServer(t, agent)
+		for _, body := range []string{
+			`{"width": 0, "height": 40}`,
+			`{"width": 120, "height": 9}`,
+			`{"width": -1, "height": 40}`,
+			`{"width": 120, "height": 65536}`,
+		} {
+			require.Equal(t, http.StatusBadRequest, resize(t, tsServer, body), body)
+		}
+		require.Zero(t, agent.width)
+	})
+
+	t.Run("agent without a terminal", func(t *testing.T) {
+		t.Parallel()
+		tsServer := newServer(t, &fakeAgent{})
+		require.Equal(t, http.StatusConflict, resize(t, tsServer, `{"width": 120, "height": 40}`))
+	})
+}
+
+func TestServer_RawInputFilter(t *testing.T) {
+	t.Parallel()
+
+	newServer := func(t *testing.T, agent *fakeAgent, allow, deny []string) *httptest.Server {
+		t.Helper()
+		_, tsServer := newTestServer(t, httpapi.ServerConfig{
+			AgentType:     msgfmt.AgentTypeClaude,
+			Process:       agent,
+			RawInputAllow: allow,
+			RawInputDeny:  deny,
+		})
+		return tsServer
+	}
+	sendRaw := func(t *testing.T, tsServer *httptest.Server, content string) int {
+		t.Helper()
+		return postMessage(t, tsServer, httpapi.MessageRequestBody{Content: content, Type: httpapi.MessageTypeRaw})
+	}
+
+	t.Run("allowlist", func(t *testing.T) {
+		t.Parallel()
+		agent := &fakeAgent{}
+		// Arrow keys and enter.
+		tsServer := newServer(t, agent, []string{`\x1b\[[ABCD]`, `\r`}, nil)
+
+		require.Equal(t, http.StatusOK, sendRaw(t, tsServer, "\x1b[A\x1b[B\r"))
+		require.Equal(t, http.StatusBadRequest, sendRaw(t, tsServer, "\x1b[Arm -rf /\r"))
+		require.Equal(t, http.StatusBadRequest, sendRaw(t, tsServer, "\x03"))
+		require.Equal(t, "\x1b[A\x1b[B\r", agent.Written())
+	})
+
+	t.Run("denylist", func(t *testing.T) {
+		t.Parallel()
+		agent := &fakeAgent{}
+		// Ctrl+C and Ctrl+D.
+		tsServer := newServer(t, agent, nil, []string{`[\x03\x04]`})
+
+		require.Equal(t, http.StatusOK, sendRaw(t, tsServer, "hello"))
+		require.Equal(t, http.StatusBadRequest, sendRaw(t, tsServer, "bye\x03"))
+		require.Equal(t, "hello", agent.Written())
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		t.Parallel()
+		agent := &fakeAgent{}
+		tsServer := newServer(t, agent, nil, nil)
+
+		require.Equal(t, http.StatusOK, sendRaw(t, tsServer, "\x03"))
+		require.Equal(t, "\x03", agent.Written())
+	})
+
+	t.Run("invalid pattern", func(t *testing.T) {
+		t.Parallel()
+		ctx := logctx.WithLogger(context.Background(), slog.New(slog.NewTextHandler(os.Stdout, nil)))
+		_, err := httpapi.NewServer(ctx, httpapi.ServerConfig{
+			AgentType:      msgfmt.AgentTypeClaude,
+			Process:        &fakeAgent{},
+			ChatBasePath:   "/chat",
+			AllowedHosts:   []string{"*"},
+			AllowedOrigins: []string{"*"},
+			RawInputDeny:   []string{"("},
+		})
+		require.ErrorContains(t, err, "invalid raw input deny pattern")
+	})
+}
+
+func TestServer_InjectMessage(t *testing.T) {
+	t.Parallel()
+
+	newServer := func(t *testing.T, agent *fakeAgent, allowInjection bool) *httptest.Server {
+		t.Helper()
+		_, tsServer := newTestServer(t, httpapi.ServerConfig{
+			AgentType:             msgfmt.AgentTypeCustom,
+			Process:               agent,
+			AllowMessageInjection: allowInjection,
+		})
+		return tsServer
+	}
+	systemMessage := httpapi.MessageRequestBody{Content: "Answer in French.", Type: httpapi.MessageTypeUser, Role: st.ConversationRoleSystem}
+
+	t.Run("system message does not trigger a run", func(t *testing.T) {
+		t.Parallel()
+		agent := &fakeAgent{screen: "> "}
+		tsServer := newServer(t, agent, true)
+
+		sendWhenStable(t, tsServer, systemMessage)
+		require.Empty(t, agent.Written())
+
+		getMessages := func(query string) []httpapi.Message {
+			resp, err := tsServer.Client().Get(tsServer.URL + "/messages" + query)
+			require.NoError(t, err)
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			var body struct {
+				Messages []httpapi.Message `json:"messages"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			return body.Messages
+		}
+		// System messages are only returned on request.
+		messages := getMessages("")
+		require.Len(t, messages, 1)
+		require.Equal(t, st.ConversationRoleAgent, messages[0].Role)
+		messages = getMessages("?include=system")
+		require.Len(t, messages, 2)
+		require.Equal(t, st.ConversationRoleSystem, messages[1].Role)
+		require.Equal(t, "Answer in French.", messages[1].Content)
+
+		resp, err := tsServer.Client().Get(tsServer.URL + "/messages?include=tool")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+		statusResp, err := tsServer.Client().Get(tsServer.URL + "/status")
+		require.NoError(t, err)
+		defer func() {
+			_ = statusResp.Body.Close()
+		}()
+		var statusBody struct {
+			Status httpapi.AgentStatus `json:"status"`
+		}
+		require.NoError(t, json.NewDecoder(statusResp.Body).Decode(&statusBody))
+		require.Equal(t, httpapi.AgentStatusStable, statusBody.Status)
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		t.Parallel()
+		agent := &fakeAgent{screen: "> "}
+		tsServer := newServer(t, agent, false)
+		require.Equal(t, http.StatusForbidden, postMessage(t, tsServer, systemMessage))
+	})
+
+	t.Run("raw messages can't have a role", func(t *testing.T) {
+		t.Parallel()
+		agent := &fakeAgent{screen: "> "}
+		tsServer := newServer(t, agent, true)
+		require.Equal(t, http.StatusBadRequest, postMessage(t, tsServer, httpapi.MessageRequestBody{Content: "x", Type: httpapi.MessageTypeRaw, Role: st.ConversationRoleAgent}))
+		require.Empty(t, agent.Written())
+	})
+}
+
+func TestServer_Regenerate(t *testing.T) {
+	t.Parallel()
+
+	agent := &fakeAgent{screen: "> ", echo: true}
+	_, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType: msgfmt.AgentTypeCustom,
+		Process:   agent,
+	})
+
+	post := func(t *testing.T, path string, body any) int {
+		t.Helper()
+		return postJSON(t, tsServer, path, body).StatusCode
+	}
+	reply := func(text string) {
+		agent.mu.Lock()
+		defer agent.mu.Unlock()
+		agent.screen += "\n" + text
+	}
+	lastMessage := func(t *testing.T) httpapi.Message {
+		t.Helper()
+		resp, err := tsServer.Client().Get(tsServer.URL + "/messages")
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		var body struct {
+			Messages []httpapi.Message `json:"messages"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return body.Messages[len(body.Messages)-1]
+	}
+
+	// There's no reply to regenerate yet.
+	require.Equal(t, http.StatusConflict, post(t, "/regenerate", nil))
+
+	sendWhenStable(t, tsServer, httpapi.MessageRequestBody{Content: "hello", Type: httpapi.MessageTypeUser})
+	reply("first reply")
+	require.Eventually(t, func() bool {
+		msg := lastMessage(t)
+		return msg.Role == st.ConversationRoleAgent && msg.Complete && strings.Contains(msg.Content, "first reply")
+	}, 10*time.Second, 100*time.Millisecond)
+
+	require.Equal(t, http.StatusOK, post(t, "/regenerate", nil))
+	require.Equal(t, 2, strings.Count(agent.Written(), "hello"))
+	// The agent is busy with the regenerated reply.
+	require.Equal(t, http.StatusConflict, post(t, "/regenerate", nil))
+
+	reply("second reply")
+	require.Eventually(t, func() bool {
+		msg := lastMessage(t)
+		return msg.Id == 2 && msg.Complete && strings.Contains(msg.Content, "second reply") && !strings.Contains(msg.Content, "first reply")
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+func TestServer_RawFormat(t *testing.T) {
+	t.Parallel()
+
+	newServer := func(t *testing.T, agent *fakeAgent) *httptest.Server {
+		t.Helper()
+		_, tsServer := newTestServer(t, httpapi.ServerConfig{
+			AgentType:    msgfmt.AgentTypeClaude,
+			Process:      agent,
+			PromptPrefix: "Be brief.",
+		})
+		return tsServer
+	}
+	lastUserMessage := func(t *testing.T, tsServer *httptest.Server) string {
+		t.Helper()
+		resp, err := tsServer.Client().Get(tsServer.URL + "/messages")
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		var body struct {
+			Messages []httpapi.Message `json:"messages"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		require.Len(t, body.Messages, 2)
+		require.Equal(t, st.ConversationRoleUser, body.Messages[1].Role)
+		return body.Messages[1].Content
+	}
+
+	t.Run("formatted", func(t *testing.T) {
+		t.Parallel()
+		agent := &fakeAgent{screen: "> ", echo: true}
+		tsServer := newServer(t, agent)
+		sendWhenStable(t, tsServer, httpapi.MessageRequestBody{Content: "  hello  ", Type: httpapi.MessageTypeUser})
+		require.True(t, strings.HasPrefix(agent.Written(), "x\b\x1b[200~Be brief.\n\nhello\x1b[201~"))
+		require.Equal(t, "hello", lastUserMessage(t, tsServer))
+	})
+
+	t.Run("raw format", func(t *testing.T) {
+		t.Parallel()
+		agent := &fakeAgent{screen: "> ", echo: true}
+		tsServer := newServer(t, agent)
+		sendWhenStable(t, tsServer, httpapi.MessageRequestBody{Content: "  hello  ", Type: httpapi.MessageTypeUser, RawFormat: true})
+		require.True(t, strings.HasPrefix(agent.Written(), "  hello  \r"))
+		require.Equal(t, "hello", lastUserMessage(t, tsServer))
+	})
+
+	t.Run("only for user messages", func(t *testing.T) {
+		t.Parallel()
+		agent := &fakeAgent{screen: "> "}
+		tsServer := newServer(t, agent)
+		require.Equal(t, http.StatusBadRequest, postMessage(t, tsServer, httpapi.MessageRequestBody{Content: "x", Type: httpapi.MessageTypeRaw, RawFormat: true}))
+		require.Empty(t, agent.Written())
+	})
+}
+
+// pingableAgent is a fakeAgent that checks its responsiveness with ping.
+type pingableAgent struct {
+	fakeAgent
+	ping func() error
+}
+
+func (a *pingableAgent) Ping() error {
+	return a.ping()
+}
+
+func TestServer_Ping(t *testing.T) {
+	t.Parallel()
+
+	newServer := func(t *testing.T, agent st.AgentIO) *httptest.Server {
+		t.Helper()
+		_, tsServer := newTestServer(t, httpapi.ServerConfig{
+			AgentType: msgfmt.AgentTypeCustom,
+			Process:   agent,
+		})
+		return tsServer
+	}
+	type pingBody struct {
+		Responsive bool   `json:"responsive"`
+		LatencyMs  int64  `json:"latency_ms"`
+		Error      string `json:"error"`
+	}
+	ping := func(t *testing.T, tsServer *httptest.Server, query string) pingBody {
+		t.Helper()
+		resp, err := tsServer.Client().Get(tsServer.URL + "/ping" + query)
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var body pingBody
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return body
+	}
+
+	t.Run("responsive", func(t *testing.T) {
+		t.Parallel()
+		tsServer := newServer(t, &pingableAgent{ping: func() error { return nil }})
+		body := ping(t, tsServer, "")
+		require.True(t, body.Responsive)
+		require.Empty(t, body.Error)
+	})
+
+	t.Run("without ping support", func(t *testing.T) {
+		t.Parallel()
+		tsServer := newServer(t, &fakeAgent{screen: "> "})
+		require.True(t, ping(t, tsServer, "").Responsive)
+	})
+
+	t.Run("unresponsive", func(t *testing.T) {
+		t.Parallel()
+		unblock := make(chan struct{})
+		t.Cleanup(func() { close(unblock) })
+		tsServer := newServer(t, &pingableAgent{ping: func() error {
+			<-unblock
+			return nil
+		}})
+		body := ping(t, tsServer, "?timeout_ms=100")
+		require.False(t, body.Responsive)
+		require.GreaterOrEqual(t, body.LatencyMs, int64(100))
+		require.Contains(t, body.Error, "did not respond")
+	})
+
+	t.Run("error", func(t *testing.T) {
+		t.Parallel()
+		tsServer := newServer(t, &pingableAgent{ping: func() error {
+			return xerrors.New("the process is not running")
+		}})
+		body := ping(t, tsServer, "")
+		require.False(t, body.Responsive)
+		require.Equal(t, "the process is not running", body.Error)
+	})
+}
+
+func TestServer_DisableScreen(t *testing.T) {
+	t.Parallel()
+
+	newServer := func(t *testing.T, disableScreen bool) *httptest.Server {
+		t.Helper()
+		_, tsServer := newTestServer(t, httpapi.ServerConfig{
+			AgentType:     msgfmt.AgentTypeClaude,
+			Process:       &fakeAgent{screen: "> "},
+			DisableScreen: disableScreen,
+		})
+		return tsServer
+	}
+	// get returns the status code and the body received until the request
+	// timeout cuts off the event stream.
+	get := func(t *testing.T, tsServer *httptest.Server, path string) (int, string) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, tsServer.URL+path, nil)
+		require.NoError(t, err)
+		resp, err := tsServer.Client().Do(req)
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		t.Parallel()
+		tsServer := newServer(t, false)
+		status, body := get(t, tsServer, "/internal/screen")
+		require.Equal(t, http.StatusOK, status)
+		require.Contains(t, body, "event: screen")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		tsServer := newServer(t, true)
+		status, _ := get(t, tsServer, "/internal/screen")
+		require.Equal(t, http.StatusNotFound, status)
+
+		// /events still works, but never sends the screen.
+		status, body := get(t, tsServer, "/events?include_screen=true")
+		require.Equal(t, http.StatusOK, status)
+		require.Contains(t, body, "event: status_change")
+		require.NotContains(t, body, "screen_update")
+	})
+}
+
+func TestServer_RedactScreen(t *testing.T) {
+	t.Parallel()
+	_, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType:      msgfmt.AgentTypeCustom,
+		Process:        &fakeAgent{screen: "token: sk-test-1234\n> "},
+		RedactPatterns: []string{`sk-test-[0-9]+`},
+	})
+
+	for _, path := range []string{"/internal/screen", "/events?include_screen=true"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, tsServer.URL+path, nil)
+		require.NoError(t, err)
+		resp, err := tsServer.Client().Do(req)
+		require.NoError(t, err)
+		// The request timeout cuts off the event stream.
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		cancel()
+		require.Contains(t, string(body), "token: ***", path)
+		require.NotContains(t, string(body), "sk-test-1234", path)
+	}
+}
+
+// nonDrainingAgent is a fakeAgent whose input isn't read until unblock is
+// closed, like a pseudo terminal with a full buffer.
+type nonDrainingAgent struct {
+	fakeAgent
+	unblock chan struct{}
+}
+
+func (a *nonDrainingAgent) Write(data []byte) (int, error) {
+	<-a.unblock
+	return a.fakeAgent.Write(data)
+}
+
+// countingAgent is a fakeAgent that counts the messages written to it and
+// blocks the first write until unblock is closed.
+type countingAgent struct {
+	fakeAgent
+	writes  atomic.Int32
+	unblock chan struct{}
+}
+
+func (a *countingAgent) Write(data []byte) (int, error) {
+	if a.writes.Add(1) == 1 {
+		<-a.unblock
+	}
+	return a.fakeAgent.Write(data)
+}
+
+func TestServer_MaxConcurrentSends(t *testing.T) {
+	t.Parallel()
+
+	agent := &countingAgent{fakeAgent: fakeAgent{screen: "> ", echo: true}, unblock: make(chan struct{})}
+	srv, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType: msgfmt.AgentTypeCustom,
+		Process:   agent,
+	})
+	require.NoError(t, srv.WaitUntilReady(context.Background()))
+
+	sendHello := func() int {
+		body, err := json.Marshal(httpapi.MessageRequestBody{Content: "hello", Type: httpapi.MessageTypeUser})
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp, err := tsServer.Client().Post(tsServer.URL+"/message", "application/json", bytes.NewReader(body))
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// The first message takes the only slot and blocks in the agent.
+	firstDone := make(chan int, 1)
+	go func() {
+		firstDone <- sendHello()
+	}()
+	require.Eventually(t, func() bool {
+		return agent.writes.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, 10)
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses <- sendHello()
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+	for status := range statuses {
+		require.Equal(t, http.StatusTooManyRequests, status)
+	}
+	require.Equal(t, int32(1), agent.writes.Load(), "only one message reached the agent")
+
+	close(agent.unblock)
+	require.Equal(t, http.StatusOK, <-firstDone)
+}
+
+func TestServer_RawWriteTimeout(t *testing.T) {
+	t.Parallel()
+
+	agent := &nonDrainingAgent{fakeAgent: fakeAgent{screen: "> "}, unblock: make(chan struct{})}
+	_, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType:       msgfmt.AgentTypeCustom,
+		Process:         agent,
+		RawWriteTimeout: 100 * time.Millisecond,
+	})
+
+	postRaw := func(t *testing.T, content string) int {
+		t.Helper()
+		return postMessage(t, tsServer, httpapi.MessageRequestBody{Content: content, Type: httpapi.MessageTypeRaw})
+	}
+
+	start := time.Now()
+	require.Equal(t, http.StatusServiceUnavailable, postRaw(t, "a"))
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	// The server isn't locked up: other requests are handled, and raw
+	// messages fail fast while the first one is still pending.
+	resp, err := tsServer.Client().Get(tsServer.URL + "/status")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, http.StatusServiceUnavailable, postRaw(t, "b"))
+
+	// Once the agent reads its input again, raw messages go through.
+	close(agent.unblock)
+	require.Eventually(t, func() bool {
+		return agent.Written() == "a"
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, http.StatusOK, postRaw(t, "c"))
+	require.Equal(t, "ac", agent.Written())
+}
+
+func TestServer_ResetStatus(t *testing.T) {
+	t.Parallel()
+
+	_, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType: msgfmt.AgentTypeClaude,
+		Process:   &fakeAgent{screen: "> "},
+	})
+
+	// Without the snapshot loop, the agent never leaves the initial status.
+	getStatus := func() httpapi.AgentStatus {
+		resp, err := tsServer.Client().Get(tsServer.URL + "/status")
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		var body struct {
+			Status httpapi.AgentStatus `json:"status"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return body.Status
+	}
+	require.Equal(t, httpapi.AgentStatusRunning, getStatus())
+
+	resp, err := tsServer.Client().Post(tsServer.URL+"/internal/reset-status", "application/json", nil)
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var body struct {
+		Status httpapi.AgentStatus `json:"status"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.Equal(t, httpapi.AgentStatusStable, body.Status)
+	require.Equal(t, httpapi.AgentStatusStable, getStatus())
+}
+
+// stuckAgent is a fakeAgent whose writes block until release is closed.
+type stuckAgent struct {
+	fakeAgent
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (a *stuckAgent) Write(data []byte) (int, error) {
+	select {
+	case a.writing <- struct{}{}:
+	default:
+	}
+	<-a.release
+	return a.fakeAgent.Write(data)
+}
+
+func TestServer_ResetStatusAbandonsStuckWrite(t *testing.T) {
+	t.Parallel()
+
+	agent := &stuckAgent{
+		fakeAgent: fakeAgent{screen: "> "},
+		writing:   make(chan struct{}, 1),
+		release:   make(chan struct{}),
+	}
+	_, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType: msgfmt.AgentTypeCustom,
+		Process:   agent,
+	})
+	// Runs before the server is closed, which waits for the stuck request.
+	t.Cleanup(func() {
+		close(agent.release)
+	})
+
+	sent := make(chan int, 1)
+	go func() {
+		var status int
+		for {
+			resp, err := tsServer.Client().Post(tsServer.URL+"/message", "application/json", strings.NewReader(`{"content": "hello", "type": "user"}`))
+			if err != nil {
+				sent <- 0
+				return
+			}
+			_ = resp.Body.Close()
+			status = resp.StatusCode
+			if status != http.StatusConflict {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		sent <- status
+	}()
+	select {
+	case <-agent.writing:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the message wasn't written")
+	}
+
+	require.Equal(t, http.StatusOK, postJSON(t, tsServer, "/internal/reset-status", nil).StatusCode)
+	select {
+	case status := <-sent:
+		require.Equal(t, http.StatusInternalServerError, status)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stuck message wasn't abandoned")
+	}
+
+	// The next request doesn't wait for the stuck write: there's no reply
+	// to regenerate, since the message was never added to the history.
+	require.Equal(t, http.StatusConflict, postJSON(t, tsServer, "/regenerate", nil).StatusCode)
+	resp, err := tsServer.Client().Get(tsServer.URL + "/messages")
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	var body struct {
+		Messages []httpapi.Message `json:"messages"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	for _, msg := range body.Messages {
+		require.NotEqual(t, st.ConversationRoleUser, msg.Role)
+	}
+}
+
+func TestServer_AuditLog(t *testing.T) {
+	t.Parallel()
+
+	var auditLog bytes.Buffer
+	_, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType:   msgfmt.AgentTypeClaude,
+		Process:     &fakeAgent{screen: "> "},
+		AuditLogger: slog.New(slog.NewJSONHandler(&auditLog, nil)),
+	})
+
+	postWithRequestId := func(requestId string, body string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, tsServer.URL+"/message", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		if requestId != "" {
+			req.Header.Set("X-Request-Id", requestId)
+		}
+		resp, err := tsServer.Client().Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = resp.Body.Close()
+		})
+		return resp
+	}
+	resp := postWithRequestId("", `{"content": "secret keystrokes", "type": "raw"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	correlationId := resp.Header.Get("X-Request-Id")
+	require.NotEmpty(t, correlationId)
+	resp = postWithRequestId("req-1", `{"content": "hi", "type": "raw", "raw_format": true}`)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	type entry struct {
+		Msg           string `json:"msg"`
+		CorrelationId string `json:"correlationId"`
+		AgentType     string `json:"agentType"`
+		ContentLength int    `json:"contentLength"`
+		Content       string `json:"content"`
+		Status        int    `json:"status"`
+	}
+	var entries []entry
+	for _, line := range strings.Split(strings.TrimSpace(auditLog.String()), "\n") {
+		var e entry
+		require.NoError(t, json.Unmarshal([]byte(line), &e))
+		entries = append(entries, e)
+	}
+	require.Equal(t, []entry{
+		{Msg: "Message request received", CorrelationId: correlationId, AgentType: "claude", ContentLength: len("secret keystrokes")},
+		{Msg: "Message request completed", CorrelationId: correlationId, Status: http.StatusOK},
+		{Msg: "Message request received", CorrelationId: "req-1", AgentType: "claude", ContentLength: len("hi")},
+		{Msg: "Message request completed", CorrelationId: "req-1", Status: http.StatusBadRequest},
+	}, entries)
+}
+
+func TestServer_TrustedProxies(t *testing.T) {
+	t.Parallel()
+
+	// clientIPOf returns the client IP recorded in the audit log for a message
+	// sent from the test server's loopback address with X-Forwarded-For set.
+	clientIPOf := func(t *testing.T, trustedProxies []string) string {
+		var auditLog bytes.Buffer
+		_, tsServer := newTestServer(t, httpapi.ServerConfig{
+			AgentType:      msgfmt.AgentTypeClaude,
+			Process:        &fakeAgent{screen: "> "},
+			TrustedProxies: trustedProxies,
+			AuditLogger:    slog.New(slog.NewJSONHandler(&auditLog, nil)),
+		})
+
+		req, err := http.NewRequest(http.MethodPost, tsServer.URL+"/message", strings.NewReader(`{"content": "x", "type": "raw"}`))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		resp, err := tsServer.Client().Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var entry struct {
+			ClientIp string `json:"clientIp"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(strings.SplitN(auditLog.String(), "\n", 2)[0]), &entry))
+		return entry.ClientIp
+	}
+
+	t.Run("trusted peer", func(t *testing.T) {
+		t.Parallel()
+		require.Equal(t, "203.0.113.9", clientIPOf(t, []string{"127.0.0.0/8"}))
+	})
+
+	t.Run("untrusted peer", func(t *testing.T) {
+		t.Parallel()
+		require.Equal(t, "127.0.0.1", clientIPOf(t, []string{"10.0.0.0/8"}))
+	})
+
+	t.Run("no trusted proxies", func(t *testing.T) {
+		t.Parallel()
+		require.Equal(t, "127.0.0.1", clientIPOf(t, nil))
+	})
+
+	t.Run("invalid range", func(t *testing.T) {
+		t.Parallel()
+		_, err := httpapi.NewServer(logctx.WithLogger(context.Background(), slog.New(logctx.DiscardHandler)), httpapi.ServerConfig{
+			AgentType:      msgfmt.AgentTypeClaude,
+			Process:        &fakeAgent{screen: "> "},
+			AllowedHosts:   []string{"*"},
+			AllowedOrigins: []string{"*"},
+			TrustedProxies: []string{"10.0.0.0/33"},
+		})
+		require.ErrorContains(t, err, "failed to parse trusted proxies")
+	})
+}
+
+// replyingAgent is a fakeAgent that prints a reply to every message it's
+// sent, so that the agent's status settles after each message.
+type replyingAgent struct {
+	fakeAgent
+	replies int
+}
+
+func (a *replyingAgent) Write(data []byte) (int, error) {
+	n, err := a.fakeAgent.Write(data)
+	if strings.Contains(string(data), "\r") {
+		a.mu.Lock()
+		a.replies++
+		a.screen += fmt.Sprintf("\nreply %d\n> ", a.replies)
+		a.mu.Unlock()
+	}
+	return n, err
+}
+
+func TestServer_MessageBatch(t *testing.T) {
+	t.Parallel()
+
+	newServer := func(t *testing.T, agent st.AgentIO) (*httpapi.Server, *httptest.Server) {
+		t.Helper()
+		srv, tsServer := newTestServer(t, httpapi.ServerConfig{
+			AgentType: msgfmt.AgentTypeCustom,
+			Process:   agent,
+		})
+		require.NoError(t, srv.WaitUntilReady(context.Background()))
+		return srv, tsServer
+	}
+	type batchResponse struct {
+		Ok      bool                         `json:"ok"`
+		Results []httpapi.BatchMessageResult `json:"results"`
+	}
+
+	t.Run("ordered", func(t *testing.T) {
+		t.Parallel()
+		agent := &replyingAgent{fakeAgent: fakeAgent{screen: "> ", echo: true}}
+		_, tsServer := newServer(t, agent)
+
+		resp, err := tsServer.Client().Post(tsServer.URL+"/messages/batch", "application/json", strings.NewReader(
+			`{"messages": [{"content": "one", "type": "user"}, {"content": "two", "type": "user"}, {"content": "three", "type": "user"}], "timeout_ms": 20000}`))
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.NotEmpty(t, resp.Header.Get("X-Request-Id"))
+		var body batchResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		require.True(t, body.Ok)
+		require.Equal(t, []httpapi.BatchMessageResult{
+			{Status: httpapi.BatchMessageStatusSent},
+			{Status: httpapi.BatchMessageStatusSent},
+			{Status: httpapi.BatchMessageStatusSent},
+		}, body.Results)
+
+		written := agent.Written()
+		one, two, three := strings.Index(written, "one"), strings.Index(written, "two"), strings.Index(written, "three")
+		require.True(t, one >= 0 && one < two && two < three, "the messages are sent in order: %q", written)
+	})
+
+	t.Run("failed message skips the rest", func(t *testing.T) {
+		t.Parallel()
+		agent := &replyingAgent{fakeAgent: fakeAgent{screen: "> ", echo: true}}
+		_, tsServer := newServer(t, agent)
+
+		resp, err := tsServer.Client().Post(tsServer.URL+"/messages/batch", "application/json", strings.NewReader(
+			`{"messages": [{"content": "one", "type": "user"}, {"content": "two", "type": "user", "role": "agent"}, {"content": "three", "type": "user"}], "timeout_ms": 20000}`))
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var body batchResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		require.False(t, body.Ok)
+		require.Len(t, body.Results, 3)
+		require.Equal(t, httpapi.BatchMessageStatusSent, body.Results[0].Status)
+		require.Equal(t, httpapi.BatchMessageStatusFailed, body.Results[1].Status)
+		require.Contains(t, body.Results[1].Error, "--allow-message-injection")
+		require.Equal(t, httpapi.BatchMessageResult{Status: httpapi.BatchMessageStatusSkipped, Error: "message 1 failed"}, body.Results[2])
+		require.NotContains(t, agent.Written(), "three")
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		t.Parallel()
+		agent := &replyingAgent{fakeAgent: fakeAgent{screen: "> ", echo: true}}
+		srv, tsServer := newServer(t, agent)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, tsServer.URL+"/messages/batch", strings.NewReader(
+			`{"messages": [{"content": "one", "type": "user"}, {"content": "two", "type": "user"}], "timeout_ms": 20000}`))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		done := make(chan error, 1)
+		go func() {
+			resp, err := tsServer.Client().Do(req)
+			if err == nil {
+				_ = resp.Body.Close()
+			}
+			done <- err
+		}()
+		require.Eventually(t, func() bool {
+			return strings.Contains(agent.Written(), "one")
+		}, 10*time.Second, 10*time.Millisecond)
+		cancel()
+		require.ErrorIs(t, <-done, context.Canceled)
+
+		// Once the agent is done with the first message, the second one would
+		// have been sent.
+		waitCtx, waitCancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer waitCancel()
+		require.NoError(t, srv.WaitUntilReady(waitCtx))
+		time.Sleep(500 * time.Millisecond)
+		require.NotContains(t, agent.Written(), "two")
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		t.Parallel()
+		_, tsServer := newServer(t, &fakeAgent{screen: "> "})
+		resp, err := tsServer.Client().Post(tsServer.URL+"/messages/batch", "application/json", strings.NewReader(`{"messages": []}`))
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	})
+}
+
+func TestServer_MessagesText(t *testing.T) {
+	t.Parallel()
+
+	greeting := "Try:\n```sh\nls\n```"
+	_, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType: msgfmt.AgentTypeCustom,
+		Process:   &fakeAgent{screen: "> "},
+		Greeting:  greeting,
+	})
+
+	get := func(path string) (*http.Response, string) {
+		resp, err := tsServer.Client().Get(tsServer.URL + path)
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	resp, body := get("/messages/text?fences=strip")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	require.Equal(t, "agent:\nTry:\nls\n\n", body)
+
+	// The JSON response keeps the raw content.
+	_, body = get("/messages")
+	var messages struct {
+		Messages []httpapi.Message `json:"messages"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &messages))
+	require.Equal(t, greeting, messages.Messages[0].Content)
+}
+
+func TestServer_Greeting(t *testing.T) {
+	t.Parallel()
+
+	_, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType: msgfmt.AgentTypeCustom,
+		Process:   &fakeAgent{screen: "> "},
+		Greeting:  "Hi! Ask me anything.",
+	})
+
+	resp, err := tsServer.Client().Get(tsServer.URL + "/messages")
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	var body struct {
+		Messages []httpapi.Message `json:"messages"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	require.Len(t, body.Messages, 1)
+	require.Equal(t, 0, body.Messages[0].Id)
+	require.Equal(t, st.ConversationRoleAgent, body.Messages[0].Role)
+	require.Equal(t, "Hi! Ask me anything.", body.Messages[0].Content)
+}
+
+func TestServer_RegisteredAgent(t *testing.T) {
+	t.Parallel()
+
+	msgfmt.RegisterAgent(msgfmt.Agent{
+		Type: "httpapi-test-agent",
+		FormatMessage: func(message string, userInput string) string {
+			return strings.ToUpper(msgfmt.RemoveUserInput(message, userInput, "httpapi-test-agent"))
+		},
+	})
+
+	agent := &fakeAgent{screen: "> ", echo: true}
+	_, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType: "httpapi-test-agent",
+		Process:   agent,
+	})
+
+	sendWhenStable(t, tsServer, httpapi.MessageRequestBody{Content: "hello", Type: httpapi.MessageTypeUser})
+	agent.mu.Lock()
+	agent.screen = "> hello\nhi there"
+	agent.mu.Unlock()
+
+	require.Eventually(t, func() bool {
+		resp, err := tsServer.Client().Get(tsServer.URL + "/messages")
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		var body struct {
+			Messages []httpapi.Message `json:"messages"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		last := body.Messages[len(body.Messages)-1]
+		return last.Role == st.ConversationRoleAgent && last.Content == "HI THERE"
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+func TestServer_DebugAgentIO(t *testing.T) {
+	t.Parallel()
+
+	newServer := func(t *testing.T, debug bool) *httptest.Server {
+		srv, tsServer := newTestServer(t, httpapi.ServerConfig{
+			AgentType:    msgfmt.AgentTypeCustom,
+			Process:      &fakeAgent{screen: "> ", echo: true},
+			DebugAgentIO: debug,
+		})
+		require.NoError(t, srv.WaitUntilReady(context.Background()))
+		return tsServer
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		tsServer := newServer(t, false)
+		resp, err := tsServer.Client().Get(tsServer.URL + "/internal/agent-io")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("send", func(t *testing.T) {
+		t.Parallel()
+		tsServer := newServer(t, true)
+		for _, body := range []httpapi.MessageRequestBody{
+			{Content: "hello", Type: httpapi.MessageTypeUser},
+			{Content: "\x1b[A", Type: httpapi.MessageTypeRaw},
+		} {
+			require.Equal(t, http.StatusOK, postMessage(t, tsServer, body))
+		}
+
+		resp, err := tsServer.Client().Get(tsServer.URL + "/internal/agent-io")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var log httpapi.AgentIOLogResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&log.Body))
+		var written strings.Builder
+		for _, entry := range log.Body.Entries {
+			require.Empty(t, entry.Error)
+			require.False(t, entry.Time.IsZero())
+			written.WriteString(entry.Data)
+		}
+		require.Contains(t, written.String(), "hello")
+		require.Equal(t, "\x1b[A", log.Body.Entries[len(log.Body.Entries)-1].Data)
+	})
+}
+
+func TestServer_Meta(t *testing.T) {
+	t.Parallel()
+
+	var auditLog bytes.Buffer
+	_, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType:   msgfmt.AgentTypeClaude,
+		Process:     &fakeAgent{screen: "> "},
+		AuditLogger: slog.New(slog.NewJSONHandler(&auditLog, nil)),
+		Meta:        map[string]string{"project": "web"},
+	})
+
+	do := func(method string, path string, body string) (int, map[string]string) {
+		req, err := http.NewRequest(method, tsServer.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := tsServer.Client().Do(req)
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		var respBody struct {
+			Meta map[string]string `json:"meta"`
+		}
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&respBody))
+		}
+		return resp.StatusCode, respBody.Meta
+	}
+
+	status, meta := do(http.MethodGet, "/meta", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, map[string]string{"project": "web"}, meta)
+
+	status, meta = do(http.MethodPut, "/meta", `{"meta": {"user": "u-1", "ticket": "ENG-12"}}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, map[string]string{"user": "u-1", "ticket": "ENG-12"}, meta)
+	status, meta = do(http.MethodGet, "/meta", "")
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, map[string]string{"user": "u-1", "ticket": "ENG-12"}, meta)
+
+	status, _ = do(http.MethodPut, "/meta", `{"meta": {"": "x"}}`)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = do(http.MethodPost, "/message", `{"content": "x", "type": "raw"}`)
+	require.Equal(t, http.StatusOK, status)
+	var entry struct {
+		Msg  string            `json:"msg"`
+		Meta map[string]string `json:"meta"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(strings.SplitN(auditLog.String(), "\n", 2)[0]), &entry))
+	require.Equal(t, "Message request received", entry.Msg)
+	require.Equal(t, map[string]string{"user": "u-1", "ticket": "ENG-12"}, entry.Meta)
+
+	// Clearing the metadata.
+	status, meta = do(http.MethodPut, "/meta", `{"meta": {}}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Empty(t, meta)
+}
+
+func TestServer_StripANSI(t *testing.T) {
+	t.Parallel()
+
+	screen := "\x1b[1;32mready\x1b[0m to help\n> "
+	for _, tc := range []struct {
+		name         string
+		preserveANSI bool
+		expected     string
+	}{
+		{"stripped by default", false, "ready to help"},
+		{"preserved", true, "\x1b[1;32mready\x1b[0m to help"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			srv, tsServer := newTestServer(t, httpapi.ServerConfig{
+				AgentType:    msgfmt.AgentTypeCustom,
+				Process:      &fakeAgent{screen: screen},
+				PreserveANSI: tc.preserveANSI,
+			})
+			require.NoError(t, srv.WaitUntilReady(context.Background()))
+
+			resp, err := tsServer.Client().Get(tsServer.URL + "/messages")
+			require.NoError(t, err)
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+			var body struct {
+				Messages []httpapi.Message `json:"messages"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			require.Len(t, body.Messages, 1)
+			require.Equal(t, tc.expected, body.Messages[0].Content)
+		})
+	}
+}
+
+func TestServer_Trim(t *testing.T) {
+	t.Parallel()
+
+	screen := "  ready\n\n\n\nto help\n$"
+	for _, tc := range []struct {
+		name     string
+		trim     *msgfmt.TrimOptions
+		expected string
+	}{
+		{"agent defaults", nil, "  ready\n\n\n\nto help\n$"},
+		{"configured", &msgfmt.TrimOptions{Whitespace: true, CollapseBlankLines: true, PromptArtifacts: true}, "ready\n\nto help"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			srv, tsServer := newTestServer(t, httpapi.ServerConfig{
+				AgentType: msgfmt.AgentTypeCustom,
+				Process:   &fakeAgent{screen: screen},
+				Trim:      tc.trim,
+			})
+			require.NoError(t, srv.WaitUntilReady(context.Background()))
+
+			resp, err := tsServer.Client().Get(tsServer.URL + "/messages")
+			require.NoError(t, err)
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+			var body struct {
+				Messages []httpapi.Message `json:"messages"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			require.Len(t, body.Messages, 1)
+			require.Equal(t, tc.expected, body.Messages[0].Content)
+		})
+	}
+}
+
+func TestServer_IdempotencyKey(t *testing.T) {
+	t.Parallel()
+
+	agent := &fakeAgent{screen: "> "}
+	_, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType: msgfmt.AgentTypeClaude,
+		Process:   agent,
+	})
+
+	postWithKey := func(idempotencyKey string, body string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, tsServer.URL+"/message", strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		if idempotencyKey != "" {
+			req.Header.Set("Idempotency-Key", idempotencyKey)
+		}
+		resp, err := tsServer.Client().Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = resp.Body.Close()
+		})
+		return resp
+	}
+
+	first := postWithKey("key-1", `{"content": "a", "type": "raw"}`)
+	require.Equal(t, http.StatusOK, first.StatusCode)
+	duplicate := postWithKey("key-1", `{"content": "a", "type": "raw"}`)
+	require.Equal(t, http.StatusOK, duplicate.StatusCode)
+	require.Equal(t, first.Header.Get("X-Request-Id"), duplicate.Header.Get("X-Request-Id"))
+	require.Equal(t, "a", agent.Written(), "the duplicate isn't sent to the agent")
+	require.Equal(t, http.StatusUnprocessableEntity, postWithKey("key-1", `{"content": "b", "type": "raw"}`).StatusCode)
+	require.Equal(t, "a", agent.Written(), "a reused key isn't sent to the agent")
+
+	require.Equal(t, http.StatusOK, postWithKey("key-2", `{"content": "b", "type": "raw"}`).StatusCode)
+	require.Equal(t, http.StatusOK, postWithKey("", `{"content": "c", "type": "raw"}`).StatusCode)
+	require.Equal(t, http.StatusOK, postWithKey("", `{"content": "c", "type": "raw"}`).StatusCode)
+	require.Equal(t, "abcc", agent.Written())
+
+	// Failed requests may be retried with the same key.
+	require.Equal(t, http.StatusBadRequest, postWithKey("key-3", `{"content": "d", "type": "raw", "raw_format": true}`).StatusCode)
+	require.Equal(t, http.StatusOK, postWithKey("key-3", `{"content": "d", "type": "raw"}`).StatusCode)
+	require.Equal(t, "abccd", agent.Written())
+}
+
+func TestServer_ExtractDiffs(t *testing.T) {
+	t.Parallel()
+
+	screen := "Editing greet.py\n--- greet.py\n+++ greet.py\n@@ ... @@\n-hello\n+hello world\n\n> "
+	for _, tc := range []struct {
+		name         string
+		extractDiffs bool
+		expected     []httpapi.FileDiff
+	}{
+		{"disabled by default", false, nil},
+		{"enabled", true, []httpapi.FileDiff{{Path: "greet.py", Hunks: []string{"@@ ... @@\n-hello\n+hello world"}}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			srv, tsServer := newTestServer(t, httpapi.ServerConfig{
+				AgentType:    msgfmt.AgentTypeAider,
+				Process:      &fakeAgent{screen: screen},
+				ExtractDiffs: tc.extractDiffs,
+			})
+			require.NoError(t, srv.WaitUntilReady(context.Background()))
+
+			resp, err := tsServer.Client().Get(tsServer.URL + "/messages")
+			require.NoError(t, err)
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+			var body struct {
+				Messages []httpapi.Message `json:"messages"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			require.Len(t, body.Messages, 1)
+			require.Contains(t, body.Messages[0].Content, "+hello world")
+			require.Equal(t, tc.expected, body.Messages[0].Diffs)
+		})
+	}
+}
+
+func TestServer_ExtractCommands(t *testing.T) {
+	t.Parallel()
+
+	screen := "Running ls\nmain.go\n\n> "
+	for _, tc := range []struct {
+		name            string
+		extractCommands bool
+		expected        []httpapi.CommandRun
+	}{
+		{"disabled by default", false, nil},
+		{"enabled", true, []httpapi.CommandRun{{Command: "ls", Output: "main.go", Status: "unknown"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			srv, tsServer := newTestServer(t, httpapi.ServerConfig{
+				AgentType:       msgfmt.AgentTypeAider,
+				Process:         &fakeAgent{screen: screen},
+				ExtractCommands: tc.extractCommands,
+			})
+			require.NoError(t, srv.WaitUntilReady(context.Background()))
+
+			resp, err := tsServer.Client().Get(tsServer.URL + "/messages")
+			require.NoError(t, err)
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+			var body struct {
+				Messages []httpapi.Message `json:"messages"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			require.Len(t, body.Messages, 1)
+			require.Contains(t, body.Messages[0].Content, "Running ls")
+			require.Equal(t, tc.expected, body.Messages[0].Commands)
+		})
+	}
+}
+
+func TestServer_Annotations(t *testing.T) {
+	t.Parallel()
+
+	srv, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType: msgfmt.AgentTypeCustom,
+		Process:   &fakeAgent{screen: "Hello there\n\n> "},
+	})
+	require.NoError(t, srv.WaitUntilReady(context.Background()))
+
+	annotate := func(t *testing.T, id int, body string) (int, []httpapi.Annotation) {
+		t.Helper()
+		resp, err := tsServer.Client().Post(fmt.Sprintf("%s/messages/%d/annotations", tsServer.URL, id), "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		var respBody struct {
+			Annotations []httpapi.Annotation `json:"annotations"`
+		}
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&respBody))
+		}
+		return resp.StatusCode, respBody.Annotations
+	}
+
+	status, annotations := annotate(t, 0, `{"reaction": "thumbs_up"}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, annotations, 1)
+	require.Equal(t, "thumbs_up", annotations[0].Reaction)
+	status, annotations = annotate(t, 0, `{"reaction": "thumbs_down", "note": "  Too terse  "}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, annotations, 2)
+	require.Equal(t, "Too terse", annotations[1].Note)
+
+	// The annotations are listed on their own and with the message.
+	resp, err := tsServer.Client().Get(tsServer.URL + "/messages/0/annotations")
+	require.NoError(t, err)
+	var listed struct {
+		Annotations []httpapi.Annotation `json:"annotations"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&listed))
+	_ = resp.Body.Close()
+	require.Equal(t, annotations, listed.Annotations)
+
+	resp, err = tsServer.Client().Get(tsServer.URL + "/messages")
+	require.NoError(t, err)
+	var messages struct {
+		Messages []httpapi.Message `json:"messages"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&messages))
+	_ = resp.Body.Close()
+	require.Len(t, messages.Messages, 1)
+	require.Equal(t, annotations, messages.Messages[0].Annotations)
+
+	t.Run("invalid", func(t *testing.T) {
+		status, _ := annotate(t, 7, `{"reaction": "thumbs_up"}`)
+		require.Equal(t, http.StatusNotFound, status)
+		status, _ = annotate(t, 0, `{"note": " "}`)
+		require.Equal(t, http.StatusBadRequest, status)
+		status, _ = annotate(t, 0, `{"reaction": "heart"}`)
+		require.Equal(t, http.StatusUnprocessableEntity, status)
+
+		resp, err := tsServer.Client().Get(tsServer.URL + "/messages/7/annotations")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestServer_Tail(t *testing.T) {
+	t.Parallel()
+
+	newServer := func(t *testing.T, enableTail bool) (*httpapi.Server, *httptest.Server) {
+		t.Helper()
+		srv, tsServer := newTestServer(t, httpapi.ServerConfig{
+			AgentType:      msgfmt.AgentTypeCustom,
+			Process:        &fakeAgent{screen: "Hello there\n\n> ", echo: true},
+			AllowedOrigins: []string{"https://example.com"},
+			EnableTail:     enableTail,
+		})
+		require.NoError(t, srv.WaitUntilReady(context.Background()))
+		return srv, tsServer
+	}
+
+	t.Run("history and new messages", func(t *testing.T) {
+		t.Parallel()
+		srv, tsServer := newServer(t, true)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		t.Cleanup(cancel)
+
+		conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(tsServer.URL, "http")+"/tail", nil)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = conn.CloseNow()
+		})
+		read := func() string {
+			t.Helper()
+			typ, data, err := conn.Read(ctx)
+			require.NoError(t, err)
+			require.Equal(t, websocket.MessageText, typ)
+			return string(data)
+		}
+		require.Equal(t, "agent: Hello there", read())
+
+		require.Equal(t, http.StatusOK, postMessage(t, tsServer, httpapi.MessageRequestBody{Content: "ping", Type: httpapi.MessageTypeUser}))
+		require.Equal(t, "user: ping", read())
+
+		// Stopping the server closes the connection.
+		require.NoError(t, srv.Stop(context.Background()))
+		for {
+			if _, _, err := conn.Read(ctx); err != nil {
+				require.Equal(t, websocket.StatusGoingAway, websocket.CloseStatus(err))
+				break
+			}
+		}
+	})
+
+	t.Run("origin", func(t *testing.T) {
+		t.Parallel()
+		_, tsServer := newServer(t, true)
+		_, resp, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(tsServer.URL, "http")+"/tail", &websocket.DialOptions{
+			HTTPHeader: http.Header{"Origin": []string{"https://evil.example"}},
+		})
+		require.Error(t, err)
+		require.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		_, tsServer := newServer(t, false)
+		resp, err := tsServer.Client().Get(tsServer.URL + "/tail")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestServer_PromptPatterns(t *testing.T) {
+	t.Parallel()
+
+	newServer := func(t *testing.T, agent *fakeAgent, config httpapi.ServerConfig) (*httpapi.Server, *httptest.Server) {
+		t.Helper()
+		config.AgentType = msgfmt.AgentTypeCustom
+		config.Process = agent
+		return newTestServer(t, config)
+	}
+	getStatus := func(t *testing.T, tsServer *httptest.Server) httpapi.AgentStatus {
+		t.Helper()
+		resp, err := tsServer.Client().Get(tsServer.URL + "/status")
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		var body struct {
+			Status httpapi.AgentStatus `json:"status"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return body.Status
+	}
+
+	t.Run("ready pattern", func(t *testing.T) {
+		t.Parallel()
+		agent := &fakeAgent{screen: "Welcome to my-agent 2.0\n\n  > "}
+		_, tsServer := newServer(t, agent, httpapi.ServerConfig{
+			InitialPrompt: "hello",
+			ReadyPattern:  `(?m)^my-agent 2\.0 ready$`,
+		})
+		// The generic input box detection would find the prompt, the
+		// override doesn't.
+		time.Sleep(4 * time.Second)
+		require.Equal(t, httpapi.AgentStatusRunning, getStatus(t, tsServer))
+		require.Empty(t, agent.Written())
+
+		agent.mu.Lock()
+		agent.screen = "my-agent 2.0 ready\n  > "
+		agent.mu.Unlock()
+		require.Eventually(t, func() bool {
+			return strings.Contains(agent.Written(), "hello")
+		}, 10*time.Second, 100*time.Millisecond)
+	})
+
+	t.Run("idle pattern", func(t *testing.T) {
+		t.Parallel()
+		agent := &fakeAgent{screen: "Working on it..."}
+		_, tsServer := newServer(t, agent, httpapi.ServerConfig{
+			IdlePattern: `(?m)^idle> $`,
+		})
+		time.Sleep(4 * time.Second)
+		require.Equal(t, httpapi.AgentStatusRunning, getStatus(t, tsServer), "the screen is stable, but the agent isn't idle")
+
+		agent.mu.Lock()
+		agent.screen = "Done\nidle> "
+		agent.mu.Unlock()
+		require.Eventually(t, func() bool {
+			return getStatus(t, tsServer) == httpapi.AgentStatusStable
+		}, 10*time.Second, 100*time.Millisecond)
+	})
+
+	t.Run("invalid pattern", func(t *testing.T) {
+		t.Parallel()
+		for _, config := range []httpapi.ServerConfig{{ReadyPattern: "("}, {IdlePattern: "("}} {
+			config.AgentType = msgfmt.AgentTypeCustom
+			config.Process = &fakeAgent{}
+			config.ChatBasePath = "/chat"
+			config.AllowedHosts = []string{"*"}
+			config.AllowedOrigins = []string{"*"}
+			_, err := httpapi.NewServer(logctx.WithLogger(context.Background(), slog.New(logctx.DiscardHandler)), config)
+			require.ErrorContains(t, err, "pattern")
+		}
+	})
+}
+
+func TestServer_DebugRawScreen(t *testing.T) {
+	t.Parallel()
+
+	screen := "Hello there\n\n> "
+	for _, tc := range []struct {
+		name           string
+		debugRawScreen bool
+		expected       string
+	}{
+		{"disabled by default", false, ""},
+		{"enabled", true, screen},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			srv, tsServer := newTestServer(t, httpapi.ServerConfig{
+				AgentType:      msgfmt.AgentTypeCustom,
+				Process:        &fakeAgent{screen: screen},
+				DebugRawScreen: tc.debugRawScreen,
+			})
+			require.NoError(t, srv.WaitUntilReady(context.Background()))
+
+			resp, err := tsServer.Client().Get(tsServer.URL + "/messages")
+			require.NoError(t, err)
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+			var body struct {
+				Messages []map[string]any `json:"messages"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			require.Len(t, body.Messages, 1)
+			require.Equal(t, "Hello there", body.Messages[0]["content"])
+			rawScreen, ok := body.Messages[0]["raw_screen"]
+			require.Equal(t, tc.debugRawScreen, ok, "raw_screen is only present when enabled")
+			if ok {
+				require.Equal(t, tc.expected, rawScreen)
+			}
+		})
+	}
+
+	t.Run("disabled screen", func(t *testing.T) {
+		t.Parallel()
+		_, err := httpapi.NewServer(logctx.WithLogger(context.Background(), slog.New(slog.NewTextHandler(os.Stdout, nil))), httpapi.ServerConfig{
+			AgentType:      msgfmt.AgentTypeCustom,
+			Process:        &fakeAgent{screen: screen},
+			Port:           0,
+			ChatBasePath:   "/chat",
+			AllowedHosts:   []string{"*"},
+			AllowedOrigins: []string{"*"},
+			DebugRawScreen: true,
+			DisableScreen:  true,
+		})
+		require.ErrorContains(t, err, "screen is disabled")
+	})
+}
+
+func TestServer_KeepInvalidUTF8(t *testing.T) {
+	t.Parallel()
+
+	screen := "Hello \xff\xfe there"
+	for _, keep := range []bool{false, true} {
+		t.Run(fmt.Sprintf("keep=%t", keep), func(t *testing.T) {
+			t.Parallel()
+			srv, tsServer := newTestServer(t, httpapi.ServerConfig{
+				AgentType:       msgfmt.AgentTypeCustom,
+				Process:         &fakeAgent{screen: screen},
+				KeepInvalidUTF8: keep,
+			})
+			require.NoError(t, srv.WaitUntilReady(context.Background()))
+
+			resp, err := tsServer.Client().Get(tsServer.URL + "/messages")
+			require.NoError(t, err)
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+			data, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.True(t, utf8.Valid(data), "response: %q", data)
+			require.True(t, json.Valid(data), "response: %q", data)
+			var body struct {
+				Messages []map[string]any `json:"messages"`
+			}
+			require.NoError(t, json.Unmarshal(data, &body))
+			require.Len(t, body.Messages, 1)
+			require.Equal(t, "Hello \uFFFD there", body.Messages[0]["content"])
+			rawBase64, ok := body.Messages[0]["raw_base64"]
+			require.Equal(t, keep, ok, "raw_base64 is only present when enabled")
+			if ok {
+				raw, err := base64.StdEncoding.DecodeString(rawBase64.(string))
+				require.NoError(t, err)
+				require.Equal(t, screen, string(raw))
+			}
+		})
+	}
+}
+
+func TestServer_MessageModel(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name     string
+		provider string
+		model    string
+	}{
+		{name: "configured", provider: "anthropic", model: "claude-sonnet-4"},
+		{name: "unset"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			srv, tsServer := newTestServer(t, httpapi.ServerConfig{
+				AgentType: msgfmt.AgentTypeCustom,
+				Process:   &fakeAgent{screen: "Hello"},
+				Provider:  tc.provider,
+				Model:     tc.model,
+			})
+			require.NoError(t, srv.WaitUntilReady(context.Background()))
+
+			resp, err := tsServer.Client().Get(tsServer.URL + "/messages")
+			require.NoError(t, err)
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+			var body struct {
+				Messages []httpapi.Message `json:"messages"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			require.Len(t, body.Messages, 1)
+			require.Equal(t, st.ConversationRoleAgent, body.Messages[0].Role)
+			require.Equal(t, tc.provider, body.Messages[0].Provider)
+			require.Equal(t, tc.model, body.Messages[0].Model)
+		})
+	}
+}
+
+func TestServer_MessageFiles(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "main.go"), []byte("package main"), 0o644))
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	require.NoError(t, err)
+
+	newServer := func(t *testing.T, filesRoot string) (*httptest.Server, *fakeAgent) {
+		agent := &fakeAgent{screen: "> ", echo: true}
+		srv, tsServer := newTestServer(t, httpapi.ServerConfig{
+			AgentType: msgfmt.AgentTypeClaude,
+			Process:   agent,
+			FilesRoot: filesRoot,
+		})
+		require.NoError(t, srv.WaitUntilReady(context.Background()))
+		return tsServer, agent
+	}
+	postFiles := func(t *testing.T, tsServer *httptest.Server, files ...string) int {
+		return postMessage(t, tsServer, httpapi.MessageRequestBody{Content: "Review this", Type: httpapi.MessageTypeUser, Files: files})
+	}
+
+	t.Run("valid path", func(t *testing.T) {
+		t.Parallel()
+		tsServer, agent := newServer(t, root)
+		require.Equal(t, http.StatusOK, postFiles(t, tsServer, "main.go"))
+		require.Contains(t, agent.Written(), "@"+filepath.Join(resolvedRoot, "main.go"))
+	})
+
+	t.Run("traversal", func(t *testing.T) {
+		t.Parallel()
+		tsServer, agent := newServer(t, root)
+		require.Equal(t, http.StatusForbidden, postFiles(t, tsServer, "../../etc/passwd"))
+		require.Empty(t, agent.Written())
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		t.Parallel()
+		tsServer, agent := newServer(t, root)
+		require.Equal(t, http.StatusBadRequest, postFiles(t, tsServer, "main.go", "missing.go"))
+		require.Empty(t, agent.Written())
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		t.Parallel()
+		tsServer, agent := newServer(t, "")
+		require.Equal(t, http.StatusForbidden, postFiles(t, tsServer, "main.go"))
+		require.Empty(t, agent.Written())
+	})
+}
+
+func TestServer_Notice(t *testing.T) {
+	t.Parallel()
+	_, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType: msgfmt.AgentTypeClaude,
+		Process:   &fakeAgent{screen: "> "},
+	})
+
+	reqCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Notices are only sent if asked for. status_change is asked for too, so
+	// that the headers arrive with the events that recreate the state, and
+	// the subscriber is registered by now.
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, tsServer.URL+"/events?types=status_change,notice", nil)
+	require.NoError(t, err)
+	resp, err := tsServer.Client().Do(req)
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	postNotice := func(body string) int {
+		resp, err := tsServer.Client().Post(tsServer.URL+"/internal/notice", "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusUnprocessableEntity, postNotice(`{"text": ""}`))
+	require.Equal(t, http.StatusUnprocessableEntity, postNotice(`{"text": "hi", "severity": "fatal"}`))
+	require.Equal(t, http.StatusOK, postNotice(`{"text": "The server restarts in 30 seconds.", "severity": "warning"}`))
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if scanner.Text() != "event: notice" {
+			continue
+		}
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				var notice httpapi.NoticeBody
+				require.NoError(t, json.Unmarshal([]byte(data), &notice))
+				require.Equal(t, httpapi.NoticeBody{Severity: "warning", Text: "The server restarts in 30 seconds."}, notice)
+				return
+			}
+		}
+	}
+	t.Fatalf("no notice event received: %v", scanner.Err())
+}
+
+func TestServer_Permissions(t *testing.T) {
+	t.Parallel()
+
+	newServer := func(t *testing.T, agent *fakeAgent, pattern string) *httptest.Server {
+		t.Helper()
+		_, tsServer := newTestServer(t, httpapi.ServerConfig{
+			AgentType:             msgfmt.AgentTypeCustom,
+			Process:               agent,
+			PermissionPattern:     pattern,
+			PermissionApproveKeys: "y\r",
+		})
+		return tsServer
+	}
+	answer := func(t *testing.T, tsServer *httptest.Server, id int, decision string) int {
+		t.Helper()
+		resp, err := tsServer.Client().Post(fmt.Sprintf("%s/permissions/%d", tsServer.URL, id), "application/json", strings.NewReader(`{"decision": "`+decision+`"}`))
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		t.Parallel()
+		agent := &fakeAgent{screen: "Allow Bash(go test ./...)? [y/n]"}
+		tsServer := newServer(t, agent, `Allow (?P<tool>\w+)\((?P<action>[^)]*)\)\?`)
+
+		reqCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, tsServer.URL+"/events?types=permission_request,permission_resolved", nil)
+		require.NoError(t, err)
+		resp, err := tsServer.Client().Do(req)
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		scanner := bufio.NewScanner(resp.Body)
+		// nextEvent returns the type and data of the next event on the stream.
+		nextEvent := func() (string, string) {
+			var eventType string
+			for scanner.Scan() {
+				if value, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+					eventType = value
+				}
+				if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+					return eventType, data
+				}
+			}
+			t.Fatalf("the stream ended: %v", scanner.Err())
+			return "", ""
+		}
+
+		eventType, data := nextEvent()
+		require.Equal(t, "permission_request", eventType)
+		var request httpapi.PermissionRequestBody
+		require.NoError(t, json.Unmarshal([]byte(data), &request))
+		require.Equal(t, httpapi.PermissionRequestBody{Id: 0, Tool: "Bash", Action: "go test ./...", Prompt: "Allow Bash(go test ./...)?"}, request)
+
+		require.Equal(t, http.StatusUnprocessableEntity, answer(t, tsServer, request.Id, "maybe"))
+		require.Equal(t, http.StatusNotFound, answer(t, tsServer, request.Id+1, "approve"))
+		require.Equal(t, http.StatusOK, answer(t, tsServer, request.Id, "approve"))
+		require.Equal(t, "y\r", agent.Written())
+		require.Equal(t, http.StatusConflict, answer(t, tsServer, request.Id, "deny"))
+
+		// The agent goes ahead.
+		agent.mu.Lock()
+		agent.screen = "Running go test ./..."
+		agent.mu.Unlock()
+		eventType, data = nextEvent()
+		require.Equal(t, "permission_resolved", eventType)
+		var resolved httpapi.PermissionResolvedBody
+		require.NoError(t, json.Unmarshal([]byte(data), &resolved))
+		require.Equal(t, httpapi.PermissionResolvedBody{Id: request.Id, Decision: httpapi.PermissionDecisionApprove}, resolved)
+		require.Equal(t, http.StatusNotFound, answer(t, tsServer, request.Id, "deny"))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		agent := &fakeAgent{screen: "Allow Bash(ls)?"}
+		tsServer := newServer(t, agent, "")
+		require.Equal(t, http.StatusNotFound, answer(t, tsServer, 0, "approve"))
+		require.Empty(t, agent.Written())
+	})
+}
+
+func TestServer_Capabilities(t *testing.T) {
+	t.Parallel()
+
+	getCapabilities := func(t *testing.T, config httpapi.ServerConfig) httpapi.Capabilities {
+		t.Helper()
+		_, tsServer := newTestServer(t, config)
+
+		resp, err := tsServer.Client().Get(tsServer.URL + "/capabilities")
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var body struct {
+			AgentType    msgfmt.AgentType     `json:"agent_type"`
+			Capabilities httpapi.Capabilities `json:"capabilities"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		require.Equal(t, config.AgentType, body.AgentType)
+		return body.Capabilities
+	}
+
+	t.Run("terminal agent", func(t *testing.T) {
+		t.Parallel()
+		capabilities := getCapabilities(t, httpapi.ServerConfig{
+			AgentType:       msgfmt.AgentTypeClaude,
+			Process:         &resizableAgent{fakeAgent: fakeAgent{screen: "> "}},
+			ExtractDiffs:    true,
+			ExtractCommands: true,
+		})
+		require.Equal(t, httpapi.Capabilities{
+			RawInput:     true,
+			FileMentions: true,
+			Screen:       true,
+			Resize:       true,
+			// Claude's diffs aren't recognized.
+			Commands: true,
+		}, capabilities)
+	})
+
+	t.Run("opencode", func(t *testing.T) {
+		t.Parallel()
+		capabilities := getCapabilities(t, httpapi.ServerConfig{
+			AgentType:             msgfmt.AgentTypeOpencode,
+			Process:               &fakeAgent{screen: "> "},
+			FilesRoot:             t.TempDir(),
+			DisableScreen:         true,
+			PermissionPattern:     `Allow \w+\?`,
+			ExtractCommands:       true,
+			EnableTail:            true,
+			AllowMessageInjection: true,
+		})
+		require.Equal(t, httpapi.Capabilities{
+			RawInput:         true,
+			Attachments:      true,
+			FileMentions:     true,
+			Permissions:      true,
+			Tail:             true,
+			MessageInjection: true,
+		}, capabilities)
+	})
+}
+
+func TestServer_MessagePreview(t *testing.T) {
+	t.Parallel()
+
+	const greeting = "Hi! Ask me anything about this repository."
+	newServer := func(t *testing.T, previewLength int) *httptest.Server {
+		t.Helper()
+		_, tsServer := newTestServer(t, httpapi.ServerConfig{
+			AgentType:            msgfmt.AgentTypeCustom,
+			Process:              &fakeAgent{screen: "> "},
+			Greeting:             greeting,
+			MessagePreviewLength: previewLength,
+		})
+		return tsServer
+	}
+	get := func(t *testing.T, tsServer *httptest.Server, path string, body any) {
+		t.Helper()
+		resp, err := tsServer.Client().Get(tsServer.URL + path)
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(body))
+	}
+	getMessages := func(t *testing.T, tsServer *httptest.Server, query string) []httpapi.Message {
+		t.Helper()
+		var body struct {
+			Messages []httpapi.Message `json:"messages"`
+		}
+		get(t, tsServer, "/messages"+query, &body)
+		require.Len(t, body.Messages, 1)
+		return body.Messages
+	}
+
+	t.Run("query", func(t *testing.T) {
+		t.Parallel()
+		tsServer := newServer(t, 0)
+
+		messages := getMessages(t, tsServer, "")
+		require.Equal(t, greeting, messages[0].Content)
+		require.False(t, messages[0].Truncated)
+		require.Zero(t, messages[0].Length)
+
+		messages = getMessages(t, tsServer, "?max_length=3")
+		require.Equal(t, "Hi!", messages[0].Content)
+		require.True(t, messages[0].Truncated)
+		require.Equal(t, len(greeting), messages[0].Length)
+
+		var message httpapi.Message
+		get(t, tsServer, "/messages/0", &message)
+		require.Equal(t, greeting, message.Content)
+		require.False(t, message.Truncated)
+	})
+
+	t.Run("server default", func(t *testing.T) {
+		t.Parallel()
+		tsServer := newServer(t, 3)
+
+		messages := getMessages(t, tsServer, "")
+		require.Equal(t, "Hi!", messages[0].Content)
+		require.True(t, messages[0].Truncated)
+		messages = getMessages(t, tsServer, "?max_length=100")
+		require.Equal(t, greeting, messages[0].Content)
+		require.False(t, messages[0].Truncated)
+
+		var message httpapi.Message
+		get(t, tsServer, "/messages/0", &message)
+		require.Equal(t, "Hi!", message.Content)
+		require.True(t, message.Truncated)
+		require.Equal(t, len(greeting), message.Length)
+
+		message = httpapi.Message{}
+		get(t, tsServer, "/messages/0?full=true", &message)
+		require.Equal(t, greeting, message.Content)
+		require.False(t, message.Truncated)
+		require.Zero(t, message.Length)
+
+		// Exports always contain the full content.
+		resp, err := tsServer.Client().Get(tsServer.URL + "/messages/export")
+		require.NoError(t, err)
+		page, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Contains(t, string(page), greeting)
+
+		resp, err = tsServer.Client().Get(tsServer.URL + "/messages/1")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestServer_Snapshot(t *testing.T) {
+	t.Parallel()
+
+	srv, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType: msgfmt.AgentTypeCustom,
+		Process:   &replyingAgent{fakeAgent: fakeAgent{screen: "> ", echo: true}},
+	})
+	require.NoError(t, srv.WaitUntilReady(context.Background()))
+
+	type snapshot struct {
+		Status    httpapi.AgentStatus `json:"status"`
+		AgentType msgfmt.AgentType    `json:"agent_type"`
+		Messages  []httpapi.Message   `json:"messages"`
+	}
+	getSnapshot := func() snapshot {
+		resp, err := tsServer.Client().Get(tsServer.URL + "/snapshot")
+		require.NoError(t, err)
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var body snapshot
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return body
+	}
+	// requireConsistent checks that the status describes the messages: the
+	// agent isn't stable while a user message waits for its reply, and the
+	// messages are complete once it's stable.
+	requireConsistent := func(body snapshot) {
+		t.Helper()
+		require.Equal(t, msgfmt.AgentTypeCustom, body.AgentType)
+		if len(body.Messages) > 0 && body.Messages[len(body.Messages)-1].Role == st.ConversationRoleUser {
+			require.Equal(t, httpapi.AgentStatusRunning, body.Status)
+		}
+		if body.Status == httpapi.AgentStatusStable {
+			for _, message := range body.Messages {
+				require.True(t, message.Complete, "message %d", message.Id)
+			}
+		}
+	}
+
+	requireConsistent(getSnapshot())
+	sent := make(chan int, 1)
+	go func() {
+		resp, err := tsServer.Client().Post(tsServer.URL+"/message", "application/json", strings.NewReader(`{"content": "hello", "type": "user"}`))
+		if err != nil {
+			sent <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		sent <- resp.StatusCode
+	}()
+	// Take snapshots while the message is sent and the agent replies.
+	require.Eventually(t, func() bool {
+		body := getSnapshot()
+		requireConsistent(body)
+		return body.Status == httpapi.AgentStatusStable && slices.ContainsFunc(body.Messages, func(message httpapi.Message) bool {
+			return message.Role == st.ConversationRoleUser && message.Content == "hello"
+		})
+	}, 10*time.Second, 25*time.Millisecond)
+	require.Equal(t, http.StatusOK, <-sent)
+	final := getSnapshot()
+	require.Equal(t, st.ConversationRoleAgent, final.Messages[len(final.Messages)-1].Role)
+
+	// The event stream starts with the snapshot instead of separate message
+	// and status events.
+	reqCtx, reqCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer reqCancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, tsServer.URL+"/events?snapshot=true&types=status_change", nil)
+	require.NoError(t, err)
+	resp, err := tsServer.Client().Do(req)
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	scanner := bufio.NewScanner(resp.Body)
+	var eventType string
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+			eventType = value
+		}
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			require.Equal(t, "snapshot", eventType)
+			var body httpapi.SnapshotBody
+			require.NoError(t, json.Unmarshal([]byte(data), &body))
+			// The events may lag behind GET /snapshot by a snapshot of the
+			// agent's screen, but they're consistent too.
+			messages := make([]httpapi.Message, 0, len(body.Messages))
+			for _, message := range body.Messages {
+				messages = append(messages, httpapi.Message{Id: message.Id, Role: message.Role, Content: message.Message, Complete: message.Complete})
+			}
+			requireConsistent(snapshot{Status: body.Status, AgentType: body.AgentType, Messages: messages})
+			require.GreaterOrEqual(t, len(messages), len(final.Messages)-1)
+			require.Equal(t, final.Messages[0].Content, messages[0].Content)
+			return
+		}
+	}
+	t.Fatalf("no snapshot event received: %v", scanner.Err())
+}
+
+func TestServer_Webhook(t *testing.T) {
+	t.Parallel()
+
+	type delivery struct {
+		signature string
+		payload   httpapi.WebhookPayload
+		body      []byte
+	}
+	deliveries := make(chan delivery, 100)
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var payload httpapi.WebhookPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		deliveries <- delivery{signature: r.Header.Get("X-AgentAPI-Signature"), payload: payload, body: body}
+	}))
+	t.Cleanup(receiver.Close)
+
+	srv, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType:     msgfmt.AgentTypeCustom,
+		Process:       &replyingAgent{fakeAgent: fakeAgent{screen: "> ", echo: true}},
+		WebhookURL:    receiver.URL,
+		WebhookSecret: "s3cret",
+	})
+	require.NoError(t, srv.WaitUntilReady(context.Background()))
+
+	require.Equal(t, http.StatusOK, postMessage(t, tsServer, httpapi.MessageRequestBody{Content: "hello", Type: httpapi.MessageTypeUser}))
+
+	// Wait for the end of the run: the agent becoming stable after its reply.
+	var sawUserMessage, sawStable, sawReply bool
+	timeout := time.After(10 * time.Second)
+	for !(sawUserMessage && sawStable && sawReply) {
+		select {
+		case d := <-deliveries:
+			mac := hmac.New(sha256.New, []byte("s3cret"))
+			mac.Write(d.body)
+			require.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), d.signature)
+
+			data, err := json.Marshal(d.payload.Data)
+			require.NoError(t, err)
+			switch d.payload.Type {
+			case httpapi.EventTypeMessageUpdate:
+				var message httpapi.MessageUpdateBody
+				require.NoError(t, json.Unmarshal(data, &message))
+				require.True(t, message.Complete)
+				if message.Role == st.ConversationRoleUser && message.Message == "hello" {
+					sawUserMessage = true
+				}
+				if sawUserMessage && message.Role == st.ConversationRoleAgent && strings.Contains(message.Message, "reply 1") {
+					sawReply = true
+				}
+			case httpapi.EventTypeStatusChange:
+				var status httpapi.StatusChangeBody
+				require.NoError(t, json.Unmarshal(data, &status))
+				require.Equal(t, httpapi.AgentStatusStable, status.Status)
+				sawStable = sawUserMessage
+			default:
+				t.Fatalf("unexpected webhook event %q", d.payload.Type)
+			}
+		case <-timeout:
+			t.Fatalf("the run didn't trigger the webhooks (user message: %t, stable: %t, reply: %t)", sawUserMessage, sawStable, sawReply)
+		}
+	}
+}
+
+func TestServer_MinMessageInterval(t *testing.T) {
+	t.Parallel()
+
+	agent := &replyingAgent{fakeAgent: fakeAgent{screen: "> ", echo: true}}
+	srv, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType:          msgfmt.AgentTypeCustom,
+		Process:            agent,
+		BusyPolicy:         httpapi.BusyPolicyForce,
+		MinMessageInterval: time.Hour,
+	})
+	require.NoError(t, srv.WaitUntilReady(context.Background()))
+
+	hello := httpapi.MessageRequestBody{Content: "hello", Type: httpapi.MessageTypeUser}
+	require.Equal(t, http.StatusOK, postMessage(t, tsServer, hello))
+
+	// The double submission is rejected and not sent to the agent.
+	resp := postJSON(t, tsServer, "/message", hello)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	require.NoError(t, err)
+	require.InDelta(t, time.Hour.Seconds(), retryAfter, 60)
+	require.Equal(t, 1, strings.Count(agent.Written(), "hello"))
+
+	// Keystrokes aren't paced.
+	require.Equal(t, http.StatusOK, postMessage(t, tsServer, httpapi.MessageRequestBody{Content: "\x1b", Type: httpapi.MessageTypeRaw}))
+}
+
+// signalingAgent is a fakeAgent that runs as a process.
+type signalingAgent struct {
+	fakeAgent
+	signals chan os.Signal
+}
+
+func (a *signalingAgent) Signal(sig os.Signal) error {
+	a.signals <- sig
+	return nil
+}
+
+func TestServer_HangWatchdog(t *testing.T) {
+	t.Parallel()
+
+	newServer := func(t *testing.T, process st.AgentIO, action httpapi.HangAction) (*httptest.Server, error) {
+		t.Helper()
+		_, tsServer, err := tryNewTestServer(t, httpapi.ServerConfig{
+			AgentType: msgfmt.AgentTypeCustom,
+			Process:   process,
+			// The agent never gets ready for the initial prompt, so its status
+			// stays changing while its screen doesn't change.
+			InitialPrompt: "hello",
+			HangTimeout:   200 * time.Millisecond,
+			HangAction:    action,
+		})
+		return tsServer, err
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		t.Parallel()
+		_, err := newServer(t, &fakeAgent{screen: "loading"}, httpapi.HangActionInterrupt)
+		require.ErrorContains(t, err, "requires an agent that runs as a process")
+		_, err = newServer(t, &signalingAgent{fakeAgent: fakeAgent{screen: "loading"}}, "restart")
+		require.ErrorContains(t, err, `unknown hang action "restart"`)
+	})
+
+	for _, tc := range []struct {
+		name   string
+		action httpapi.HangAction
+		signal os.Signal
+	}{
+		{"default", "", syscall.SIGINT},
+		{"interrupt", httpapi.HangActionInterrupt, syscall.SIGINT},
+		{"kill", httpapi.HangActionKill, os.Kill},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			agent := &signalingAgent{fakeAgent: fakeAgent{screen: "loading"}, signals: make(chan os.Signal, 10)}
+			tsServer, err := newServer(t, agent, tc.action)
+			require.NoError(t, err)
+
+			reqCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, tsServer.URL+"/events?types=notice", nil)
+			require.NoError(t, err)
+			resp, err := tsServer.Client().Do(req)
+			require.NoError(t, err)
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+
+			select {
+			case sig := <-agent.signals:
+				require.Equal(t, tc.signal, sig)
+			case <-reqCtx.Done():
+				t.Fatal("the hung agent wasn't signaled")
+			}
+			scanner := bufio.NewScanner(resp.Body)
+			for scanner.Scan() {
+				if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+					var notice httpapi.NoticeBody
+					require.NoError(t, json.Unmarshal([]byte(data), &notice))
+					require.Equal(t, "warning", notice.Severity)
+					require.Contains(t, notice.Text, "didn't respond for 200ms")
+					return
+				}
+			}
+			t.Fatalf("no notice event received: %v", scanner.Err())
+		})
+	}
+}
+
+func TestServer_Heartbeat(t *testing.T) {
+	t.Parallel()
+	_, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType:         msgfmt.AgentTypeClaude,
+		Process:           &fakeAgent{screen: "> "},
+		HeartbeatInterval: 100 * time.Millisecond,
+	})
+
+	reqCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, tsServer.URL+"/events?types=heartbeat", nil)
+	require.NoError(t, err)
+	resp, err := tsServer.Client().Do(req)
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var heartbeats []httpapi.HeartbeatBody
+	scanner := bufio.NewScanner(resp.Body)
+	for len(heartbeats) < 3 && scanner.Scan() {
+		line := scanner.Text()
+		require.False(t, strings.HasPrefix(line, "id:"), "heartbeats have no id")
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var heartbeat httpapi.HeartbeatBody
+			require.NoError(t, json.Unmarshal([]byte(data), &heartbeat))
+			require.Equal(t, heartbeat.Time.UnixMilli(), heartbeat.TimeMs)
+			heartbeats = append(heartbeats, heartbeat)
+		} else if event, ok := strings.CutPrefix(line, "event: "); ok {
+			require.Equal(t, "heartbeat", event)
+		}
+	}
+	require.Len(t, heartbeats, 3, "stream ended: %v", scanner.Err())
+	elapsed := time.Since(start)
+	require.GreaterOrEqual(t, elapsed, 300*time.Millisecond)
+	// Heartbeats carry the time they were scheduled at. Some may be skipped
+	// if the stream is slow, but they are never sent early.
+	for i := 1; i < len(heartbeats); i++ {
+		require.GreaterOrEqual(t, heartbeats[i].TimeMs-heartbeats[i-1].TimeMs, int64(90))
+	}
+}
+
+func TestServer_MaxEventsDuration(t *testing.T) {
+	t.Parallel()
+	srv, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType:         msgfmt.AgentTypeClaude,
+		Process:           &fakeAgent{screen: "> "},
+		MaxEventsDuration: 200 * time.Millisecond,
+	})
+	require.NoError(t, srv.WaitUntilReady(context.Background()))
+
+	reqCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, tsServer.URL+"/events?include_screen=true", nil)
+	require.NoError(t, err)
+	resp, err := tsServer.Client().Do(req)
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	// The server ends the stream, so the body can be read to the end.
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+
+	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
+	require.GreaterOrEqual(t, len(lines), 2)
+	require.Equal(t, "event: reconnect", lines[len(lines)-2])
+	var reconnect httpapi.ReconnectBody
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(lines[len(lines)-1], "data: ")), &reconnect))
+	// All events are wanted, so the reconnect event names the last one sent.
+	ids := regexp.MustCompile(`(?m)^id: (\d+)$`).FindAllStringSubmatch(string(body), -1)
+	require.NotEmpty(t, ids)
+	require.Equal(t, ids[len(ids)-1][1], strconv.Itoa(reconnect.LastEventId))
+}
+
+func TestServer_MessageForm(t *testing.T) {
+	t.Parallel()
+
+	agent := &fakeAgent{}
+	_, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType:      msgfmt.AgentTypeClaude,
+		Process:        agent,
+		AllowedOrigins: []string{"https://example.com"},
+	})
+
+	post := func(t *testing.T, origin string, form url.Values) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, tsServer.URL+"/message/form", strings.NewReader(form.Encode()))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		resp, err := tsServer.Client().Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	require.Equal(t, http.StatusOK, post(t, "", url.Values{"content": {"hello & bye"}, "type": {"raw"}}))
+	require.Equal(t, http.StatusOK, post(t, "https://example.com", url.Values{"content": {"!"}, "type": {"raw"}}))
+	require.Equal(t, "hello & bye!", agent.Written())
+
+	require.Equal(t, http.StatusForbidden, post(t, "https://evil.example", url.Values{"content": {"rm -rf /"}, "type": {"raw"}}))
+	require.Equal(t, http.StatusUnprocessableEntity, post(t, "", url.Values{"content": {"hello"}, "type": {"shell"}}))
+	require.Equal(t, "hello & bye!", agent.Written())
+}
+
+// stderrAgent is a fakeAgent whose stderr is captured.
+type stderrAgent struct {
+	fakeAgent
+	stderr string
+}
+
+func (a *stderrAgent) Stderr() (string, bool) {
+	return a.stderr, true
+}
+
+func TestServer_DebugStderr(t *testing.T) {
+	t.Parallel()
+
+	newServer := func(t *testing.T, agent st.AgentIO, debug bool) (*httptest.Server, error) {
+		t.Helper()
+		_, tsServer, err := tryNewTestServer(t, httpapi.ServerConfig{
+			AgentType:   msgfmt.AgentTypeCustom,
+			Process:     agent,
+			DebugStderr: debug,
+		})
+		return tsServer, err
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		t.Parallel()
+		tsServer, err := newServer(t, &stderrAgent{stderr: "panic: out of memory\n"}, true)
+		require.NoError(t, err)
+		resp, err := tsServer.Client().Get(tsServer.URL + "/internal/stderr")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var stderr httpapi.StderrResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&stderr.Body))
+		require.Equal(t, "panic: out of memory\n", stderr.Body.Stderr)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		tsServer, err := newServer(t, &stderrAgent{stderr: "secret"}, false)
+		require.NoError(t, err)
+		resp, err := tsServer.Client().Get(tsServer.URL + "/internal/stderr")
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("not captured", func(t *testing.T) {
+		t.Parallel()
+		_, err := newServer(t, &fakeAgent{}, true)
+		require.ErrorContains(t, err, "only be captured for agents that run as a process")
+	})
+}
+
+func TestServer_Continue(t *testing.T) {
+	t.Parallel()
+
+	newServer := func(t *testing.T, agent *fakeAgent, phrase string) (*httpapi.Server, *httptest.Server) {
+		t.Helper()
+		srv, tsServer := newTestServer(t, httpapi.ServerConfig{
+			AgentType:      msgfmt.AgentTypeCustom,
+			Process:        agent,
+			ContinuePhrase: phrase,
+		})
+		return srv, tsServer
+	}
+	start := func(t *testing.T, srv *httpapi.Server) {
+		t.Helper()
+		ctx, cancel := context.WithCancel(logctx.WithLogger(context.Background(), slog.New(slog.NewTextHandler(os.Stdout, nil))))
+		t.Cleanup(cancel)
+		srv.StartSnapshotLoop(ctx)
+		require.NoError(t, srv.WaitUntilReady(ctx))
+	}
+	postContinue := func(t *testing.T, tsServer *httptest.Server) int {
+		t.Helper()
+		resp, err := tsServer.Client().Post(tsServer.URL+"/continue", "application/json", nil)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("enter", func(t *testing.T) {
+		t.Parallel()
+		agent := &fakeAgent{screen: "Proceed? [Enter] "}
+		srv, tsServer := newServer(t, agent, "")
+		// The agent isn't stable before the screen is tracked.
+		require.Equal(t, http.StatusConflict, postContinue(t, tsServer))
+		require.Empty(t, agent.Written())
+
+		start(t, srv)
+		require.Equal(t, http.StatusOK, postContinue(t, tsServer))
+		require.Equal(t, "\r", agent.Written())
+	})
+
+	t.Run("phrase", func(t *testing.T) {
+		t.Parallel()
+		agent := &fakeAgent{screen: "> ", echo: true}
+		srv, tsServer := newServer(t, agent, "continue")
+		require.Equal(t, http.StatusConflict, postContinue(t, tsServer))
+
+		start(t, srv)
+		require.Equal(t, http.StatusOK, postContinue(t, tsServer))
+		require.Contains(t, agent.Written(), "continue")
+		// The agent is busy with the phrase.
+		require.Equal(t, http.StatusConflict, postContinue(t, tsServer))
+	})
+}
+
+func TestServer_ExportMessages(t *testing.T) {
+	t.Parallel()
+	srv, tsServer := newTestServer(t, httpapi.ServerConfig{
+		AgentType:             msgfmt.AgentTypeCustom,
+		Process:               &fakeAgent{screen: "> "},
+		AllowMessageInjection: true,
+	})
+	require.NoError(t, srv.WaitUntilReady(context.Background()))
+
+	require.Equal(t, http.StatusOK, postMessage(t, tsServer, httpapi.MessageRequestBody{Content: "Tests pass <3", Type: httpapi.MessageTypeUser, Role: st.ConversationRoleAgent}))
+
+	resp, err := tsServer.Client().Get(tsServer.URL + "/messages/export?format=html")
+	require.NoError(t, err)
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+	require.Equal(t, `attachment; filename="conversation.html"`, resp.Header.Get("Content-Disposition"))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "<p>Tests pass &lt;3</p>")
+	require.Contains(t, string(body), "</html>")
+
+	resp, err = tsServer.Client().Get(tsServer.URL + "/messages/export?format=pdf")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+}
+
+func TestServer_BusyPolicy(t *testing.T) {
+	t.Parallel()
+
+	// newBusyServer returns a server whose agent is running: its screen
+	// keeps changing after it was stable once, until stopWorking is called.
+	newBusyServer := func(t *testing.T, policy httpapi.BusyPolicy) (agent *fakeAgent, tsServer *httptest.Server, stopWorking func()) {
+		t.Helper()
+		agent = &fakeAgent{screen: "> ", echo: true}
+		srv, tsServer := newTestServer(t, httpapi.ServerConfig{
+			AgentType:  msgfmt.AgentTypeCustom,
+			Process:    agent,
+			BusyPolicy: policy,
+		})
+		require.NoError(t, srv.WaitUntilReady(context.Background()))
+
+		workCtx, stopWorking := context.WithCancel(context.Background())
+		t.Cleanup(stopWorking)
+		go func() {
+			for i := 0; workCtx.Err() == nil; i++ {
+				agent.mu.Lock()
+				agent.screen = fmt.Sprintf("> \nWorking %d", i)
+				agent.mu.Unlock()
+				time.Sleep(20 * time.Millisecond)
+			}
+		}()
+		require.Eventually(t, func() bool {
+			resp, err := tsServer.Client().Get(tsServer.URL + "/status")
+			require.NoError(t, err)
+			defer func() {
+				_ = resp.Body.Close()
+			}()
+			var status httpapi.StatusResponse
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&status.Body))
+			return status.Body.Status == httpapi.AgentStatusRunning
+		}, 10*time.Second, 50*time.Millisecond)
+		return agent, tsServer, stopWorking
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		t.Parallel()
+		agent, tsServer, _ := newBusyServer(t, "")
+		require.Equal(t, http.StatusConflict, postMessage(t, tsServer, httpapi.MessageRequestBody{Content: "hello", Type: httpapi.MessageTypeUser}))
+		require.Empty(t, agent.Written())
+		// Keystrokes still reach the busy agent.
+		require.Equal(t, http.StatusOK, postMessage(t, tsServer, httpapi.MessageRequestBody{Content: "\x1b", Type: httpapi.MessageTypeRaw}))
+		require.Equal(t, "\x1b", agent.Written())
+	})
+
+	t.Run("force", func(t *testing.T) {
+		t.Parallel()
+		agent, tsServer, stopWorking := newBusyServer(t, httpapi.BusyPolicyForce)
+		// The agent is still running for a while after its screen stops
+		// changing, but it then reacts to the message like an idle agent.
+		stopWorking()
+		require.Equal(t, http.StatusOK, postMessage(t, tsServer, httpapi.MessageRequestBody{Content: "hello", Type: httpapi.MessageTypeUser}))
+		require.Contains(t, agent.Written(), "hello")
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		t.Parallel()
+		ctx := logctx.WithLogger(context.Background(), slog.New(slog.NewTextHandler(os.Stdout, nil)))
+		_, err := httpapi.NewServer(ctx, httpapi.ServerConfig{
+			AgentType:      msgfmt.AgentTypeCustom,
+			Process:        &fakeAgent{},
+			ChatBasePath:   "/chat",
+			AllowedHosts:   []string{"*"},
+			AllowedOrigins: []string{"*"},
+			BusyPolicy:     "queue",
+		})
+		require.ErrorContains(t, err, `unknown busy policy "queue"`)
+	})
+}
@@ -19,7 +19,14 @@ type SetupProcessConfig struct {
 	ProgramArgs    []string
 	TerminalWidth  uint16
 	TerminalHeight uint16
+	Term           string
 	AgentType      mf.AgentType
+	// ShutdownGracePeriod is how long the process is given to exit after
+	// each signal when the server receives SIGINT or SIGTERM.
+	ShutdownGracePeriod time.Duration
+	// StderrBufferSize, if positive, keeps the process's stderr apart from
+	// its terminal. See termexec.StartProcessConfig.
+	StderrBufferSize int
 }
 
 func SetupProcess(ctx context.Context, config SetupProcessConfig) (*termexec.Process, error) {
@@ -32,15 +39,17 @@ func SetupProcess(ctx context.Context, config SetupProcessConfig) (*termexec.Pro
 		Args:           config.ProgramArgs,
 		TerminalWidth:  config.TerminalWidth,
 		TerminalHeight: config.TerminalHeight,
+		Term:           config.Term,
+
+		StderrBufferSize: config.StderrBufferSize,
 	})
 	if err != nil {
 		logger.Error(fmt.Sprintf("Error starting process: %v", err))
 		os.Exit(1)
 	}
 
-	// Hack for sourcegraph amp to stop the animation.
-	if config.AgentType == mf.AgentTypeAmp {
-		_, err = process.Write([]byte(" \b"))
+	if agent, ok := mf.LookupAgent(string(config.AgentType)); ok && agent.StartupInput != "" {
+		_, err = process.Write([]byte(agent.StartupInput))
 		if err != nil {
 			return nil, err
 		}
@@ -51,7 +60,7 @@ func SetupProcess(ctx context.Context, config SetupProcessConfig) (*termexec.Pro
 	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-signalCh
-		if err := process.Close(logger, 5*time.Second); err != nil {
+		if err := process.Close(logger, config.ShutdownGracePeriod); err != nil {
 			logger.Error("Error closing process", "error", err)
 		}
 	}()
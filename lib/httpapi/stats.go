@@ -0,0 +1,80 @@
+package httpapi
+
+import (
+	"sync"
+	"time"
+
+	st "github.com/coder/agentapi/lib/screentracker"
+)
+
+// conversationTotals are aggregates over a prefix of the conversation history.
+type conversationTotals struct {
+	userMessages   int
+	agentMessages  int
+	systemMessages int
+	// responses is the number of complete agent replies to user messages.
+	// runTime and longestResponse are measured from the user message to the
+	// last update of the reply.
+	responses       int
+	runTime         time.Duration
+	longestResponse time.Duration
+	lastActivity    time.Time
+}
+
+// add folds messages[i] into the totals.
+func (t *conversationTotals) add(messages []st.ConversationMessage, i int, status AgentStatus) {
+	msg := messages[i]
+	switch msg.Role {
+	case st.ConversationRoleUser:
+		t.userMessages++
+	case st.ConversationRoleAgent:
+		t.agentMessages++
+	case st.ConversationRoleSystem:
+		t.systemMessages++
+	}
+	if msg.Time.After(t.lastActivity) {
+		t.lastActivity = msg.Time
+	}
+	if msg.Role == st.ConversationRoleAgent && i > 0 && messages[i-1].Role == st.ConversationRoleUser && isMessageComplete(messages, i, status) {
+		duration := msg.Time.Sub(messages[i-1].Time)
+		t.responses++
+		t.runTime += duration
+		t.longestResponse = max(t.longestResponse, duration)
+	}
+}
+
+// conversationStats maintains running aggregates over the conversation
+// history. Only the last message can change, so every other message is folded
+// into the aggregates once and each update only looks at the last message.
+type conversationStats struct {
+	mu sync.Mutex
+	// settled are the totals over the first settledCount messages.
+	settled      conversationTotals
+	settledCount int
+	// current are the totals over all messages.
+	current conversationTotals
+}
+
+func (s *conversationStats) update(messages []st.ConversationMessage, status AgentStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(messages) < s.settledCount {
+		// Messages were removed from the history, e.g. by a regeneration.
+		s.settled = conversationTotals{}
+		s.settledCount = 0
+	}
+	for ; s.settledCount < len(messages)-1; s.settledCount++ {
+		s.settled.add(messages, s.settledCount, status)
+	}
+	s.current = s.settled
+	if len(messages) > 0 {
+		s.current.add(messages, len(messages)-1, status)
+	}
+}
+
+func (s *conversationStats) totals() conversationTotals {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current
+}
@@ -0,0 +1,71 @@
+package httpapi
+
+import (
+	"testing"
+	"time"
+
+	st "github.com/coder/agentapi/lib/screentracker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConversationStats(t *testing.T) {
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+	messages := []st.ConversationMessage{
+		{Id: 0, Role: st.ConversationRoleAgent, Message: "Welcome", Time: at(0)},
+		{Id: 1, Role: st.ConversationRoleSystem, Message: "Be brief", Time: at(1)},
+		{Id: 2, Role: st.ConversationRoleUser, Message: "Hi", Time: at(10)},
+		{Id: 3, Role: st.ConversationRoleAgent, Message: "Hello", Time: at(12)},
+		{Id: 4, Role: st.ConversationRoleUser, Message: "Fix the bug", Time: at(20)},
+		{Id: 5, Role: st.ConversationRoleAgent, Message: "Done", Time: at(30)},
+	}
+
+	t.Run("known-set", func(t *testing.T) {
+		var stats conversationStats
+		stats.update(messages, AgentStatusStable)
+		assert.Equal(t, conversationTotals{
+			userMessages:    2,
+			agentMessages:   3,
+			systemMessages:  1,
+			responses:       2,
+			runTime:         12 * time.Second,
+			longestResponse: 10 * time.Second,
+			lastActivity:    at(30),
+		}, stats.totals())
+	})
+
+	t.Run("running-reply", func(t *testing.T) {
+		var stats conversationStats
+		running := append(messages[:5:5], st.ConversationMessage{Id: 5, Role: st.ConversationRoleAgent, Message: "Wor", Time: at(25)})
+		stats.update(running, AgentStatusRunning)
+		// The reply in progress is counted, but its response time isn't.
+		totals := stats.totals()
+		assert.Equal(t, 3, totals.agentMessages)
+		assert.Equal(t, 1, totals.responses)
+		assert.Equal(t, 2*time.Second, totals.runTime)
+
+		stats.update(messages, AgentStatusStable)
+		assert.Equal(t, 2, stats.totals().responses)
+		assert.Equal(t, 12*time.Second, stats.totals().runTime)
+	})
+
+	t.Run("messages-removed", func(t *testing.T) {
+		var stats conversationStats
+		stats.update(messages, AgentStatusStable)
+		stats.update(messages[:3], AgentStatusRunning)
+		assert.Equal(t, conversationTotals{
+			userMessages:   1,
+			agentMessages:  1,
+			systemMessages: 1,
+			lastActivity:   at(10),
+		}, stats.totals())
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		var stats conversationStats
+		stats.update(nil, AgentStatusRunning)
+		assert.Equal(t, conversationTotals{}, stats.totals())
+	})
+}
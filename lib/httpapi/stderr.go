@@ -0,0 +1,42 @@
+package httpapi
+
+import (
+	"context"
+
+	"golang.org/x/xerrors"
+)
+
+// stderrReader is implemented by agents whose stderr may be captured apart
+// from their terminal.
+type stderrReader interface {
+	// Stderr returns the end of the agent's stderr, and false if it isn't
+	// captured.
+	Stderr() (string, bool)
+}
+
+// StderrResponse is the response of GET /internal/stderr.
+type StderrResponse struct {
+	Body struct {
+		Stderr string `json:"stderr" doc:"The end of the agent's stderr, including control sequences"`
+	}
+}
+
+// newStderrSource returns the agent as a stderrReader, or an error if its
+// stderr isn't captured.
+func newStderrSource(agent any) (stderrReader, error) {
+	r, ok := agent.(stderrReader)
+	if !ok {
+		return nil, xerrors.New("the agent's stderr can only be captured for agents that run as a process")
+	}
+	if _, ok := r.Stderr(); !ok {
+		return nil, xerrors.New("the agent's stderr isn't captured")
+	}
+	return r, nil
+}
+
+// getStderr handles GET /internal/stderr
+func (s *Server) getStderr(ctx context.Context, input *struct{}) (*StderrResponse, error) {
+	resp := &StderrResponse{}
+	resp.Body.Stderr, _ = s.stderr.Stderr()
+	return resp, nil
+}
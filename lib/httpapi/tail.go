@@ -0,0 +1,117 @@
+package httpapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// tailWriteTimeout bounds how long a message may take to be sent to a tail
+// client before it's disconnected.
+const tailWriteTimeout = 10 * time.Second
+
+// tailLines turns message update events into the lines sent to tail clients:
+// every message once it's complete, as "role: content". A message is sent
+// again if it changes afterwards, e.g. when a regenerated reply takes the id
+// of the discarded one.
+type tailLines struct {
+	// sent maps message ids to the content last sent for them.
+	sent map[int]string
+}
+
+// lines returns the lines to send for event.
+func (t *tailLines) lines(event Event) []string {
+	switch payload := event.Payload.(type) {
+	case MessageUpdateBody:
+		if !payload.Complete || payload.Message == "" {
+			return nil
+		}
+		if sent, ok := t.sent[payload.Id]; ok && sent == payload.Message {
+			return nil
+		}
+		if t.sent == nil {
+			t.sent = map[int]string{}
+		}
+		t.sent[payload.Id] = payload.Message
+		return []string{fmt.Sprintf("%s: %s", payload.Role, payload.Message)}
+	case MessagesClearBody:
+		for id := range t.sent {
+			if id >= payload.FromId {
+				delete(t.sent, id)
+			}
+		}
+	}
+	return nil
+}
+
+// tail handles GET /tail. It upgrades the connection to a WebSocket, sends
+// the conversation history and then every new message as text frames, and
+// ignores everything the client sends.
+func (s *Server) tail(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" && !originAllowed(s.allowedOrigins, origin) {
+		http.Error(w, fmt.Sprintf("origin %q is not allowed", origin), http.StatusForbidden)
+		return
+	}
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		// The origin is checked above, against the allowed origins rather
+		// than the host.
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		s.logger.Error("Failed to accept tail connection", "error", err)
+		return
+	}
+	defer func() {
+		_ = conn.CloseNow()
+	}()
+
+	// The client only reads. CloseRead cancels ctx once it disconnects.
+	ctx := conn.CloseRead(r.Context())
+
+	subscriberId, ch, stateEvents := s.emitter.Subscribe()
+	defer s.emitter.Unsubscribe(subscriberId)
+	s.logger.Info("New tail client", "subscriberId", subscriberId, "clientIp", clientIPFrom(ctx))
+
+	var lines tailLines
+	send := func(event Event) bool {
+		for _, line := range lines.lines(event) {
+			writeCtx, cancel := context.WithTimeout(ctx, tailWriteTimeout)
+			err := conn.Write(writeCtx, websocket.MessageText, []byte(line))
+			cancel()
+			if err != nil {
+				s.logger.Info("Tail client disconnected", "subscriberId", subscriberId, "error", err)
+				return false
+			}
+		}
+		return true
+	}
+	for _, event := range stateEvents {
+		if !send(event) {
+			return
+		}
+	}
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				s.logger.Warn("Disconnecting slow tail client", "subscriberId", subscriberId)
+				_ = conn.Close(websocket.StatusTryAgainLater, "the client didn't keep up with the messages")
+				return
+			}
+			if !send(event) {
+				return
+			}
+		case <-ctx.Done():
+			s.logger.Info("Tail client disconnected", "subscriberId", subscriberId)
+			return
+		case <-s.tailCtx.Done():
+			// The connection is hijacked, so the request's context isn't
+			// canceled when the server stops.
+			_ = conn.Close(websocket.StatusGoingAway, "the server is stopping")
+			return
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package httpapi
+
+import (
+	"context"
+	"time"
+
+	st "github.com/coder/agentapi/lib/screentracker"
+)
+
+// defaultStuckStatusTimeout is how long writing a message to the agent may
+// take before the watchdog abandons it and resets the status. It's well above
+// the time it takes to write a message to the agent.
+const defaultStuckStatusTimeout = 2 * time.Minute
+
+// statusWatchdog detects a conversation stuck in the changing status: the
+// status has been changing for longer than timeout, and the agent's screen
+// hasn't changed for just as long. It's used by the hang watchdog.
+type statusWatchdog struct {
+	timeout       time.Duration
+	screen        string
+	lastChangeAt  time.Time
+	changingSince time.Time
+}
+
+// update records the current status and screen and reports whether the
+// status is stuck.
+func (w *statusWatchdog) update(status st.ConversationStatus, screen string, now time.Time) bool {
+	if screen != w.screen || w.lastChangeAt.IsZero() {
+		w.screen = screen
+		w.lastChangeAt = now
+	}
+	if status != st.ConversationStatusChanging {
+		w.changingSince = time.Time{}
+		return false
+	}
+	if w.changingSince.IsZero() {
+		w.changingSince = now
+	}
+	return now.Sub(w.changingSince) >= w.timeout && now.Sub(w.lastChangeAt) >= w.timeout
+}
+
+// resetStatus forces the conversation status back to stable and notifies
+// subscribers.
+func (s *Server) resetStatus() st.ConversationStatus {
+	s.conversation.ResetStatus()
+	messages, status := s.conversation.State()
+	s.emitter.UpdateStateAndEmitChanges(status, s.agentType, messages)
+	return status
+}
+
+// runStatusWatchdog resets the status whenever writing a message has been
+// stuck for stuckStatusTimeout, until ctx is done. It runs separately from
+// the snapshot loop, which is blocked by the stuck write. Other states in
+// which the status stays changing on a static screen, e.g. an agent that
+// isn't ready yet or one paused under an idle pattern, are left alone.
+func (s *Server) runStatusWatchdog(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(snapshotInterval):
+		}
+		if writeStuck(s.conversation, s.stuckStatusTimeout, time.Now()) {
+			s.logger.Warn("Writing a message to the agent is stuck, abandoning it and resetting the status", "timeout", s.stuckStatusTimeout)
+			s.resetStatus()
+		}
+	}
+}
+
+// writeStuck reports whether the message that's being written to the agent
+// has been written for timeout or longer at now.
+func writeStuck(conversation *st.Conversation, timeout time.Duration, now time.Time) bool {
+	since, sending := conversation.SendingSince()
+	return sending && now.Sub(since) >= timeout
+}
@@ -0,0 +1,103 @@
+package httpapi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	st "github.com/coder/agentapi/lib/screentracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusWatchdog(t *testing.T) {
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+
+	t.Run("stuck", func(t *testing.T) {
+		w := statusWatchdog{timeout: 10 * time.Second}
+		assert.False(t, w.update(st.ConversationStatusChanging, "a", at(0)))
+		assert.False(t, w.update(st.ConversationStatusChanging, "a", at(9)))
+		assert.True(t, w.update(st.ConversationStatusChanging, "a", at(10)))
+	})
+
+	t.Run("screen activity", func(t *testing.T) {
+		w := statusWatchdog{timeout: 10 * time.Second}
+		assert.False(t, w.update(st.ConversationStatusChanging, "a", at(0)))
+		assert.False(t, w.update(st.ConversationStatusChanging, "b", at(5)))
+		assert.False(t, w.update(st.ConversationStatusChanging, "b", at(14)))
+		assert.True(t, w.update(st.ConversationStatusChanging, "b", at(15)))
+	})
+
+	t.Run("stable in between", func(t *testing.T) {
+		w := statusWatchdog{timeout: 10 * time.Second}
+		assert.False(t, w.update(st.ConversationStatusChanging, "a", at(0)))
+		assert.False(t, w.update(st.ConversationStatusStable, "a", at(5)))
+		assert.False(t, w.update(st.ConversationStatusChanging, "a", at(10)))
+		assert.False(t, w.update(st.ConversationStatusChanging, "a", at(19)))
+		assert.True(t, w.update(st.ConversationStatusChanging, "a", at(20)))
+	})
+}
+
+// stuckWriteAgent never returns from Write until unblock is closed.
+type stuckWriteAgent struct {
+	writing chan struct{}
+	unblock chan struct{}
+}
+
+func (a *stuckWriteAgent) Write(data []byte) (int, error) {
+	select {
+	case a.writing <- struct{}{}:
+	default:
+	}
+	<-a.unblock
+	return len(data), nil
+}
+
+func (a *stuckWriteAgent) ReadScreen() string {
+	return ""
+}
+
+func TestWriteStuck(t *testing.T) {
+	start := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("agent never ready", func(t *testing.T) {
+		conversation := st.NewConversation(context.Background(), st.ConversationConfig{
+			AgentIO:               &recordingAgent{},
+			GetTime:               func() time.Time { return start },
+			SnapshotInterval:      time.Second,
+			ScreenStabilityLength: 0,
+			// The agent stays on e.g. a login dialog.
+			ReadyForInitialPrompt: func(message string) bool { return false },
+		}, "initial prompt")
+		conversation.AddSnapshot("")
+		require.Equal(t, st.ConversationStatusChanging, conversation.Status())
+		assert.False(t, writeStuck(conversation, 10*time.Second, start.Add(time.Hour)))
+	})
+
+	t.Run("stuck write", func(t *testing.T) {
+		agent := &stuckWriteAgent{writing: make(chan struct{}, 1), unblock: make(chan struct{})}
+		defer close(agent.unblock)
+		conversation := st.NewConversation(context.Background(), st.ConversationConfig{
+			AgentIO:               agent,
+			GetTime:               func() time.Time { return start },
+			SnapshotInterval:      time.Second,
+			ScreenStabilityLength: 0,
+		}, "")
+		conversation.AddSnapshot("")
+		sendErr := make(chan error, 1)
+		go func() {
+			sendErr <- conversation.SendMessage(st.MessagePartText{Content: "hello"})
+		}()
+		<-agent.writing
+
+		assert.False(t, writeStuck(conversation, 10*time.Second, start.Add(9*time.Second)))
+		require.True(t, writeStuck(conversation, 10*time.Second, start.Add(10*time.Second)))
+		conversation.ResetStatus()
+		assert.ErrorIs(t, <-sendErr, st.MessageErrorAbandoned)
+		assert.Equal(t, st.ConversationStatusStable, conversation.Status())
+		assert.False(t, writeStuck(conversation, 10*time.Second, start.Add(time.Hour)))
+	})
+}
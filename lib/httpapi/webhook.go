@@ -0,0 +1,208 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// Webhook delivery settings.
+const (
+	// webhookTimeout bounds a single delivery attempt.
+	webhookTimeout = 10 * time.Second
+	// webhookMaxAttempts is how many times an event is sent before it's
+	// dropped.
+	webhookMaxAttempts = 3
+	// defaultWebhookRetryDelay is the delay before the first retry. It
+	// doubles with every further retry.
+	defaultWebhookRetryDelay = time.Second
+	// webhookQueueSize is how many events may wait to be delivered. Further
+	// events are dropped, so that a slow receiver doesn't hold up the
+	// emitter.
+	webhookQueueSize = 100
+)
+
+// webhookSignatureHeader carries the HMAC-SHA256 of the request body, keyed
+// with the webhook secret, as "sha256=<hex>".
+const webhookSignatureHeader = "X-AgentAPI-Signature"
+
+// WebhookPayload is the body of the requests sent to the webhook URL.
+type WebhookPayload struct {
+	Type    EventType `json:"type"`
+	EventId int       `json:"event_id"`
+	Data    any       `json:"data"`
+}
+
+// webhook forwards events to a URL, for integrations that don't hold an
+// /events connection.
+type webhook struct {
+	url        string
+	secret     string
+	client     *http.Client
+	retryDelay time.Duration
+	// sent maps message ids to the content last sent for them, so that a
+	// message is only sent once it's complete and again if it changes.
+	sent map[int]string
+}
+
+// newWebhook returns nil if rawURL is empty.
+func newWebhook(rawURL string, secret string) (*webhook, error) {
+	if rawURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, xerrors.Errorf("invalid webhook URL %q: it must be an http or https URL", rawURL)
+	}
+	return &webhook{
+		url:        rawURL,
+		secret:     secret,
+		client:     &http.Client{Timeout: webhookTimeout},
+		retryDelay: defaultWebhookRetryDelay,
+	}, nil
+}
+
+// wanted reports whether event is forwarded: the agent becoming stable, i.e.
+// a run finishing, and messages once they're complete.
+func (w *webhook) wanted(event Event) bool {
+	switch payload := event.Payload.(type) {
+	case StatusChangeBody:
+		return payload.Status == AgentStatusStable
+	case MessageUpdateBody:
+		if !payload.Complete {
+			return false
+		}
+		if sent, ok := w.sent[payload.Id]; ok && sent == payload.Message {
+			return false
+		}
+		if w.sent == nil {
+			w.sent = map[int]string{}
+		}
+		w.sent[payload.Id] = payload.Message
+		return true
+	case MessagesClearBody:
+		for id := range w.sent {
+			if id >= payload.FromId {
+				delete(w.sent, id)
+			}
+		}
+	}
+	return false
+}
+
+// sign returns the value of the signature header for body.
+func (w *webhook) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(w.secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver sends event to the webhook URL. Network errors, 429 and 5xx
+// responses are retried.
+func (w *webhook) deliver(ctx context.Context, event Event) error {
+	body, err := json.Marshal(WebhookPayload{Type: event.Type, EventId: event.Id, Data: event.Payload})
+	if err != nil {
+		return xerrors.Errorf("failed to encode event: %w", err)
+	}
+	delay := w.retryDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := w.post(ctx, body, event.Type)
+		if err == nil || !retry || attempt == webhookMaxAttempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// post sends body to the webhook URL once. It returns whether a failed
+// request is worth sending again.
+func (w *webhook) post(ctx context.Context, body []byte, eventType EventType) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, xerrors.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-AgentAPI-Event", string(eventType))
+	if w.secret != "" {
+		req.Header.Set(webhookSignatureHeader, w.sign(body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return true, xerrors.Errorf("the receiver responded with %s", resp.Status)
+	}
+	if resp.StatusCode >= 400 {
+		return false, xerrors.Errorf("the receiver rejected the event with %s", resp.Status)
+	}
+	return false, nil
+}
+
+// runWebhook forwards the events of the emitter to the webhook until ctx is
+// done. Events are delivered in order by a separate goroutine.
+func (s *Server) runWebhook(ctx context.Context) {
+	queue := make(chan Event, webhookQueueSize)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-queue:
+				if err := s.webhook.deliver(ctx, event); err != nil && ctx.Err() == nil {
+					s.logger.Error("Failed to deliver webhook", "eventType", event.Type, "eventId", event.Id, "error", err)
+				}
+			}
+		}
+	}()
+
+	for {
+		// The state events are skipped: the receiver only learns about what
+		// happens from now on.
+		subscriberId, ch, _ := s.emitter.Subscribe()
+		s.logger.Info("Forwarding events to webhook", "subscriberId", subscriberId, "url", s.webhook.url, "signed", s.webhook.secret != "")
+		open := s.forwardToWebhook(ctx, ch, queue)
+		s.emitter.Unsubscribe(subscriberId)
+		if !open {
+			return
+		}
+		s.logger.Warn("Webhook subscriber fell behind the events, subscribing again", "subscriberId", subscriberId)
+	}
+}
+
+// forwardToWebhook queues the wanted events of ch until ctx is done, and
+// returns false then. It returns true if ch was closed.
+func (s *Server) forwardToWebhook(ctx context.Context, ch <-chan Event, queue chan<- Event) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case event, ok := <-ch:
+			if !ok {
+				return true
+			}
+			if !s.webhook.wanted(event) {
+				continue
+			}
+			select {
+			case queue <- event:
+			default:
+				s.logger.Warn("Dropping webhook event, the receiver doesn't keep up", "eventType", event.Type, "eventId", event.Id)
+			}
+		}
+	}
+}
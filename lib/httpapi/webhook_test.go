@@ -0,0 +1,91 @@
+package httpapi
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewWebhook(t *testing.T) {
+	t.Parallel()
+
+	w, err := newWebhook("", "secret")
+	require.NoError(t, err)
+	require.Nil(t, w)
+	for _, rawURL := range []string{"example.com/hook", "ftp://example.com/hook", "http://", "://"} {
+		_, err := newWebhook(rawURL, "")
+		require.ErrorContains(t, err, "invalid webhook URL", rawURL)
+	}
+	w, err = newWebhook("https://example.com/hook", "")
+	require.NoError(t, err)
+	require.NotNil(t, w)
+}
+
+func TestWebhookWanted(t *testing.T) {
+	t.Parallel()
+
+	w := &webhook{}
+	message := func(id int, content string, complete bool) Event {
+		return Event{Type: EventTypeMessageUpdate, Payload: MessageUpdateBody{Id: id, Message: content, Complete: complete}}
+	}
+	require.False(t, w.wanted(Event{Type: EventTypeStatusChange, Payload: StatusChangeBody{Status: AgentStatusRunning}}))
+	require.True(t, w.wanted(Event{Type: EventTypeStatusChange, Payload: StatusChangeBody{Status: AgentStatusStable}}))
+	require.False(t, w.wanted(Event{Type: EventTypeScreenUpdate, Payload: ScreenUpdateBody{Screen: "> "}}))
+
+	require.False(t, w.wanted(message(1, "hel", false)), "incomplete")
+	require.True(t, w.wanted(message(1, "hello", true)))
+	require.False(t, w.wanted(message(1, "hello", true)), "already sent")
+	require.True(t, w.wanted(message(1, "hello there", true)), "changed")
+
+	require.False(t, w.wanted(Event{Type: EventTypeMessagesClear, Payload: MessagesClearBody{FromId: 1}}))
+	require.True(t, w.wanted(message(1, "hello there", true)), "the id was reused")
+}
+
+func TestWebhookDeliver(t *testing.T) {
+	t.Parallel()
+
+	var attempts atomic.Int32
+	var signature, eventType string
+	var body []byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) < 3 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		signature = r.Header.Get(webhookSignatureHeader)
+		eventType = r.Header.Get("X-AgentAPI-Event")
+		body, _ = io.ReadAll(r.Body)
+	}))
+	t.Cleanup(receiver.Close)
+
+	w, err := newWebhook(receiver.URL, "secret")
+	require.NoError(t, err)
+	w.retryDelay = time.Millisecond
+	require.NoError(t, w.deliver(context.Background(), Event{Id: 7, Type: EventTypeStatusChange, Payload: StatusChangeBody{Status: AgentStatusStable, AgentType: "claude"}}))
+	require.EqualValues(t, 3, attempts.Load())
+	require.Equal(t, "status_change", eventType)
+	require.JSONEq(t, `{"type": "status_change", "event_id": 7, "data": {"status": "stable", "agent_type": "claude"}}`, string(body))
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	require.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), signature)
+
+	// Rejected events aren't sent again.
+	rejecting := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		rw.WriteHeader(http.StatusBadRequest)
+	}))
+	t.Cleanup(rejecting.Close)
+	attempts.Store(0)
+	w.url = rejecting.URL
+	require.ErrorContains(t, w.deliver(context.Background(), Event{Id: 8, Type: EventTypeStatusChange, Payload: StatusChangeBody{}}), "rejected")
+	require.EqualValues(t, 1, attempts.Load())
+}
@@ -2,7 +2,9 @@ package logctx
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
+	"strings"
 )
 
 type contextKey int
@@ -34,3 +36,37 @@ func (dh discardHandler) Enabled(context.Context, slog.Level) bool  { return fal
 func (dh discardHandler) Handle(context.Context, slog.Record) error { return nil }
 func (dh discardHandler) WithAttrs(attrs []slog.Attr) slog.Handler  { return dh }
 func (dh discardHandler) WithGroup(name string) slog.Handler        { return dh }
+
+// InstanceKey is the attribute that identifies the AgentAPI instance in log
+// entries.
+const InstanceKey = "instance"
+
+// WithInstance returns a logger that adds instanceId to every entry, so that
+// the logs of several instances can be told apart once aggregated. The logger
+// is returned unchanged if instanceId is empty.
+func WithInstance(logger *slog.Logger, instanceId string) *slog.Logger {
+	if instanceId == "" {
+		return logger
+	}
+	return logger.With(InstanceKey, instanceId)
+}
+
+// LevelNames are the log levels accepted by ParseLevel, from the most to the
+// least verbose.
+var LevelNames = []string{"debug", "info", "warn", "error"}
+
+// ParseLevel returns the log level with the given name, one of LevelNames.
+// Names are case-insensitive, and "warning" is accepted for "warn".
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q (valid levels: %s)", name, strings.Join(LevelNames, ", "))
+}
@@ -0,0 +1,59 @@
+package logctx_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/coder/agentapi/lib/logctx"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithInstance(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logctx.WithInstance(slog.New(slog.NewJSONHandler(&buf, nil)), "web-1")
+	logger.Info("first")
+	logger.With("component", "server").Warn("second", "key", "value")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	for _, line := range lines {
+		var entry map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &entry))
+		require.Equal(t, "web-1", entry[logctx.InstanceKey], line)
+	}
+
+	buf.Reset()
+	base := slog.New(slog.NewJSONHandler(&buf, nil))
+	require.Same(t, base, logctx.WithInstance(base, ""))
+	base.Info("hello")
+	require.NotContains(t, buf.String(), `"instance"`)
+}
+
+func TestParseLevel(t *testing.T) {
+	for name, want := range map[string]slog.Level{
+		"debug":   slog.LevelDebug,
+		"info":    slog.LevelInfo,
+		"WARN":    slog.LevelWarn,
+		"warning": slog.LevelWarn,
+		"error":   slog.LevelError,
+	} {
+		level, err := logctx.ParseLevel(name)
+		require.NoError(t, err, name)
+		require.Equal(t, want, level, name)
+	}
+	_, err := logctx.ParseLevel("verbose")
+	require.ErrorContains(t, err, `unknown log level "verbose"`)
+
+	// Info logs are suppressed at the warn level.
+	level, err := logctx.ParseLevel("warn")
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: level}))
+	logger.Info("starting")
+	logger.Warn("careful")
+	require.NotContains(t, buf.String(), "starting")
+	require.Contains(t, buf.String(), "careful")
+}
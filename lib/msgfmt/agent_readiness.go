@@ -1,34 +1,13 @@
 package msgfmt
 
+// IsAgentReadyForInitialPrompt reports whether the screen of the registered
+// agent shows that it accepts input. Unknown agents are always ready.
 func IsAgentReadyForInitialPrompt(agentType AgentType, message string) bool {
-	switch agentType {
-	case AgentTypeClaude:
-		return isGenericAgentReadyForInitialPrompt(message)
-	case AgentTypeGoose:
-		return isGenericAgentReadyForInitialPrompt(message)
-	case AgentTypeAider:
-		return isGenericAgentReadyForInitialPrompt(message)
-	case AgentTypeCodex:
-		return isCodexAgentReadyForInitialPrompt(message)
-	case AgentTypeGemini:
-		return isGenericAgentReadyForInitialPrompt(message)
-	case AgentTypeCopilot:
-		return isGenericAgentReadyForInitialPrompt(message)
-	case AgentTypeAmp:
-		return isAmpAgentReadyForInitialPrompt(message)
-	case AgentTypeCursor:
-		return isGenericAgentReadyForInitialPrompt(message)
-	case AgentTypeAuggie:
-		return isGenericAgentReadyForInitialPrompt(message)
-	case AgentTypeAmazonQ:
-		return isGenericAgentReadyForInitialPrompt(message)
-	case AgentTypeOpencode:
-		return isOpencodeAgentReadyForInitialPrompt(message)
-	case AgentTypeCustom:
-		return isGenericAgentReadyForInitialPrompt(message)
-	default:
+	agent, ok := LookupAgent(string(agentType))
+	if !ok {
 		return true
 	}
+	return agent.IsReadyForInitialPrompt(message)
 }
 
 func isGenericAgentReadyForInitialPrompt(message string) bool {
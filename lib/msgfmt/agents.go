@@ -0,0 +1,160 @@
+package msgfmt
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Agent describes how AgentAPI interacts with a terminal agent. Adding support
+// for a new agent amounts to registering an Agent with RegisterAgent.
+type Agent struct {
+	Type AgentType
+	// Aliases are additional names that select the agent on the command line.
+	Aliases []string
+	// FormatMessage extracts the agent's reply from the part of the screen
+	// that changed since the last user message. userInput is the last user
+	// message. Defaults to the generic formatter. Its result is trimmed
+	// according to Trim.
+	FormatMessage func(message string, userInput string) string
+	// Trim controls how replies are cleaned up after FormatMessage. Defaults
+	// to DefaultTrimOptions.
+	Trim *TrimOptions
+	// IsReadyForInitialPrompt reports whether the screen shows that the agent
+	// accepts input. Defaults to looking for a generic input box.
+	IsReadyForInitialPrompt func(message string) bool
+	// InputBoxBottom are the markers of the bottom border of the box the
+	// agent echoes the user's input in. The border is removed from replies.
+	InputBoxBottom []string
+	// LinesAfterInput is the number of lines following the echoed user input
+	// that are removed from replies.
+	LinesAfterInput int
+	// HeaderLines is the number of lines at the top of the screen whose
+	// content changes on its own, e.g. a token counter. They are ignored when
+	// looking for new output.
+	HeaderLines int
+	// StartupInput, if set, is written to the agent's terminal right after
+	// the agent starts.
+	StartupInput string
+	// ExtractDiffs, if set, finds the file changes the agent prints in its
+	// replies.
+	ExtractDiffs func(message string) []FileDiff
+	// ExtractCommands, if set, finds the shell commands the agent ran in its
+	// replies.
+	ExtractCommands func(message string) []CommandRun
+	// FileMentionPrefix is prepended to the paths of files attached to
+	// messages, e.g. "@" for agents that read the files mentioned that way.
+	FileMentionPrefix string
+}
+
+var builtinAgents = []Agent{
+	{
+		Type:              AgentTypeClaude,
+		FormatMessage:     formatClaudeMessage,
+		ExtractCommands:   ExtractClaudeCommands,
+		FileMentionPrefix: "@",
+	},
+	{Type: AgentTypeGoose},
+	{Type: AgentTypeAider, ExtractDiffs: ExtractUnifiedDiffs, ExtractCommands: ExtractAiderCommands},
+	{
+		Type:                    AgentTypeCodex,
+		FormatMessage:           formatCodexMessage,
+		IsReadyForInitialPrompt: isCodexAgentReadyForInitialPrompt,
+		FileMentionPrefix:       "@",
+	},
+	{Type: AgentTypeGemini, InputBoxBottom: []string{"╯", "╰"}, FileMentionPrefix: "@"},
+	{Type: AgentTypeCopilot, InputBoxBottom: []string{"╯", "╰"}},
+	{
+		Type:                    AgentTypeAmp,
+		FormatMessage:           formatAmpMessage,
+		IsReadyForInitialPrompt: isAmpAgentReadyForInitialPrompt,
+		// Stops the animation.
+		StartupInput: " \b",
+	},
+	{Type: AgentTypeCursor, Aliases: []string{"cursor-agent"}, InputBoxBottom: []string{"┘", "└"}},
+	{Type: AgentTypeAuggie},
+	{Type: AgentTypeAmazonQ, Aliases: []string{"q"}},
+	{
+		Type:                    AgentTypeOpencode,
+		FormatMessage:           formatOpencodeMessage,
+		IsReadyForInitialPrompt: isOpencodeAgentReadyForInitialPrompt,
+		FileMentionPrefix:       "@",
+		// The input is followed by its author and time:
+		//
+		//   ┃  jkmr (08:46 PM)                                                     ┃
+		//   ┃                                                                      ┃
+		LinesAfterInput: 2,
+		// The header contains dynamic content (token count, context
+		// percentage, cost) that changes between screens:
+		//
+		// ┃  # Getting Started with Claude CLI                                   ┃
+		// ┃  /share to create a shareable link                 12.6K/6% ($0.05)  ┃
+		HeaderLines: 3,
+	},
+	{Type: AgentTypeCustom},
+}
+
+var (
+	agentsMu sync.RWMutex
+	// agents maps agent types and their aliases to agents.
+	agents = map[string]Agent{}
+)
+
+func init() {
+	for _, agent := range builtinAgents {
+		RegisterAgent(agent)
+	}
+}
+
+// RegisterAgent makes an agent available under its type and aliases. Missing
+// functions are filled in with the generic implementations. It panics if a
+// name is already taken.
+func RegisterAgent(agent Agent) {
+	if agent.FormatMessage == nil {
+		agentType := agent.Type
+		agent.FormatMessage = func(message string, userInput string) string {
+			return formatGenericMessage(message, userInput, agentType)
+		}
+	}
+	if agent.Trim == nil {
+		trim := DefaultTrimOptions
+		agent.Trim = &trim
+	}
+	if agent.IsReadyForInitialPrompt == nil {
+		agent.IsReadyForInitialPrompt = isGenericAgentReadyForInitialPrompt
+	}
+
+	agentsMu.Lock()
+	defer agentsMu.Unlock()
+	names := append([]string{string(agent.Type)}, agent.Aliases...)
+	for _, name := range names {
+		if _, ok := agents[name]; ok {
+			panic(fmt.Sprintf("agent %q is already registered", name))
+		}
+	}
+	for _, name := range names {
+		agents[name] = agent
+	}
+}
+
+// LookupAgent returns the agent registered under name, which can be an agent
+// type or an alias.
+func LookupAgent(name string) (Agent, bool) {
+	agentsMu.RLock()
+	defer agentsMu.RUnlock()
+	agent, ok := agents[name]
+	return agent, ok
+}
+
+// AgentNames returns the sorted names of all registered agents, including
+// aliases.
+func AgentNames() []string {
+	agentsMu.RLock()
+	defer agentsMu.RUnlock()
+	names := make([]string, 0, len(agents))
+	for name := range agents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,58 @@
+package msgfmt
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterAgent(t *testing.T) {
+	RegisterAgent(Agent{
+		Type:    "dummy",
+		Aliases: []string{"dummy-cli"},
+		FormatMessage: func(message string, userInput string) string {
+			return strings.TrimPrefix(message, "dummy: ")
+		},
+		IsReadyForInitialPrompt: func(message string) bool {
+			return strings.HasSuffix(message, "$")
+		},
+	})
+
+	agent, ok := LookupAgent("dummy-cli")
+	require.True(t, ok)
+	assert.Equal(t, AgentType("dummy"), agent.Type)
+	assert.Contains(t, AgentNames(), "dummy")
+	assert.Contains(t, AgentNames(), "dummy-cli")
+
+	assert.Equal(t, "hello", FormatAgentMessage("dummy", "dummy: hello", ""))
+	assert.True(t, IsAgentReadyForInitialPrompt("dummy", "ready $"))
+	assert.False(t, IsAgentReadyForInitialPrompt("dummy", "loading"))
+
+	assert.Panics(t, func() {
+		RegisterAgent(Agent{Type: "other", Aliases: []string{"dummy"}})
+	})
+	_, ok = LookupAgent("other")
+	assert.False(t, ok)
+}
+
+func TestRegisterAgent_Defaults(t *testing.T) {
+	RegisterAgent(Agent{Type: "dummy-defaults"})
+	message := "hello\n> something\n───────────────\n> \n───────────────"
+	assert.Equal(t, FormatAgentMessage(AgentTypeCustom, message, ""), FormatAgentMessage("dummy-defaults", message, ""))
+	assert.Equal(t, IsAgentReadyForInitialPrompt(AgentTypeCustom, message), IsAgentReadyForInitialPrompt("dummy-defaults", message))
+}
+
+func TestBuiltinAgents(t *testing.T) {
+	for _, name := range []string{"claude", "goose", "aider", "codex", "gemini", "copilot", "amp", "cursor", "cursor-agent", "auggie", "q", "amazonq", "opencode", "custom"} {
+		_, ok := LookupAgent(name)
+		assert.True(t, ok, name)
+	}
+	agent, _ := LookupAgent("q")
+	assert.Equal(t, AgentTypeAmazonQ, agent.Type)
+
+	// Unknown agents are left alone.
+	assert.Equal(t, " msg ", FormatAgentMessage("unknown", " msg ", ""))
+	assert.True(t, IsAgentReadyForInitialPrompt("unknown", ""))
+}
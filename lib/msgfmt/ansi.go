@@ -0,0 +1,26 @@
+package msgfmt
+
+import (
+	"regexp"
+)
+
+// ansiSequence matches ANSI escape sequences: CSI sequences such as colors and
+// cursor movements, OSC sequences such as window titles and hyperlinks, and
+// the remaining two-character escape sequences.
+var ansiSequence = regexp.MustCompile(
+	`\x1b\[[0-?]*[ -/]*[@-~]` + // CSI
+		`|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)` + // OSC, terminated by BEL or ST
+		`|\x1b[ -/]*[0-~]`, // other escape sequences
+)
+
+// controlChars matches C0 control characters other than tabs and newlines,
+// and DEL. Escape characters left over after removing the sequences above are
+// matched too.
+var controlChars = regexp.MustCompile(`[\x00-\x08\x0b-\x1f\x7f]`)
+
+// StripANSI removes ANSI escape sequences and control characters from a
+// message, so that clients that don't render them get plain text.
+func StripANSI(message string) string {
+	message = ansiSequence.ReplaceAllString(message, "")
+	return controlChars.ReplaceAllString(message, "")
+}
@@ -0,0 +1,30 @@
+package msgfmt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStripANSI(t *testing.T) {
+	cases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"plain", "Hello, World!\n\tindented", "Hello, World!\n\tindented"},
+		{"colors", "\x1b[1;31mError:\x1b[0m file not found", "Error: file not found"},
+		{"256 colors", "\x1b[38;5;208morange\x1b[m", "orange"},
+		{"cursor movement", "one\x1b[2Ktwo\x1b[?25l", "onetwo"},
+		{"hyperlink", "see \x1b]8;;https://example.com\x1b\\docs\x1b]8;;\x1b\\ here", "see docs here"},
+		{"window title", "\x1b]0;agent\x07ready", "ready"},
+		{"charset", "\x1b(Bbox", "box"},
+		{"control characters", "bell\x07 back\x08space\r\n", "bell backspace\n"},
+		{"unicode", "✓ done ─── │", "✓ done ─── │"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expected, StripANSI(c.input))
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package msgfmt
+
+import (
+	"regexp"
+	"strings"
+)
+
+// CommandStatus is the outcome of a shell command as shown by the agent.
+type CommandStatus string
+
+const (
+	CommandStatusOk    CommandStatus = "ok"
+	CommandStatusError CommandStatus = "error"
+	// CommandStatusUnknown is used for agents that don't show whether a
+	// command failed.
+	CommandStatusUnknown CommandStatus = "unknown"
+)
+
+// CommandRun is a shell command the agent ran, found in an agent message.
+type CommandRun struct {
+	Command string
+	// Output is the output of the command as far as the agent shows it. It
+	// may be truncated by the agent.
+	Output string
+	Status CommandStatus
+}
+
+// trimTrailingEmptyLines drops the empty lines at the end of lines.
+func trimTrailingEmptyLines(lines []string) []string {
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// isAiderCommandEnd reports whether line ends the output of a command run by
+// Aider.
+func isAiderCommandEnd(line string) bool {
+	return strings.HasPrefix(line, "Running ") ||
+		(strings.HasPrefix(line, "Add ") && strings.Contains(line, "output to the chat?"))
+}
+
+// ExtractAiderCommands finds the shell commands Aider ran in a message:
+//
+//	Running npm test
+//	<output>
+//	Add command output to the chat? (Y)es/(N)o [Yes]:
+//
+// Aider doesn't show the exit status of commands.
+func ExtractAiderCommands(message string) []CommandRun {
+	lines := strings.Split(message, "\n")
+	var commands []CommandRun
+	for i := 0; i < len(lines); i++ {
+		command, ok := strings.CutPrefix(lines[i], "Running ")
+		if !ok || strings.TrimSpace(command) == "" {
+			continue
+		}
+		end := i + 1
+		for end < len(lines) && !isAiderCommandEnd(lines[end]) {
+			end++
+		}
+		commands = append(commands, CommandRun{
+			Command: strings.TrimSpace(command),
+			Output:  strings.Join(trimTrailingEmptyLines(lines[i+1:end]), "\n"),
+			Status:  CommandStatusUnknown,
+		})
+		i = end - 1
+	}
+	return commands
+}
+
+// claudeBashToolCall matches the first line of a Bash tool call of Claude
+// Code. The bullet is ⏺ on macOS and ● elsewhere.
+var claudeBashToolCall = regexp.MustCompile(`^[●⏺] Bash\((.*)\)\s*$`)
+
+// ExtractClaudeCommands finds the Bash tool calls in a message of Claude Code:
+//
+//	● Bash(npm test)
+//	  ⎿  > test
+//	     > jest
+//
+// A command failed if its output starts with "Error".
+func ExtractClaudeCommands(message string) []CommandRun {
+	lines := strings.Split(message, "\n")
+	var commands []CommandRun
+	for i := 0; i < len(lines); i++ {
+		match := claudeBashToolCall.FindStringSubmatch(lines[i])
+		if match == nil {
+			continue
+		}
+		run := CommandRun{Command: match[1], Status: CommandStatusOk}
+		var output []string
+		if i+1 < len(lines) {
+			if first, ok := strings.CutPrefix(strings.TrimLeft(lines[i+1], " "), "⎿"); ok {
+				output = append(output, strings.TrimLeft(first, " "))
+				i++
+				for i+1 < len(lines) && strings.HasPrefix(lines[i+1], "     ") {
+					output = append(output, strings.TrimPrefix(lines[i+1], "     "))
+					i++
+				}
+			}
+		}
+		run.Output = strings.Join(trimTrailingEmptyLines(output), "\n")
+		if strings.HasPrefix(run.Output, "Error") {
+			run.Status = CommandStatusError
+		}
+		commands = append(commands, run)
+	}
+	return commands
+}
+
+// ExtractAgentCommands finds the shell commands in a reply of the agent, if
+// the agent's command runs are recognized. It returns nil for agents without
+// ExtractCommands.
+func ExtractAgentCommands(agentType AgentType, message string) []CommandRun {
+	agent, ok := LookupAgent(string(agentType))
+	if !ok || agent.ExtractCommands == nil {
+		return nil
+	}
+	return agent.ExtractCommands(message)
+}
@@ -0,0 +1,65 @@
+package msgfmt
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractAiderCommands(t *testing.T) {
+	message := strings.Join([]string{
+		"Run the tests to check the change:",
+		"",
+		"```bash",
+		"go test ./...",
+		"```",
+		"",
+		"Run shell command? (Y)es/(N)o/(D)on't ask again [Yes]: y",
+		"",
+		"Running go test ./...",
+		"ok  \texample.com/greet\t0.002s",
+		"",
+		"Running go vet ./...",
+		"Add command output to the chat? (Y)es/(N)o/(D)on't ask again [Yes]: n",
+		"Running",
+	}, "\n")
+	assert.Equal(t, []CommandRun{
+		{Command: "go test ./...", Output: "ok  \texample.com/greet\t0.002s", Status: CommandStatusUnknown},
+		{Command: "go vet ./...", Output: "", Status: CommandStatusUnknown},
+	}, ExtractAiderCommands(message))
+
+	assert.Empty(t, ExtractAiderCommands("No commands to run."))
+}
+
+func TestExtractClaudeCommands(t *testing.T) {
+	message := strings.Join([]string{
+		"● I'll run the tests.",
+		"",
+		"● Bash(npm test)",
+		"  ⎿  > test",
+		"     > jest",
+		"     … +12 lines (ctrl+r to expand)",
+		"",
+		"⏺ Bash(npm run lint)",
+		"  ⎿  Error: Command failed with exit code 1",
+		"",
+		"● Bash(true)",
+		"",
+		"● All tests pass.",
+	}, "\n")
+	assert.Equal(t, []CommandRun{
+		{Command: "npm test", Output: "> test\n> jest\n… +12 lines (ctrl+r to expand)", Status: CommandStatusOk},
+		{Command: "npm run lint", Output: "Error: Command failed with exit code 1", Status: CommandStatusError},
+		{Command: "true", Output: "", Status: CommandStatusOk},
+	}, ExtractClaudeCommands(message))
+
+	assert.Empty(t, ExtractClaudeCommands("● Read(main.go)\n  ⎿  Read 20 lines"))
+}
+
+func TestExtractAgentCommands(t *testing.T) {
+	message := "Running ls\nmain.go"
+	assert.Equal(t, []CommandRun{{Command: "ls", Output: "main.go", Status: CommandStatusUnknown}}, ExtractAgentCommands(AgentTypeAider, message))
+	assert.Nil(t, ExtractAgentCommands(AgentTypeGoose, message))
+	assert.Nil(t, ExtractAgentCommands("unknown", message))
+}
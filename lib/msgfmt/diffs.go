@@ -0,0 +1,92 @@
+package msgfmt
+
+import (
+	"strings"
+)
+
+// FileDiff is the unified diff of a single file found in an agent message.
+type FileDiff struct {
+	// Path is the path of the file after the change, without the "b/"
+	// prefix of git diffs. For deleted files, it's the path before.
+	Path string
+	// Hunks are the hunks of the diff, each starting with its "@@" header.
+	Hunks []string
+}
+
+// diffPath returns the path of a "--- " or "+++ " header line.
+func diffPath(header string) string {
+	path := strings.TrimSpace(header[4:])
+	// Drop the timestamp some tools append after a tab.
+	path, _, _ = strings.Cut(path, "\t")
+	if path == "/dev/null" {
+		return ""
+	}
+	if rest, ok := strings.CutPrefix(path, "a/"); ok {
+		return rest
+	}
+	if rest, ok := strings.CutPrefix(path, "b/"); ok {
+		return rest
+	}
+	return path
+}
+
+// isHunkLine reports whether line continues a hunk.
+func isHunkLine(line string) bool {
+	if line == "" {
+		// Editors and terminals drop the space of empty context lines.
+		return true
+	}
+	switch line[0] {
+	case ' ', '+', '-', '\\':
+		return !strings.HasPrefix(line, "--- ") && !strings.HasPrefix(line, "+++ ")
+	}
+	return false
+}
+
+// ExtractUnifiedDiffs finds the unified diffs in a message, e.g. the ones
+// Aider prints with --edit-format udiff. Text around the diffs, such as code
+// fences, is ignored.
+func ExtractUnifiedDiffs(message string) []FileDiff {
+	lines := strings.Split(message, "\n")
+	var diffs []FileDiff
+	for i := 0; i+1 < len(lines); i++ {
+		if !strings.HasPrefix(lines[i], "--- ") || !strings.HasPrefix(lines[i+1], "+++ ") {
+			continue
+		}
+		diff := FileDiff{Path: diffPath(lines[i+1])}
+		if diff.Path == "" {
+			diff.Path = diffPath(lines[i])
+		}
+		i += 2
+		for i < len(lines) && strings.HasPrefix(lines[i], "@@") {
+			hunk := []string{lines[i]}
+			i++
+			for i < len(lines) && isHunkLine(lines[i]) && !strings.HasPrefix(lines[i], "@@") {
+				hunk = append(hunk, lines[i])
+				i++
+			}
+			// Empty lines at the end belong to the text after the diff.
+			for len(hunk) > 1 && hunk[len(hunk)-1] == "" {
+				hunk = hunk[:len(hunk)-1]
+			}
+			diff.Hunks = append(diff.Hunks, strings.Join(hunk, "\n"))
+		}
+		// Step back so that the loop's increment lands on the first line
+		// after the diff.
+		i--
+		if len(diff.Hunks) > 0 {
+			diffs = append(diffs, diff)
+		}
+	}
+	return diffs
+}
+
+// ExtractAgentDiffs finds the file diffs in a reply of the agent, if the
+// agent prints any. It returns nil for agents without ExtractDiffs.
+func ExtractAgentDiffs(agentType AgentType, message string) []FileDiff {
+	agent, ok := LookupAgent(string(agentType))
+	if !ok || agent.ExtractDiffs == nil {
+		return nil
+	}
+	return agent.ExtractDiffs(message)
+}
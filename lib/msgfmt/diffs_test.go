@@ -0,0 +1,90 @@
+package msgfmt
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractUnifiedDiffs(t *testing.T) {
+	t.Run("aider", func(t *testing.T) {
+		message := strings.Join([]string{
+			"I'll add a name parameter to greet.",
+			"",
+			"```diff",
+			"--- greet.py",
+			"+++ greet.py",
+			"@@ ... @@",
+			"-def greet():",
+			`-    print("hello")`,
+			"+def greet(name):",
+			`+    print(f"hello {name}")`,
+			"@@ ... @@",
+			" if __name__ == \"__main__\":",
+			"-    greet()",
+			`+    greet("world")`,
+			"```",
+			"",
+			"```diff",
+			"--- /dev/null",
+			"+++ tests/test_greet.py",
+			"@@ -0,0 +1,2 @@",
+			"+def test_greet():",
+			"+    pass",
+			"```",
+			"",
+			"Applied edit to greet.py",
+		}, "\n")
+
+		diffs := ExtractUnifiedDiffs(message)
+		require.Equal(t, []FileDiff{
+			{
+				Path: "greet.py",
+				Hunks: []string{
+					"@@ ... @@\n-def greet():\n-    print(\"hello\")\n+def greet(name):\n+    print(f\"hello {name}\")",
+					"@@ ... @@\n if __name__ == \"__main__\":\n-    greet()\n+    greet(\"world\")",
+				},
+			},
+			{
+				Path:  "tests/test_greet.py",
+				Hunks: []string{"@@ -0,0 +1,2 @@\n+def test_greet():\n+    pass"},
+			},
+		}, diffs)
+		// The message itself is left as is.
+		assert.Equal(t, diffs, ExtractAgentDiffs(AgentTypeAider, message))
+	})
+
+	t.Run("git diff", func(t *testing.T) {
+		message := strings.Join([]string{
+			"diff --git a/main.go b/main.go",
+			"--- a/main.go",
+			"+++ b/main.go",
+			"@@ -1,3 +1,3 @@",
+			" package main",
+			"",
+			"-var x = 1",
+			"+var x = 2",
+			"",
+			"Done.",
+		}, "\n")
+		assert.Equal(t, []FileDiff{
+			{Path: "main.go", Hunks: []string{"@@ -1,3 +1,3 @@\n package main\n\n-var x = 1\n+var x = 2"}},
+		}, ExtractUnifiedDiffs(message))
+	})
+
+	t.Run("deleted file", func(t *testing.T) {
+		message := "--- a/old.txt\n+++ /dev/null\n@@ -1 +0,0 @@\n-gone"
+		assert.Equal(t, []FileDiff{{Path: "old.txt", Hunks: []string{"@@ -1 +0,0 @@\n-gone"}}}, ExtractUnifiedDiffs(message))
+	})
+
+	t.Run("no diffs", func(t *testing.T) {
+		assert.Empty(t, ExtractUnifiedDiffs("--- not a diff\njust text\n+++ neither"))
+		assert.Empty(t, ExtractUnifiedDiffs("--- a.txt\n+++ b.txt\nno hunks"))
+	})
+
+	t.Run("agents without diffs", func(t *testing.T) {
+		assert.Nil(t, ExtractAgentDiffs(AgentTypeClaude, "--- a.txt\n+++ a.txt\n@@ -1 +1 @@\n-a\n+b"))
+	})
+}
@@ -187,22 +187,14 @@ func RemoveUserInput(msgRaw string, userInputRaw string, agentType AgentType) st
 	// that doesn't contain the echoed user input.
 	lastUserInputLineIdx := msgRuneLineLocations[userInputEndIdx]
 
-	// Skip Gemini/Cursor trailing input box line
-	if agentType == AgentTypeGemini || agentType == AgentTypeCopilot {
-		if idx, found := skipTrailingInputBoxLine(msgLines, lastUserInputLineIdx, "╯", "╰"); found {
+	agent, _ := LookupAgent(string(agentType))
+	if len(agent.InputBoxBottom) > 0 {
+		// Skip the bottom border of the box the input is echoed in
+		if idx, found := skipTrailingInputBoxLine(msgLines, lastUserInputLineIdx, agent.InputBoxBottom...); found {
 			lastUserInputLineIdx = idx
 		}
-	} else if agentType == AgentTypeCursor {
-		if idx, found := skipTrailingInputBoxLine(msgLines, lastUserInputLineIdx, "┘", "└"); found {
-			lastUserInputLineIdx = idx
-		}
-	} else if agentType == AgentTypeOpencode {
-		// skip +2 lines after the input
-		//   ┃  jkmr (08:46 PM)                                                     ┃
-		//   ┃                                                                      ┃
-		if lastUserInputLineIdx+2 < len(msgLines) {
-			lastUserInputLineIdx += 2
-		}
+	} else if agent.LinesAfterInput > 0 && lastUserInputLineIdx+agent.LinesAfterInput < len(msgLines) {
+		lastUserInputLineIdx += agent.LinesAfterInput
 	}
 
 	return strings.Join(msgLines[lastUserInputLineIdx+1:], "\n")
@@ -250,7 +242,6 @@ const (
 func formatGenericMessage(message string, userInput string, agentType AgentType) string {
 	message = RemoveUserInput(message, userInput, agentType)
 	message = removeMessageBox(message)
-	message = trimEmptyLines(message)
 	return message
 }
 
@@ -258,58 +249,43 @@ func formatClaudeMessage(message string, userInput string) string {
 	message = RemoveUserInput(message, userInput, AgentTypeClaude)
 	message = removeMessageBox(message)
 	message = removeClaudeReportTaskToolCall(message)
-	message = trimEmptyLines(message)
 	return message
 }
 
 func formatCodexMessage(message string, userInput string) string {
 	message = RemoveUserInput(message, userInput, AgentTypeCodex)
 	message = removeCodexInputBox(message)
-	message = trimEmptyLines(message)
 	return message
 }
 
 func formatOpencodeMessage(message string, userInput string) string {
 	message = RemoveUserInput(message, userInput, AgentTypeOpencode)
 	message = removeOpencodeMessageBox(message)
-	message = trimEmptyLines(message)
 	return message
 }
 
 func formatAmpMessage(message string, userInput string) string {
 	message = RemoveUserInput(message, userInput, AgentTypeAmp)
 	message = removeAmpMessageBox(message)
-	message = trimEmptyLines(message)
 	return message
 }
 
+// FormatAgentMessage formats the agent's reply with the formatter of the
+// registered agent and trims it with the agent's trim options. Messages of
+// unknown agents are returned unchanged.
 func FormatAgentMessage(agentType AgentType, message string, userInput string) string {
-	switch agentType {
-	case AgentTypeClaude:
-		return formatClaudeMessage(message, userInput)
-	case AgentTypeGoose:
-		return formatGenericMessage(message, userInput, agentType)
-	case AgentTypeAider:
-		return formatGenericMessage(message, userInput, agentType)
-	case AgentTypeCodex:
-		return formatCodexMessage(message, userInput)
-	case AgentTypeGemini:
-		return formatGenericMessage(message, userInput, agentType)
-	case AgentTypeCopilot:
-		return formatGenericMessage(message, userInput, agentType)
-	case AgentTypeAmp:
-		return formatAmpMessage(message, userInput)
-	case AgentTypeCursor:
-		return formatGenericMessage(message, userInput, agentType)
-	case AgentTypeAuggie:
-		return formatGenericMessage(message, userInput, agentType)
-	case AgentTypeAmazonQ:
-		return formatGenericMessage(message, userInput, agentType)
-	case AgentTypeOpencode:
-		return formatOpencodeMessage(message, userInput)
-	case AgentTypeCustom:
-		return formatGenericMessage(message, userInput, agentType)
-	default:
+	return FormatAgentMessageWithTrim(agentType, message, userInput, nil)
+}
+
+// FormatAgentMessageWithTrim is like FormatAgentMessage, but trims the reply
+// with trim instead of the agent's trim options if it's set.
+func FormatAgentMessageWithTrim(agentType AgentType, message string, userInput string, trim *TrimOptions) string {
+	agent, ok := LookupAgent(string(agentType))
+	if !ok {
 		return message
 	}
+	if trim == nil {
+		trim = agent.Trim
+	}
+	return Trim(agent.FormatMessage(message, userInput), *trim)
 }
@@ -0,0 +1,120 @@
+package msgfmt
+
+import (
+	"sort"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// TrimOptions controls how agent messages are cleaned up after the agent's
+// formatter has extracted them from the screen.
+type TrimOptions struct {
+	// EmptyLines removes the blank lines at the start and end of messages.
+	EmptyLines bool
+	// Whitespace removes the whitespace at the start and end of messages,
+	// including the indentation of their first line.
+	Whitespace bool
+	// CollapseBlankLines replaces runs of blank lines inside messages with a
+	// single blank line.
+	CollapseBlankLines bool
+	// PromptArtifacts removes the lines at the end of messages that only
+	// contain a shell or agent prompt, e.g. ">" or "$".
+	PromptArtifacts bool
+}
+
+// DefaultTrimOptions are the options of agents that don't set their own.
+var DefaultTrimOptions = TrimOptions{EmptyLines: true}
+
+// trimOptionNames maps the names accepted by ParseTrimOptions to the options
+// they enable.
+var trimOptionNames = map[string]func(*TrimOptions){
+	"empty-lines":          func(o *TrimOptions) { o.EmptyLines = true },
+	"whitespace":           func(o *TrimOptions) { o.Whitespace = true },
+	"collapse-blank-lines": func(o *TrimOptions) { o.CollapseBlankLines = true },
+	"prompt-artifacts":     func(o *TrimOptions) { o.PromptArtifacts = true },
+}
+
+// TrimOptionNames returns the names accepted by ParseTrimOptions, sorted.
+func TrimOptionNames() []string {
+	names := make([]string, 0, len(trimOptionNames))
+	for name := range trimOptionNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseTrimOptions returns the options that enable exactly the named rules.
+// "none" disables all of them.
+func ParseTrimOptions(names []string) (TrimOptions, error) {
+	var opts TrimOptions
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "none" {
+			continue
+		}
+		enable, ok := trimOptionNames[name]
+		if !ok {
+			return TrimOptions{}, xerrors.Errorf("unknown trim option %q (valid options: %s, none)", name, strings.Join(TrimOptionNames(), ", "))
+		}
+		enable(&opts)
+	}
+	return opts, nil
+}
+
+// promptArtifacts are the contents of lines that only show a prompt.
+var promptArtifacts = []string{">", "$", "#", "%", "❯", "›"}
+
+func isPromptArtifact(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	for _, prompt := range promptArtifacts {
+		if trimmed == prompt {
+			return true
+		}
+	}
+	return false
+}
+
+// removePromptArtifacts removes the trailing lines that are blank or only
+// contain a prompt.
+func removePromptArtifacts(message string) string {
+	lines := strings.Split(message, "\n")
+	end := len(lines)
+	for end > 0 && (strings.TrimSpace(lines[end-1]) == "" || isPromptArtifact(lines[end-1])) {
+		end--
+	}
+	if end == len(lines) {
+		return message
+	}
+	return strings.Join(lines[:end], "\n")
+}
+
+func collapseBlankLines(message string) string {
+	lines := strings.Split(message, "\n")
+	out := make([]string, 0, len(lines))
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" && i > 0 && strings.TrimSpace(lines[i-1]) == "" {
+			continue
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "\n")
+}
+
+// Trim applies opts to message.
+func Trim(message string, opts TrimOptions) string {
+	if opts.PromptArtifacts {
+		message = removePromptArtifacts(message)
+	}
+	if opts.CollapseBlankLines {
+		message = collapseBlankLines(message)
+	}
+	if opts.EmptyLines {
+		message = trimEmptyLines(message)
+	}
+	if opts.Whitespace {
+		message = TrimWhitespace(message)
+	}
+	return message
+}
@@ -0,0 +1,65 @@
+package msgfmt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrim(t *testing.T) {
+	message := "\n\n  Hello\n\n\n\nWorld  \n\n>\n$ \n"
+	cases := []struct {
+		name     string
+		opts     TrimOptions
+		expected string
+	}{
+		{"none", TrimOptions{}, message},
+		{"empty lines", TrimOptions{EmptyLines: true}, "  Hello\n\n\n\nWorld  \n\n>\n$ "},
+		{"whitespace", TrimOptions{Whitespace: true}, "Hello\n\n\n\nWorld  \n\n>\n$"},
+		{"collapse blank lines", TrimOptions{CollapseBlankLines: true}, "\n  Hello\n\nWorld  \n\n>\n$ \n"},
+		{"prompt artifacts", TrimOptions{PromptArtifacts: true}, "\n\n  Hello\n\n\n\nWorld  "},
+		{"all", TrimOptions{EmptyLines: true, Whitespace: true, CollapseBlankLines: true, PromptArtifacts: true}, "Hello\n\nWorld"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expected, Trim(message, c.opts))
+		})
+	}
+
+	// Prompts inside the message are kept.
+	assert.Equal(t, "> quoted\n>\ntext", Trim("> quoted\n>\ntext\n>", TrimOptions{PromptArtifacts: true}))
+}
+
+func TestParseTrimOptions(t *testing.T) {
+	cases := []struct {
+		names    []string
+		expected TrimOptions
+	}{
+		{nil, TrimOptions{}},
+		{[]string{"none"}, TrimOptions{}},
+		{[]string{"empty-lines"}, TrimOptions{EmptyLines: true}},
+		{[]string{"whitespace", " collapse-blank-lines"}, TrimOptions{Whitespace: true, CollapseBlankLines: true}},
+		{[]string{"prompt-artifacts"}, TrimOptions{PromptArtifacts: true}},
+	}
+	for _, c := range cases {
+		opts, err := ParseTrimOptions(c.names)
+		require.NoError(t, err)
+		assert.Equal(t, c.expected, opts, c.names)
+	}
+
+	_, err := ParseTrimOptions([]string{"everything"})
+	require.ErrorContains(t, err, `unknown trim option "everything"`)
+}
+
+func TestFormatAgentMessageWithTrim(t *testing.T) {
+	message := "\n  hello\n\n\nworld\n$\n"
+	// The agent's options by default.
+	assert.Equal(t, "  hello\n\n\nworld\n$", FormatAgentMessage(AgentTypeCustom, message, ""))
+	assert.Equal(t, "  hello\n\n\nworld\n$", FormatAgentMessageWithTrim(AgentTypeCustom, message, "", nil))
+	assert.Equal(t, "hello\n\nworld", FormatAgentMessageWithTrim(AgentTypeCustom, message, "", &TrimOptions{
+		Whitespace:         true,
+		CollapseBlankLines: true,
+		PromptArtifacts:    true,
+	}))
+}
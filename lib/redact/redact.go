@@ -0,0 +1,69 @@
+package redact
+
+import (
+	"regexp"
+
+	"golang.org/x/xerrors"
+)
+
+// Replacement is the text that replaces every redacted match.
+const Replacement = "***"
+
+// builtinPatterns match common secret formats.
+var builtinPatterns = []string{
+	// Private key blocks
+	`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`,
+	// AWS access key IDs
+	`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`,
+	// GitHub tokens
+	`\bgh[pousr]_[A-Za-z0-9]{36,}\b`,
+	`\bgithub_pat_[A-Za-z0-9_]{22,}\b`,
+	// Anthropic and OpenAI API keys
+	`\bsk-ant-[A-Za-z0-9_-]{20,}`,
+	`\bsk-(?:proj-)?[A-Za-z0-9_-]{20,}`,
+	// Slack tokens
+	`\bxox[abprs]-[A-Za-z0-9-]{10,}`,
+	// Google API keys
+	`\bAIza[0-9A-Za-z_-]{35}\b`,
+}
+
+// Redactor replaces secrets in text with Replacement.
+type Redactor struct {
+	patterns []*regexp.Regexp
+}
+
+// New creates a Redactor from the given regular expressions. If includeBuiltins
+// is true, patterns for common token formats are also used.
+func New(patterns []string, includeBuiltins bool) (*Redactor, error) {
+	all := make([]string, 0, len(builtinPatterns)+len(patterns))
+	if includeBuiltins {
+		all = append(all, builtinPatterns...)
+	}
+	all = append(all, patterns...)
+
+	r := &Redactor{patterns: make([]*regexp.Regexp, 0, len(all))}
+	for _, pattern := range all {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid redaction pattern %q: %w", pattern, err)
+		}
+		r.patterns = append(r.patterns, re)
+	}
+	return r, nil
+}
+
+// Enabled reports whether the redactor has any patterns.
+func (r *Redactor) Enabled() bool {
+	return r != nil && len(r.patterns) > 0
+}
+
+// Redact returns text with every match of the redactor's patterns replaced.
+func (r *Redactor) Redact(text string) string {
+	if r == nil {
+		return text
+	}
+	for _, re := range r.patterns {
+		text = re.ReplaceAllString(text, Replacement)
+	}
+	return text
+}
@@ -6,6 +6,7 @@ import (
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/coder/agentapi/lib/msgfmt"
 	"github.com/coder/agentapi/lib/util"
@@ -35,6 +36,9 @@ type ConversationConfig struct {
 	// Function to format the messages received from the agent
 	// userInput is the last user message
 	FormatMessage func(message string, userInput string) string
+	// RedactMessage, if set, is applied to the content of every user and agent
+	// message before it is stored in the conversation history
+	RedactMessage func(message string) string
 	// SkipWritingMessage skips the writing of a message to the agent.
 	// This is used in tests
 	SkipWritingMessage bool
@@ -43,6 +47,29 @@ type ConversationConfig struct {
 	SkipSendMessageStatusCheck bool
 	// ReadyForInitialPrompt detects whether the agent has initialized and is ready to accept the initial prompt
 	ReadyForInitialPrompt func(message string) bool
+	// IsIdle, if set, detects whether the agent waits for input. The status
+	// is only stable once the screen both stopped changing and is idle.
+	IsIdle func(screen string) bool
+	// ExtractDiffs, if set, finds the file changes in agent messages. They're
+	// stored in ConversationMessage.Diffs.
+	ExtractDiffs func(message string) []msgfmt.FileDiff
+	// ExtractCommands, if set, finds the shell commands the agent ran in
+	// agent messages. They're stored in ConversationMessage.Commands.
+	ExtractCommands func(message string) []msgfmt.CommandRun
+	// KeepRawScreen stores the screen agent messages are parsed from in
+	// ConversationMessage.RawScreen, for debugging.
+	KeepRawScreen bool
+	// KeepInvalidUTF8 stores the bytes of agent messages that aren't valid
+	// UTF-8 in ConversationMessage.RawBytes. Their Message always has the
+	// invalid bytes replaced.
+	KeepInvalidUTF8 bool
+	// Greeting, if set, is the first agent message of the conversation. The
+	// agent's own output then starts in a separate message.
+	Greeting string
+	// Provider and Model, if set, name the model the agent uses. They're
+	// stored in ConversationMessage.Provider and Model of the agent's messages.
+	Provider string
+	Model    string
 }
 
 type ConversationRole string
@@ -50,11 +77,14 @@ type ConversationRole string
 const (
 	ConversationRoleUser  ConversationRole = "user"
 	ConversationRoleAgent ConversationRole = "agent"
+	// ConversationRoleSystem is only used for messages added with InjectMessage.
+	ConversationRoleSystem ConversationRole = "system"
 )
 
 var ConversationRoleValues = []ConversationRole{
 	ConversationRoleUser,
 	ConversationRoleAgent,
+	ConversationRoleSystem,
 }
 
 func (c ConversationRole) Schema(r huma.Registry) *huma.Schema {
@@ -66,22 +96,66 @@ type ConversationMessage struct {
 	Message string
 	Role    ConversationRole
 	Time    time.Time
+	// Diffs are the file changes found in an agent message by
+	// ConversationConfig.ExtractDiffs. Message still contains them.
+	Diffs []msgfmt.FileDiff
+	// Commands are the shell commands found in an agent message by
+	// ConversationConfig.ExtractCommands. Message still contains them.
+	Commands []msgfmt.CommandRun
+	// RawScreen is the redacted screen an agent message was last parsed
+	// from. Only set if ConversationConfig.KeepRawScreen is.
+	RawScreen string
+	// RawBytes is an agent message as read from the screen, before invalid
+	// UTF-8 was replaced. Only set for messages with invalid UTF-8 if
+	// ConversationConfig.KeepInvalidUTF8 is.
+	RawBytes []byte
+	// Provider and Model name the model that wrote an agent message, from
+	// ConversationConfig. They're empty for injected messages and the
+	// greeting, which no model wrote.
+	Provider string
+	Model    string
 }
 
 type Conversation struct {
 	cfg ConversationConfig
 	// How many stable snapshots are required to consider the screen stable
-	stableSnapshotsThreshold    int
-	snapshotBuffer              *RingBuffer[screenSnapshot]
-	messages                    []ConversationMessage
+	stableSnapshotsThreshold int
+	snapshotBuffer           *RingBuffer[screenSnapshot]
+	messages                 []ConversationMessage
+	// messagesVersion changes whenever messages do. See MessagesVersion.
+	messagesVersion             uint64
 	screenBeforeLastUserMessage string
-	lock                        sync.Mutex
+	// frozenMessages is the number of messages at the start of the history
+	// that are never updated from the screen. It's set by InjectMessage.
+	frozenMessages int
+	// lock protects the conversation state. It's only held for short periods
+	// so that readers such as Messages and Status stay responsive.
+	lock sync.Mutex
+	// sendLock is held while a message is written to the agent, which can take
+	// several seconds. The snapshot loop takes it too, so that no snapshot
+	// is taken while the agent's screen shows a partially written message.
+	sendLock sync.Mutex
+	// sending is true while a message is written to the agent. sendingSince
+	// is when the write started.
+	sending      bool
+	sendingSince time.Time
+	// cancelSend abandons the message that's being written to the agent.
+	// It's set while sending is true.
+	cancelSend context.CancelCauseFunc
+	// lastUserMessageParts are the parts of the last user message, kept so
+	// that Regenerate can send them again and its echo can be removed from
+	// the agent's reply.
+	lastUserMessageParts []MessagePart
 	// InitialPrompt is the initial prompt passed to the agent
 	InitialPrompt string
 	// InitialPromptSent keeps track if the InitialPrompt has been successfully sent to the agents
 	InitialPromptSent bool
 	// ReadyForInitialPrompt keeps track if the agent is ready to accept the initial prompt
 	ReadyForInitialPrompt bool
+	// idleScreen is a screen that's considered idle even if IsIdle doesn't
+	// match it. It's set by ResetStatus.
+	idleScreen    string
+	hasIdleScreen bool
 }
 
 type ConversationStatus string
@@ -92,6 +166,13 @@ const (
 	ConversationStatusInitializing ConversationStatus = "initializing"
 )
 
+// ConversationStatusValues lists every status a conversation can be in.
+var ConversationStatusValues = []ConversationStatus{
+	ConversationStatusInitializing,
+	ConversationStatusChanging,
+	ConversationStatusStable,
+}
+
 func getStableSnapshotsThreshold(cfg ConversationConfig) int {
 	length := cfg.ScreenStabilityLength.Milliseconds()
 	interval := cfg.SnapshotInterval.Milliseconds()
@@ -110,7 +191,7 @@ func NewConversation(ctx context.Context, cfg ConversationConfig, initialPrompt
 		snapshotBuffer:           NewRingBuffer[screenSnapshot](threshold),
 		messages: []ConversationMessage{
 			{
-				Message: "",
+				Message: cfg.Greeting,
 				Role:    ConversationRoleAgent,
 				Time:    cfg.GetTime(),
 			},
@@ -118,6 +199,10 @@ func NewConversation(ctx context.Context, cfg ConversationConfig, initialPrompt
 		InitialPrompt:     initialPrompt,
 		InitialPromptSent: len(initialPrompt) == 0,
 	}
+	if cfg.Greeting != "" {
+		// The greeting isn't overwritten by the screen, like an injected message.
+		c.frozenMessages = 1
+	}
 	return c
 }
 
@@ -135,10 +220,12 @@ func (c *Conversation) StartSnapshotLoop(ctx context.Context) {
 				// 3. AddSnapshot is called and waits on the lock.
 				// 4. SendMessage modifies the terminal state, releases the lock
 				// 5. AddSnapshot adds a snapshot from a stale screen
+				c.sendLock.Lock()
 				c.lock.Lock()
 				screen := c.cfg.AgentIO.ReadScreen()
 				c.addSnapshotInner(screen)
 				c.lock.Unlock()
+				c.sendLock.Unlock()
 			}
 		}
 	}()
@@ -152,14 +239,13 @@ func FindNewMessage(oldScreen, newScreen string, agentType msgfmt.AgentType) str
 	// -1 indicates no header
 	dynamicHeaderEnd := -1
 
-	// Skip header lines for Opencode agent type to avoid false positives
-	// The header contains dynamic content (token count, context percentage, cost)
-	// that changes between screens, causing line comparison mismatches:
-	//
-	// ┃  # Getting Started with Claude CLI                                   ┃
-	// ┃  /share to create a shareable link                 12.6K/6% ($0.05)  ┃
-	if len(newLines) >= 2 && agentType == msgfmt.AgentTypeOpencode {
-		dynamicHeaderEnd = 2
+	// Skip the agent's header lines to avoid false positives. Their dynamic
+	// content changes between screens, causing line comparison mismatches.
+	// Screens shorter than the header, e.g. while the agent starts, are
+	// compared in full: there are no header lines to skip, and skipping them
+	// would slice past the end of the screen.
+	if agent, ok := msgfmt.LookupAgent(string(agentType)); ok && agent.HeaderLines > 0 && len(newLines) >= agent.HeaderLines {
+		dynamicHeaderEnd = agent.HeaderLines - 1
 	}
 
 	for _, line := range oldLines {
@@ -201,12 +287,86 @@ func (c *Conversation) lastMessage(role ConversationRole) ConversationMessage {
 	return ConversationMessage{}
 }
 
+// lastUserInput returns the last user message as it was written to the agent,
+// which is what the agent echoes. Unlike the message in the history, it
+// includes hidden parts such as a prompt prefix and isn't redacted.
+func (c *Conversation) lastUserInput() string {
+	if c.lastUserMessageParts == nil {
+		return c.lastMessage(ConversationRoleUser).Message
+	}
+	return PartsToInput(c.lastUserMessageParts...)
+}
+
+func (c *Conversation) redact(message string) string {
+	if c.cfg.RedactMessage == nil {
+		return message
+	}
+	return c.cfg.RedactMessage(message)
+}
+
+func (c *Conversation) extractDiffs(message string) []msgfmt.FileDiff {
+	if c.cfg.ExtractDiffs == nil {
+		return nil
+	}
+	return c.cfg.ExtractDiffs(message)
+}
+
+func (c *Conversation) extractCommands(message string) []msgfmt.CommandRun {
+	if c.cfg.ExtractCommands == nil {
+		return nil
+	}
+	return c.cfg.ExtractCommands(message)
+}
+
+func (c *Conversation) rawScreen(screen string) string {
+	if !c.cfg.KeepRawScreen {
+		return ""
+	}
+	return strings.ToValidUTF8(c.redact(screen), string(utf8.RuneError))
+}
+
+// sanitizeUTF8 replaces the invalid UTF-8 in an agent message with U+FFFD, so
+// that it can be serialized to JSON as is. The original bytes are returned
+// too if the message had to be changed and ConversationConfig.KeepInvalidUTF8
+// is set.
+func (c *Conversation) sanitizeUTF8(message string) (string, []byte) {
+	if utf8.ValidString(message) {
+		return message, nil
+	}
+	var raw []byte
+	if c.cfg.KeepInvalidUTF8 {
+		raw = []byte(message)
+	}
+	return strings.ToValidUTF8(message, string(utf8.RuneError)), raw
+}
+
 // This function assumes that the caller holds the lock
 func (c *Conversation) updateLastAgentMessage(screen string, timestamp time.Time) {
 	agentMessage := FindNewMessage(c.screenBeforeLastUserMessage, screen, c.cfg.AgentType)
-	lastUserMessage := c.lastMessage(ConversationRoleUser)
 	if c.cfg.FormatMessage != nil {
-		agentMessage = c.cfg.FormatMessage(agentMessage, lastUserMessage.Message)
+		agentMessage = c.cfg.FormatMessage(agentMessage, c.lastUserInput())
+	}
+	agentMessage, rawBytes := c.sanitizeUTF8(c.redact(agentMessage))
+	if len(c.messages) <= c.frozenMessages {
+		// The last message was injected. Only start a new agent message
+		// once the agent writes something.
+		if agentMessage == "" {
+			return
+		}
+		c.messages = append(c.messages, ConversationMessage{
+			Id:        len(c.messages),
+			Message:   agentMessage,
+			Role:      ConversationRoleAgent,
+			Time:      timestamp,
+			Diffs:     c.extractDiffs(agentMessage),
+			Commands:  c.extractCommands(agentMessage),
+			RawScreen: c.rawScreen(screen),
+			RawBytes:  rawBytes,
+			Provider:  c.cfg.Provider,
+			Model:     c.cfg.Model,
+		})
+		c.messagesVersion++
+		return
 	}
 	shouldCreateNewMessage := len(c.messages) == 0 || c.messages[len(c.messages)-1].Role == ConversationRoleUser
 	lastAgentMessage := c.lastMessage(ConversationRoleAgent)
@@ -214,9 +374,15 @@ func (c *Conversation) updateLastAgentMessage(screen string, timestamp time.Time
 		return
 	}
 	conversationMessage := ConversationMessage{
-		Message: agentMessage,
-		Role:    ConversationRoleAgent,
-		Time:    timestamp,
+		Message:   agentMessage,
+		Role:      ConversationRoleAgent,
+		Time:      timestamp,
+		Diffs:     c.extractDiffs(agentMessage),
+		Commands:  c.extractCommands(agentMessage),
+		RawScreen: c.rawScreen(screen),
+		RawBytes:  rawBytes,
+		Provider:  c.cfg.Provider,
+		Model:     c.cfg.Model,
 	}
 	if shouldCreateNewMessage {
 		c.messages = append(c.messages, conversationMessage)
@@ -224,6 +390,7 @@ func (c *Conversation) updateLastAgentMessage(screen string, timestamp time.Time
 		c.messages[len(c.messages)-1] = conversationMessage
 	}
 	c.messages[len(c.messages)-1].Id = len(c.messages) - 1
+	c.messagesVersion++
 }
 
 // assumes the caller holds the lock
@@ -252,6 +419,10 @@ type MessagePartText struct {
 	Content string
 	Alias   string
 	Hidden  bool
+	// Echoed marks hidden content that the agent echoes like the rest of
+	// the message, e.g. a prompt prefix. It's removed from the agent's reply
+	// along with the message.
+	Echoed bool
 }
 
 func (p MessagePartText) Do(writer AgentIO) error {
@@ -277,6 +448,23 @@ func PartsToString(parts ...MessagePart) string {
 	return sb.String()
 }
 
+// PartsToInput returns the text the agent echoes when the parts are written:
+// the content of the parts that are visible or echoed, without aliases.
+func PartsToInput(parts ...MessagePart) string {
+	var sb strings.Builder
+	for _, part := range parts {
+		text, ok := part.(MessagePartText)
+		if !ok {
+			sb.WriteString(part.String())
+			continue
+		}
+		if !text.Hidden || text.Echoed {
+			sb.WriteString(text.Content)
+		}
+	}
+	return sb.String()
+}
+
 func ExecuteParts(writer AgentIO, parts ...MessagePart) error {
 	for _, part := range parts {
 		if err := part.Do(writer); err != nil {
@@ -286,12 +474,38 @@ func ExecuteParts(writer AgentIO, parts ...MessagePart) error {
 	return nil
 }
 
+// writeParts writes messageParts to the agent until ctx is done. A write
+// that blocks can't be interrupted, so it's abandoned instead: writeParts
+// returns, and the parts after it are skipped once it returns.
+func (c *Conversation) writeParts(ctx context.Context, messageParts ...MessagePart) error {
+	done := make(chan error, 1)
+	go func() {
+		for _, part := range messageParts {
+			if err := ctx.Err(); err != nil {
+				done <- err
+				return
+			}
+			if err := part.Do(c.cfg.AgentIO); err != nil {
+				done <- xerrors.Errorf("failed to write message part: %w", err)
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (c *Conversation) writeMessageWithConfirmation(ctx context.Context, messageParts ...MessagePart) error {
 	if c.cfg.SkipWritingMessage {
 		return nil
 	}
 	screenBeforeMessage := c.cfg.AgentIO.ReadScreen()
-	if err := ExecuteParts(c.cfg.AgentIO, messageParts...); err != nil {
+	if err := c.writeParts(ctx, messageParts...); err != nil {
 		return xerrors.Errorf("failed to write message: %w", err)
 	}
 	// wait for the screen to stabilize after the message is written
@@ -323,7 +537,7 @@ func (c *Conversation) writeMessageWithConfirmation(ctx context.Context, message
 		// happening for a while
 		if time.Since(lastCarriageReturnTime) >= 3*time.Second {
 			lastCarriageReturnTime = time.Now()
-			if _, err := c.cfg.AgentIO.Write([]byte("\r")); err != nil {
+			if err := c.writeParts(ctx, MessagePartText{Content: "\r", Hidden: true}); err != nil {
 				return false, xerrors.Errorf("failed to write carriage return: %w", err)
 			}
 		}
@@ -341,8 +555,13 @@ func (c *Conversation) writeMessageWithConfirmation(ctx context.Context, message
 var MessageValidationErrorWhitespace = xerrors.New("message must be trimmed of leading and trailing whitespace")
 var MessageValidationErrorEmpty = xerrors.New("message must not be empty")
 var MessageValidationErrorChanging = xerrors.New("message can only be sent when the agent is waiting for user input")
+var MessageValidationErrorRole = xerrors.New("only agent and system messages can be injected")
+var MessageValidationErrorRegenerate = xerrors.New("the last message must be an agent reply to a user message")
+var MessageErrorAbandoned = xerrors.New("the message was abandoned because the status was reset while it was written")
 
 func (c *Conversation) SendMessage(messageParts ...MessagePart) error {
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
@@ -350,6 +569,18 @@ func (c *Conversation) SendMessage(messageParts ...MessagePart) error {
 		return MessageValidationErrorChanging
 	}
 
+	if err := validateUserMessage(messageParts...); err != nil {
+		return err
+	}
+
+	screenBeforeMessage := c.cfg.AgentIO.ReadScreen()
+	now := c.cfg.GetTime()
+	c.updateLastAgentMessage(screenBeforeMessage, now)
+	return c.writeUserMessage(screenBeforeMessage, now, messageParts...)
+}
+
+// validateUserMessage checks that a user message can be written to the agent.
+func validateUserMessage(messageParts ...MessagePart) error {
 	message := PartsToString(messageParts...)
 	if message != msgfmt.TrimWhitespace(message) {
 		// msgfmt formatting functions assume this
@@ -359,25 +590,162 @@ func (c *Conversation) SendMessage(messageParts ...MessagePart) error {
 		// writeMessageWithConfirmation requires a non-empty message
 		return MessageValidationErrorEmpty
 	}
+	return nil
+}
 
-	screenBeforeMessage := c.cfg.AgentIO.ReadScreen()
-	now := c.cfg.GetTime()
-	c.updateLastAgentMessage(screenBeforeMessage, now)
+// writeUserMessage writes a user message to the agent and appends it to the
+// history. The caller must hold sendLock and the lock. The lock is released
+// while the message is written.
+func (c *Conversation) writeUserMessage(screenBeforeMessage string, now time.Time, messageParts ...MessagePart) error {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	c.sending = true
+	c.sendingSince = now
+	c.cancelSend = cancel
+	c.lock.Unlock()
+
+	// Writing the message takes a while, so it's done without holding the lock.
+	// sendLock keeps the snapshot loop and other senders out in the meantime.
+	// ResetStatus cancels ctx if the write gets stuck.
+	err := c.writeMessageWithConfirmation(ctx, messageParts...)
 
-	if err := c.writeMessageWithConfirmation(context.Background(), messageParts...); err != nil {
+	c.lock.Lock()
+	c.sending = false
+	c.cancelSend = nil
+	if ctx.Err() != nil {
+		err = context.Cause(ctx)
+	}
+	if err != nil {
 		return xerrors.Errorf("failed to send message: %w", err)
 	}
 
 	c.screenBeforeLastUserMessage = screenBeforeMessage
+	c.lastUserMessageParts = messageParts
 	c.messages = append(c.messages, ConversationMessage{
 		Id:      len(c.messages),
-		Message: message,
+		Message: c.redact(PartsToString(messageParts...)),
 		Role:    ConversationRoleUser,
 		Time:    now,
 	})
+	c.messagesVersion++
+	return nil
+}
+
+// Regenerate discards the last agent message and sends the user message that
+// preceded it to the agent again, so that the agent writes a fresh reply. If
+// messageParts are given, they're sent and recorded instead of the parts of
+// that message, e.g. because they're rewritten whenever they're sent.
+func (c *Conversation) Regenerate(messageParts ...MessagePart) error {
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.cfg.SkipSendMessageStatusCheck && c.statusInner() != ConversationStatusStable {
+		return MessageValidationErrorChanging
+	}
+	n := len(c.messages)
+	if n < 2 || n <= c.frozenMessages || c.lastUserMessageParts == nil ||
+		c.messages[n-1].Role != ConversationRoleAgent || c.messages[n-2].Role != ConversationRoleUser {
+		return MessageValidationErrorRegenerate
+	}
+	if len(messageParts) == 0 {
+		messageParts = c.lastUserMessageParts
+	} else if err := validateUserMessage(messageParts...); err != nil {
+		return err
+	}
+
+	// The screen still shows the discarded exchange. That's fine: the new
+	// reply is found by comparing against the screen before the new message.
+	discarded := c.messages[n-2:]
+	c.messages = c.messages[: n-2 : n-2]
+	c.messagesVersion++
+	screenBeforeMessage := c.cfg.AgentIO.ReadScreen()
+	if err := c.writeUserMessage(screenBeforeMessage, c.cfg.GetTime(), messageParts...); err != nil {
+		c.messages = append(c.messages, discarded...)
+		c.messagesVersion++
+		return err
+	}
+	return nil
+}
+
+// InjectMessage appends a message to the conversation history without sending
+// anything to the agent. It's meant for seeding transcripts, e.g. with system
+// instructions or example agent replies. User messages must be sent with
+// SendMessage.
+func (c *Conversation) InjectMessage(role ConversationRole, message string) error {
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if role != ConversationRoleAgent && role != ConversationRoleSystem {
+		return MessageValidationErrorRole
+	}
+	if !c.cfg.SkipSendMessageStatusCheck && c.statusInner() != ConversationStatusStable {
+		return MessageValidationErrorChanging
+	}
+	if message != msgfmt.TrimWhitespace(message) {
+		return MessageValidationErrorWhitespace
+	}
+	if message == "" {
+		return MessageValidationErrorEmpty
+	}
+
+	screen := c.cfg.AgentIO.ReadScreen()
+	now := c.cfg.GetTime()
+	c.updateLastAgentMessage(screen, now)
+
+	// Whatever is on the screen now belongs to the messages before the
+	// injected one.
+	c.screenBeforeLastUserMessage = screen
+	c.messages = append(c.messages, ConversationMessage{
+		Id:      len(c.messages),
+		Message: c.redact(message),
+		Role:    role,
+		Time:    now,
+	})
+	c.messagesVersion++
+	c.frozenMessages = len(c.messages)
 	return nil
 }
 
+// ResetStatus forces the status back to stable. It's a safety valve for a
+// conversation stuck in the changing status, e.g. because writing a message
+// never returned. The current screen is treated as if it had been stable for
+// the whole stability period, so the status changes again if the agent keeps
+// writing. A message that's being written is abandoned and not added to the
+// history. An agent that isn't ready for the initial prompt yet stays
+// changing, so that the prompt isn't typed into e.g. a login dialog.
+func (c *Conversation) ResetStatus() {
+	// sendLock isn't taken: it's held by the stuck write until it's
+	// abandoned.
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.cancelSend != nil {
+		c.cancelSend(MessageErrorAbandoned)
+		c.cancelSend = nil
+	}
+	c.sending = false
+	screen := c.cfg.AgentIO.ReadScreen()
+	c.idleScreen, c.hasIdleScreen = screen, true
+	now := c.cfg.GetTime()
+	for i := 0; i < c.stableSnapshotsThreshold; i++ {
+		c.snapshotBuffer.Add(screenSnapshot{timestamp: now, screen: screen})
+	}
+	c.updateLastAgentMessage(screen, now)
+	if len(c.messages) > 0 && c.messages[len(c.messages)-1].Role == ConversationRoleUser {
+		// The agent didn't write a reply that differs from its previous one.
+		c.messages = append(c.messages, ConversationMessage{
+			Id:   len(c.messages),
+			Role: ConversationRoleAgent,
+			Time: now,
+		})
+		c.messagesVersion++
+	}
+}
+
 // Assumes that the caller holds the lock
 func (c *Conversation) statusInner() ConversationStatus {
 	// sanity checks
@@ -388,6 +756,10 @@ func (c *Conversation) statusInner() ConversationStatus {
 		panic("stable snapshots threshold is 0. can't check stability")
 	}
 
+	if c.sending {
+		return ConversationStatusChanging
+	}
+
 	snapshots := c.snapshotBuffer.GetAll()
 	if len(c.messages) > 0 && c.messages[len(c.messages)-1].Role == ConversationRoleUser {
 		// if the last message is a user message then the snapshot loop hasn't
@@ -406,6 +778,11 @@ func (c *Conversation) statusInner() ConversationStatus {
 		}
 	}
 
+	if screen := snapshots[len(snapshots)-1].screen; c.cfg.IsIdle != nil && !c.cfg.IsIdle(screen) &&
+		(!c.hasIdleScreen || screen != c.idleScreen) {
+		return ConversationStatusChanging
+	}
+
 	if !c.InitialPromptSent && !c.ReadyForInitialPrompt {
 		if len(snapshots) > 0 && c.cfg.ReadyForInitialPrompt(snapshots[len(snapshots)-1].screen) {
 			c.ReadyForInitialPrompt = true
@@ -417,6 +794,15 @@ func (c *Conversation) statusInner() ConversationStatus {
 	return ConversationStatusStable
 }
 
+// SendingSince returns when the write of the message that's being written to
+// the agent started, and false if no message is being written.
+func (c *Conversation) SendingSince() (time.Time, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.sendingSince, c.sending
+}
+
 func (c *Conversation) Status() ConversationStatus {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -433,13 +819,33 @@ func (c *Conversation) Messages() []ConversationMessage {
 	return result
 }
 
+// State returns the messages and the status of the conversation at the same
+// point in time. Calling Messages and Status one after the other may return a
+// status that belongs to different messages, e.g. a stable status with a
+// user message that was just sent.
+func (c *Conversation) State() ([]ConversationMessage, ConversationStatus) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	result := make([]ConversationMessage, len(c.messages))
+	copy(result, c.messages)
+	return result, c.statusInner()
+}
+
+// MessagesVersion returns a number that changes whenever the messages
+// returned by Messages do, so that callers polling the conversation can skip
+// copying unchanged messages.
+func (c *Conversation) MessagesVersion() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.messagesVersion
+}
+
 func (c *Conversation) Screen() string {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	snapshots := c.snapshotBuffer.GetAll()
-	if len(snapshots) == 0 {
-		return ""
-	}
-	return snapshots[len(snapshots)-1].screen
+	snapshot, _ := c.snapshotBuffer.Last()
+	return snapshot.screen
 }
@@ -3,8 +3,11 @@ package screentracker_test
 import (
 	"context"
 	"embed"
+	"encoding/json"
 	"fmt"
 	"path"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -328,6 +331,73 @@ func TestMessages(t *testing.T) {
 		}, c.Messages())
 	})
 
+	t.Run("format-message-echoed-parts", func(t *testing.T) {
+		agent := &testAgent{}
+		c := newConversation(func(cfg *st.ConversationConfig) {
+			cfg.AgentIO = agent
+			cfg.FormatMessage = func(message string, userInput string) string {
+				return msgfmt.RemoveUserInput(message, userInput, msgfmt.AgentTypeCustom)
+			}
+		})
+		assert.NoError(t, c.SendMessage(
+			st.MessagePartText{Content: "\x1b[200~", Hidden: true},
+			st.MessagePartText{Content: "Act as a reviewer.\n\n", Hidden: true, Echoed: true},
+			st.MessagePartText{Content: "hello"},
+			st.MessagePartText{Content: "\n\nBe concise.", Hidden: true, Echoed: true},
+			st.MessagePartText{Content: "\x1b[201~", Hidden: true},
+		))
+		// The agent echoes the prefix and suffix along with the message.
+		c.AddSnapshot("> Act as a reviewer.\n\nhello\n\nBe concise.\nhi there")
+		assert.Equal(t, []st.ConversationMessage{
+			agentMsg(0, ""),
+			userMsg(1, "hello"),
+			agentMsg(2, "hi there"),
+		}, c.Messages())
+	})
+
+	t.Run("redact-message", func(t *testing.T) {
+		agent := &testAgent{}
+		c := newConversation(func(cfg *st.ConversationConfig) {
+			cfg.AgentIO = agent
+			cfg.RedactMessage = func(message string) string {
+				return strings.ReplaceAll(message, "secret", "***")
+			}
+		})
+		agent.screen = "1"
+		assert.NoError(t, sendMsg(c, "my secret is 2"))
+		c.AddSnapshot("the secret is 3")
+		assert.Equal(t, []st.ConversationMessage{
+			agentMsg(0, "1"),
+			userMsg(1, "my *** is 2"),
+			agentMsg(2, "the *** is 3"),
+		}, c.Messages())
+
+		// text without secrets is untouched
+		c.AddSnapshot("4")
+		assert.Equal(t, agentMsg(2, "4"), c.Messages()[2])
+	})
+
+	t.Run("redact-message-echo", func(t *testing.T) {
+		agent := &testAgent{}
+		c := newConversation(func(cfg *st.ConversationConfig) {
+			cfg.AgentIO = agent
+			cfg.FormatMessage = func(message string, userInput string) string {
+				return msgfmt.RemoveUserInput(message, userInput, msgfmt.AgentTypeCustom)
+			}
+			cfg.RedactMessage = func(message string) string {
+				return strings.ReplaceAll(message, "secret", "***")
+			}
+		})
+		assert.NoError(t, sendMsg(c, "my secret is 2"))
+		// The echo shows the message as it was sent, before redaction.
+		c.AddSnapshot("> my secret is 2\nnoted")
+		assert.Equal(t, []st.ConversationMessage{
+			agentMsg(0, ""),
+			userMsg(1, "my *** is 2"),
+			agentMsg(2, "noted"),
+		}, c.Messages())
+	})
+
 	t.Run("send-message-status-check", func(t *testing.T) {
 		c := newConversation(func(cfg *st.ConversationConfig) {
 			cfg.SkipSendMessageStatusCheck = false
@@ -348,6 +418,204 @@ func TestMessages(t *testing.T) {
 		c := newConversation()
 		assert.Error(t, sendMsg(c, ""), st.MessageValidationErrorEmpty)
 	})
+
+	t.Run("inject-message", func(t *testing.T) {
+		agent := &testAgent{}
+		c := newConversation(func(cfg *st.ConversationConfig) {
+			cfg.AgentIO = agent
+		})
+		systemMsg := st.ConversationMessage{Id: 1, Message: "be brief", Role: st.ConversationRoleSystem, Time: now}
+
+		c.AddSnapshot("1")
+		agent.screen = "1"
+		assert.NoError(t, c.InjectMessage(st.ConversationRoleSystem, "be brief"))
+		assert.NoError(t, c.InjectMessage(st.ConversationRoleAgent, "ok"))
+		expected := []st.ConversationMessage{
+			agentMsg(0, "1"),
+			systemMsg,
+			agentMsg(2, "ok"),
+		}
+		assert.Equal(t, expected, c.Messages())
+
+		// injected messages are not overwritten by the screen
+		c.AddSnapshot("1")
+		c.AddSnapshot("1")
+		assert.Equal(t, expected, c.Messages())
+		assert.Equal(t, st.ConversationStatusStable, c.Status())
+
+		// the conversation continues normally afterwards
+		assert.NoError(t, sendMsg(c, "2"))
+		c.AddSnapshot("1\n3")
+		assert.Equal(t, []st.ConversationMessage{
+			agentMsg(0, "1"),
+			systemMsg,
+			agentMsg(2, "ok"),
+			userMsg(3, "2"),
+			agentMsg(4, "3"),
+		}, c.Messages())
+
+		assert.ErrorIs(t, c.InjectMessage(st.ConversationRoleUser, "4"), st.MessageValidationErrorRole)
+		assert.ErrorIs(t, c.InjectMessage(st.ConversationRoleSystem, ""), st.MessageValidationErrorEmpty)
+	})
+
+	t.Run("greeting", func(t *testing.T) {
+		c := newConversation(func(cfg *st.ConversationConfig) {
+			cfg.Greeting = "Welcome!"
+		})
+		assert.Equal(t, []st.ConversationMessage{agentMsg(0, "Welcome!")}, c.Messages())
+
+		// The agent's output starts a new message once there is some.
+		c.AddSnapshot("")
+		assert.Equal(t, []st.ConversationMessage{agentMsg(0, "Welcome!")}, c.Messages())
+		c.AddSnapshot("1")
+		c.AddSnapshot("2")
+		assert.Equal(t, []st.ConversationMessage{
+			agentMsg(0, "Welcome!"),
+			agentMsg(1, "2"),
+		}, c.Messages())
+	})
+
+	t.Run("regenerate", func(t *testing.T) {
+		agent := &testAgent{}
+		c := newConversation(func(cfg *st.ConversationConfig) {
+			cfg.AgentIO = agent
+		})
+
+		// nothing to regenerate yet
+		assert.ErrorIs(t, c.Regenerate(), st.MessageValidationErrorRegenerate)
+
+		agent.screen = "1"
+		assert.NoError(t, sendMsg(c, "2"))
+		// the user message hasn't been answered yet
+		assert.ErrorIs(t, c.Regenerate(), st.MessageValidationErrorRegenerate)
+		agent.screen = "1\n3"
+		c.AddSnapshot(agent.screen)
+		assert.Equal(t, []st.ConversationMessage{
+			agentMsg(0, "1"),
+			userMsg(1, "2"),
+			agentMsg(2, "3"),
+		}, c.Messages())
+
+		assert.NoError(t, c.Regenerate())
+		assert.Equal(t, []st.ConversationMessage{
+			agentMsg(0, "1"),
+			userMsg(1, "2"),
+		}, c.Messages())
+		c.AddSnapshot("1\n3\n4")
+		assert.Equal(t, []st.ConversationMessage{
+			agentMsg(0, "1"),
+			userMsg(1, "2"),
+			agentMsg(2, "4"),
+		}, c.Messages())
+
+		// the user message can be replaced
+		agent.screen = "1\n3\n4"
+		assert.ErrorIs(t, c.Regenerate(st.MessagePartText{Content: " 5"}), st.MessageValidationErrorWhitespace)
+		assert.NoError(t, c.Regenerate(st.MessagePartText{Content: "5"}))
+		assert.Equal(t, []st.ConversationMessage{
+			agentMsg(0, "1"),
+			userMsg(1, "5"),
+		}, c.Messages())
+		c.AddSnapshot("1\n3\n4\n6")
+		assert.Equal(t, []st.ConversationMessage{
+			agentMsg(0, "1"),
+			userMsg(1, "5"),
+			agentMsg(2, "6"),
+		}, c.Messages())
+
+		// injected agent messages can't be regenerated
+		assert.NoError(t, c.InjectMessage(st.ConversationRoleAgent, "7"))
+		assert.ErrorIs(t, c.Regenerate(), st.MessageValidationErrorRegenerate)
+	})
+
+	t.Run("regenerate-status-check", func(t *testing.T) {
+		c := newConversation(func(cfg *st.ConversationConfig) {
+			cfg.SkipSendMessageStatusCheck = false
+			cfg.SnapshotInterval = 1 * time.Second
+			cfg.ScreenStabilityLength = 2 * time.Second
+			cfg.AgentIO = &testAgent{}
+		})
+		for range 3 {
+			c.AddSnapshot("1")
+		}
+		assert.NoError(t, sendMsg(c, "2"))
+		c.AddSnapshot("1\n3")
+		assert.ErrorIs(t, c.Regenerate(), st.MessageValidationErrorChanging)
+	})
+}
+
+// blockingAgent blocks every write until unblock is closed. Written data is
+// echoed to the screen.
+type blockingAgent struct {
+	mu      sync.Mutex
+	screen  string
+	writing chan struct{}
+	unblock chan struct{}
+}
+
+func (a *blockingAgent) ReadScreen() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.screen
+}
+
+func (a *blockingAgent) Write(data []byte) (int, error) {
+	select {
+	case a.writing <- struct{}{}:
+	default:
+	}
+	<-a.unblock
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.screen += string(data)
+	return len(data), nil
+}
+
+func TestSendMessageDoesNotBlockReaders(t *testing.T) {
+	agent := &blockingAgent{
+		screen:  "1",
+		writing: make(chan struct{}, 1),
+		unblock: make(chan struct{}),
+	}
+	c := st.NewConversation(context.Background(), st.ConversationConfig{
+		AgentIO:               agent,
+		GetTime:               time.Now,
+		SnapshotInterval:      1 * time.Second,
+		ScreenStabilityLength: 2 * time.Second,
+	}, "")
+	for range 3 {
+		c.AddSnapshot("1")
+	}
+	assert.Equal(t, st.ConversationStatusStable, c.Status())
+
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- c.SendMessage(st.MessagePartText{Content: "hello"})
+	}()
+	<-agent.writing
+
+	// Readers return immediately while the message is being written.
+	readersDone := make(chan struct{})
+	go func() {
+		defer close(readersDone)
+		assert.Len(t, c.Messages(), 1)
+		assert.Equal(t, st.ConversationStatusChanging, c.Status())
+		_ = c.Screen()
+	}()
+	select {
+	case <-readersDone:
+	case <-time.After(time.Second):
+		t.Fatal("readers blocked by SendMessage")
+	}
+
+	close(agent.unblock)
+	select {
+	case err := <-sendErr:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("SendMessage did not return")
+	}
+	assert.Len(t, c.Messages(), 2)
 }
 
 //go:embed testdata
@@ -361,6 +629,12 @@ func TestFindNewMessage(t *testing.T) {
 	assert.Equal(t, "42", st.FindNewMessage("123", "123\n  \n \n \n42\n   \n \n \n", msgfmt.AgentTypeCustom))
 	assert.Equal(t, "42", st.FindNewMessage("89", "42", msgfmt.AgentTypeCustom))
 
+	// Opencode's 3 header lines are only skipped on screens that have them.
+	// Shorter screens are new in full.
+	short := "┃  # Getting Started  ┃\n┃  12.6K/6% ($0.05)  ┃"
+	assert.Equal(t, "", st.FindNewMessage("", short+"\n┃                    ┃", msgfmt.AgentTypeOpencode))
+	assert.Equal(t, short, st.FindNewMessage("", short, msgfmt.AgentTypeOpencode))
+
 	dir := "testdata/diff"
 	cases, err := testdataDir.ReadDir(dir)
 	assert.NoError(t, err)
@@ -407,6 +681,18 @@ func TestPartsToString(t *testing.T) {
 	)
 }
 
+func TestPartsToInput(t *testing.T) {
+	assert.Equal(t,
+		"prefix hello",
+		st.PartsToInput(
+			st.MessagePartText{Content: "\x1b[200~", Hidden: true},
+			st.MessagePartText{Content: "prefix ", Hidden: true, Echoed: true},
+			st.MessagePartText{Content: "hello", Alias: "hi"},
+			st.MessagePartText{Content: "\x1b[201~", Hidden: true},
+		),
+	)
+}
+
 func TestInitialPromptReadiness(t *testing.T) {
 	now := time.Now()
 
@@ -555,3 +841,380 @@ func TestInitialPromptReadiness(t *testing.T) {
 		assert.True(t, c.InitialPromptSent)
 	})
 }
+
+func TestResetStatus(t *testing.T) {
+	now := time.Now()
+
+	t.Run("agent never ready", func(t *testing.T) {
+		cfg := st.ConversationConfig{
+			GetTime:               func() time.Time { return now },
+			SnapshotInterval:      1 * time.Second,
+			ScreenStabilityLength: 0,
+			AgentIO:               &testAgent{screen: "loading..."},
+			ReadyForInitialPrompt: func(message string) bool {
+				return false
+			},
+		}
+		c := st.NewConversation(context.Background(), cfg, "initial prompt here")
+		c.AddSnapshot("loading...")
+		assert.Equal(t, st.ConversationStatusChanging, c.Status())
+
+		// The initial prompt mustn't be typed into whatever the agent shows
+		// instead of its prompt.
+		c.ResetStatus()
+		assert.Equal(t, st.ConversationStatusChanging, c.Status())
+		assert.False(t, c.ReadyForInitialPrompt)
+	})
+
+	t.Run("no reply after user message", func(t *testing.T) {
+		agent := &testAgent{screen: "hello"}
+		cfg := st.ConversationConfig{
+			GetTime:                    func() time.Time { return now },
+			SnapshotInterval:           1 * time.Second,
+			ScreenStabilityLength:      2 * time.Second,
+			AgentIO:                    agent,
+			SkipWritingMessage:         true,
+			SkipSendMessageStatusCheck: true,
+		}
+		c := st.NewConversation(context.Background(), cfg, "")
+		assert.NoError(t, c.SendMessage(st.MessagePartText{Content: "hi"}))
+		assert.Equal(t, st.ConversationStatusChanging, c.Status())
+
+		c.ResetStatus()
+		assert.Equal(t, st.ConversationStatusStable, c.Status())
+		messages := c.Messages()
+		assert.Equal(t, st.ConversationRoleAgent, messages[len(messages)-1].Role)
+
+		// The status follows the screen again afterwards.
+		c.AddSnapshot("hello world")
+		assert.Equal(t, st.ConversationStatusChanging, c.Status())
+	})
+}
+
+func TestResetStatusAbandonsStuckWrite(t *testing.T) {
+	agent := &blockingAgent{
+		screen:  "1",
+		writing: make(chan struct{}, 1),
+		unblock: make(chan struct{}),
+	}
+	defer close(agent.unblock)
+	c := st.NewConversation(context.Background(), st.ConversationConfig{
+		AgentIO:               agent,
+		GetTime:               time.Now,
+		SnapshotInterval:      1 * time.Second,
+		ScreenStabilityLength: 2 * time.Second,
+	}, "")
+	for range 3 {
+		c.AddSnapshot("1")
+	}
+	_, sending := c.SendingSince()
+	assert.False(t, sending)
+
+	start := time.Now()
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- c.SendMessage(st.MessagePartText{Content: "hello"})
+	}()
+	<-agent.writing
+	since, sending := c.SendingSince()
+	assert.True(t, sending)
+	assert.False(t, since.Before(start))
+	c.ResetStatus()
+	select {
+	case err := <-sendErr:
+		assert.ErrorIs(t, err, st.MessageErrorAbandoned)
+	case <-time.After(5 * time.Second):
+		t.Fatal("SendMessage did not return")
+	}
+
+	// The abandoned message isn't part of the history, and the next
+	// operation doesn't wait for the stuck write.
+	_, sending = c.SendingSince()
+	assert.False(t, sending)
+	assert.Equal(t, st.ConversationStatusStable, c.Status())
+	messages := c.Messages()
+	assert.Len(t, messages, 1)
+	assert.Equal(t, st.ConversationRoleAgent, messages[0].Role)
+	injected := make(chan error, 1)
+	go func() {
+		injected <- c.InjectMessage(st.ConversationRoleAgent, "2")
+	}()
+	select {
+	case err := <-injected:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("InjectMessage waited for the stuck write")
+	}
+}
+
+func TestIsIdle(t *testing.T) {
+	now := time.Now()
+	agent := &testAgent{screen: "Thinking..."}
+	c := st.NewConversation(context.Background(), st.ConversationConfig{
+		GetTime:               func() time.Time { return now },
+		SnapshotInterval:      1 * time.Second,
+		ScreenStabilityLength: 0,
+		AgentIO:               agent,
+		IsIdle: func(screen string) bool {
+			return strings.HasSuffix(screen, "> ")
+		},
+	}, "")
+
+	// The screen is stable, but the agent is still working.
+	c.AddSnapshot("Thinking...")
+	assert.Equal(t, st.ConversationStatusChanging, c.Status())
+
+	c.AddSnapshot("Done\n> ")
+	assert.Equal(t, st.ConversationStatusStable, c.Status())
+
+	// ResetStatus makes the current screen idle until it changes.
+	agent.screen = "Thinking harder..."
+	c.AddSnapshot(agent.screen)
+	assert.Equal(t, st.ConversationStatusChanging, c.Status())
+	c.ResetStatus()
+	assert.Equal(t, st.ConversationStatusStable, c.Status())
+	c.AddSnapshot("Still thinking...")
+	assert.Equal(t, st.ConversationStatusChanging, c.Status())
+}
+
+func TestExtractDiffs(t *testing.T) {
+	now := time.Now()
+	diff := "--- a.txt\n+++ a.txt\n@@ -1 +1 @@\n-a\n+b"
+	cfg := st.ConversationConfig{
+		GetTime:               func() time.Time { return now },
+		SnapshotInterval:      1 * time.Second,
+		ScreenStabilityLength: 0,
+		AgentIO:               &testAgent{},
+		ExtractDiffs:          msgfmt.ExtractUnifiedDiffs,
+	}
+	c := st.NewConversation(context.Background(), cfg, "")
+	c.AddSnapshot("Editing a.txt\n" + diff)
+
+	messages := c.Messages()
+	assert.Len(t, messages, 1)
+	assert.Equal(t, "Editing a.txt\n"+diff, messages[0].Message, "the diff stays in the message")
+	assert.Equal(t, []msgfmt.FileDiff{{Path: "a.txt", Hunks: []string{"@@ -1 +1 @@\n-a\n+b"}}}, messages[0].Diffs)
+
+	c.AddSnapshot("Nothing to change")
+	assert.Empty(t, c.Messages()[0].Diffs)
+}
+
+func TestExtractCommands(t *testing.T) {
+	now := time.Now()
+	cfg := st.ConversationConfig{
+		GetTime:               func() time.Time { return now },
+		SnapshotInterval:      1 * time.Second,
+		ScreenStabilityLength: 0,
+		AgentIO:               &testAgent{},
+		ExtractCommands:       msgfmt.ExtractAiderCommands,
+	}
+	c := st.NewConversation(context.Background(), cfg, "")
+	c.AddSnapshot("Running ls\nmain.go")
+
+	messages := c.Messages()
+	assert.Len(t, messages, 1)
+	assert.Equal(t, "Running ls\nmain.go", messages[0].Message, "the command stays in the message")
+	assert.Equal(t, []msgfmt.CommandRun{{Command: "ls", Output: "main.go", Status: msgfmt.CommandStatusUnknown}}, messages[0].Commands)
+
+	c.AddSnapshot("Nothing to run")
+	assert.Empty(t, c.Messages()[0].Commands)
+}
+
+func TestKeepRawScreen(t *testing.T) {
+	now := time.Now()
+	for _, keep := range []bool{false, true} {
+		cfg := st.ConversationConfig{
+			GetTime:               func() time.Time { return now },
+			SnapshotInterval:      1 * time.Second,
+			ScreenStabilityLength: 0,
+			AgentIO:               &testAgent{},
+			FormatMessage: func(message string, userInput string) string {
+				return strings.TrimSuffix(message, "\n> ")
+			},
+			RedactMessage: func(message string) string {
+				return strings.ReplaceAll(message, "secret", "***")
+			},
+			KeepRawScreen: keep,
+		}
+		c := st.NewConversation(context.Background(), cfg, "")
+		c.AddSnapshot("hello secret\n> ")
+
+		messages := c.Messages()
+		assert.Len(t, messages, 1)
+		assert.Equal(t, "hello ***", messages[0].Message)
+		if keep {
+			assert.Equal(t, "hello ***\n> ", messages[0].RawScreen)
+		} else {
+			assert.Empty(t, messages[0].RawScreen)
+		}
+	}
+}
+
+func TestMessageModel(t *testing.T) {
+	now := time.Now()
+	c := st.NewConversation(context.Background(), st.ConversationConfig{
+		GetTime:               func() time.Time { return now },
+		SnapshotInterval:      1 * time.Second,
+		ScreenStabilityLength: 0,
+		AgentIO:               &testAgent{},
+		Greeting:              "Welcome!",
+		Provider:              "anthropic",
+		Model:                 "claude-sonnet-4",
+	}, "")
+	c.AddSnapshot("hello")
+
+	messages := c.Messages()
+	assert.Len(t, messages, 2)
+	assert.Equal(t, "Welcome!", messages[0].Message)
+	assert.Empty(t, messages[0].Provider, "no model wrote the greeting")
+	assert.Empty(t, messages[0].Model)
+	assert.Equal(t, "hello", messages[1].Message)
+	assert.Equal(t, "anthropic", messages[1].Provider)
+	assert.Equal(t, "claude-sonnet-4", messages[1].Model)
+
+	c.AddSnapshot("hello again")
+	assert.Equal(t, "claude-sonnet-4", c.Messages()[1].Model, "updates keep the model")
+}
+
+func TestInvalidUTF8(t *testing.T) {
+	now := time.Now()
+	screen := "caf\xe9 \xff\xfe ok"
+	for _, keep := range []bool{false, true} {
+		c := st.NewConversation(context.Background(), st.ConversationConfig{
+			GetTime:               func() time.Time { return now },
+			SnapshotInterval:      1 * time.Second,
+			ScreenStabilityLength: 0,
+			AgentIO:               &testAgent{},
+			KeepRawScreen:         true,
+			KeepInvalidUTF8:       keep,
+		}, "")
+		c.AddSnapshot(screen)
+
+		messages := c.Messages()
+		assert.Len(t, messages, 1)
+		assert.Equal(t, "caf\uFFFD \uFFFD ok", messages[0].Message)
+		assert.Equal(t, "caf\uFFFD \uFFFD ok", messages[0].RawScreen)
+		if keep {
+			assert.Equal(t, []byte(screen), messages[0].RawBytes)
+		} else {
+			assert.Nil(t, messages[0].RawBytes)
+		}
+		data, err := json.Marshal(messages[0])
+		assert.NoError(t, err)
+		assert.True(t, json.Valid(data))
+		var decoded st.ConversationMessage
+		assert.NoError(t, json.Unmarshal(data, &decoded))
+		assert.Equal(t, messages[0].Message, decoded.Message)
+	}
+
+	// Valid messages are never copied.
+	c := st.NewConversation(context.Background(), st.ConversationConfig{
+		GetTime:          func() time.Time { return now },
+		SnapshotInterval: 1 * time.Second,
+		AgentIO:          &testAgent{},
+		KeepInvalidUTF8:  true,
+	}, "")
+	c.AddSnapshot("café")
+	assert.Equal(t, "café", c.Messages()[0].Message)
+	assert.Nil(t, c.Messages()[0].RawBytes)
+}
+
+func TestMessagesVersion(t *testing.T) {
+	now := time.Now()
+	agent := &testAgent{}
+	c := st.NewConversation(context.Background(), st.ConversationConfig{
+		GetTime:                    func() time.Time { return now },
+		SnapshotInterval:           1 * time.Second,
+		ScreenStabilityLength:      0,
+		AgentIO:                    agent,
+		SkipWritingMessage:         true,
+		SkipSendMessageStatusCheck: true,
+	}, "")
+
+	version := c.MessagesVersion()
+	changed := func() bool {
+		newVersion := c.MessagesVersion()
+		defer func() { version = newVersion }()
+		return newVersion != version
+	}
+
+	c.AddSnapshot("hello")
+	assert.True(t, changed(), "agent message added")
+	c.AddSnapshot("hello")
+	assert.False(t, changed(), "same screen")
+	c.AddSnapshot("hello there")
+	assert.True(t, changed(), "agent message updated")
+
+	agent.screen = "hello there"
+	assert.NoError(t, c.SendMessage(st.MessagePartText{Content: "hi"}))
+	assert.True(t, changed(), "user message added")
+	assert.NoError(t, c.InjectMessage(st.ConversationRoleSystem, "be brief"))
+	assert.True(t, changed(), "message injected")
+	// The injection also closed the agent's reply to the user message.
+	assert.Len(t, c.Messages(), 4)
+}
+
+func TestState(t *testing.T) {
+	now := time.Now()
+	agent := &testAgent{}
+	c := st.NewConversation(context.Background(), st.ConversationConfig{
+		GetTime:                    func() time.Time { return now },
+		SnapshotInterval:           1 * time.Second,
+		ScreenStabilityLength:      0,
+		AgentIO:                    agent,
+		SkipWritingMessage:         true,
+		SkipSendMessageStatusCheck: true,
+	}, "")
+
+	c.AddSnapshot("hello")
+	messages, status := c.State()
+	assert.Equal(t, c.Messages(), messages)
+	assert.Equal(t, c.Status(), status)
+
+	agent.screen = "hello"
+	assert.NoError(t, c.SendMessage(st.MessagePartText{Content: "hi"}))
+	messages, status = c.State()
+	assert.Len(t, messages, 2)
+	assert.Equal(t, st.ConversationRoleUser, messages[1].Role)
+	assert.Equal(t, st.ConversationStatusChanging, status, "the agent hasn't replied to the user message yet")
+}
+
+// BenchmarkIdlePolling compares polling an idle conversation with a long
+// history by copying its messages on every tick with copying them only when
+// MessagesVersion changed, as the server's snapshot loop does.
+func BenchmarkIdlePolling(b *testing.B) {
+	now := time.Now()
+	c := st.NewConversation(context.Background(), st.ConversationConfig{
+		GetTime:                    func() time.Time { return now },
+		SnapshotInterval:           1 * time.Second,
+		ScreenStabilityLength:      0,
+		AgentIO:                    &testAgent{},
+		SkipWritingMessage:         true,
+		SkipSendMessageStatusCheck: true,
+	}, "")
+	for i := 0; i < 500; i++ {
+		if err := c.InjectMessage(st.ConversationRoleSystem, fmt.Sprintf("message %d", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("copy", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = c.Messages()
+			_ = c.Screen()
+		}
+	})
+	b.Run("versioned", func(b *testing.B) {
+		b.ReportAllocs()
+		version := c.MessagesVersion()
+		_ = c.Messages()
+		for i := 0; i < b.N; i++ {
+			if v := c.MessagesVersion(); v != version {
+				version = v
+				_ = c.Messages()
+			}
+			_ = c.Screen()
+		}
+	})
+}
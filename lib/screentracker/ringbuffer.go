@@ -36,6 +36,15 @@ func (b *RingBuffer[T]) GetAll() []T {
 	return result
 }
 
+// Last returns the most recently added item, or false if the buffer is empty
+func (b *RingBuffer[T]) Last() (T, bool) {
+	if b.count == 0 {
+		var zero T
+		return zero, false
+	}
+	return b.items[(b.nextIndex-1+len(b.items))%len(b.items)], true
+}
+
 // Capacity returns the capacity of the ring buffer
 func (b *RingBuffer[T]) Capacity() int {
 	return b.size
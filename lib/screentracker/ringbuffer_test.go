@@ -0,0 +1,21 @@
+package screentracker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingBufferLast(t *testing.T) {
+	b := NewRingBuffer[int](3)
+	_, ok := b.Last()
+	assert.False(t, ok)
+
+	for i := 1; i <= 5; i++ {
+		b.Add(i)
+		last, ok := b.Last()
+		assert.True(t, ok)
+		assert.Equal(t, i, last)
+	}
+	assert.Equal(t, []int{3, 4, 5}, b.GetAll())
+}
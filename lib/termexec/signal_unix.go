@@ -0,0 +1,24 @@
+//go:build !windows
+
+package termexec
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// signalProcessGroup sends sig to every process in the process group led by
+// process. The agent is started in a new session, so its pid is also the id
+// of its process group.
+func signalProcessGroup(process *os.Process, sig syscall.Signal) error {
+	if err := syscall.Kill(-process.Pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return err
+	}
+	return nil
+}
+
+// processExists reports whether process hasn't been reaped yet.
+func processExists(process *os.Process) bool {
+	return !errors.Is(syscall.Kill(process.Pid, 0), syscall.ESRCH)
+}
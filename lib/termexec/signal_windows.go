@@ -0,0 +1,23 @@
+//go:build windows
+
+package termexec
+
+import (
+	"os"
+	"syscall"
+)
+
+// signalProcessGroup signals only process itself: Windows has no process
+// groups that can be signaled.
+func signalProcessGroup(process *os.Process, sig syscall.Signal) error {
+	if sig == syscall.SIGKILL {
+		return process.Kill()
+	}
+	return process.Signal(sig)
+}
+
+// processExists always reports true: Windows can't signal a process to check
+// that it exists, so Ping only relies on the pseudo terminal there.
+func processExists(process *os.Process) bool {
+	return true
+}
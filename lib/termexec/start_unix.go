@@ -0,0 +1,39 @@
+//go:build !windows
+
+package termexec
+
+import (
+	"io"
+	"os/exec"
+	"syscall"
+
+	"github.com/ActiveState/termtest/xpty"
+)
+
+// startInTerminal starts cmd in the pseudo terminal. If stderr is set, the
+// process's stderr is written to it instead of the terminal.
+func startInTerminal(xp *xpty.Xpty, cmd *exec.Cmd, stderr io.Writer) error {
+	if stderr == nil {
+		return xp.StartProcessInTerminal(cmd)
+	}
+	// Same as xp.StartProcessInTerminal, which always sends stderr to the
+	// terminal.
+	tty := xp.Tty()
+	cmd.Stdin = tty
+	cmd.Stdout = tty
+	cmd.Stderr = stderr
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Setsid = true
+	return cmd.Start()
+}
+
+// closeTty closes the server's handle of the process's side of the pseudo
+// terminal. Once the process and its children closed theirs too, reading the
+// terminal fails after everything they wrote has been read. It reports
+// whether the handle was closed.
+func closeTty(xp *xpty.Xpty) bool {
+	return xp.Tty().Close() == nil
+}
@@ -0,0 +1,26 @@
+//go:build windows
+
+package termexec
+
+import (
+	"io"
+	"os/exec"
+
+	"github.com/ActiveState/termtest/xpty"
+	"golang.org/x/xerrors"
+)
+
+// startInTerminal starts cmd in the pseudo terminal. Windows processes are
+// spawned by the pseudo console itself, so stderr can't be kept apart.
+func startInTerminal(xp *xpty.Xpty, cmd *exec.Cmd, stderr io.Writer) error {
+	if stderr != nil {
+		return xerrors.New("capturing stderr is not supported on Windows")
+	}
+	return xp.StartProcessInTerminal(cmd)
+}
+
+// closeTty reports false: the pseudo console doesn't expose the process's
+// side of the terminal.
+func closeTty(xp *xpty.Xpty) bool {
+	return false
+}
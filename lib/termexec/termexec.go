@@ -22,13 +22,30 @@ type Process struct {
 	execCmd          *exec.Cmd
 	screenUpdateLock sync.RWMutex
 	lastScreenUpdate time.Time
+	// readerDone is closed once the process's output is no longer read.
+	readerDone chan struct{}
+	// stderr keeps the end of the process's stderr. Nil unless enabled.
+	stderr *tailBuffer
 }
 
+// DefaultTerm is the terminal type that the vt10x library emulates.
+// Setting it signals to the process that it should only use compatible
+// escape sequences.
+const DefaultTerm = "vt100"
+
 type StartProcessConfig struct {
 	Program        string
 	Args           []string
 	TerminalWidth  uint16
 	TerminalHeight uint16
+	// Term is the value of the TERM environment variable passed to the
+	// process. Defaults to DefaultTerm.
+	Term string
+	// StderrBufferSize, if positive, keeps the process's stderr out of the
+	// terminal and its last StderrBufferSize bytes in memory, for Stderr.
+	// Agents that draw their interface on stderr can't be used with it. Not
+	// supported on Windows.
+	StderrBufferSize int
 }
 
 func StartProcess(ctx context.Context, args StartProcessConfig) (*Process, error) {
@@ -38,17 +55,25 @@ func StartProcess(ctx context.Context, args StartProcessConfig) (*Process, error
 		return nil, err
 	}
 	execCmd := exec.Command(args.Program, args.Args...)
-	// vt100 is the terminal type that the vt10x library emulates.
-	// Setting this signals to the process that it should only use compatible
-	// escape sequences.
-	execCmd.Env = append(os.Environ(), "TERM=vt100")
-	if err := xp.StartProcessInTerminal(execCmd); err != nil {
+	term := args.Term
+	if term == "" {
+		term = DefaultTerm
+	}
+	execCmd.Env = append(os.Environ(), "TERM="+term)
+	var stderr *tailBuffer
+	var stderrWriter io.Writer
+	if args.StderrBufferSize > 0 {
+		stderr = newTailBuffer(args.StderrBufferSize)
+		stderrWriter = stderr
+	}
+	if err := startInTerminal(xp, execCmd, stderrWriter); err != nil {
 		return nil, err
 	}
 
-	process := &Process{xp: xp, execCmd: execCmd}
+	process := &Process{xp: xp, execCmd: execCmd, readerDone: make(chan struct{}), stderr: stderr}
 
 	go func() {
+		defer close(process.readerDone)
 		// HACK: Working around xpty concurrency limitations
 		//
 		// Problem:
@@ -78,7 +103,9 @@ func StartProcess(ctx context.Context, args StartProcessConfig) (*Process, error
 		for {
 			r, _, err := pp.ReadRune()
 			if err != nil {
-				if err != io.EOF {
+				// EIO means that the process's side of the terminal was
+				// closed after the process exited.
+				if err != io.EOF && !errors.Is(err, syscall.EIO) {
 					logger.Error("Error reading from pseudo terminal", "error", err)
 				}
 				// TODO: handle this error better. if this happens, the terminal
@@ -125,16 +152,56 @@ func (p *Process) ReadScreen() string {
 	return p.xp.State.String()
 }
 
+// Stderr returns the end of the process's stderr, and false if it isn't
+// captured.
+func (p *Process) Stderr() (string, bool) {
+	if p.stderr == nil {
+		return "", false
+	}
+	return p.stderr.String(), true
+}
+
+// Resize changes the size of the pseudo terminal and of the emulated screen.
+// The process is notified with SIGWINCH.
+func (p *Process) Resize(width, height uint16) error {
+	p.screenUpdateLock.Lock()
+	defer p.screenUpdateLock.Unlock()
+	if err := p.xp.Resize(width, height); err != nil {
+		return xerrors.Errorf("failed to resize pseudo terminal: %w", err)
+	}
+	p.lastScreenUpdate = time.Now()
+	return nil
+}
+
+// Ping checks that the process is still running and that its output is still
+// read and its screen can be read. It may block if the terminal is wedged, so
+// callers should bound it with a timeout.
+func (p *Process) Ping() error {
+	select {
+	case <-p.readerDone:
+		return xerrors.New("the pseudo terminal is no longer read")
+	default:
+	}
+	if !processExists(p.execCmd.Process) {
+		return xerrors.New("the process is not running")
+	}
+	p.ReadScreen()
+	return nil
+}
+
 // Write sends input to the process via the pseudo terminal.
 func (p *Process) Write(data []byte) (int, error) {
 	return p.xp.TerminalInPipe().Write(data)
 }
 
-// Close closes the process using a SIGINT signal or forcefully killing it if the process
-// does not exit after the timeout. It then closes the pseudo terminal.
-func (p *Process) Close(logger *slog.Logger, timeout time.Duration) error {
+// Close stops the process and closes the pseudo terminal. It sends SIGINT to
+// the process group of the process, then SIGTERM if the process is still
+// running after gracePeriod, then SIGKILL after another gracePeriod. Once the
+// process has exited, any remaining process in its group is killed so that
+// children spawned by the agent don't outlive it.
+func (p *Process) Close(logger *slog.Logger, gracePeriod time.Duration) error {
 	logger.Info("Closing process")
-	if err := p.execCmd.Process.Signal(os.Interrupt); err != nil {
+	if err := signalProcessGroup(p.execCmd.Process, syscall.SIGINT); err != nil {
 		return xerrors.Errorf("failed to send SIGINT to process: %w", err)
 	}
 
@@ -146,20 +213,32 @@ func (p *Process) Close(logger *slog.Logger, timeout time.Duration) error {
 	}()
 
 	var exitErr error
-	select {
-	case <-time.After(timeout):
-		if err := p.execCmd.Process.Kill(); err != nil {
-			exitErr = xerrors.Errorf("failed to forcefully kill the process: %w", err)
+	waitForExit := func() bool {
+		select {
+		case <-time.After(gracePeriod):
+			return false
+		case err := <-exited:
+			var pathErr *os.SyscallError
+			// ECHILD is expected if the process has already exited
+			if err != nil && !(errors.As(err, &pathErr) && pathErr.Err == syscall.ECHILD) {
+				exitErr = xerrors.Errorf("process exited with error: %w", err)
+			}
+			return true
 		}
-		// don't wait for the process to exit to avoid hanging indefinitely
-		// if the process never exits
-	case err := <-exited:
-		var pathErr *os.SyscallError
-		// ECHILD is expected if the process has already exited
-		if err != nil && !(errors.As(err, &pathErr) && pathErr.Err == syscall.ECHILD) {
-			exitErr = xerrors.Errorf("process exited with error: %w", err)
+	}
+	if !waitForExit() {
+		logger.Info("Process did not exit after SIGINT, sending SIGTERM", "gracePeriod", gracePeriod)
+		if err := signalProcessGroup(p.execCmd.Process, syscall.SIGTERM); err != nil {
+			exitErr = xerrors.Errorf("failed to send SIGTERM to process: %w", err)
+		} else if !waitForExit() {
+			logger.Info("Process did not exit after SIGTERM, killing it", "gracePeriod", gracePeriod)
+			// don't wait for the process to exit to avoid hanging indefinitely
+			// if the process never exits
 		}
 	}
+	if err := signalProcessGroup(p.execCmd.Process, syscall.SIGKILL); err != nil && exitErr == nil {
+		exitErr = xerrors.Errorf("failed to forcefully kill the process: %w", err)
+	}
 	if err := p.xp.Close(); err != nil {
 		return xerrors.Errorf("failed to close pseudo terminal: %w, exitErr: %w", err, exitErr)
 	}
@@ -168,9 +247,21 @@ func (p *Process) Close(logger *slog.Logger, timeout time.Duration) error {
 
 var ErrNonZeroExitCode = xerrors.New("non-zero exit code")
 
-// Wait waits for the process to exit.
+// outputDrainTimeout bounds how long Wait waits for the output of the
+// process to be read after it exited, e.g. in case a child it left behind
+// keeps the terminal open.
+const outputDrainTimeout = 5 * time.Second
+
+// Wait waits for the process to exit and for the output it wrote before to be
+// read, so that ReadScreen shows all of it.
 func (p *Process) Wait() error {
 	state, err := p.execCmd.Process.Wait()
+	if closeTty(p.xp) {
+		select {
+		case <-p.readerDone:
+		case <-time.After(outputDrainTimeout):
+		}
+	}
 	if err != nil {
 		return xerrors.Errorf("process exited with error: %w", err)
 	}
@@ -0,0 +1,218 @@
+package termexec_test
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/agentapi/lib/logctx"
+	"github.com/coder/agentapi/lib/termexec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartProcess_TermAndWindowSize(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		term     string
+		expected string
+	}{
+		{"default term", "", "vt100 24 100"},
+		{"custom term", "xterm-256color", "xterm-256color 24 100"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+			ctx := logctx.WithLogger(context.Background(), logger)
+			process, err := termexec.StartProcess(ctx, termexec.StartProcessConfig{
+				Program:        "sh",
+				Args:           []string{"-c", `echo "$TERM $(stty size)"; sleep 10`},
+				TerminalWidth:  100,
+				TerminalHeight: 24,
+				Term:           tc.term,
+			})
+			require.NoError(t, err)
+			t.Cleanup(func() {
+				_ = process.Close(logger, time.Second)
+			})
+
+			require.Eventually(t, func() bool {
+				return strings.Contains(process.ReadScreen(), tc.expected)
+			}, 5*time.Second, 50*time.Millisecond, "screen: %q", process.ReadScreen())
+		})
+	}
+}
+
+func TestProcess_Resize(t *testing.T) {
+	t.Parallel()
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	ctx := logctx.WithLogger(context.Background(), logger)
+	process, err := termexec.StartProcess(ctx, termexec.StartProcessConfig{
+		Program:        "sh",
+		Args:           []string{"-c", `while true; do echo "size: $(stty size)"; sleep 0.05; done`},
+		TerminalWidth:  80,
+		TerminalHeight: 24,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = process.Close(logger, time.Second)
+	})
+	screenWidth := func() int {
+		return len(strings.Split(process.ReadScreen(), "\n")[0])
+	}
+	require.Equal(t, 80, screenWidth())
+
+	require.NoError(t, process.Resize(120, 30))
+	require.Equal(t, 120, screenWidth())
+	require.Eventually(t, func() bool {
+		return strings.Contains(process.ReadScreen(), "size: 30 120")
+	}, 5*time.Second, 50*time.Millisecond, "screen: %q", process.ReadScreen())
+}
+
+func TestProcess_WaitReadsRemainingOutput(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("the pseudo console doesn't expose the process's side of the terminal")
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	ctx := logctx.WithLogger(context.Background(), logger)
+	process, err := termexec.StartProcess(ctx, termexec.StartProcessConfig{
+		Program:        "sh",
+		Args:           []string{"-c", `seq 1 20; echo done`},
+		TerminalWidth:  80,
+		TerminalHeight: 24,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = process.Close(logger, time.Second)
+	})
+	require.NoError(t, process.Wait())
+	require.Contains(t, process.ReadScreen(), "done")
+}
+
+func TestProcess_CloseKillsProcessGroup(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS != "linux" {
+		t.Skip("reads process state from /proc")
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	ctx := logctx.WithLogger(context.Background(), logger)
+	// The child ignores SIGINT and SIGHUP, so it outlives the shell unless the
+	// whole group is killed.
+	process, err := termexec.StartProcess(ctx, termexec.StartProcessConfig{
+		Program:        "sh",
+		Args:           []string{"-c", `sh -c 'trap "" INT HUP; exec sleep 100' & echo "child=$!"; wait`},
+		TerminalWidth:  80,
+		TerminalHeight: 24,
+	})
+	require.NoError(t, err)
+
+	childPidRe := regexp.MustCompile(`child=(\d+)`)
+	var childPid int
+	require.Eventually(t, func() bool {
+		match := childPidRe.FindStringSubmatch(process.ReadScreen())
+		if match == nil {
+			return false
+		}
+		childPid, err = strconv.Atoi(match[1])
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	require.True(t, processRunning(childPid))
+
+	require.NoError(t, process.Close(logger, 500*time.Millisecond))
+	require.Eventually(t, func() bool {
+		return !processRunning(childPid)
+	}, 5*time.Second, 50*time.Millisecond, "child process should be terminated")
+}
+
+func TestProcess_Ping(t *testing.T) {
+	t.Parallel()
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	ctx := logctx.WithLogger(context.Background(), logger)
+	process, err := termexec.StartProcess(ctx, termexec.StartProcessConfig{
+		Program:        "sh",
+		Args:           []string{"-c", "sleep 100"},
+		TerminalWidth:  80,
+		TerminalHeight: 24,
+	})
+	require.NoError(t, err)
+	require.NoError(t, process.Ping())
+
+	require.NoError(t, process.Close(logger, 500*time.Millisecond))
+	require.Eventually(t, func() bool {
+		return process.Ping() != nil
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+// processRunning reports whether pid exists and is not a zombie.
+func processRunning(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// The state follows the parenthesized command name.
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestProcess_Stderr(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("capturing stderr is not supported on Windows")
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	ctx := logctx.WithLogger(context.Background(), logger)
+
+	t.Run("captured", func(t *testing.T) {
+		t.Parallel()
+		process, err := termexec.StartProcess(ctx, termexec.StartProcessConfig{
+			Program:          "sh",
+			Args:             []string{"-c", `echo out; printf 'first line\nabcdefghijklmnop' >&2; sleep 10`},
+			TerminalWidth:    80,
+			TerminalHeight:   24,
+			StderrBufferSize: 8,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = process.Close(logger, time.Second)
+		})
+
+		require.Eventually(t, func() bool {
+			stderr, ok := process.Stderr()
+			return ok && stderr == "ijklmnop"
+		}, 5*time.Second, 50*time.Millisecond)
+		require.Eventually(t, func() bool {
+			return strings.Contains(process.ReadScreen(), "out")
+		}, 5*time.Second, 50*time.Millisecond)
+		require.NotContains(t, process.ReadScreen(), "first line")
+	})
+
+	t.Run("not captured", func(t *testing.T) {
+		t.Parallel()
+		process, err := termexec.StartProcess(ctx, termexec.StartProcessConfig{
+			Program:        "sh",
+			Args:           []string{"-c", `echo err >&2; sleep 10`},
+			TerminalWidth:  80,
+			TerminalHeight: 24,
+		})
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			_ = process.Close(logger, time.Second)
+		})
+
+		_, ok := process.Stderr()
+		require.False(t, ok)
+		require.Eventually(t, func() bool {
+			return strings.Contains(process.ReadScreen(), "err")
+		}, 5*time.Second, 50*time.Millisecond)
+	})
+}